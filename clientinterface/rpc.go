@@ -9,19 +9,39 @@ import (
 type ClientRPC interface {
 	GetKeylist(serverURL string) (*types.RatchetList, error)
 	Decrypt(serverURL string, oracleMessage []byte) (responseMessage []byte, err error)
+	DecryptBatch(serverURL string, oracleMessages [][]byte) (responseMessages [][]byte, errs []error, err error)
+	DecryptOblivious(serverURL string, blindedKey *[32]byte) (secrets []*[32]byte, err error)
+	PollUnlock(serverURL string, ticket *[32]byte) (responseMessage []byte, err error)
+	CancelUnlocks(serverURL string, cancel []byte) error
+	Approve(serverURL string, approval []byte) error
+	GetReleaseKeys(serverURL string) (*types.RatchetList, error)
+	GetReleasedKey(serverURL string, counter uint64) (*types.ReleasedKey, error)
+	Burn(serverURL string, oracleMessage []byte) error
+	Checkin(serverURL string, checkin []byte) error
 }
 
 // DefaultRPC is the default implementation for RPC.
 type DefaultRPC struct {
 }
 
-// GetKeylist returns the keylist from a server.
+// GetKeylist returns the keylist from a server. The compact encoding is preferred.
 func (dr *DefaultRPC) GetKeylist(serverURL string) (*types.RatchetList, error) {
 	rpclient, err := clrpcclient.NewRPCClient(serverURL)
 	if err != nil {
 		return nil, err
 	}
-	klB, err := rpclient.GetKeys()
+	return getKeylist(rpclient.GetCompactKeys, rpclient.GetKeys)
+}
+
+// getKeylist returns the keylist from getCompact, falling back to the full keylist from getFull
+// if the compact keylist is not available or cannot be parsed.
+func getKeylist(getCompact, getFull func() ([]byte, error)) (*types.RatchetList, error) {
+	if klB, err := getCompact(); err == nil && types.IsCompact(klB) {
+		if kl, err := new(types.RatchetList).ParseCompact(klB); err == nil {
+			return kl, nil
+		}
+	}
+	klB, err := getFull()
 	if err != nil {
 		return nil, err
 	}
@@ -36,3 +56,93 @@ func (dr *DefaultRPC) Decrypt(serverURL string, oracleMessage []byte) (responseM
 	}
 	return rpclient.Decrypt(oracleMessage)
 }
+
+// DecryptBatch decrypts oracleMessages at the serverURL in one call. It returns a response or an error
+// for each message.
+func (dr *DefaultRPC) DecryptBatch(serverURL string, oracleMessages [][]byte) (responseMessages [][]byte, errs []error, err error) {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rpclient.DecryptBatch(oracleMessages)
+}
+
+// DecryptOblivious returns the blinded secrets of all current ratchet keys at the serverURL for blindedKey.
+func (dr *DefaultRPC) DecryptOblivious(serverURL string, blindedKey *[32]byte) (secrets []*[32]byte, err error) {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return rpclient.DecryptOblivious(blindedKey)
+}
+
+// PollUnlock returns the response to a delayed oracle message at the serverURL once its ticket is ready.
+func (dr *DefaultRPC) PollUnlock(serverURL string, ticket *[32]byte) (responseMessage []byte, err error) {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return rpclient.PollUnlock(ticket)
+}
+
+// CancelUnlocks sends a signed cancellation of delayed oracle messages to the serverURL.
+func (dr *DefaultRPC) CancelUnlocks(serverURL string, cancel []byte) error {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return err
+	}
+	return rpclient.CancelUnlocks(cancel)
+}
+
+// Approve sends a signed approval of a request to the serverURL.
+func (dr *DefaultRPC) Approve(serverURL string, approval []byte) error {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return err
+	}
+	return rpclient.Approve(approval)
+}
+
+// Burn a use-limited oracleMessage at the serverURL.
+func (dr *DefaultRPC) Burn(serverURL string, oracleMessage []byte) error {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return err
+	}
+	return rpclient.Burn(oracleMessage)
+}
+
+// Checkin sends a signed check-in to the serverURL.
+func (dr *DefaultRPC) Checkin(serverURL string, checkin []byte) error {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return err
+	}
+	return rpclient.Checkin(checkin)
+}
+
+// GetReleaseKeys returns the timed-release keylist from a server.
+func (dr *DefaultRPC) GetReleaseKeys(serverURL string) (*types.RatchetList, error) {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	klB, err := rpclient.GetReleaseKeys()
+	if err != nil {
+		return nil, err
+	}
+	return new(types.RatchetList).Parse(klB)
+}
+
+// GetReleasedKey returns the released key of a timed-release period from a server.
+func (dr *DefaultRPC) GetReleasedKey(serverURL string, counter uint64) (*types.ReleasedKey, error) {
+	rpclient, err := clrpcclient.NewRPCClient(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	rkB, err := rpclient.GetReleasedKey(counter)
+	if err != nil {
+		return nil, err
+	}
+	return new(types.ReleasedKey).Parse(rkB)
+}
@@ -0,0 +1,45 @@
+package clientinterface
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestGetKeylist(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	sigKey := new([ed25519.PrivateKeySize]byte)
+	copy(sigKey[:], priv)
+	rl := types.NewRatchetList([32]byte{}, 1)
+	rl.StartDate, rl.Duration, rl.ValidUntil, rl.IssuedAt = 1000, 1000, 2000, 900
+	rl.Append(*types.NewPregenerateEntry(&rl.PreviousLineHash, 1, 1000, 2000, [32]byte{0x01}))
+	rl.Sign(sigKey)
+	compact, err := rl.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+	full := func() ([]byte, error) { return rl.Bytes(), nil }
+	if kl, err := getKeylist(func() ([]byte, error) { return compact, nil }, full); err != nil || kl.ValidUntil != 2000 {
+		t.Errorf("getKeylist compact: %v", err)
+	}
+	broken := func() ([]byte, error) { return compact[:len(compact)-1], nil }
+	if _, err := new(types.RatchetList).ParseCompact(compact[:len(compact)-1]); err == nil {
+		t.Fatal("ParseCompact must fail on truncated keylist")
+	}
+	if kl, err := getKeylist(broken, full); err != nil || kl.ValidUntil != 2000 {
+		t.Errorf("getKeylist must fall back to the full keylist: %v", err)
+	}
+	unavailable := func() ([]byte, error) { return nil, errors.New("unknown method") }
+	if kl, err := getKeylist(unavailable, full); err != nil || kl.ValidUntil != 2000 {
+		t.Errorf("getKeylist without compact keylist: %v", err)
+	}
+	if _, err := getKeylist(broken, unavailable); err == nil {
+		t.Error("getKeylist must fail without keylist")
+	}
+}
@@ -2,9 +2,11 @@
 package clientinterface
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -15,15 +17,26 @@ import (
 type Storage interface {
 	StoreLock(filename string, data []byte) error     // Store a lock.
 	GetLock(now uint64) (data []byte, err error)      // Return a matching lock.
+	ListLocks() (filenames []string, err error)       // Return the filenames of all locks. They can be read with GetData.
 	StoreKeylist(keys *types.RatchetList) error       // Store a keylist.
 	GetKeylist() (keys *types.RatchetList, err error) // Read a keylist.
 	StoreSecret(data []byte) error                    // Store a secret.
 	GetSecret() (data []byte, err error)              // Load a secret.
+	StoreData(name string, data []byte) error         // Store named data.
+	GetData(name string) (data []byte, err error)     // Load named data.
+	RemoveData(name string) error                     // Overwrite and delete named data. Missing data is no error.
+	Replace(files map[string][]byte) error            // Replace named data and locks atomically, names of sub storages as "sub/name".
+	Sub(name string) Storage                          // Return a separate storage contained in this one.
+	Destroy() error                                   // Overwrite and delete all data, including sub storages.
 }
 
+// ErrJournal is returned if the journal of an interrupted Replace cannot be parsed.
+var ErrJournal = errors.New("clientinterface: invalid replace journal")
+
 // DefaultStorage is the default file-backed storage.
 type DefaultStorage struct {
 	Path string // Storage path
+	root string // Path of the storage this one is contained in, if any.
 }
 
 // StoreLock stores a lock.
@@ -32,12 +45,18 @@ func (ds DefaultStorage) StoreLock(filename string, data []byte) error {
 }
 
 func (ds DefaultStorage) writeFile(filename string, data []byte) error {
+	if err := ds.completeReplace(); err != nil {
+		return err
+	}
 	os.MkdirAll(ds.Path, 0700)
 	p := path.Join(ds.Path, filename)
 	return ioutil.WriteFile(p, data, 0600)
 }
 
 func (ds DefaultStorage) readFile(filename string) ([]byte, error) {
+	if err := ds.completeReplace(); err != nil {
+		return nil, err
+	}
 	filenameX := path.Join(ds.Path, filename)
 	return ioutil.ReadFile(filenameX)
 }
@@ -65,7 +84,7 @@ func parseFilename(fn string) (validFrom, validTo uint64, ok bool) {
 // GetLock returns a matching lock.
 func (ds DefaultStorage) GetLock(now uint64) (data []byte, err error) {
 	var filename string
-	entries, err := ioutil.ReadDir(ds.Path)
+	entries, err := ds.readDir()
 	if err != nil {
 		return nil, err
 	}
@@ -89,10 +108,30 @@ FilterLoop:
 	return ds.readFile(filename)
 }
 
-// StoreKeylist stores a keylist.
+// ListLocks returns the filenames of all locks.
+func (ds DefaultStorage) ListLocks() (filenames []string, err error) {
+	entries, err := ds.readDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if _, _, ok := parseFilename(e.Name()); ok {
+			filenames = append(filenames, e.Name())
+		}
+	}
+	return filenames, nil
+}
+
+// StoreKeylist stores a keylist, in compact encoding if possible.
 func (ds DefaultStorage) StoreKeylist(keys *types.RatchetList) error {
 	filename := "keylist"
-	data := keys.Bytes()
+	data, err := keys.Compact()
+	if err != nil {
+		data = keys.Bytes()
+	}
 	return ds.StoreLock(filename, data)
 }
 
@@ -102,16 +141,243 @@ func (ds DefaultStorage) GetKeylist() (keys *types.RatchetList, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if types.IsCompact(data) {
+		return new(types.RatchetList).ParseCompact(data)
+	}
 	return new(types.RatchetList).Parse(data)
 }
 
+// SecretFile is the name of the secret in the storage, to be used with Replace.
+const SecretFile = "secret"
+
 // StoreSecret stores a secret.
 func (ds DefaultStorage) StoreSecret(data []byte) error {
-	filename := "secret"
-	return ds.StoreLock(filename, data)
+	return ds.StoreLock(SecretFile, data)
 }
 
 // GetSecret loads a secret.
 func (ds DefaultStorage) GetSecret() (data []byte, err error) {
-	return ds.readFile("secret")
+	return ds.readFile(SecretFile)
+}
+
+// StoreData stores named data.
+func (ds DefaultStorage) StoreData(name string, data []byte) error {
+	return ds.writeFile(name, data)
+}
+
+// GetData loads named data.
+func (ds DefaultStorage) GetData(name string) (data []byte, err error) {
+	return ds.readFile(name)
+}
+
+// RemoveData overwrites named data with zeros before deleting it.
+func (ds DefaultStorage) RemoveData(name string) error {
+	if err := ds.completeReplace(); err != nil {
+		return err
+	}
+	p := path.Join(ds.Path, name)
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := overwriteFile(p, info.Size()); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// Replace journal in the storage directory:
+//
+// (StagedFile TAB File LF)...
+//
+// Paths are relative to the storage directory. The journal is renamed into place once all staged
+// files are written, which commits the replacement. Interrupted replacements are completed before
+// the storage or one of its sub storages is read or written again.
+
+const replaceJournal = ".replace"
+
+// Replace replaces the named files atomically: all new contents are written before the journal
+// that commits them, so that either all or none of the files are replaced, also after a crash.
+// Names may address files of sub storages as "sub/name". Old contents are overwritten with zeros.
+func (ds DefaultStorage) Replace(files map[string][]byte) error {
+	if err := ds.completeReplace(); err != nil {
+		return err
+	}
+	root := ds.rootPath()
+	var staged []string
+	defer func() {
+		for _, s := range staged {
+			os.Remove(s)
+		}
+	}()
+	var journal []byte
+	for name, data := range files {
+		target := path.Join(ds.Path, name)
+		s, err := writeTemp(path.Dir(target), data)
+		if err != nil {
+			return err
+		}
+		staged = append(staged, s)
+		relStaged, err := filepath.Rel(root, s)
+		if err != nil {
+			return err
+		}
+		relTarget, err := filepath.Rel(root, target)
+		if err != nil {
+			return err
+		}
+		journal = append(journal, relStaged+"\t"+relTarget+"\n"...)
+	}
+	t, err := writeTemp(root, journal)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(t, path.Join(root, replaceJournal)); err != nil {
+		os.Remove(t)
+		return err
+	}
+	staged = nil // Committed, the staged files belong to the journal.
+	if err := syncDir(root); err != nil {
+		return err
+	}
+	return ds.completeReplace()
+}
+
+// completeReplace completes a committed Replace. It is a no-op if there is no journal.
+func (ds DefaultStorage) completeReplace() error {
+	root := ds.rootPath()
+	journal := path.Join(root, replaceJournal)
+	d, err := ioutil.ReadFile(journal)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, line := range strings.Split(string(d), "\n") {
+		if line == "" {
+			continue
+		}
+		names := strings.Split(line, "\t")
+		if len(names) != 2 {
+			return ErrJournal
+		}
+		target := path.Join(root, names[1])
+		if err := replaceFile(path.Join(root, names[0]), target); err != nil {
+			return err
+		}
+		dirs[path.Dir(target)] = true
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return os.Remove(journal)
+}
+
+// replaceFile renames staged to target and overwrites the old content of target with zeros. It
+// can be repeated after it was interrupted.
+func replaceFile(staged, target string) error {
+	old := staged + ".old"
+	if _, err := os.Stat(staged); err == nil {
+		os.Remove(old) // Left by an interrupted attempt, still a link to the content of target.
+		linked := os.Link(target, old) == nil
+		if err := os.Rename(staged, target); err != nil {
+			if linked {
+				os.Remove(old)
+			}
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if info, err := os.Stat(old); err == nil {
+		overwriteFile(old, info.Size())
+		os.Remove(old)
+	}
+	return nil
+}
+
+// writeTemp writes data to a new temporary file in dir and returns its path.
+func writeTemp(dir string, data []byte) (string, error) {
+	os.MkdirAll(dir, 0700)
+	f, err := ioutil.TempFile(dir, ".replace-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func overwriteFile(p string, size int64) error {
+	f, err := os.OpenFile(p, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, size)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readDir completes an interrupted Replace and returns the entries of the storage directory.
+func (ds DefaultStorage) readDir() ([]os.FileInfo, error) {
+	if err := ds.completeReplace(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(ds.Path)
+}
+
+// rootPath returns the path of the outermost storage that contains this one.
+func (ds DefaultStorage) rootPath() string {
+	if ds.root != "" {
+		return ds.root
+	}
+	return ds.Path
+}
+
+// Sub returns a storage in a subdirectory.
+func (ds DefaultStorage) Sub(name string) Storage {
+	return &DefaultStorage{Path: path.Join(ds.Path, name), root: ds.rootPath()}
+}
+
+// Destroy overwrites all files with zeros before deleting the storage directory.
+func (ds DefaultStorage) Destroy() error {
+	var firstErr error
+	filepath.Walk(ds.Path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			err = overwriteFile(p, info.Size())
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return nil
+	})
+	if err := os.RemoveAll(ds.Path); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
@@ -1,6 +1,11 @@
 package clientinterface
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
 
 func TestParseFilename(t *testing.T) {
 	validFrom, validTo, _ := parseFilename("39812-44791.oracle")
@@ -11,3 +16,120 @@ func TestParseFilename(t *testing.T) {
 		t.Error("ValidTo")
 	}
 }
+
+func TestReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &DefaultStorage{Path: dir}
+	if err := ds.StoreLock("10-20.oracle", []byte("old lock")); err != nil {
+		t.Fatalf("StoreLock: %s", err)
+	}
+	if err := ds.Sub("sub").StoreLock("10-20.oracle", []byte("old sub lock")); err != nil {
+		t.Fatalf("StoreLock: %s", err)
+	}
+	if err := ds.StoreSecret([]byte("secret")); err != nil {
+		t.Fatalf("StoreSecret: %s", err)
+	}
+	locks, err := ds.ListLocks()
+	if err != nil || len(locks) != 1 || locks[0] != "10-20.oracle" {
+		t.Fatalf("ListLocks: %v %v", locks, err)
+	}
+	err = ds.Replace(map[string][]byte{
+		"10-20.oracle":     []byte("new lock"),
+		"sub/10-20.oracle": []byte("new sub lock"),
+		"new":              []byte("new file"),
+	})
+	if err != nil {
+		t.Fatalf("Replace: %s", err)
+	}
+	for name, content := range map[string]string{"10-20.oracle": "new lock", "sub/10-20.oracle": "new sub lock", "new": "new file"} {
+		if d, err := ds.GetData(name); err != nil || string(d) != content {
+			t.Errorf("%s not replaced: %v", name, err)
+		}
+	}
+	if d, err := ds.Sub("sub").GetLock(15); err != nil || string(d) != "new sub lock" {
+		t.Errorf("GetLock: %v", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Temporary files left: %d entries", len(entries))
+	}
+}
+
+func TestReplaceInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &DefaultStorage{Path: dir}
+	if err := ds.Sub("sub").StoreLock("10-20.oracle", []byte("old lock")); err != nil {
+		t.Fatalf("StoreLock: %s", err)
+	}
+	// Committed journal whose first file was already renamed into place.
+	staged, err := writeTemp(path.Join(dir, "sub"), []byte("new lock"))
+	if err != nil {
+		t.Fatalf("writeTemp: %s", err)
+	}
+	journal := path.Base(staged) + ".gone\tsecret\n" + "sub/" + path.Base(staged) + "\tsub/10-20.oracle\n"
+	if err := ioutil.WriteFile(path.Join(dir, replaceJournal), []byte(journal), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if d, err := ds.Sub("sub").GetLock(15); err != nil || string(d) != "new lock" {
+		t.Errorf("Interrupted Replace not completed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, replaceJournal)); !os.IsNotExist(err) {
+		t.Error("Journal not removed")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &DefaultStorage{Path: dir}
+	if err := ds.StoreSecret([]byte("secret")); err != nil {
+		t.Fatalf("StoreSecret: %s", err)
+	}
+	if err := ds.Sub("sub").StoreData("data", []byte("data")); err != nil {
+		t.Fatalf("StoreData: %s", err)
+	}
+	if d, err := ds.Sub("sub").GetData("data"); err != nil || string(d) != "data" {
+		t.Errorf("GetData: %v", err)
+	}
+	if err := ds.Destroy(); err != nil {
+		t.Fatalf("Destroy: %s", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Storage not deleted")
+	}
+}
+
+func TestRemoveData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ds := &DefaultStorage{Path: dir}
+	if err := ds.StoreData("data", []byte("data")); err != nil {
+		t.Fatalf("StoreData: %s", err)
+	}
+	if err := ds.RemoveData("data"); err != nil {
+		t.Fatalf("RemoveData: %s", err)
+	}
+	if _, err := ds.GetData("data"); err == nil {
+		t.Error("Data not removed")
+	}
+	if err := ds.RemoveData("data"); err != nil {
+		t.Errorf("RemoveData of missing data: %v", err)
+	}
+}
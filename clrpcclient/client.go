@@ -2,11 +2,15 @@
 package clrpcclient
 
 import (
+	"errors"
 	"net/rpc"
 
 	"github.com/JonathanLogan/cypherlock/types"
 )
 
+// ErrBatchResponse is returned if a batch response does not match its request.
+var ErrBatchResponse = errors.New("clrpcclient: batch response does not match request")
+
 // RPCClient is a Cypherlock RPC client.
 type RPCClient struct {
 	rpc *rpc.Client
@@ -34,7 +38,17 @@ func (rc *RPCClient) GetKeys() ([]byte, error) {
 	return resp.Keys, nil
 }
 
-// Decrypt an oraclemessage.
+// GetCompactKeys returns a compact binary list of keys from the server.
+func (rc *RPCClient) GetCompactKeys() ([]byte, error) {
+	resp := new(types.RPCTypeGetKeysResponse)
+	err := rc.rpc.Call("RPCMethods.GetCompactKeys", new(types.RPCTypeNone), resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// Decrypt an oraclemessage. Errors of the server are returned as *types.RPCError.
 func (rc *RPCClient) Decrypt(msg []byte) ([]byte, error) {
 	resp := new(types.RPCTypeDecryptResponse)
 	params := &types.RPCTypeDecrypt{
@@ -44,5 +58,119 @@ func (rc *RPCClient) Decrypt(msg []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.Code != types.RPCErrorNone {
+		return nil, &types.RPCError{Code: resp.Code, Message: resp.Error}
+	}
 	return resp.ResponseMessage, nil
 }
+
+// DecryptBatch decrypts oraclemessages. It returns a response or a *types.RPCError for each message.
+func (rc *RPCClient) DecryptBatch(msgs [][]byte) ([][]byte, []error, error) {
+	resp := new(types.RPCTypeDecryptBatchResponse)
+	params := &types.RPCTypeDecryptBatch{
+		OracleMessages: msgs,
+	}
+	err := rc.rpc.Call("RPCMethods.DecryptBatch", params, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.ResponseMessages) != len(msgs) || len(resp.Codes) != len(msgs) || len(resp.Errors) != len(msgs) {
+		return nil, nil, ErrBatchResponse
+	}
+	errs := make([]error, len(msgs))
+	for i, code := range resp.Codes {
+		if code != types.RPCErrorNone {
+			errs[i] = &types.RPCError{Code: code, Message: resp.Errors[i]}
+		}
+	}
+	return resp.ResponseMessages, errs, nil
+}
+
+// DecryptOblivious returns the blinded secrets of all current ratchet keys of the server for blindedKey.
+func (rc *RPCClient) DecryptOblivious(blindedKey *[32]byte) ([]*[32]byte, error) {
+	resp := new(types.RPCTypeDecryptObliviousResponse)
+	params := &types.RPCTypeDecryptOblivious{
+		BlindedKey: *blindedKey,
+	}
+	err := rc.rpc.Call("RPCMethods.DecryptOblivious", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*[32]byte, len(resp.Secrets))
+	for i := range resp.Secrets {
+		secrets[i] = &resp.Secrets[i]
+	}
+	return secrets, nil
+}
+
+// PollUnlock returns the response to a delayed oraclemessage once its ticket is ready. Errors of the
+// server are returned as *types.RPCError.
+func (rc *RPCClient) PollUnlock(ticket *[32]byte) ([]byte, error) {
+	resp := new(types.RPCTypeDecryptResponse)
+	params := &types.RPCTypePollUnlock{
+		Ticket: *ticket,
+	}
+	err := rc.rpc.Call("RPCMethods.PollUnlock", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != types.RPCErrorNone {
+		return nil, &types.RPCError{Code: resp.Code, Message: resp.Error}
+	}
+	return resp.ResponseMessage, nil
+}
+
+// CancelUnlocks sends a binary Cancel to the server.
+func (rc *RPCClient) CancelUnlocks(cancel []byte) error {
+	params := &types.RPCTypeCancelUnlocks{
+		Cancel: cancel,
+	}
+	return rc.rpc.Call("RPCMethods.CancelUnlocks", params, new(types.RPCTypeNone))
+}
+
+// Approve sends a binary Approval to the server.
+func (rc *RPCClient) Approve(approval []byte) error {
+	params := &types.RPCTypeApprove{
+		Approval: approval,
+	}
+	return rc.rpc.Call("RPCMethods.Approve", params, new(types.RPCTypeNone))
+}
+
+// GetReleaseKeys returns a binary list of timed-release keys from the server.
+func (rc *RPCClient) GetReleaseKeys() ([]byte, error) {
+	resp := new(types.RPCTypeGetKeysResponse)
+	err := rc.rpc.Call("RPCMethods.GetReleaseKeys", new(types.RPCTypeNone), resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+// GetReleasedKey returns the binary released key of a timed-release period.
+func (rc *RPCClient) GetReleasedKey(counter uint64) ([]byte, error) {
+	resp := new(types.RPCTypeGetReleasedKeyResponse)
+	params := &types.RPCTypeGetReleasedKey{
+		Counter: counter,
+	}
+	err := rc.rpc.Call("RPCMethods.GetReleasedKey", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+// Burn a use-limited oraclemessage.
+func (rc *RPCClient) Burn(msg []byte) error {
+	params := &types.RPCTypeDecrypt{
+		OracleMessage: msg,
+	}
+	return rc.rpc.Call("RPCMethods.Burn", params, new(types.RPCTypeNone))
+}
+
+// Checkin sends a signed check-in.
+func (rc *RPCClient) Checkin(checkin []byte) error {
+	params := &types.RPCTypeCheckin{
+		Checkin: checkin,
+	}
+	return rc.rpc.Call("RPCMethods.Checkin", params, new(types.RPCTypeNone))
+}
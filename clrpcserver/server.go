@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/rpc"
 
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
 	"github.com/JonathanLogan/cypherlock/ratchetserver"
 	"github.com/JonathanLogan/cypherlock/types"
 )
@@ -44,12 +45,96 @@ func (rm *RPCMethods) GetKeys(params types.RPCTypeNone, reply *types.RPCTypeGetK
 	return nil
 }
 
+// GetCompactKeys returns the current pregenerated keys in compact encoding.
+func (rm *RPCMethods) GetCompactKeys(params types.RPCTypeNone, reply *types.RPCTypeGetKeysResponse) error {
+	reply.Keys = rm.server.GetCompactKeys()
+	return nil
+}
+
+// GetReleaseKeys returns the current timed-release keys.
+func (rm *RPCMethods) GetReleaseKeys(params types.RPCTypeNone, reply *types.RPCTypeGetKeysResponse) error {
+	reply.Keys = rm.server.GetReleaseKeys()
+	return nil
+}
+
+// GetReleasedKey returns the signed private key of a timed-release period that has started.
+func (rm *RPCMethods) GetReleasedKey(params types.RPCTypeGetReleasedKey, reply *types.RPCTypeGetReleasedKeyResponse) error {
+	k, err := rm.server.GetReleasedKey(params.Counter)
+	if err != nil {
+		return err
+	}
+	reply.Key = k
+	return nil
+}
+
+// errorReply returns the code and message of err to be sent in a response, so that clients can act upon it.
+func errorReply(err error) (types.RPCErrorCode, string) {
+	if err == nil {
+		return types.RPCErrorNone, ""
+	}
+	return msgcrypt.ErrorCode(err), err.Error()
+}
+
 // Decrypt the message and return it's payload. Only use over TLS.
 func (rm *RPCMethods) Decrypt(params types.RPCTypeDecrypt, reply *types.RPCTypeDecryptResponse) error {
 	r, err := rm.server.Decrypt(params.OracleMessage)
+	reply.ResponseMessage = r
+	reply.Code, reply.Error = errorReply(err)
+	return nil
+}
+
+// DecryptBatch decrypts the messages and returns a payload or an error for each. Only use over TLS.
+func (rm *RPCMethods) DecryptBatch(params types.RPCTypeDecryptBatch, reply *types.RPCTypeDecryptBatchResponse) error {
+	r, errs, err := rm.server.DecryptBatch(params.OracleMessages)
 	if err != nil {
 		return err
 	}
+	reply.ResponseMessages = r
+	reply.Codes = make([]types.RPCErrorCode, len(errs))
+	reply.Errors = make([]string, len(errs))
+	for i, err := range errs {
+		reply.Codes[i], reply.Errors[i] = errorReply(err)
+	}
+	return nil
+}
+
+// DecryptOblivious returns the blinded secrets of all current ratchet keys for a blinded key.
+func (rm *RPCMethods) DecryptOblivious(params types.RPCTypeDecryptOblivious, reply *types.RPCTypeDecryptObliviousResponse) error {
+	secrets, err := rm.server.DecryptOblivious(&params.BlindedKey)
+	if err != nil {
+		return err
+	}
+	reply.Secrets = make([][32]byte, len(secrets))
+	for i, secret := range secrets {
+		reply.Secrets[i] = *secret
+	}
+	return nil
+}
+
+// PollUnlock returns the response to a delayed message once its ticket is ready.
+func (rm *RPCMethods) PollUnlock(params types.RPCTypePollUnlock, reply *types.RPCTypeDecryptResponse) error {
+	r, err := rm.server.PollUnlock(&params.Ticket)
 	reply.ResponseMessage = r
+	reply.Code, reply.Error = errorReply(err)
 	return nil
 }
+
+// CancelUnlocks cancels the delayed messages of a lock owner.
+func (rm *RPCMethods) CancelUnlocks(params types.RPCTypeCancelUnlocks, reply *types.RPCTypeNone) error {
+	return rm.server.CancelUnlocks(params.Cancel)
+}
+
+// Approve records a signed approval of a request.
+func (rm *RPCMethods) Approve(params types.RPCTypeApprove, reply *types.RPCTypeNone) error {
+	return rm.server.Approve(params.Approval)
+}
+
+// Checkin records a signed check-in of a lock owner.
+func (rm *RPCMethods) Checkin(params types.RPCTypeCheckin, reply *types.RPCTypeNone) error {
+	return rm.server.Checkin(params.Checkin)
+}
+
+// Burn a use-limited message so that it cannot be decrypted anymore.
+func (rm *RPCMethods) Burn(params types.RPCTypeDecrypt, reply *types.RPCTypeNone) error {
+	return rm.server.Burn(params.OracleMessage)
+}
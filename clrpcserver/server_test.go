@@ -1,11 +1,13 @@
 package clrpcserver
 
 import (
+	"bytes"
 	"crypto/rand"
 	"testing"
 
 	"github.com/JonathanLogan/cypherlock/clrpcclient"
 	"github.com/JonathanLogan/cypherlock/ratchetserver"
+	"github.com/JonathanLogan/cypherlock/types"
 )
 
 func TestServer(t *testing.T) {
@@ -29,9 +31,57 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Fatalf("GetKeys: %s", err)
 	}
+	compactKeys, err := rpcClient.GetCompactKeys()
+	if err != nil {
+		t.Fatalf("GetCompactKeys: %s", err)
+	}
+	list, err := new(types.RatchetList).ParseCompact(compactKeys)
+	if err != nil {
+		t.Fatalf("ParseCompact: %s", err)
+	}
+	if !bytes.Equal(list.Bytes(), keys) {
+		t.Error("Compact keys do not match keys")
+	}
+	releaseKeys, err := rpcClient.GetReleaseKeys()
+	if err != nil {
+		t.Fatalf("GetReleaseKeys: %s", err)
+	}
+	releaseList, err := new(types.RatchetList).Parse(releaseKeys)
+	if err != nil {
+		t.Fatalf("Parse release keys: %s", err)
+	}
+	if !releaseList.IsReleaseList() {
+		t.Error("Release keys are not a release list")
+	}
+	if _, err := rpcClient.GetReleasedKey(releaseList.PublicKeys[0].Counter); err == nil {
+		t.Error("Future release key must not be returned")
+	}
 	rspmsg, err := rpcClient.Decrypt([]byte("nothing"))
 	if err == nil {
 		t.Error("Decrypt should fail")
 	}
+	if _, errs, err := rpcClient.DecryptBatch([][]byte{[]byte("nothing")}); err != nil || len(errs) != 1 || errs[0] == nil {
+		t.Errorf("DecryptBatch should fail per message: %v", err)
+	}
+	if secrets, err := rpcClient.DecryptOblivious(new([32]byte)); err != nil || len(secrets) < 2 {
+		t.Errorf("DecryptOblivious: %v", err)
+	}
+	if _, err := rpcClient.PollUnlock(new([32]byte)); err == nil {
+		t.Error("PollUnlock should fail")
+	} else if e, ok := err.(*types.RPCError); !ok || e.Code != types.RPCErrorTicketUnknown {
+		t.Errorf("PollUnlock should return the code of an unknown ticket: %v", err)
+	}
+	if err := rpcClient.CancelUnlocks([]byte("nothing")); err == nil {
+		t.Error("CancelUnlocks should fail")
+	}
+	if err := rpcClient.Approve([]byte("nothing")); err == nil {
+		t.Error("Approve should fail")
+	}
+	if err := rpcClient.Burn([]byte("nothing")); err == nil {
+		t.Error("Burn should fail")
+	}
+	if err := rpcClient.Checkin([]byte("nothing")); err == nil {
+		t.Error("Checkin should fail")
+	}
 	_, _, _ = rpcServer, keys, rspmsg
 }
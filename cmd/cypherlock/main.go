@@ -2,17 +2,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 	"unicode"
 
 	"github.com/JonathanLogan/cypherlock/clientinterface"
 	"github.com/JonathanLogan/cypherlock/msgcrypt"
+	"github.com/JonathanLogan/cypherlock/types"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -20,11 +26,46 @@ import (
 var (
 	flagSignatureKey   string
 	flagServerURL      string
+	flagServers        string
+	flagThreshold      int
+	flagPartial        bool
 	flagPath           string
+	flagKeyfile        string
+	flagClientKey      string
+	flagClientKeyFD    int
+	flagClientPub      string
+	flagReleaseKey     string
+	flagCancelKey      string
+	flagCancelPub      string
+	flagApproverKey    string
+	flagApprovers      string
+	flagRequest        string
+	flagSchedule       string
+	flagSubkey         string
+	flagEntry          string
+	flagContentType    string
+	flagRecipient      string
+	flagLabel          string
+	flagNewKeyfile     string
+	flagReleaseAt      uint64
 	flagValidFrom      uint64
 	flagValidTo        uint64
 	flagFD             int
+	flagMaxAge         uint64
+	flagMaxUses        uint
+	flagApprovals      uint
+	flagKDFTime        uint
+	flagKDFMemory      uint
+	flagKDFThreads     uint
+	flagKDFTarget      time.Duration
+	flagCheckin        time.Duration
+	flagDelay          time.Duration
+	flagHorizon        time.Duration
 	flagNL             bool
+	flagDuress         bool
+	flagDuressBurn     bool
+	flagOblivious      bool
+	flagHex            bool
 	flagFunctionExtend bool
 	flagFunctionCreate bool
 	flagFunctionUnlock bool
@@ -36,19 +77,59 @@ func init() {
 	flag.BoolVar(&flagFunctionExtend, "extend", false, "extend existing Cypherlock")
 	flag.BoolVar(&flagFunctionCreate, "create", false, "create new Cypherlock")
 	flag.BoolVar(&flagFunctionUnlock, "unlock", false, "unlock Cypherlock")
-	flag.BoolVar(&flagNL, "nl", false, "add newline to secret when writing")
+	flag.BoolVar(&flagNL, "nl", false, "add newline to secret when writing, remove it from the value read by entry-add")
+	flag.BoolVar(&flagDuress, "duress", false, "ask for a duress passphrase with -create. Unlocking with it destroys the lock")
+	flag.BoolVar(&flagDuressBurn, "duressburn", false, "also burn the lock on the server when the duress passphrase is used. Requires -maxuses")
+	flag.BoolVar(&flagOblivious, "oblivious", false, "hide from the server which ratchet key unlocks the lock. Excludes -maxuses, -checkin, -delay, -approvers and -schedule")
 
 	flag.StringVar(&flagPath, "path", "/tmp/cypherlock", "path to store lock")
+	flag.StringVar(&flagClientKey, "clientkey", "", "client private key file. Replaces the passphrase, created by keygen")
+	flag.IntVar(&flagClientKeyFD, "clientkeyfd", -1, "file descriptor to read the client private key from. Replaces -clientkey")
+	flag.StringVar(&flagClientPub, "clientpub", "", "client public key. Allows -create without the client private key")
+	flag.StringVar(&flagKeyfile, "keyfile", "", "file required in addition to the passphrase. Must be given for all commands if used with -create")
+	flag.StringVar(&flagRecipient, "recipient", "", "recipient label of a multi-recipient lock. Must be given for all commands if used with -create")
+	flag.StringVar(&flagLabel, "label", "", "label of the recipient to add or remove with recipient-add and recipient-remove")
+	flag.StringVar(&flagNewKeyfile, "newkeyfile", "", "keyfile of the recipient added with recipient-add")
+	flag.StringVar(&flagReleaseKey, "releasekey", "", "released key file. Written by release-fetch, read by release-unlock to unlock offline")
+	flag.StringVar(&flagCancelKey, "cancelkey", "", "cancel key file. Created by cancel-keygen, read by unlock-cancel")
+	flag.StringVar(&flagCancelPub, "cancelpub", "", "cancel public key. Allows -delay without the cancel key file")
+	flag.StringVar(&flagApproverKey, "approverkey", "", "approver key file. Created by approver-keygen, read by approve")
+	flag.StringVar(&flagApprovers, "approvers", "", "approver public keys [hex,...]. Unlocking requires -approvals of them to approve")
+	flag.StringVar(&flagRequest, "request", "", "request to approve with approve, as printed by -unlock")
+	flag.StringVar(&flagSchedule, "schedule", "", "restrict the lock to recurring windows between -from and -to, e.g. \"Europe/Berlin Mon-Fri 09:00-17:00; Sat 10:00-12:00\"")
+	flag.StringVar(&flagSubkey, "subkey", "", "names of subkeys [name,...] to write with -unlock instead of the secret")
+	flag.BoolVar(&flagHex, "hex", false, "write subkeys hex encoded")
+	flag.StringVar(&flagEntry, "entry", "", "name of the entry for entry-add, entry-get and entry-remove")
+	flag.StringVar(&flagContentType, "type", "", "content type of the entry added with entry-add, e.g. text/plain")
 	flag.StringVar(&flagServerURL, "server", "127.0.0.1:11139", "Cypherlock server [IP:Port]")
-	flag.StringVar(&flagSignatureKey, "sigkey", "", "cypherlockd signature key. Required for -create and -extend")
+	flag.StringVar(&flagSignatureKey, "sigkey", "", "cypherlockd signature key. Required for -create and -extend, and to unlock locks written before responses were signed")
+	flag.StringVar(&flagServers, "servers", "", "servers of a threshold lock [IP:Port=sigkey,...]. Replaces -server and -sigkey")
+	flag.IntVar(&flagThreshold, "threshold", 0, "number of -servers required to unlock a threshold lock")
+	flag.BoolVar(&flagPartial, "partial", false, "write a threshold lock even if some -servers fail, as long as -threshold of them succeed")
 
 	flag.Uint64Var(&flagValidFrom, "from", now, "earliest unix timestamp at which the lock is valid")
 	flag.Uint64Var(&flagValidTo, "to", now+1800, "latest unix timestamp at which the lock is valid")
+	flag.Uint64Var(&flagReleaseAt, "at", now, "earliest unix timestamp at which a timed-release lock can be unlocked")
+	flag.Uint64Var(&flagMaxAge, "maxage", msgcrypt.DefaultMaxKeylistAge, "maximum age in seconds of a keylist before it is rejected as stale")
+	flag.UintVar(&flagMaxUses, "maxuses", 0, "number of times the lock can be unlocked (or extended) before it is renewed. 0 for unlimited")
+	flag.UintVar(&flagApprovals, "approvals", 1, "number of -approvers required to unlock")
+	flag.UintVar(&flagKDFTime, "kdftime", uint(msgcrypt.DefaultKDFParams.Time), "argon2 passes for new locks")
+	flag.UintVar(&flagKDFMemory, "kdfmem", uint(msgcrypt.DefaultKDFParams.Memory/1024), "argon2 memory in MiB for new locks")
+	flag.UintVar(&flagKDFThreads, "kdfthreads", uint(msgcrypt.DefaultKDFParams.Threads), "argon2 threads for new locks")
+	flag.DurationVar(&flagKDFTarget, "kdftarget", 0, "calibrate argon2 passes to take this long (e.g. 2s), using at most -kdfmem. Replaces -kdftime")
+	flag.DurationVar(&flagCheckin, "checkin", 0, "require check-ins at least this often (e.g. 168h) for the lock to stay unlockable. Only with -create")
+	flag.DurationVar(&flagDelay, "delay", 0, "hold unlocks back this long (e.g. 24h) after unlock-request. Requires -cancelpub or -cancelkey")
+	flag.DurationVar(&flagHorizon, "horizon", 7*24*time.Hour, "how far ahead schedule-extend writes the occurrences of the schedule")
 	flag.IntVar(&flagFD, "fd", 3, "file descriptor to read/write secret from. Required for -create and -unlock")
 
 	flag.Parse()
 }
 
+func fail(err interface{}) {
+	fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+	os.Exit(1)
+}
+
 func writeSecret(s []byte) {
 	q := s
 	if flagNL {
@@ -58,21 +139,59 @@ func writeSecret(s []byte) {
 	defer file.Close()
 	_, err := file.Write(q)
 	if err != nil {
-		fmt.Printf("ERR: %s\n", err)
-		os.Exit(1)
+		fail(err)
+	}
+}
+
+// readValue reads the value of an entry unchanged, except for the newline removed with -nl.
+func readValue() []byte {
+	file := os.NewFile(uintptr(flagFD), "pipe")
+	defer file.Close()
+	d, err := ioutil.ReadAll(io.LimitReader(file, msgcrypt.MaxSecretSize+1))
+	if err != nil {
+		fail(err)
+	}
+	if len(d) > msgcrypt.MaxSecretSize {
+		fail(msgcrypt.ErrSecretToLong)
+	}
+	if flagNL {
+		d = bytes.TrimSuffix(d, []byte("\n"))
+	}
+	return d
+}
+
+// writeSubkeys writes the subkeys named by -subkey in order, 32 bytes each, or one per line with -hex.
+func writeSubkeys(Config *msgcrypt.Cypherlock, passphrase []byte) {
+	subkeys, err := Config.LoadLockSubkeys(passphrase, now, strings.Split(flagSubkey, ","))
+	if err != nil {
+		failPending(Config, passphrase, err)
 	}
+	var out []byte
+	for i, subkey := range subkeys {
+		if flagHex {
+			if i > 0 {
+				out = append(out, '\n')
+			}
+			out = append(out, hex.EncodeToString(subkey[:])...)
+		} else {
+			out = append(out, subkey[:]...)
+		}
+	}
+	writeSecret(out)
 }
 
 func readSecret() []byte {
-	d := make([]byte, 500)
 	file := os.NewFile(uintptr(flagFD), "pipe")
 	defer file.Close()
-	n, err := file.Read(d)
-	if n == 0 && err != nil {
-		fmt.Printf("ERR: %s\n", err)
-		os.Exit(1)
+	d, err := ioutil.ReadAll(io.LimitReader(file, msgcrypt.MaxSecretSize+1))
+	if err != nil {
+		fail(err)
 	}
-	return bytes.TrimFunc(d[:n], unicode.IsSpace)
+	d = bytes.TrimFunc(d, unicode.IsSpace)
+	if len(d) > msgcrypt.MaxSecretSize {
+		fail(msgcrypt.ErrSecretToLong)
+	}
+	return d
 }
 
 func getSigKey() *[ed25519.PublicKeySize]byte {
@@ -83,121 +202,660 @@ func getSigKey() *[ed25519.PublicKeySize]byte {
 	}
 	sigKeyB, err := hex.DecodeString(flagSignatureKey)
 	if err != nil {
-		fmt.Printf("ERR: %s\n", err)
-		os.Exit(1)
+		fail(err)
 	}
 	copy(sigKey[:], sigKeyB)
 	return sigKey
 }
 
+func getServers(requireSigKey bool) []msgcrypt.Server {
+	var servers []msgcrypt.Server
+	for _, e := range strings.Split(flagServers, ",") {
+		s := msgcrypt.Server{}
+		fields := strings.SplitN(e, "=", 2)
+		s.URL = fields[0]
+		if len(fields) == 2 {
+			sigKeyB, err := hex.DecodeString(fields[1])
+			if err != nil || len(sigKeyB) != ed25519.PublicKeySize {
+				fail("Invalid signature key for " + s.URL)
+			}
+			s.SignatureKey = new([ed25519.PublicKeySize]byte)
+			copy(s.SignatureKey[:], sigKeyB)
+		} else if requireSigKey {
+			fail("Must give signature key for " + s.URL)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+// terminalFD returns the file descriptor of the terminal. Stdin is used unless it is a pipe.
+func terminalFD() int {
+	if terminal.IsTerminal(0) {
+		return 0
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		fail("Not a terminal.")
+	}
+	return int(tty.Fd())
+}
+
 func getPassphraseOnce(prompt string, fd int) []byte {
 	if !terminal.IsTerminal(fd) {
-		fmt.Println("ERR: Not a terminal.")
-		os.Exit(1)
+		fail("Not a terminal.")
 	}
-	fmt.Printf("%s: ", prompt)
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
 	state, err := terminal.GetState(fd)
 	if err != nil {
-		fmt.Printf("ERR: %s\n", err)
-		os.Exit(1)
+		fail(err)
 	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
 		terminal.Restore(fd, state)
-		fmt.Println("\ncancelled")
+		fmt.Fprintln(os.Stderr, "\ncancelled")
 		os.Exit(1)
 	}()
 	p, err := terminal.ReadPassword(fd)
 	if err != nil {
-		fmt.Printf("ERR: %s\n", err)
-		os.Exit(1)
+		fail(err)
 	}
 	signal.Stop(c)
-	fmt.Print("\n")
+	fmt.Fprint(os.Stderr, "\n")
 	return bytes.TrimFunc(p, unicode.IsSpace)
 }
 
-func getPassphrase() []byte {
+func getPassphrase(name string) []byte {
 	var p1 []byte
-	fd := 0
+	fd := terminalFD()
 RequestLoop:
 	for {
-		p1 = getPassphraseOnce("Please enter passphrase (no echo)", fd)
+		p1 = getPassphraseOnce("Please enter "+name+" (no echo)", fd)
 		if len(p1) == 0 {
-			fmt.Println("empty passphrase, please repeat.")
+			fmt.Fprintln(os.Stderr, "empty "+name+", please repeat.")
 			continue RequestLoop
 		}
-		p2 := getPassphraseOnce("Please repeat passphrase (no echo)", fd)
+		p2 := getPassphraseOnce("Please repeat "+name+" (no echo)", fd)
 		if bytes.Equal(p1, p2) {
 			break RequestLoop
 		}
-		fmt.Print("Passphrases dont match.\n")
+		fmt.Fprint(os.Stderr, "Passphrases dont match.\n")
 	}
-	fmt.Print("\n")
+	fmt.Fprint(os.Stderr, "\n")
 	return p1
 }
 
+// decodeKey decodes a hex encoded 32 byte key.
+func decodeKey(s string) *[32]byte {
+	d, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(d) != 32 {
+		fail("Invalid client key.")
+	}
+	key := new([32]byte)
+	copy(key[:], d)
+	return key
+}
+
+// readClientKey reads the client private key from -clientkeyfd or -clientkey.
+func readClientKey() *[32]byte {
+	var file *os.File
+	var err error
+	if flagClientKeyFD >= 0 {
+		file = os.NewFile(uintptr(flagClientKeyFD), "clientkey")
+	} else if file, err = os.Open(flagClientKey); err != nil {
+		fail(err)
+	}
+	defer file.Close()
+	d, err := ioutil.ReadAll(io.LimitReader(file, 1024))
+	if err != nil {
+		fail(err)
+	}
+	return decodeKey(string(d))
+}
+
+// usesClientKey returns true if the lock is protected by a client key instead of a passphrase.
+func usesClientKey() bool {
+	return flagClientKey != "" || flagClientKeyFD >= 0 || flagClientPub != ""
+}
+
+// unlockPassphrase asks for the passphrase unless a client key is used.
+func unlockPassphrase() []byte {
+	if usesClientKey() {
+		return nil
+	}
+	return getPassphraseOnce("Please enter passphrase (no echo)", terminalFD())
+}
+
+// keygen creates a new client key pair, writes the private key to -clientkey and prints the public key.
+func keygen() {
+	if flagClientKey == "" {
+		fail("Must give -clientkey.")
+	}
+	pub, priv, err := msgcrypt.GenKeyPair(rand.Reader)
+	if err != nil {
+		fail(err)
+	}
+	file, err := os.OpenFile(flagClientKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail(err)
+	}
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(priv[:])); err != nil {
+		fail(err)
+	}
+	if err := file.Close(); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Client key created.\nPublicKey: %s\n", hex.EncodeToString(pub[:]))
+}
+
+// signingKeygen creates a new signing key, writes it to filename (given as -flagName) and prints its public key.
+func signingKeygen(filename, flagName, name string) {
+	if filename == "" {
+		fail("Must give -" + flagName + ".")
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fail(err)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail(err)
+	}
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(priv)); err != nil {
+		fail(err)
+	}
+	if err := file.Close(); err != nil {
+		fail(err)
+	}
+	fmt.Printf("%s created.\nPublicKey: %s\n", name, hex.EncodeToString(pub))
+}
+
+// readSigningKey reads a signing key from filename (given as -flagName).
+func readSigningKey(filename, flagName, name string) *[ed25519.PrivateKeySize]byte {
+	if filename == "" {
+		fail("Must give -" + flagName + ".")
+	}
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fail(err)
+	}
+	keyB, err := hex.DecodeString(strings.TrimSpace(string(d)))
+	if err != nil || len(keyB) != ed25519.PrivateKeySize {
+		fail("Invalid " + name + ".")
+	}
+	key := new([ed25519.PrivateKeySize]byte)
+	copy(key[:], keyB)
+	return key
+}
+
+// getCancelPub returns the cancel public key from -cancelpub or -cancelkey.
+func getCancelPub() *[ed25519.PublicKeySize]byte {
+	pub := new([ed25519.PublicKeySize]byte)
+	if flagCancelPub != "" {
+		pubB, err := hex.DecodeString(flagCancelPub)
+		if err != nil || len(pubB) != ed25519.PublicKeySize {
+			fail("Invalid cancel public key.")
+		}
+		copy(pub[:], pubB)
+		return pub
+	}
+	if flagCancelKey == "" {
+		fail("-delay requires -cancelpub or -cancelkey.")
+	}
+	copy(pub[:], readSigningKey(flagCancelKey, "cancelkey", "cancel key")[32:])
+	return pub
+}
+
+// getApprovers returns the approver public keys from -approvers.
+func getApprovers() [][ed25519.PublicKeySize]byte {
+	var approvers [][ed25519.PublicKeySize]byte
+	for _, e := range strings.Split(flagApprovers, ",") {
+		pubB, err := hex.DecodeString(strings.TrimSpace(e))
+		if err != nil || len(pubB) != ed25519.PublicKeySize {
+			fail("Invalid approver key " + e)
+		}
+		var pub [ed25519.PublicKeySize]byte
+		copy(pub[:], pubB)
+		approvers = append(approvers, pub)
+	}
+	if flagApprovals < 1 || flagApprovals > uint(len(approvers)) || len(approvers) > msgcrypt.MaxApprovers {
+		fail(fmt.Sprintf("-approvals must be between 1 and the number of -approvers, at most %d.", msgcrypt.MaxApprovers))
+	}
+	return approvers
+}
+
+// failPending fails with err, adding the time from which a pending unlock can be completed, or
+// the requests that must be approved.
+func failPending(Config *msgcrypt.Cypherlock, passphrase []byte, err error) {
+	if err == msgcrypt.ErrUnlockPending {
+		if readyAt, err2 := Config.PendingUnlock(); err2 == nil {
+			fail(fmt.Sprintf("%s. Ready at \"%s\"", err, time.Unix(int64(readyAt), 0).Format(timeFormat)))
+		}
+	}
+	if err == msgcrypt.ErrApprovalPending {
+		if requests, err2 := Config.ApprovalRequests(passphrase, now); err2 == nil {
+			for _, r := range requests {
+				fmt.Fprintf(os.Stderr, "Request: %s on %s\n", hex.EncodeToString(r.Request[:]), r.ServerURL)
+			}
+		}
+	}
+	fail(err)
+}
+
 const timeFormat = "Mon Jan 2 15:04:05 -0700 MST 2006"
 
-func main() {
-	if !(flagFunctionExtend || flagFunctionCreate || flagFunctionUnlock) {
-		fmt.Println("One of -extend , -create or -unlock required.")
+// getCommand returns the command given either as flag or as first argument.
+func getCommand() string {
+	var commands []string
+	if flagFunctionExtend {
+		commands = append(commands, "extend")
+	}
+	if flagFunctionCreate {
+		commands = append(commands, "create")
+	}
+	if flagFunctionUnlock {
+		commands = append(commands, "unlock")
+	}
+	if flag.NArg() > 0 {
+		commands = append(commands, flag.Arg(0))
+	}
+	if len(commands) == 0 {
+		fmt.Println("One of -extend , -create , -unlock , encrypt , decrypt , checkin , passwd , schedule-extend , unlock-request , unlock-cancel , approve , entries , entry-add , entry-get , entry-remove , recipients , recipient-add , recipient-remove , release , release-fetch , release-unlock , keygen , cancel-keygen or approver-keygen required.")
 		os.Exit(1)
 	}
-	if (flagFunctionExtend && (flagFunctionCreate || flagFunctionUnlock)) ||
-		(flagFunctionCreate && (flagFunctionExtend || flagFunctionUnlock)) ||
-		(flagFunctionUnlock && (flagFunctionExtend || flagFunctionCreate)) {
-		fmt.Println("Only one of -extend , -create or -unlock allowed.")
+	if len(commands) > 1 || flag.NArg() > 1 {
+		fmt.Println("Only one of -extend , -create , -unlock , encrypt , decrypt , checkin , passwd , schedule-extend , unlock-request , unlock-cancel , approve , entries , entry-add , entry-get , entry-remove , recipients , recipient-add , recipient-remove , release , release-fetch , release-unlock , keygen , cancel-keygen or approver-keygen allowed.")
 		os.Exit(1)
 	}
+	return commands[0]
+}
+
+// writeReleasedKey writes a released key to -releasekey.
+func writeReleasedKey(rk *types.ReleasedKey) {
+	if flagReleaseKey == "" {
+		fail("Must give -releasekey.")
+	}
+	file, err := os.OpenFile(flagReleaseKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail(err)
+	}
+	if _, err := fmt.Fprintln(file, hex.EncodeToString(rk.Bytes())); err != nil {
+		fail(err)
+	}
+	if err := file.Close(); err != nil {
+		fail(err)
+	}
+}
+
+// readReleasedKey reads a released key from -releasekey.
+func readReleasedKey() *types.ReleasedKey {
+	d, err := ioutil.ReadFile(flagReleaseKey)
+	if err != nil {
+		fail(err)
+	}
+	rkB, err := hex.DecodeString(strings.TrimSpace(string(d)))
+	if err != nil {
+		fail("Invalid released key.")
+	}
+	rk, err := new(types.ReleasedKey).Parse(rkB)
+	if err != nil {
+		fail(err)
+	}
+	return rk
+}
+
+// getKDFParams returns the key derivation parameters from the command line.
+func getKDFParams() *msgcrypt.KDFParams {
+	if flagKDFMemory < 1 || flagKDFMemory > msgcrypt.MaxKDFMemory/1024 {
+		fail(fmt.Sprintf("-kdfmem must be between 1 and %d.", msgcrypt.MaxKDFMemory/1024))
+	}
+	if flagKDFTarget > 0 {
+		return msgcrypt.CalibrateKDF(flagKDFTarget, uint32(flagKDFMemory*1024))
+	}
+	if flagKDFTime < 1 || flagKDFTime > msgcrypt.MaxKDFTime {
+		fail(fmt.Sprintf("-kdftime must be between 1 and %d.", msgcrypt.MaxKDFTime))
+	}
+	if flagKDFThreads < 1 || flagKDFThreads > 255 {
+		fail("-kdfthreads must be between 1 and 255.")
+	}
+	return &msgcrypt.KDFParams{
+		Time:    uint32(flagKDFTime),
+		Memory:  uint32(flagKDFMemory * 1024),
+		Threads: uint8(flagKDFThreads),
+	}
+}
+
+// isKDFFlagSet returns true if any key derivation flag was given.
+func isKDFFlagSet() bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "kdftime", "kdfmem", "kdfthreads", "kdftarget":
+			set = true
+		}
+	})
+	return set
+}
+
+func main() {
+	command := getCommand()
 	Config := &msgcrypt.Cypherlock{
-		ServerURL: flagServerURL,
-		Storage:   &clientinterface.DefaultStorage{Path: flagPath},
-		ClientRPC: new(clientinterface.DefaultRPC),
+		ServerURL:     flagServerURL,
+		Storage:       &clientinterface.DefaultStorage{Path: flagPath},
+		ClientRPC:     new(clientinterface.DefaultRPC),
+		MaxKeylistAge: flagMaxAge,
 	}
-	if flagFunctionCreate || flagFunctionExtend {
+	writesLock := command == "create" || command == "extend"
+	isRecipientCommand := command == "recipient-add" || command == "recipient-remove"
+	isRelease := strings.HasPrefix(command, "release")
+	if isRelease {
+		if flagServers != "" {
+			fail("Timed-release locks do not support -servers.")
+		}
 		Config.SignatureKey = getSigKey()
-
+	} else if flagServers != "" {
+		Config.Servers = getServers(writesLock)
+		Config.Threshold = flagThreshold
+		Config.PartialWrite = flagPartial
+		if Config.Threshold < 1 || Config.Threshold > len(Config.Servers) {
+			fail("-threshold must be between 1 and the number of -servers.")
+		}
+	} else if writesLock || flagSignatureKey != "" {
+		Config.SignatureKey = getSigKey()
+	}
+	if writesLock || command == "recipient-add" || (command == "passwd" && isKDFFlagSet()) {
+		Config.KDFParams = getKDFParams()
+	}
+	if writesLock {
+		if uint64(flagMaxUses) > 0xffffffff {
+			fail("-maxuses too large.")
+		}
+		Config.MaxUses = uint32(flagMaxUses)
+		if flagCheckin < 0 || flagCheckin > msgcrypt.MaxCheckinInterval*time.Second {
+			fail("-checkin too long.")
+		}
+		Config.CheckinInterval = uint32(flagCheckin / time.Second)
+		Config.Oblivious = flagOblivious
+		if flagDelay < 0 || flagDelay > msgcrypt.MaxDelay*time.Second {
+			fail("-delay too long.")
+		}
+		Config.Delay = uint32(flagDelay / time.Second)
+		if Config.Delay > 0 {
+			Config.CancelKey = getCancelPub()
+		}
+		if flagApprovers != "" {
+			Config.Approvers = getApprovers()
+			Config.Approvals = uint8(flagApprovals)
+		}
+		if flagSchedule != "" {
+			schedule, err := msgcrypt.ParseSchedule(flagSchedule)
+			if err != nil {
+				fail(err)
+			}
+			Config.Schedule = schedule
+		}
+	}
+	if command == "keygen" {
+		keygen()
+		os.Exit(0)
+	}
+	if command == "cancel-keygen" {
+		signingKeygen(flagCancelKey, "cancelkey", "Cancel key")
+		os.Exit(0)
+	}
+	if command == "approver-keygen" {
+		signingKeygen(flagApproverKey, "approverkey", "Approver key")
+		os.Exit(0)
+	}
+	if flagClientKey != "" || flagClientKeyFD >= 0 {
+		Config.ClientPrivateKey = readClientKey()
+	} else if flagClientPub != "" {
+		if command != "create" {
+			fail("-clientpub can only be used with create.")
+		}
+		Config.ClientPublicKey = decodeKey(flagClientPub)
+	}
+	if flagRecipient != "" {
+		if usesClientKey() {
+			fail("-recipient cannot be used with a client key.")
+		}
+		Config.Recipient = flagRecipient
+	} else if isRecipientCommand {
+		fail("Must give -recipient.")
 	}
-	if flagFunctionCreate || flagFunctionUnlock {
+	if flagKeyfile != "" {
+		keyfile, err := ioutil.ReadFile(flagKeyfile)
+		if err != nil {
+			fail(err)
+		}
+		Config.Keyfile = keyfile
+	}
+	if command == "create" || command == "unlock" || command == "release" || command == "release-unlock" || command == "entry-add" || command == "entry-get" {
 		if flagFD < 3 {
-			fmt.Println("ERR: fd must be 3 or higher.")
-			os.Exit(1)
+			fail("fd must be 3 or higher.")
 		}
 	}
-	if flagFunctionCreate {
-		passphrase := getPassphrase()
+	if strings.HasPrefix(command, "entry-") && flagEntry == "" {
+		fail("Must give -entry.")
+	}
+	switch command {
+	case "create":
+		var passphrase []byte
+		if !usesClientKey() {
+			passphrase = getPassphrase("passphrase")
+		}
+		if flagDuress {
+			if usesClientKey() {
+				fail("-duress cannot be used with a client key.")
+			}
+			Config.DuressPassphrase = getPassphrase("duress passphrase")
+			Config.DuressBurn = flagDuressBurn
+		}
 		secret := readSecret()
 		validFrom, validTo, err := Config.CreateLock(passphrase, secret, flagValidFrom, flagValidTo)
 		if err != nil {
-			fmt.Printf("ERR: %s\n", err)
-			os.Exit(1)
+			fail(err)
 		}
 		validFromT, validToT := time.Unix(int64(validFrom), 0).Format(timeFormat), time.Unix(int64(validTo), 0).Format(timeFormat)
 		fmt.Printf("Lock created. From \"%s\" to \"%s\"\n", validFromT, validToT)
-		os.Exit(0)
-	}
-	passphrase := getPassphraseOnce("Please enter passphrase (no echo)", 0)
-	if flagFunctionExtend {
+	case "extend":
+		passphrase := unlockPassphrase()
 		validFrom, validTo, err := Config.ExtendLock(passphrase, now, flagValidFrom, flagValidTo)
 		if err != nil {
-			fmt.Printf("ERR: %s\n", err)
-			os.Exit(1)
+			failPending(Config, passphrase, err)
 		}
 		validFromT, validToT := time.Unix(int64(validFrom), 0).Format(timeFormat), time.Unix(int64(validTo), 0).Format(timeFormat)
 		fmt.Printf("Lock extended. From \"%s\" to \"%s\"\n", validFromT, validToT)
-		os.Exit(0)
-	}
-	if flagFunctionUnlock {
+	case "unlock":
+		passphrase := unlockPassphrase()
+		if flagSubkey != "" {
+			writeSubkeys(Config, passphrase)
+			break
+		}
 		realSecret, err := Config.LoadLock(passphrase, now)
 		if err != nil {
-			fmt.Printf("ERR: %s\n", err)
-			os.Exit(1)
+			failPending(Config, passphrase, err)
 		}
 		writeSecret(realSecret)
-		_ = realSecret
-		os.Exit(0)
+	case "schedule-extend":
+		passphrase := unlockPassphrase()
+		scheduledTo, err := Config.ExtendSchedule(passphrase, now, uint64(flagHorizon/time.Second))
+		if err != nil {
+			failPending(Config, passphrase, err)
+		}
+		fmt.Printf("Schedule extended to \"%s\"\n", time.Unix(int64(scheduledTo), 0).Format(timeFormat))
+	case "unlock-request":
+		passphrase := unlockPassphrase()
+		readyAt, err := Config.RequestUnlock(passphrase, now)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Unlock requested. Ready at \"%s\"\n", time.Unix(int64(readyAt), 0).Format(timeFormat))
+	case "unlock-cancel":
+		if err := Config.CancelUnlocks(readSigningKey(flagCancelKey, "cancelkey", "cancel key"), now); err != nil {
+			fail(err)
+		}
+		fmt.Println("Pending unlocks cancelled.")
+	case "approve":
+		approverKey := readSigningKey(flagApproverKey, "approverkey", "approver key")
+		requestB, err := hex.DecodeString(flagRequest)
+		if err != nil || len(requestB) != 32 {
+			fail("Must give -request.")
+		}
+		request := new([32]byte)
+		copy(request[:], requestB)
+		if err := Config.Approve(flagServerURL, request, approverKey, now); err != nil {
+			fail(err)
+		}
+		fmt.Println("Request approved.")
+	case "encrypt":
+		// Stdout carries the encrypted stream, all messages go to stderr.
+		passphrase := unlockPassphrase()
+		out := bufio.NewWriter(os.Stdout)
+		sw, err := Config.NewEncrypter(passphrase, now, out)
+		if err != nil {
+			fail(err)
+		}
+		if _, err := io.Copy(sw, os.Stdin); err != nil {
+			fail(err)
+		}
+		if err := sw.Close(); err != nil {
+			fail(err)
+		}
+		if err := out.Flush(); err != nil {
+			fail(err)
+		}
+	case "decrypt":
+		passphrase := unlockPassphrase()
+		sr, err := Config.NewDecrypter(passphrase, now, bufio.NewReader(os.Stdin))
+		if err != nil {
+			fail(err)
+		}
+		if _, err := io.Copy(os.Stdout, sr); err != nil {
+			fail(err)
+		}
+	case "checkin":
+		passphrase := unlockPassphrase()
+		if err := Config.Checkin(passphrase); err != nil {
+			fail(err)
+		}
+		fmt.Println("Checked in.")
+	case "passwd":
+		if usesClientKey() {
+			fail("passwd cannot be used with a client key.")
+		}
+		passphrase := unlockPassphrase()
+		newPassphrase := getPassphrase("new passphrase")
+		if err := Config.ChangePassphrase(passphrase, newPassphrase); err != nil {
+			fail(err)
+		}
+		fmt.Println("Passphrase changed.")
+	case "entries":
+		passphrase := unlockPassphrase()
+		payload, err := Config.LoadPayload(passphrase, now)
+		if err != nil {
+			failPending(Config, passphrase, err)
+		}
+		for _, e := range payload.Entries {
+			fmt.Printf("%s\t%s\t%d\n", e.Name, e.ContentType, len(e.Value))
+		}
+	case "entry-add":
+		passphrase := unlockPassphrase()
+		value := readValue()
+		err := Config.UpdatePayload(passphrase, now, func(p *msgcrypt.Payload) error {
+			return p.Set(msgcrypt.Entry{Name: flagEntry, ContentType: flagContentType, Value: value})
+		})
+		if err != nil {
+			failPending(Config, passphrase, err)
+		}
+		fmt.Println("Entry added.")
+	case "entry-get":
+		passphrase := unlockPassphrase()
+		payload, err := Config.LoadPayload(passphrase, now)
+		if err != nil {
+			failPending(Config, passphrase, err)
+		}
+		e, err := payload.Get(flagEntry)
+		if err != nil {
+			fail(err)
+		}
+		writeSecret(e.Value)
+	case "entry-remove":
+		passphrase := unlockPassphrase()
+		err := Config.UpdatePayload(passphrase, now, func(p *msgcrypt.Payload) error {
+			return p.Remove(flagEntry)
+		})
+		if err != nil {
+			failPending(Config, passphrase, err)
+		}
+		fmt.Println("Entry removed.")
+	case "recipients":
+		labels, err := Config.Recipients()
+		if err != nil {
+			fail(err)
+		}
+		for _, label := range labels {
+			fmt.Println(label)
+		}
+	case "recipient-add":
+		if flagLabel == "" {
+			fail("Must give -label.")
+		}
+		passphrase := unlockPassphrase()
+		newPassphrase := getPassphrase("passphrase of " + flagLabel)
+		var newKeyfile []byte
+		if flagNewKeyfile != "" {
+			var err error
+			if newKeyfile, err = ioutil.ReadFile(flagNewKeyfile); err != nil {
+				fail(err)
+			}
+		}
+		if err := Config.AddRecipient(passphrase, now, flagLabel, newPassphrase, newKeyfile); err != nil {
+			fail(err)
+		}
+		fmt.Println("Recipient added.")
+	case "recipient-remove":
+		if flagLabel == "" {
+			fail("Must give -label.")
+		}
+		passphrase := unlockPassphrase()
+		if err := Config.RemoveRecipient(passphrase, now, flagLabel); err != nil {
+			fail(err)
+		}
+		fmt.Println("Recipient removed. Lock files resealed, copies kept by the recipient remain unlockable.")
+	case "release":
+		secret := readSecret()
+		releaseAt, err := Config.CreateReleaseLock(secret, flagReleaseAt)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Timed-release lock created. Unlocks at \"%s\"\n", time.Unix(int64(releaseAt), 0).Format(timeFormat))
+	case "release-fetch":
+		rk, err := Config.FetchReleasedKey()
+		if err != nil {
+			fail(err)
+		}
+		writeReleasedKey(rk)
+		fmt.Println("Released key written.")
+	case "release-unlock":
+		var realSecret []byte
+		var err error
+		if flagReleaseKey != "" {
+			realSecret, err = Config.OpenReleaseLockWithKey(readReleasedKey())
+		} else {
+			realSecret, err = Config.OpenReleaseLock()
+		}
+		if err != nil {
+			if releaseAt, err2 := Config.ReleaseTime(); err2 == nil && releaseAt > now {
+				fail(fmt.Sprintf("%s. Unlocks at \"%s\"", err, time.Unix(int64(releaseAt), 0).Format(timeFormat)))
+			}
+			fail(err)
+		}
+		writeSecret(realSecret)
+	default:
+		fail("Unknown command: " + command)
 	}
+	os.Exit(0)
 }
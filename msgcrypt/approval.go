@@ -0,0 +1,163 @@
+package msgcrypt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrApprovalPending is returned if a request has not been approved by enough approvers yet.
+	ErrApprovalPending = errors.New("msgcrypt: approval pending")
+	// ErrApprovalUnknown is returned if an approval is sent for a request the server has not received.
+	ErrApprovalUnknown = errors.New("msgcrypt: no pending request for approval")
+	// ErrApprovalFormat is returned if an Approval cannot be parsed.
+	ErrApprovalFormat = errors.New("msgcrypt: invalid approval")
+	// ErrApprovalInvalid is returned if the signature, time or approver of an Approval is invalid.
+	ErrApprovalInvalid = errors.New("msgcrypt: approval signature, time or approver invalid")
+	// ErrApprovers is returned if a new lock has more approvers than MaxApprovers or fewer than Approvals.
+	ErrApprovers = errors.New("msgcrypt: invalid approvers or number of approvals")
+)
+
+const (
+	// MaxApprovers is the largest number of approvers of a message.
+	MaxApprovers = 64
+	// ApprovalRetention is the number of seconds servers wait for the approvals of a request.
+	ApprovalRetention = 24 * 3600
+)
+
+// ApprovalFunc returns nil if approvals of the request have been received from at least approvals
+// of the approvers. The approvals are used up by that. Otherwise it records the request as pending
+// and returns ErrApprovalPending.
+type ApprovalFunc func(request *[32]byte, approvers [][32]byte, approvals uint8) error
+
+// RequestID returns the ID under which a request is approved. It is the hash of the ServerMessage
+// that the response answers.
+func RequestID(serverMessage []byte) *[32]byte {
+	id := sha256.Sum256(serverMessage)
+	return &id
+}
+
+// Approval is the signed statement of an approver that the server may answer a request.
+type Approval struct {
+	PublicKey [ed25519.PublicKeySize]byte // Approver key.
+	Request   [32]byte                    // RequestID of the approved request.
+	Time      uint64                      // Time of the approval.
+	Signature [ed25519.SignatureSize]byte // Signature by the approver key.
+}
+
+// Approval format:
+//
+// Header | PublicKey | Request | Time (uint64) | Signature
+
+const approvalSize = ed25519.PublicKeySize + 32 + 8 + ed25519.SignatureSize
+
+var approvalContext = []byte("cypherlock approval")
+
+func (a *Approval) body() []byte {
+	return timeStatement(append(append([]byte{}, approvalContext...), a.Request[:]...), &a.PublicKey, a.Time)
+}
+
+// NewApproval returns an Approval of request for now, signed with the approver's privateKey.
+func NewApproval(privateKey *[ed25519.PrivateKeySize]byte, request *[32]byte, now uint64) *Approval {
+	a := &Approval{Request: *request, Time: now}
+	copy(a.PublicKey[:], privateKey[32:])
+	copy(a.Signature[:], ed25519.Sign(privateKey[:], a.body()))
+	return a
+}
+
+// Verify the signature of the Approval and that its time lies within types.MaxClockSkew of now.
+func (a *Approval) Verify(now uint64) error {
+	if a.Time > now+types.MaxClockSkew || a.Time+types.MaxClockSkew < now {
+		return ErrApprovalInvalid
+	}
+	if !ed25519.Verify(a.PublicKey[:], a.body(), a.Signature[:]) {
+		return ErrApprovalInvalid
+	}
+	return nil
+}
+
+// Bytes returns the marshalled Approval.
+func (a *Approval) Bytes() []byte {
+	out := newHeader(TypeApproval, approvalSize)
+	out = append(out, a.PublicKey[:]...)
+	out = append(out, a.Request[:]...)
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, a.Time)
+	out = append(out, t...)
+	return append(out, a.Signature[:]...)
+}
+
+// Parse a marshalled Approval.
+func (a *Approval) Parse(d []byte) (*Approval, error) {
+	version, body, err := splitHeader(d, TypeApproval)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) != approvalSize {
+		return nil, ErrApprovalFormat
+	}
+	na := &Approval{
+		Time: binary.BigEndian.Uint64(body[64:72]),
+	}
+	copy(na.PublicKey[:], body[0:32])
+	copy(na.Request[:], body[32:64])
+	copy(na.Signature[:], body[72:])
+	return na, nil
+}
+
+// checkApprovers returns an error if the approvers of a new lock are invalid.
+func (cl *Cypherlock) checkApprovers() error {
+	if len(cl.Approvers) > MaxApprovers || int(cl.Approvals) > len(cl.Approvers) || (cl.Approvals == 0 && len(cl.Approvers) > 0) {
+		return ErrApprovers
+	}
+	return nil
+}
+
+// ApprovalRequest is a request of a lock that must be approved on a server.
+type ApprovalRequest struct {
+	ServerURL string   // Server to send the approvals to.
+	Request   [32]byte // RequestID to approve.
+}
+
+// ApprovalRequests returns the requests that approvers must approve to unlock the lock at now. The
+// server only accepts approvals after it has received the request, which happens when unlocking
+// returns ErrApprovalPending. Threshold locks return one request per server.
+func (cl *Cypherlock) ApprovalRequests(passphrase []byte, now uint64) ([]ApprovalRequest, error) {
+	if cl.Recipient != "" {
+		if err := cl.openRecipient(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return cl.approvalRequests(passphrase, now)
+}
+
+func (cl *Cypherlock) approvalRequests(passphrase []byte, now uint64) ([]ApprovalRequest, error) {
+	if !cl.isThreshold() {
+		om, _, err := cl.openOracleMessage(passphrase, now)
+		if err != nil {
+			return nil, err
+		}
+		return []ApprovalRequest{{ServerURL: cl.ServerURL, Request: *RequestID(om.ServerMessage)}}, nil
+	}
+	var requests []ApprovalRequest
+	for i := range cl.Servers {
+		r, err := cl.forServer(i).approvalRequests(passphrase, now)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, r...)
+	}
+	if len(requests) < cl.Threshold {
+		return nil, ErrThresholdNotReached
+	}
+	return requests, nil
+}
+
+// Approve sends the approval of request, signed with approverKey, to the server at serverURL.
+func (cl *Cypherlock) Approve(serverURL string, request *[32]byte, approverKey *[ed25519.PrivateKeySize]byte, now uint64) error {
+	return cl.ClientRPC.Approve(serverURL, NewApproval(approverKey, request, now).Bytes())
+}
@@ -0,0 +1,143 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// genApprovers returns n approver keys.
+func genApprovers(t *testing.T, n int) ([][ed25519.PublicKeySize]byte, []*[ed25519.PrivateKeySize]byte) {
+	publicKeys := make([][ed25519.PublicKeySize]byte, n)
+	privateKeys := make([]*[ed25519.PrivateKeySize]byte, n)
+	for i := range publicKeys {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		copy(publicKeys[i][:], pub)
+		privateKeys[i] = new([ed25519.PrivateKeySize]byte)
+		copy(privateKeys[i][:], priv)
+	}
+	return publicKeys, privateKeys
+}
+
+func TestApproval(t *testing.T) {
+	_, privateKeys := genApprovers(t, 1)
+	request := RequestID([]byte("server message"))
+	a, err := new(Approval).Parse(NewApproval(privateKeys[0], request, 1000).Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if a.Request != *request {
+		t.Error("Request not reproduced")
+	}
+	if err := a.Verify(1000); err != nil {
+		t.Errorf("Verify: %s", err)
+	}
+	if err := a.Verify(100000); err != ErrApprovalInvalid {
+		t.Errorf("Verify outside clock skew: %v", err)
+	}
+	a.Request[0] ^= 0x01
+	if err := a.Verify(1000); err != ErrApprovalInvalid {
+		t.Errorf("Verify with modified request: %v", err)
+	}
+}
+
+func TestCypherlockApproval(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	approvers, approverKeys := genApprovers(t, 3)
+	_, otherKeys := genApprovers(t, 1)
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Approvers:    approvers,
+		Approvals:    4,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != ErrApprovers {
+		t.Errorf("CreateLock with too many approvals: %v", err)
+	}
+	cl.Approvals = 2
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	requests, err := cl.ApprovalRequests(passphrase, now)
+	if err != nil || len(requests) != 1 {
+		t.Fatalf("ApprovalRequests: %v", err)
+	}
+	request := &requests[0].Request
+	if err := cl.Approve("server", request, approverKeys[0], now); err != ErrApprovalUnknown {
+		t.Errorf("Approve before request: %v", err)
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != ErrApprovalPending {
+		t.Fatalf("LoadLock without approvals: %v", err)
+	}
+	if err := cl.Approve("server", request, approverKeys[0], now); err != nil {
+		t.Fatalf("Approve: %s", err)
+	}
+	if err := cl.Approve("server", request, otherKeys[0], now); err != ErrApprovalInvalid {
+		t.Errorf("Approve by other key: %v", err)
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != ErrApprovalPending {
+		t.Errorf("LoadLock with one approval: %v", err)
+	}
+	if err := cl.Approve("server", request, approverKeys[2], now); err != nil {
+		t.Fatalf("Approve: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock with approvals: %v", err)
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != ErrApprovalPending {
+		t.Errorf("Approvals must be used up: %v", err)
+	}
+}
+
+func TestCypherlockApprovalThreshold(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	approvers, approverKeys := genApprovers(t, 2)
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+		Approvers: approvers,
+		Approvals: 1,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase, secret := []byte("passphrase"), []byte("threshold secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	rpc.down["c"] = true
+	if _, err := cl.LoadLock(passphrase, now); err != ErrApprovalPending {
+		t.Fatalf("LoadLock without approvals: %v", err)
+	}
+	requests, err := cl.ApprovalRequests(passphrase, now)
+	if err != nil || len(requests) != 3 {
+		t.Fatalf("ApprovalRequests: %v", err)
+	}
+	for _, r := range requests[:2] {
+		if err := cl.Approve(r.ServerURL, &r.Request, approverKeys[1], now); err != nil {
+			t.Fatalf("Approve %s: %s", r.ServerURL, err)
+		}
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock with approvals: %v", err)
+	}
+}
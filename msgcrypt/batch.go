@@ -0,0 +1,148 @@
+package msgcrypt
+
+import (
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+	"github.com/JonathanLogan/cypherlock/shamir"
+	"github.com/JonathanLogan/cypherlock/types"
+)
+
+// LoadLocks returns the secrets of the locks in storages, or an error for each lock that could not
+// be unlocked. All locks must share the configuration of cl and passphrase. The oracle messages of
+// all locks are sent to each server in one DecryptBatch call. As with LoadLock, a lock is destroyed
+// if passphrase is its duress passphrase.
+func (cl *Cypherlock) LoadLocks(passphrase []byte, now uint64, storages []clientinterface.Storage) (realSecrets [][]byte, errs []error) {
+	cl.init()
+	locks := make([]*Cypherlock, len(storages))
+	errs = make([]error, len(storages))
+	for i, storage := range storages {
+		lock := *cl
+		lock.Storage = storage
+		locks[i] = &lock
+		if lock.Recipient != "" {
+			errs[i] = lock.openRecipient(passphrase)
+		}
+	}
+	var secretKeys []*[32]byte
+	if cl.isThreshold() {
+		secretKeys = cl.batchThresholdLockKeys(locks, passphrase, now, errs)
+	} else {
+		secretKeys = cl.batchLockKeys(cl.ServerURL, locks, passphrase, now, errs)
+	}
+	realSecrets = make([][]byte, len(storages))
+	for i, lock := range locks {
+		if errs[i] == nil {
+			var encrypted []byte
+			if encrypted, errs[i] = lock.Storage.GetSecret(); errs[i] == nil {
+				realSecrets[i], errs[i] = DecryptRealSecret(secretKeys[i], encrypted)
+			}
+		}
+		if errs[i] != nil && passphrase != nil {
+			lock.checkDuress(passphrase)
+		}
+	}
+	return realSecrets, errs
+}
+
+// batchLockKeys returns the secret keys of single server locks, decrypted by the server at serverURL.
+// Locks with an error in errs are skipped, errors of the other locks are set in errs. Oblivious
+// locks and pending unlocks of delayed locks are handled one by one.
+func (cl *Cypherlock) batchLockKeys(serverURL string, locks []*Cypherlock, passphrase []byte, now uint64, errs []error) []*[32]byte {
+	secretKeys := make([]*[32]byte, len(locks))
+	oms, omDs := make([]*OracleMessage, len(locks)), make([][]byte, len(locks))
+	var requests [][]byte
+	var pos []int
+	for i, lock := range locks {
+		if errs[i] != nil {
+			continue
+		}
+		if ticket, omD, err := lock.loadTicket(); err != ErrNoTicket {
+			if errs[i] = err; err == nil {
+				secretKeys[i], errs[i] = lock.pollLockKey(passphrase, now, ticket, omD)
+			}
+			continue
+		}
+		if oms[i], omDs[i], errs[i] = lock.openOracleMessage(passphrase, now); errs[i] != nil {
+			continue
+		}
+		if oms[i].Oblivious() {
+			secretKeys[i], errs[i] = cl.obliviousLockKey(serverURL, oms[i])
+			continue
+		}
+		requests = append(requests, oms[i].ServerMessage)
+		pos = append(pos, i)
+	}
+	for start := 0; start < len(requests); start += types.MaxDecryptBatch {
+		end := start + types.MaxDecryptBatch
+		if end > len(requests) {
+			end = len(requests)
+		}
+		responses, responseErrs, err := cl.ClientRPC.DecryptBatch(serverURL, requests[start:end])
+		for j := start; j < end; j++ {
+			i := pos[j]
+			switch {
+			case err != nil:
+				errs[i] = err
+			case responseErrs[j-start] != nil:
+				errs[i] = serverError(responseErrs[j-start])
+			default:
+				secretKeys[i], errs[i] = locks[i].processResponse(oms[i], omDs[i], responses[j-start])
+			}
+		}
+	}
+	return secretKeys
+}
+
+// batchThresholdLockKeys collects shares of threshold locks from the servers until the threshold
+// is reached for all locks. It sets errs like batchLockKeys.
+func (cl *Cypherlock) batchThresholdLockKeys(locks []*Cypherlock, passphrase []byte, now uint64, errs []error) []*[32]byte {
+	secretKeys := make([]*[32]byte, len(locks))
+	if cl.Threshold < 1 || cl.Threshold > len(cl.Servers) {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = ErrThresholdInvalid
+			}
+		}
+		return secretKeys
+	}
+	shares := make([][]shamir.Share, len(locks))
+	pendingShares := make([]int, len(locks))
+	approvalShares := make([]int, len(locks))
+	for s := range cl.Servers {
+		serverLocks := make([]*Cypherlock, len(locks))
+		serverErrs := make([]error, len(locks))
+		var pending bool
+		for i, lock := range locks {
+			serverLocks[i] = lock.forServer(s)
+			if errs[i] != nil || len(shares[i]) == cl.Threshold {
+				serverErrs[i] = ErrThresholdNotReached // Skip.
+				continue
+			}
+			pending = true
+		}
+		if !pending {
+			break
+		}
+		serverShares := cl.batchLockKeys(cl.Servers[s].URL, serverLocks, passphrase, now, serverErrs)
+		for i, share := range serverShares {
+			if serverErrs[i] == nil {
+				shares[i] = append(shares[i], shamir.Share{X: byte(s + 1), Value: share[:]})
+			} else if serverErrs[i] == ErrUnlockPending {
+				pendingShares[i]++
+			} else if serverErrs[i] == ErrApprovalPending {
+				approvalShares[i]++
+			}
+		}
+	}
+	for i := range locks {
+		switch {
+		case errs[i] != nil:
+		case len(shares[i]) < cl.Threshold && len(shares[i])+pendingShares[i] >= cl.Threshold:
+			errs[i] = ErrUnlockPending
+		case len(shares[i]) < cl.Threshold && len(shares[i])+pendingShares[i]+approvalShares[i] >= cl.Threshold:
+			errs[i] = ErrApprovalPending
+		default:
+			secretKeys[i], errs[i] = cl.combineShares(shares[i])
+		}
+	}
+	return secretKeys
+}
@@ -0,0 +1,97 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+)
+
+func TestCypherlockLoadLocks(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	passphrase := []byte("passphrase")
+	now := testNow()
+	var storages []clientinterface.Storage
+	var secrets [][]byte
+	for i := 0; i < 3; i++ {
+		cl := &Cypherlock{
+			SignatureKey: &ts.sigPublicKey,
+			ServerURL:    "server",
+			Storage:      storage.Sub("lock-" + strconv.Itoa(i)),
+			ClientRPC:    rpc,
+		}
+		secret := []byte("secret " + strconv.Itoa(i))
+		if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+			t.Fatalf("CreateLock: %s", err)
+		}
+		storages = append(storages, cl.Storage)
+		secrets = append(secrets, secret)
+	}
+	storages = append(storages, storage.Sub("missing"))
+	cl := &Cypherlock{
+		ServerURL: "server",
+		ClientRPC: rpc,
+	}
+	realSecrets, errs := cl.LoadLocks(passphrase, now, storages)
+	if rpc.batches != 1 {
+		t.Errorf("LoadLocks made %d batch calls", rpc.batches)
+	}
+	for i, secret := range secrets {
+		if errs[i] != nil || !bytes.Equal(realSecrets[i], secret) {
+			t.Errorf("Lock %d: %v", i, errs[i])
+		}
+	}
+	if errs[3] == nil {
+		t.Error("Missing lock must fail")
+	}
+	if _, errs := cl.LoadLocks([]byte("wrong"), now, storages[:1]); errs[0] == nil {
+		t.Error("LoadLocks must fail with wrong passphrase")
+	}
+}
+
+func TestCypherlockLoadLocksThreshold(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	cl := &Cypherlock{
+		ClientRPC: rpc,
+		Threshold: 2,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase := []byte("passphrase")
+	now := testNow()
+	var storages []clientinterface.Storage
+	var secrets [][]byte
+	for i := 0; i < 2; i++ {
+		cl.Storage = storage.Sub("lock-" + strconv.Itoa(i))
+		secret := []byte("threshold secret " + strconv.Itoa(i))
+		if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+			t.Fatalf("CreateLock: %s", err)
+		}
+		storages = append(storages, cl.Storage)
+		secrets = append(secrets, secret)
+	}
+	rpc.down["a"] = true
+	realSecrets, errs := cl.LoadLocks(passphrase, now, storages)
+	if rpc.batches != 2 {
+		t.Errorf("LoadLocks made %d batch calls", rpc.batches)
+	}
+	for i, secret := range secrets {
+		if errs[i] != nil || !bytes.Equal(realSecrets[i], secret) {
+			t.Errorf("Lock %d: %v", i, errs[i])
+		}
+	}
+	rpc.down["b"] = true
+	if _, errs := cl.LoadLocks(passphrase, now, storages); errs[0] != ErrThresholdNotReached {
+		t.Errorf("LoadLocks below threshold: %v", errs[0])
+	}
+}
@@ -0,0 +1,211 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrCheckinOverdue is returned if the owner of a message has not checked in within the check-in interval.
+	ErrCheckinOverdue = errors.New("msgcrypt: owner check-in overdue")
+	// ErrCheckinFormat is returned if a Checkin cannot be parsed.
+	ErrCheckinFormat = errors.New("msgcrypt: invalid check-in")
+	// ErrCheckinInvalid is returned if the signature or time of a Checkin is invalid.
+	ErrCheckinInvalid = errors.New("msgcrypt: check-in signature or time invalid")
+	// ErrCheckinReplay is returned if a Checkin is not newer than the last one of its owner.
+	ErrCheckinReplay = errors.New("msgcrypt: check-in replayed")
+	// ErrCheckinInterval is returned if the check-in interval of a new lock is too long.
+	ErrCheckinInterval = errors.New("msgcrypt: check-in interval too long")
+	// ErrNoCheckin is returned on check-in for a lock that does not require check-ins.
+	ErrNoCheckin = errors.New("msgcrypt: lock does not require check-ins")
+)
+
+// MaxCheckinInterval is the longest check-in interval in seconds. Servers forget check-ins after it.
+const MaxCheckinInterval = 366 * 24 * 3600
+
+// CheckinFunc returns the unix time of the last check-in of the owner key, or 0 if there is none.
+type CheckinFunc func(ownerKey *[32]byte) (lastCheckin uint64, err error)
+
+// Checkin is the signed statement of the owner of a lock that they were able to unlock it at Time.
+type Checkin struct {
+	PublicKey [ed25519.PublicKeySize]byte // Owner key.
+	Time      uint64                      // Time of the check-in.
+	Signature [ed25519.SignatureSize]byte // Signature by the owner key.
+}
+
+// Checkin format:
+//
+// Header | PublicKey | Time (uint64) | Signature
+
+const checkinSize = ed25519.PublicKeySize + 8 + ed25519.SignatureSize
+
+var checkinContext = []byte("cypherlock checkin")
+
+// timeStatement returns the signed data of a statement by publicKey at time.
+func timeStatement(context []byte, publicKey *[ed25519.PublicKeySize]byte, time uint64) []byte {
+	d := make([]byte, 0, len(context)+ed25519.PublicKeySize+8)
+	d = append(d, context...)
+	d = append(d, publicKey[:]...)
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, time)
+	return append(d, t...)
+}
+
+func (c *Checkin) body() []byte {
+	return timeStatement(checkinContext, &c.PublicKey, c.Time)
+}
+
+// NewCheckin returns a Checkin for now, signed with the owner's privateKey.
+func NewCheckin(privateKey *[ed25519.PrivateKeySize]byte, now uint64) *Checkin {
+	c := &Checkin{Time: now}
+	copy(c.PublicKey[:], privateKey[32:])
+	copy(c.Signature[:], ed25519.Sign(privateKey[:], c.body()))
+	return c
+}
+
+// Verify the signature of the Checkin and that its time lies within types.MaxClockSkew of now.
+func (c *Checkin) Verify(now uint64) error {
+	if c.Time > now+types.MaxClockSkew || c.Time+types.MaxClockSkew < now {
+		return ErrCheckinInvalid
+	}
+	if !ed25519.Verify(c.PublicKey[:], c.body(), c.Signature[:]) {
+		return ErrCheckinInvalid
+	}
+	return nil
+}
+
+// Bytes returns the marshalled Checkin.
+func (c *Checkin) Bytes() []byte {
+	out := newHeader(TypeCheckin, checkinSize)
+	out = append(out, c.PublicKey[:]...)
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, c.Time)
+	out = append(out, t...)
+	return append(out, c.Signature[:]...)
+}
+
+// Parse a marshalled Checkin.
+func (c *Checkin) Parse(d []byte) (*Checkin, error) {
+	version, body, err := splitHeader(d, TypeCheckin)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) != checkinSize {
+		return nil, ErrCheckinFormat
+	}
+	nc := &Checkin{
+		Time: binary.BigEndian.Uint64(body[32:40]),
+	}
+	copy(nc.PublicKey[:], body[0:32])
+	copy(nc.Signature[:], body[40:])
+	return nc, nil
+}
+
+// checkCheckin returns an error if the owner of a message has not checked in within its interval.
+func (sc ServerConfig) checkCheckin(policy *Policy) error {
+	if policy.CheckinInterval == 0 {
+		return nil
+	}
+	last, err := sc.CheckinFunc(&policy.CheckinKey)
+	if err != nil {
+		return err
+	}
+	now := uint64(timesource.Clock.Now().Unix())
+	if last+uint64(policy.CheckinInterval) < now {
+		return ErrCheckinOverdue
+	}
+	return nil
+}
+
+// Check-in key file in the storage of a lock:
+//
+// Protector(CheckinInterval (uint32) | Ed25519 PrivateKey)
+
+const (
+	checkinFile    = "checkin"
+	checkinKeySize = 4 + ed25519.PrivateKeySize
+)
+
+// writeCheckinKey creates the owner key of a new lock and stores it sealed by the lock's protector.
+func (cl *Cypherlock) writeCheckinKey(passphrase []byte) (*[ed25519.PrivateKeySize]byte, error) {
+	if cl.CheckinInterval > MaxCheckinInterval {
+		return nil, ErrCheckinInterval
+	}
+	_, privateKey, err := ed25519.GenerateKey(cl.randomSource)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, 4, checkinKeySize)
+	binary.BigEndian.PutUint32(d, cl.CheckinInterval)
+	d = append(d, privateKey...)
+	sealed, err := cl.protector(passphrase).Seal(d, cl.randomSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := cl.Storage.StoreData(checkinFile, sealed); err != nil {
+		return nil, err
+	}
+	priv := new([ed25519.PrivateKeySize]byte)
+	copy(priv[:], privateKey)
+	return priv, nil
+}
+
+// loadCheckinKey returns the owner key and check-in interval of the lock. It returns nil if
+// the lock does not require check-ins.
+func (cl *Cypherlock) loadCheckinKey(passphrase []byte) (*[ed25519.PrivateKeySize]byte, uint32, error) {
+	d, err := cl.Storage.GetData(checkinFile)
+	if err != nil {
+		return nil, 0, nil
+	}
+	p, err := cl.protector(passphrase).Open(d)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p) != checkinKeySize {
+		return nil, 0, ErrCheckinFormat
+	}
+	priv := new([ed25519.PrivateKeySize]byte)
+	copy(priv[:], p[4:])
+	return priv, binary.BigEndian.Uint32(p[0:4]), nil
+}
+
+// sendCheckin sends a check-in to the server, or to all servers of a threshold lock.
+func (cl *Cypherlock) sendCheckin(privateKey *[ed25519.PrivateKeySize]byte) error {
+	c := NewCheckin(privateKey, uint64(timesource.Clock.Now().Unix())).Bytes()
+	if !cl.isThreshold() {
+		return cl.ClientRPC.Checkin(cl.ServerURL, c)
+	}
+	var checkedIn int
+	for _, s := range cl.Servers {
+		if err := cl.ClientRPC.Checkin(s.URL, c); err == nil {
+			checkedIn++
+		}
+	}
+	if checkedIn < cl.Threshold {
+		return ErrThresholdNotReached
+	}
+	return nil
+}
+
+// Checkin proves to the server that the owner can still unlock the lock, keeping it unlockable
+// for another check-in interval.
+func (cl *Cypherlock) Checkin(passphrase []byte) error {
+	cl.init()
+	if cl.Recipient != "" {
+		if err := cl.openRecipient(passphrase); err != nil {
+			return err
+		}
+	}
+	privateKey, _, err := cl.loadCheckinKey(passphrase)
+	if err != nil {
+		return err
+	}
+	if privateKey == nil {
+		return ErrNoCheckin
+	}
+	return cl.sendCheckin(privateKey)
+}
@@ -0,0 +1,109 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestCheckin(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	priv := new([ed25519.PrivateKeySize]byte)
+	copy(priv[:], privateKey)
+	c := NewCheckin(priv, 1000)
+	c2, err := new(Checkin).Parse(c.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if *c2 != *c {
+		t.Error("Parse: check-in mismatch")
+	}
+	if err := c2.Verify(1000); err != nil {
+		t.Errorf("Verify: %s", err)
+	}
+	if err := c2.Verify(2000); err != ErrCheckinInvalid {
+		t.Errorf("Verify old check-in: %v", err)
+	}
+	c2.Time++
+	if err := c2.Verify(1000); err != ErrCheckinInvalid {
+		t.Errorf("Verify modified check-in: %v", err)
+	}
+	if _, err := new(Checkin).Parse(c.Bytes()[:50]); err != ErrCheckinFormat {
+		t.Errorf("Parse short check-in: %v", err)
+	}
+}
+
+func TestCypherlockCheckin(t *testing.T) {
+	clock := timesource.Clock
+	defer func() { timesource.Clock = clock }()
+	nc := timesource.NewMockClock(time.Now())
+	timesource.Clock = nc
+
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey:    &ts.sigPublicKey,
+		ServerURL:       "server",
+		Storage:         storage,
+		ClientRPC:       rpc,
+		CheckinInterval: MaxCheckinInterval + 1,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != ErrCheckinInterval {
+		t.Errorf("CreateLock with too long interval: %v", err)
+	}
+	cl.CheckinInterval = 600
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	nc.Advance(time.Second * 601)
+	now = testNow()
+	if _, err := cl.LoadLock(passphrase, now); err != ErrCheckinOverdue {
+		t.Errorf("LoadLock after check-in interval: %v", err)
+	}
+	if err := cl.Checkin([]byte("wrong")); err == nil {
+		t.Error("Checkin must fail with wrong passphrase")
+	}
+	if err := cl.Checkin(passphrase); err != nil {
+		t.Fatalf("Checkin: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock after check-in: %v", err)
+	}
+	// Extended messages carry the same check-in policy.
+	if _, _, err := cl.ExtendLock(passphrase, now, now, now+3600); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+	nc.Advance(time.Second * 601)
+	if _, err := cl.LoadLock(passphrase, testNow()); err != ErrCheckinOverdue {
+		t.Errorf("LoadLock of extended lock after check-in interval: %v", err)
+	}
+	ts.config.CheckinFunc = nil
+	if _, err := cl.LoadLock(passphrase, testNow()); err != ErrPolicyUnsupported {
+		t.Errorf("LoadLock without CheckinFunc: %v", err)
+	}
+	cl.CheckinInterval = 0
+	storage2, cleanup2 := testStorage(t)
+	defer cleanup2()
+	cl.Storage = storage2
+	if _, _, err := cl.CreateLock(passphrase, secret, testNow(), testNow()+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if err := cl.Checkin(passphrase); err != ErrNoCheckin {
+		t.Errorf("Checkin without check-in key: %v", err)
+	}
+}
@@ -7,9 +7,13 @@ import (
 
 	"github.com/JonathanLogan/cypherlock/clientinterface"
 	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
 	"golang.org/x/crypto/ed25519"
 )
 
+// DefaultMaxKeylistAge is the default number of seconds after issuance for which a keylist is accepted.
+const DefaultMaxKeylistAge = 48 * 3600
+
 var (
 	// ErrNoLocksFound is returned if no matching locks could be found in the keylist of the server.
 	ErrNoLocksFound = errors.New("msgcrypt: no matching locks found")
@@ -21,32 +25,133 @@ var (
 
 // Cypherlock implements the client's github.com/JonathanLogan/cypherlock functionality.
 type Cypherlock struct {
-	SignatureKey      *[ed25519.PublicKeySize]byte // SignatureKey for verification.
-	ServerURL         string                       // Address of the server.
-	Storage           clientinterface.Storage      // Storage interface
-	ClientRPC         clientinterface.ClientRPC    // RPC interface.
-	randomSource      io.Reader                    // Source for random bytes suitable for key generation.
-	ratchetPublicKeys *types.RatchetList           // The keylist of the github.com/JonathanLogan/cypherlockd.
+	SignatureKey      *[ed25519.PublicKeySize]byte  // SignatureKey for verification.
+	ServerURL         string                        // Address of the server.
+	Storage           clientinterface.Storage       // Storage interface
+	ClientRPC         clientinterface.ClientRPC     // RPC interface.
+	MaxKeylistAge     uint64                        // Maximum age of a keylist in seconds. Defaults to DefaultMaxKeylistAge.
+	Servers           []Server                      // Servers of a threshold lock. If set, SignatureKey and ServerURL are ignored.
+	Threshold         int                           // Number of Servers required to unlock a threshold lock.
+	PartialWrite      bool                          // Write threshold locks if at least Threshold, but not all, servers succeed.
+	KDFParams         *KDFParams                    // Key derivation parameters for new locks. Defaults to DefaultKDFParams.
+	Keyfile           []byte                        // Content of a keyfile required in addition to the passphrase. Optional.
+	ClientPublicKey   *[32]byte                     // Client key to seal locks to instead of a passphrase. Optional.
+	ClientPrivateKey  *[32]byte                     // Client key to open locks sealed to ClientPublicKey.
+	MaxUses           uint32                        // Number of times each oracle message of a new lock can be used. 0 for unlimited.
+	DuressPassphrase  []byte                        // Passphrase that destroys a new lock when used to unlock it. Optional.
+	DuressBurn        bool                          // Burn the oracle messages of a new lock on the servers when the duress passphrase is used. Requires MaxUses.
+	CheckinInterval   uint32                        // Seconds within which the owner must check in to keep a new lock unlockable. 0 to disable.
+	Recipient         string                        // Label of the recipient using a multi-recipient lock. Empty for single passphrase locks.
+	Oblivious         bool                          // Create locks that are unlocked without revealing their ratchet keys to the server. Excludes MaxUses, CheckinInterval, Delay, Approvers and Schedule.
+	Delay             uint32                        // Seconds the server holds back the secret of a new lock after an unlock request. 0 for none.
+	CancelKey         *[ed25519.PublicKeySize]byte  // Key of the owner that can cancel delayed unlocks. Required with Delay.
+	Approvers         [][ed25519.PublicKeySize]byte // Keys of the approvers of unlocks of a new lock. Optional.
+	Approvals         uint8                         // Number of Approvers that must approve each unlock. Required with Approvers.
+	Schedule          *Schedule                     // Recurring windows to which new locks are restricted within their time range. Optional.
+	randomSource      io.Reader                     // Source for random bytes suitable for key generation.
+	ratchetPublicKeys *types.RatchetList            // The keylist of the github.com/JonathanLogan/cypherlockd.
+	lockPublicKey     *[32]byte                     // Lock key of a multi-recipient lock.
+	lockPrivateKey    *[32]byte                     // Lock key of a multi-recipient lock, once opened by Recipient.
 }
 
 func (cl *Cypherlock) init() {
 	if cl.randomSource == nil {
 		cl.randomSource = rand.Reader
 	}
+	if cl.MaxKeylistAge == 0 {
+		cl.MaxKeylistAge = DefaultMaxKeylistAge
+	}
+}
+
+// protector returns the Protector for the oracle messages of the lock. Multi-recipient locks use
+// the lock key, otherwise a configured client key replaces the passphrase.
+func (cl *Cypherlock) protector(passphrase []byte) Protector {
+	if cl.Recipient != "" {
+		return &KeyProtector{PublicKey: cl.lockPublicKey, PrivateKey: cl.lockPrivateKey}
+	}
+	if cl.ClientPublicKey != nil || cl.ClientPrivateKey != nil {
+		return &KeyProtector{PublicKey: cl.ClientPublicKey, PrivateKey: cl.ClientPrivateKey}
+	}
+	return &PassphraseProtector{Passphrase: passphrase, Keyfile: cl.Keyfile, Params: cl.KDFParams}
+}
+
+// checkKeylist verifies the signature, structure and freshness of a keylist.
+func (cl *Cypherlock) checkKeylist(keys *types.RatchetList) error {
+	if keys.IsReleaseList() {
+		return ErrKeylistType
+	}
+	if !keys.Verify(cl.SignatureKey) {
+		return ErrKeylistUntrusted
+	}
+	if err := keys.Validate(); err != nil {
+		return err
+	}
+	now := uint64(timesource.Clock.Now().Unix())
+	return keys.CheckFreshness(now, cl.MaxKeylistAge)
 }
 
 // CreateLock creates a lock.
 func (cl *Cypherlock) CreateLock(passphrase []byte, secret []byte, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
 	cl.init()
+	if cl.Oblivious && (cl.MaxUses > 0 || cl.CheckinInterval > 0 || cl.Delay > 0 || cl.Approvals > 0 || cl.Schedule != nil) {
+		return 0, 0, ErrObliviousPolicy
+	}
+	if err := cl.checkDelay(); err != nil {
+		return 0, 0, err
+	}
+	if err := cl.checkApprovers(); err != nil {
+		return 0, 0, err
+	}
 	secretKey, encrypted, err := EncryptRealSecret(secret, cl.randomSource)
 	if err != nil {
 		return 0, 0, err
 	}
-	err = cl.Storage.StoreSecret(encrypted)
+	lcl := cl
+	var staged *stagedStorage
+	if cl.isThreshold() {
+		// All files of the new lock are only written together with the locks of the servers.
+		n := *cl
+		staged = newStagedStorage(cl.Storage)
+		n.Storage = staged
+		lcl = &n
+	}
+	if cl.Recipient != "" {
+		if err := lcl.createRecipients(passphrase); err != nil {
+			return 0, 0, err
+		}
+	}
+	if cl.Recipient == "" && (cl.ClientPublicKey != nil || cl.ClientPrivateKey != nil) {
+		if len(cl.DuressPassphrase) > 0 {
+			return 0, 0, ErrDuressClientKey
+		}
+	} else if err := lcl.writeDuress(passphrase, secretKey); err != nil {
+		return 0, 0, err
+	}
+	var checkinKey *[ed25519.PrivateKeySize]byte
+	if cl.CheckinInterval > 0 {
+		if checkinKey, err = lcl.writeCheckinKey(passphrase); err != nil {
+			return 0, 0, err
+		}
+	}
+	err = lcl.Storage.StoreSecret(encrypted)
 	if err != nil {
 		return 0, 0, err
 	}
-	return cl.WriteLock(passphrase, secretKey, validFrom, validTo)
+	finalValidFrom, finalValidTo, err = lcl.WriteLock(passphrase, secretKey, validFrom, validTo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if staged != nil {
+		if err := staged.commit(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if checkinKey != nil {
+		if err := cl.sendCheckin(checkinKey); err != nil {
+			return 0, 0, err
+		}
+	}
+	return finalValidFrom, finalValidTo, nil
 }
 
 func (cl *Cypherlock) getRatchetPublicKeysFromFile() error {
@@ -54,6 +159,9 @@ func (cl *Cypherlock) getRatchetPublicKeysFromFile() error {
 	if err != nil {
 		return err
 	}
+	if err := cl.checkKeylist(keys); err != nil {
+		return err
+	}
 	cl.ratchetPublicKeys = keys
 	return nil
 }
@@ -63,11 +171,11 @@ func (cl *Cypherlock) getRatchetPublicKeysFromCypherlockd() error {
 	if err != nil {
 		return err
 	}
-	if keys.Verify(cl.SignatureKey) {
-		cl.ratchetPublicKeys = keys
-		return cl.Storage.StoreKeylist(keys)
+	if err := cl.checkKeylist(keys); err != nil {
+		return err
 	}
-	return ErrKeylistUntrusted
+	cl.ratchetPublicKeys = keys
+	return cl.Storage.StoreKeylist(keys)
 }
 
 func (cl *Cypherlock) getLockTargets(validFrom, validTo uint64) ([]types.MatchKey, error) {
@@ -95,8 +203,49 @@ func (cl *Cypherlock) getLockTargets(validFrom, validTo uint64) ([]types.MatchKe
 }
 
 // WriteLock creates a set of oracle messages for the given parameters. It returns the _actual_ time range used.
+// For threshold locks secretKey is split and one set of oracle messages per server is created. With a
+// Schedule only its occurrences within the time range are written.
 func (cl *Cypherlock) WriteLock(passphrase []byte, secretKey *[32]byte, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
 	cl.init()
+	if cl.Recipient != "" && cl.lockPublicKey == nil {
+		if err := cl.loadLockPublicKey(); err != nil {
+			return 0, 0, err
+		}
+	}
+	policy := &Policy{MaxUses: cl.MaxUses}
+	checkinKey, checkinInterval, err := cl.loadCheckinKey(passphrase)
+	if err != nil {
+		return 0, 0, err
+	}
+	if checkinKey != nil {
+		copy(policy.CheckinKey[:], checkinKey[32:])
+		policy.CheckinInterval = checkinInterval
+	}
+	if err := cl.checkDelay(); err != nil {
+		return 0, 0, err
+	}
+	if cl.Delay > 0 {
+		policy.CancelKey = *cl.CancelKey
+		policy.Delay = cl.Delay
+	}
+	if err := cl.checkApprovers(); err != nil {
+		return 0, 0, err
+	}
+	policy.Approvers, policy.Approvals = cl.Approvers, cl.Approvals
+	if cl.Schedule != nil {
+		return cl.writeScheduleLock(passphrase, secretKey, policy, validFrom, validTo)
+	}
+	return cl.writeLock(passphrase, secretKey, cl.duressPublicKey(secretKey), policy, validFrom, validTo)
+}
+
+// writeLock implements WriteLock. The burn records of the new messages are sealed to duressKey, if not nil.
+func (cl *Cypherlock) writeLock(passphrase []byte, secretKey, duressKey *[32]byte, policy *Policy, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
+	if cl.isThreshold() {
+		return cl.writeThresholdLock(passphrase, secretKey, duressKey, policy, validFrom, validTo)
+	}
+	if cl.SignatureKey == nil {
+		return 0, 0, ErrNoSignatureKey // Responses to the new messages could not be verified.
+	}
 
 	lockTargets, err := cl.getLockTargets(validFrom, validTo)
 	if err != nil {
@@ -104,6 +253,7 @@ func (cl *Cypherlock) WriteLock(passphrase []byte, secretKey *[32]byte, validFro
 	}
 
 	realFrom, realTo := types.GetTimeFrame(lockTargets)
+	var burnRecords []byte
 	for _, lockTarget := range lockTargets {
 		omt := &OracleMessageTemplate{
 			ValidFrom:        lockTarget.ValidFrom,
@@ -111,8 +261,19 @@ func (cl *Cypherlock) WriteLock(passphrase []byte, secretKey *[32]byte, validFro
 			ServerURL:        cl.ServerURL,
 			ServerPublicKey:  lockTarget.EnvelopeKey,
 			RatchetPublicKey: lockTarget.RatchetKey,
+			Policy:           policy,
+			SignatureKey:     *cl.SignatureKey,
+		}
+		var om *OracleMessage
+		if cl.Oblivious {
+			om, err = omt.CreateOblivious(secretKey, cl.randomSource)
+		} else {
+			om, err = omt.Create(secretKey, cl.randomSource)
 		}
-		oracleMessage, filename, err := omt.CreateEncrypted(passphrase, secretKey, cl.randomSource)
+		if err != nil {
+			return 0, 0, err
+		}
+		oracleMessage, filename, err := om.Seal(cl.protector(passphrase), cl.randomSource)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -120,25 +281,93 @@ func (cl *Cypherlock) WriteLock(passphrase []byte, secretKey *[32]byte, validFro
 		if err != nil {
 			return 0, 0, err
 		}
+		if !cl.Oblivious {
+			burnRecords = append(burnRecords, encodeSlice([]byte(om.ServerURL))...)
+			burnRecords = append(burnRecords, encodeSlice(om.ServerMessage)...)
+		}
+	}
+	if duressKey != nil {
+		if err := cl.appendBurnRecords(duressKey, burnRecords); err != nil {
+			return 0, 0, err
+		}
 	}
 	return realFrom, realTo, nil
 }
 
-// loadLockKey recovers the encryption secret for the real secret.
+// loadLockKey recovers the encryption secret for the real secret. If that fails and passphrase
+// is the duress passphrase, the lock is destroyed and the same error is returned.
 func (cl *Cypherlock) loadLockKey(passphrase []byte, now uint64) (secretKey *[32]byte, err error) {
+	if cl.Recipient != "" {
+		err = cl.openRecipient(passphrase)
+	}
+	if err == nil {
+		secretKey, err = cl.openLockKey(passphrase, now)
+	}
+	if err != nil && passphrase != nil {
+		cl.checkDuress(passphrase)
+	}
+	return secretKey, err
+}
+
+// openOracleMessage returns the stored OracleMessage that is valid at now, and its sealed form.
+func (cl *Cypherlock) openOracleMessage(passphrase []byte, now uint64) (*OracleMessage, []byte, error) {
 	omD, err := cl.Storage.GetLock(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	om, err := cl.openOracleData(passphrase, omD)
+	return om, omD, err
+}
+
+// openOracleData opens a sealed OracleMessage.
+func (cl *Cypherlock) openOracleData(passphrase, omD []byte) (*OracleMessage, error) {
+	om, err := new(OracleMessage).Open(cl.protector(passphrase), omD)
 	if err != nil {
 		return nil, err
 	}
-	om, err := new(OracleMessage).Decrypt(passphrase, omD)
+	if om.SignatureKey == ([ed25519.PublicKeySize]byte{}) && cl.SignatureKey != nil {
+		om.SignatureKey = *cl.SignatureKey // Written before keys were pinned.
+	}
+	return om, nil
+}
+
+// openLockKey implements loadLockKey.
+func (cl *Cypherlock) openLockKey(passphrase []byte, now uint64) (secretKey *[32]byte, err error) {
+	if cl.isThreshold() {
+		return cl.loadThresholdLockKey(passphrase, now)
+	}
+	if ticket, omD, err := cl.loadTicket(); err != ErrNoTicket {
+		if err != nil {
+			return nil, err
+		}
+		return cl.pollLockKey(passphrase, now, ticket, omD)
+	}
+	om, omD, err := cl.openOracleMessage(passphrase, now)
 	if err != nil {
 		return nil, err
 	}
+	if om.Oblivious() {
+		return cl.obliviousLockKey(cl.ServerURL, om)
+	}
 	responseMessage, err := cl.ClientRPC.Decrypt(cl.ServerURL, om.ServerMessage)
+	if err != nil {
+		return nil, serverError(err)
+	}
+	return cl.processResponse(om, omD, responseMessage)
+}
+
+// obliviousLockKey unlocks an oblivious OracleMessage with the server at serverURL.
+func (cl *Cypherlock) obliviousLockKey(serverURL string, om *OracleMessage) (secretKey *[32]byte, err error) {
+	cl.init()
+	blindedKey, unblindKey, err := om.Blind(cl.randomSource)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := cl.ClientRPC.DecryptOblivious(serverURL, blindedKey)
 	if err != nil {
 		return nil, err
 	}
-	return om.ProcessResponseMessage(responseMessage)
+	return om.ProcessObliviousResponse(unblindKey, secrets)
 }
 
 // LoadLock returns the secret from a lock.
@@ -154,6 +383,27 @@ func (cl *Cypherlock) LoadLock(passphrase []byte, now uint64) (realSecret []byte
 	return DecryptRealSecret(secretKey, encrypteSecret)
 }
 
+// NewEncrypter unlocks the lock and returns a StreamWriter that encrypts to w with a key derived
+// from the lock's secret key.
+func (cl *Cypherlock) NewEncrypter(passphrase []byte, now uint64, w io.Writer) (*StreamWriter, error) {
+	cl.init()
+	secretKey, err := cl.loadLockKey(passphrase, now)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamWriter(w, StreamKey(secretKey), cl.randomSource)
+}
+
+// NewDecrypter unlocks the lock and returns a StreamReader that decrypts r with a key derived
+// from the lock's secret key.
+func (cl *Cypherlock) NewDecrypter(passphrase []byte, now uint64, r io.Reader) (*StreamReader, error) {
+	secretKey, err := cl.loadLockKey(passphrase, now)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamReader(r, StreamKey(secretKey))
+}
+
 // ExtendLock extends a lock towards the future.
 func (cl *Cypherlock) ExtendLock(passphrase []byte, now, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
 	secretKey, err := cl.loadLockKey(passphrase, now)
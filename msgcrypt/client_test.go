@@ -0,0 +1,599 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+	"github.com/JonathanLogan/cypherlock/ratchet"
+	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testServer is an in-process Cypherlock server.
+type testServer struct {
+	sigPublicKey  [ed25519.PublicKeySize]byte
+	sigPrivateKey [ed25519.PrivateKeySize]byte
+	keylist       []byte
+	fountain      *ratchet.Fountain
+	release       *ratchet.ReleaseFountain
+	releaseList   []byte
+	config        *ServerConfig
+	spent         map[[32]byte]uint32
+	checkins      map[[32]byte]uint64
+	pending       map[[32]byte]*testPending
+	approvals     map[[32]byte]*testApproval
+}
+
+// testPending is a response held back by a testServer.
+type testPending struct {
+	cancelKey [32]byte
+	created   uint64
+	readyAt   uint64
+	response  []byte
+}
+
+func (ts *testServer) spend(nullifier *[32]byte, maxUses uint32, expire uint64) error {
+	if ts.spent[*nullifier] >= maxUses {
+		return ErrMessageSpent
+	}
+	ts.spent[*nullifier]++
+	return nil
+}
+
+func (ts *testServer) lastCheckin(ownerKey *[32]byte) (uint64, error) {
+	return ts.checkins[*ownerKey], nil
+}
+
+func (ts *testServer) checkin(d []byte) error {
+	c, err := new(Checkin).Parse(d)
+	if err != nil {
+		return err
+	}
+	if err := c.Verify(testNow()); err != nil {
+		return err
+	}
+	if ts.checkins[c.PublicKey] >= c.Time {
+		return ErrCheckinReplay
+	}
+	ts.checkins[c.PublicKey] = c.Time
+	return nil
+}
+
+func (ts *testServer) burn(nullifier *[32]byte, expire uint64) error {
+	ts.spent[*nullifier] = math.MaxUint32
+	return nil
+}
+
+func (ts *testServer) delay(response []byte, cancelKey *[32]byte, delay uint32) (*Ticket, error) {
+	id, err := genRandom(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := testNow()
+	ticket := &Ticket{ID: *id, ReadyAt: now + uint64(delay)}
+	ts.pending[*id] = &testPending{cancelKey: *cancelKey, created: now, readyAt: ticket.ReadyAt, response: response}
+	return ticket, nil
+}
+
+func (ts *testServer) poll(ticket *[32]byte) ([]byte, error) {
+	p, ok := ts.pending[*ticket]
+	if !ok {
+		return nil, ErrTicketUnknown
+	}
+	if p.readyAt > testNow() {
+		return nil, ErrUnlockPending
+	}
+	return p.response, nil
+}
+
+func (ts *testServer) cancel(d []byte) error {
+	c, err := new(Cancel).Parse(d)
+	if err != nil {
+		return err
+	}
+	if err := c.Verify(testNow()); err != nil {
+		return err
+	}
+	for id, p := range ts.pending {
+		if p.cancelKey == c.PublicKey && p.created <= c.Time {
+			delete(ts.pending, id)
+		}
+	}
+	return nil
+}
+
+// testApproval is a request waiting for approvals at a testServer.
+type testApproval struct {
+	approvers [][32]byte
+	approvals uint8
+	approved  map[[32]byte]bool
+}
+
+func (ts *testServer) approval(request *[32]byte, approvers [][32]byte, approvals uint8) error {
+	ta, ok := ts.approvals[*request]
+	if !ok {
+		ts.approvals[*request] = &testApproval{approvers: approvers, approvals: approvals, approved: make(map[[32]byte]bool)}
+		return ErrApprovalPending
+	}
+	if len(ta.approved) < int(ta.approvals) {
+		return ErrApprovalPending
+	}
+	delete(ts.approvals, *request)
+	return nil
+}
+
+func (ts *testServer) approve(d []byte) error {
+	a, err := new(Approval).Parse(d)
+	if err != nil {
+		return err
+	}
+	if err := a.Verify(testNow()); err != nil {
+		return err
+	}
+	ta, ok := ts.approvals[a.Request]
+	if !ok {
+		return ErrApprovalUnknown
+	}
+	for _, approver := range ta.approvers {
+		if approver == a.PublicKey {
+			ta.approved[approver] = true
+			return nil
+		}
+	}
+	return ErrApprovalInvalid
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ts := new(testServer)
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	copy(ts.sigPublicKey[:], pubkey)
+	copy(ts.sigPrivateKey[:], privkey)
+	encPublicKey, encPrivateKey := genTestKeys()
+	ts.fountain, err = ratchet.NewFountain(3600, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewFountain: %s", err)
+	}
+	list := ratchet.NewPregeneratorFromFountain(ts.fountain, 24*3600).Generate()
+	list.EnvelopeKey = *encPublicKey
+	list.SignatureKey = ts.sigPublicKey
+	list.Sign(&ts.sigPrivateKey)
+	ts.keylist = list.Bytes()
+	ts.fountain.StartService()
+	ts.config = &ServerConfig{
+		PublicKey:       *encPublicKey,
+		PrivateKey:      *encPrivateKey,
+		GetSecretFunc:   ts.fountain.GetSecret,
+		BlindSecretFunc: ts.fountain.GetBlindSecrets,
+		SpendFunc:       ts.spend,
+		BurnFunc:        ts.burn,
+		CheckinFunc:     ts.lastCheckin,
+		DelayFunc:       ts.delay,
+		ApprovalFunc:    ts.approval,
+		SignatureKey:    &ts.sigPrivateKey,
+		RandomSource:    rand.Reader,
+	}
+	ts.spent = make(map[[32]byte]uint32)
+	ts.checkins = make(map[[32]byte]uint64)
+	ts.pending = make(map[[32]byte]*testPending)
+	ts.approvals = make(map[[32]byte]*testApproval)
+	return ts
+}
+
+var errServerDown = errors.New("server down")
+
+// testRPC implements clientinterface.ClientRPC for testServers.
+type testRPC struct {
+	servers  map[string]*testServer
+	down     map[string]bool
+	batches  int // Number of DecryptBatch calls.
+	decrypts int // Number of Decrypt calls and messages in DecryptBatch calls.
+}
+
+func newTestRPC() *testRPC {
+	return &testRPC{
+		servers: make(map[string]*testServer),
+		down:    make(map[string]bool),
+	}
+}
+
+// wireError returns err as it is received from a server over RPC. Only errors of PollUnlock are
+// converted, the tests of other calls compare the server's errors directly.
+func wireError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &types.RPCError{Code: ErrorCode(err), Message: err.Error()}
+}
+
+func (tr *testRPC) GetKeylist(serverURL string) (*types.RatchetList, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	return new(types.RatchetList).Parse(tr.servers[serverURL].keylist)
+}
+
+func (tr *testRPC) Decrypt(serverURL string, oracleMessage []byte) ([]byte, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	tr.decrypts++
+	return tr.servers[serverURL].config.ProcessOracleMessage(oracleMessage)
+}
+
+func (tr *testRPC) DecryptBatch(serverURL string, oracleMessages [][]byte) ([][]byte, []error, error) {
+	if tr.down[serverURL] {
+		return nil, nil, errServerDown
+	}
+	tr.batches++
+	tr.decrypts += len(oracleMessages)
+	responses, errs := make([][]byte, len(oracleMessages)), make([]error, len(oracleMessages))
+	for i, msg := range oracleMessages {
+		responses[i], errs[i] = tr.servers[serverURL].config.ProcessOracleMessage(msg)
+	}
+	return responses, errs, nil
+}
+
+func (tr *testRPC) DecryptOblivious(serverURL string, blindedKey *[32]byte) ([]*[32]byte, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	return tr.servers[serverURL].config.ProcessObliviousRequest(blindedKey)
+}
+
+func (tr *testRPC) PollUnlock(serverURL string, ticket *[32]byte) ([]byte, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	response, err := tr.servers[serverURL].poll(ticket)
+	return response, wireError(err)
+}
+
+func (tr *testRPC) CancelUnlocks(serverURL string, cancel []byte) error {
+	if tr.down[serverURL] {
+		return errServerDown
+	}
+	return tr.servers[serverURL].cancel(cancel)
+}
+
+func (tr *testRPC) Approve(serverURL string, approval []byte) error {
+	if tr.down[serverURL] {
+		return errServerDown
+	}
+	return tr.servers[serverURL].approve(approval)
+}
+
+func (tr *testRPC) Burn(serverURL string, oracleMessage []byte) error {
+	if tr.down[serverURL] {
+		return errServerDown
+	}
+	return tr.servers[serverURL].config.BurnOracleMessage(oracleMessage)
+}
+
+func (tr *testRPC) Checkin(serverURL string, checkin []byte) error {
+	if tr.down[serverURL] {
+		return errServerDown
+	}
+	return tr.servers[serverURL].checkin(checkin)
+}
+
+func (tr *testRPC) GetReleaseKeys(serverURL string) (*types.RatchetList, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	return new(types.RatchetList).Parse(tr.servers[serverURL].releaseList)
+}
+
+func (tr *testRPC) GetReleasedKey(serverURL string, counter uint64) (*types.ReleasedKey, error) {
+	if tr.down[serverURL] {
+		return nil, errServerDown
+	}
+	ts := tr.servers[serverURL]
+	privateKey, validFrom, err := ts.release.Release(counter)
+	if err != nil {
+		return nil, err
+	}
+	rk := &types.ReleasedKey{Counter: counter, ValidFrom: validFrom, PrivateKey: *privateKey}
+	rk.Sign(&ts.sigPrivateKey)
+	return rk, nil
+}
+
+func testStorage(t *testing.T) (clientinterface.Storage, func()) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	return &clientinterface.DefaultStorage{Path: dir}, func() { os.RemoveAll(dir) }
+}
+
+func testNow() uint64 {
+	return uint64(timesource.Clock.Now().Unix())
+}
+
+func TestCypherlock(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	secret2, err := cl.LoadLock(passphrase, now)
+	if err != nil {
+		t.Fatalf("LoadLock: %s", err)
+	}
+	if !bytes.Equal(secret, secret2) {
+		t.Error("Secrets don't match")
+	}
+	if _, err := cl.LoadLock([]byte("wrong"), now); err == nil {
+		t.Error("LoadLock must fail with wrong passphrase")
+	}
+	enc := new(bytes.Buffer)
+	sw, err := cl.NewEncrypter(passphrase, now, enc)
+	if err != nil {
+		t.Fatalf("NewEncrypter: %s", err)
+	}
+	sw.Write(secret)
+	sw.Close()
+	sr, err := cl.NewDecrypter(passphrase, now, enc)
+	if err != nil {
+		t.Fatalf("NewDecrypter: %s", err)
+	}
+	if dec, err := ioutil.ReadAll(sr); err != nil || !bytes.Equal(dec, secret) {
+		t.Errorf("Stream: %v", err)
+	}
+}
+
+func TestCypherlockThreshold(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase, secret := []byte("passphrase"), []byte("threshold secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	rpc.down["a"] = true
+	secret2, err := cl.LoadLock(passphrase, now)
+	if err != nil {
+		t.Fatalf("LoadLock: %s", err)
+	}
+	if !bytes.Equal(secret, secret2) {
+		t.Error("Secrets don't match")
+	}
+	// Extending with one server down must keep shares compatible.
+	cl.PartialWrite = true
+	if _, _, err := cl.ExtendLock(passphrase, now, now, now+3600); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+	rpc.down["b"] = true
+	if _, err := cl.LoadLock(passphrase, now); err != ErrThresholdNotReached {
+		t.Errorf("LoadLock below threshold: %v", err)
+	}
+	rpc.down["a"] = false
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock after extend: %v", err)
+	}
+	// Shares are found by server URL, not by position.
+	rpc.down["b"] = false
+	cl.Servers[0], cl.Servers[2] = cl.Servers[2], cl.Servers[0]
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock with reordered servers: %v", err)
+	}
+	cl.Servers[0].URL = "d"
+	if _, _, err := cl.ExtendLock(passphrase, now, now, now+3600); err != ErrServerUnknown {
+		t.Errorf("ExtendLock with unknown server: %v", err)
+	}
+}
+
+func TestCypherlockThresholdWriteFailure(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase, secret := []byte("passphrase"), []byte("threshold secret")
+	now := testNow()
+	rpc.down["c"] = true
+	_, _, err := cl.CreateLock(passphrase, secret, now, now+1800)
+	if we, ok := err.(*ServerWriteError); !ok || we.Err != ErrServersFailed || len(we.Servers) != 1 || we.Servers[0] != "c" {
+		t.Fatalf("CreateLock with server down: %v", err)
+	}
+	for i := range cl.Servers {
+		if _, err := cl.forServer(i).Storage.GetLock(now); err == nil {
+			t.Errorf("Lock file of failed write left for server %d", i)
+		}
+	}
+	if _, err := storage.GetData(sharesFile); err == nil {
+		t.Error("Shares of failed write left")
+	}
+	cl.PartialWrite = true
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock with PartialWrite: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock: %v", err)
+	}
+	// A failed write keeps the previous lock and secret.
+	cl.PartialWrite = false
+	_, _, err = cl.CreateLock(passphrase, []byte("other secret"), now, now+1800)
+	if we, ok := err.(*ServerWriteError); !ok || we.Err != ErrServersFailed {
+		t.Errorf("CreateLock with server down: %v", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock after failed write: %v", err)
+	}
+	// Servers without a stored keylist fail when down.
+	storage2, cleanup2 := testStorage(t)
+	defer cleanup2()
+	cl.Storage = storage2
+	cl.PartialWrite = true
+	rpc.down["b"] = true
+	_, _, err = cl.CreateLock(passphrase, secret, now, now+1800)
+	if we, ok := err.(*ServerWriteError); !ok || we.Err != ErrThresholdNotReached || len(we.Servers) != 2 {
+		t.Errorf("CreateLock below threshold: %v", err)
+	}
+	if _, err := storage2.GetSecret(); err == nil {
+		t.Error("Secret of failed write left")
+	}
+	if _, err := storage2.GetData(duressFile); err == nil {
+		t.Error("Duress file of failed write left")
+	}
+}
+
+func TestCypherlockKeyfile(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Keyfile:      []byte("keyfile content"),
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	cl.Keyfile = []byte("other keyfile")
+	if _, err := cl.LoadLock(passphrase, now); err == nil {
+		t.Error("LoadLock must fail with wrong keyfile")
+	}
+	cl.Keyfile = nil
+	if _, err := cl.LoadLock(passphrase, now); err != ErrKeyfileRequired {
+		t.Errorf("LoadLock without keyfile: %v", err)
+	}
+}
+
+func TestCypherlockClientKey(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	pub, priv, err := GenKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenKeyPair: %s", err)
+	}
+	cl := &Cypherlock{
+		SignatureKey:    &ts.sigPublicKey,
+		ServerURL:       "server",
+		Storage:         storage,
+		ClientRPC:       rpc,
+		ClientPublicKey: pub,
+	}
+	secret := []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(nil, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if _, err := cl.LoadLock(nil, now); err != ErrNoClientKey {
+		t.Errorf("LoadLock without private key: %v", err)
+	}
+	cl.ClientPublicKey, cl.ClientPrivateKey = nil, priv
+	if secret2, err := cl.LoadLock(nil, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	if _, _, err := cl.ExtendLock(nil, now, now, now+3600); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+}
+
+func TestCypherlockMaxUses(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		MaxUses:      2,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+			t.Fatalf("LoadLock %d: %v", i, err)
+		}
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != ErrMessageSpent {
+		t.Errorf("LoadLock after use limit: %v", err)
+	}
+	ts.config.SpendFunc = nil
+	if _, err := cl.LoadLock(passphrase, now); err != ErrPolicyUnsupported {
+		t.Errorf("LoadLock without SpendFunc: %v", err)
+	}
+}
+
+func TestCypherlockNoSignatureKey(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		ServerURL: "server",
+		Storage:   storage,
+		ClientRPC: rpc,
+	}
+	secretKey := new([32]byte)
+	now := testNow()
+	if _, _, err := cl.WriteLock([]byte("passphrase"), secretKey, now, now+1800); err != ErrNoSignatureKey {
+		t.Errorf("WriteLock without signature key: %v", err)
+	}
+	cl.Servers = []Server{{URL: "server"}}
+	cl.Threshold = 1
+	_, _, err := cl.WriteLock([]byte("passphrase"), secretKey, now, now+1800)
+	if we, ok := err.(*ServerWriteError); !ok || we.Errs[0] != ErrNoSignatureKey {
+		t.Errorf("WriteLock without server signature key: %v", err)
+	}
+}
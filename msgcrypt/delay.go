@@ -0,0 +1,348 @@
+package msgcrypt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrUnlockPending is returned if the response to a delayed message is not ready yet.
+	ErrUnlockPending = errors.New("msgcrypt: unlock pending")
+	// ErrTicketUnknown is returned if a ticket is unknown, cancelled or expired.
+	ErrTicketUnknown = errors.New("msgcrypt: unlock ticket unknown, cancelled or expired")
+	// ErrTicketFormat is returned if a Ticket cannot be parsed.
+	ErrTicketFormat = errors.New("msgcrypt: invalid unlock ticket")
+	// ErrNoTicket is returned if no unlock is pending for a lock.
+	ErrNoTicket = errors.New("msgcrypt: no unlock pending")
+	// ErrCancelFormat is returned if a Cancel cannot be parsed.
+	ErrCancelFormat = errors.New("msgcrypt: invalid cancellation")
+	// ErrCancelInvalid is returned if the signature or time of a Cancel is invalid.
+	ErrCancelInvalid = errors.New("msgcrypt: cancellation signature or time invalid")
+	// ErrDelay is returned if the delay of a new lock is too long or lacks a cancel key.
+	ErrDelay = errors.New("msgcrypt: delay too long or without cancel key")
+	// ErrNoDelay is returned if an unlock is requested for a lock without delay.
+	ErrNoDelay = errors.New("msgcrypt: lock is not delayed")
+)
+
+const (
+	// MaxDelay is the longest delay of a message in seconds.
+	MaxDelay = 30 * 24 * 3600
+	// TicketRetention is the number of seconds servers keep a response after its ticket is ready.
+	TicketRetention = 7 * 24 * 3600
+)
+
+// DelayFunc holds back the response to a delayed message for delay seconds. It returns the
+// ticket to fetch the response with. Tickets can be cancelled by the owner of cancelKey.
+type DelayFunc func(response []byte, cancelKey *[32]byte, delay uint32) (*Ticket, error)
+
+// Ticket is returned by the server instead of the response to a delayed message. It is signed by
+// the server and bound to the request, so that ReadyAt cannot be forged.
+type Ticket struct {
+	ID          [32]byte                    // Random ID of the pending response.
+	ReadyAt     uint64                      // Time from which the response can be fetched.
+	RequestHash [32]byte                    // SHA-256 of the request answered by the ticket.
+	Signature   [ed25519.SignatureSize]byte // Signature by the server's signature key.
+}
+
+// Ticket format:
+//
+// Header | ID | ReadyAt (uint64) | RequestHash | Signature
+
+const ticketSize = 32 + 8 + 32 + ed25519.SignatureSize
+
+var ticketContext = []byte("cypherlock ticket")
+
+func (t *Ticket) signedData() []byte {
+	d := make([]byte, 0, len(ticketContext)+32+8+32)
+	d = append(d, ticketContext...)
+	d = append(d, t.ID[:]...)
+	r := make([]byte, 8)
+	binary.BigEndian.PutUint64(r, t.ReadyAt)
+	d = append(d, r...)
+	return append(d, t.RequestHash[:]...)
+}
+
+// Sign binds the Ticket to request and signs it with the server's signature key.
+func (t *Ticket) Sign(signatureKey *[ed25519.PrivateKeySize]byte, request []byte) {
+	t.RequestHash = sha256.Sum256(request)
+	copy(t.Signature[:], ed25519.Sign(signatureKey[:], t.signedData()))
+}
+
+// Verify returns true if the Ticket answers request and was signed by signatureKey.
+func (t *Ticket) Verify(signatureKey *[ed25519.PublicKeySize]byte, request []byte) bool {
+	if t.RequestHash != sha256.Sum256(request) {
+		return false
+	}
+	return ed25519.Verify(signatureKey[:], t.signedData(), t.Signature[:])
+}
+
+// Bytes returns the marshalled Ticket.
+func (t *Ticket) Bytes() []byte {
+	out := newHeader(TypeTicket, ticketSize)
+	out = append(out, t.ID[:]...)
+	r := make([]byte, 8)
+	binary.BigEndian.PutUint64(r, t.ReadyAt)
+	out = append(out, r...)
+	out = append(out, t.RequestHash[:]...)
+	return append(out, t.Signature[:]...)
+}
+
+// Parse a marshalled Ticket.
+func (t *Ticket) Parse(d []byte) (*Ticket, error) {
+	version, body, err := splitHeader(d, TypeTicket)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) != ticketSize {
+		return nil, ErrTicketFormat
+	}
+	nt := &Ticket{
+		ReadyAt: binary.BigEndian.Uint64(body[32:40]),
+	}
+	copy(nt.ID[:], body[0:32])
+	copy(nt.RequestHash[:], body[40:72])
+	copy(nt.Signature[:], body[72:])
+	return nt, nil
+}
+
+// IsTicket returns true if the server returned a Ticket instead of a ResponseMessage.
+func IsTicket(d []byte) bool {
+	t, _ := Identify(d, TypeResponse)
+	return t == TypeTicket
+}
+
+// Cancel is the signed statement of the owner of a lock that all responses to delayed messages
+// of the lock that were requested until Time must not be released.
+type Cancel struct {
+	PublicKey [ed25519.PublicKeySize]byte // Cancel key.
+	Time      uint64                      // Time of the cancellation.
+	Signature [ed25519.SignatureSize]byte // Signature by the cancel key.
+}
+
+// Cancel format:
+//
+// Header | PublicKey | Time (uint64) | Signature
+
+const cancelSize = ed25519.PublicKeySize + 8 + ed25519.SignatureSize
+
+var cancelContext = []byte("cypherlock cancel")
+
+// NewCancel returns a Cancel for now, signed with the owner's privateKey.
+func NewCancel(privateKey *[ed25519.PrivateKeySize]byte, now uint64) *Cancel {
+	c := &Cancel{Time: now}
+	copy(c.PublicKey[:], privateKey[32:])
+	copy(c.Signature[:], ed25519.Sign(privateKey[:], timeStatement(cancelContext, &c.PublicKey, c.Time)))
+	return c
+}
+
+// Verify the signature of the Cancel and that its time lies within types.MaxClockSkew of now.
+func (c *Cancel) Verify(now uint64) error {
+	if c.Time > now+types.MaxClockSkew || c.Time+types.MaxClockSkew < now {
+		return ErrCancelInvalid
+	}
+	if !ed25519.Verify(c.PublicKey[:], timeStatement(cancelContext, &c.PublicKey, c.Time), c.Signature[:]) {
+		return ErrCancelInvalid
+	}
+	return nil
+}
+
+// Bytes returns the marshalled Cancel.
+func (c *Cancel) Bytes() []byte {
+	out := newHeader(TypeCancel, cancelSize)
+	out = append(out, c.PublicKey[:]...)
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, c.Time)
+	out = append(out, t...)
+	return append(out, c.Signature[:]...)
+}
+
+// Parse a marshalled Cancel.
+func (c *Cancel) Parse(d []byte) (*Cancel, error) {
+	version, body, err := splitHeader(d, TypeCancel)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) != cancelSize {
+		return nil, ErrCancelFormat
+	}
+	nc := &Cancel{
+		Time: binary.BigEndian.Uint64(body[32:40]),
+	}
+	copy(nc.PublicKey[:], body[0:32])
+	copy(nc.Signature[:], body[40:])
+	return nc, nil
+}
+
+// ErrorCode returns the code with which a server reports err to clients.
+func ErrorCode(err error) types.RPCErrorCode {
+	switch err {
+	case nil:
+		return types.RPCErrorNone
+	case ErrUnlockPending:
+		return types.RPCErrorUnlockPending
+	case ErrTicketUnknown:
+		return types.RPCErrorTicketUnknown
+	case ErrApprovalPending:
+		return types.RPCErrorApprovalPending
+	default:
+		return types.RPCErrorOther
+	}
+}
+
+// serverError returns the error of this package for an error returned by a server with its code.
+func serverError(err error) error {
+	e, ok := err.(*types.RPCError)
+	if !ok {
+		return err
+	}
+	switch e.Code {
+	case types.RPCErrorUnlockPending:
+		return ErrUnlockPending
+	case types.RPCErrorTicketUnknown:
+		return ErrTicketUnknown
+	case types.RPCErrorApprovalPending:
+		return ErrApprovalPending
+	default:
+		return err
+	}
+}
+
+// checkDelay returns an error if the delay of a new lock is invalid.
+func (cl *Cypherlock) checkDelay() error {
+	if cl.Delay > MaxDelay || (cl.Delay > 0 && cl.CancelKey == nil) {
+		return ErrDelay
+	}
+	return nil
+}
+
+// Ticket file in the storage of a lock:
+//
+// encodeSlice(Ticket) | sealed OracleMessage
+//
+// The OracleMessage is kept with the ticket, since the response answers its ServerMessage.
+
+const ticketFile = "ticket"
+
+// processResponse returns the secret key from the server's response to om. If the server returned
+// a ticket signed for om instead, it is stored with omD, the sealed om, and ErrUnlockPending is returned.
+func (cl *Cypherlock) processResponse(om *OracleMessage, omD, response []byte) (*[32]byte, error) {
+	if !IsTicket(response) {
+		return om.ProcessResponseMessage(response)
+	}
+	ticket, err := new(Ticket).Parse(response)
+	if err != nil {
+		return nil, err
+	}
+	if !ticket.Verify(&om.SignatureKey, om.ServerMessage) {
+		return nil, ErrResponseUntrusted
+	}
+	if err := cl.Storage.StoreData(ticketFile, append(encodeSlice(response), omD...)); err != nil {
+		return nil, err
+	}
+	return nil, ErrUnlockPending
+}
+
+// loadTicket returns the stored ticket of the lock and the sealed OracleMessage it answers.
+func (cl *Cypherlock) loadTicket() (*Ticket, []byte, error) {
+	d, err := cl.Storage.GetData(ticketFile)
+	if err != nil {
+		return nil, nil, ErrNoTicket
+	}
+	if len(d) < 8 {
+		return nil, nil, ErrTicketFormat
+	}
+	l := binary.BigEndian.Uint64(d[0:8])
+	if uint64(len(d)-8) < l {
+		return nil, nil, ErrTicketFormat
+	}
+	t, err := new(Ticket).Parse(d[8 : 8+l])
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, d[8+l:], nil
+}
+
+// pollLockKey fetches the response to a pending ticket from the server. The ticket is removed once
+// the response has been processed, or if the server does not know it anymore.
+func (cl *Cypherlock) pollLockKey(passphrase []byte, now uint64, ticket *Ticket, omD []byte) (*[32]byte, error) {
+	om, err := cl.openOracleData(passphrase, omD)
+	if err != nil {
+		return nil, err
+	}
+	if now < ticket.ReadyAt {
+		return nil, ErrUnlockPending
+	}
+	response, err := cl.ClientRPC.PollUnlock(cl.ServerURL, &ticket.ID)
+	err = serverError(err)
+	if err == ErrTicketUnknown {
+		cl.Storage.RemoveData(ticketFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := om.ProcessResponseMessage(response)
+	if err != nil {
+		return nil, err
+	}
+	return secretKey, cl.Storage.RemoveData(ticketFile)
+}
+
+// PendingUnlock returns the time from which a pending unlock can be completed. For threshold
+// locks it is the latest time of all servers with a pending unlock.
+func (cl *Cypherlock) PendingUnlock() (readyAt uint64, err error) {
+	if !cl.isThreshold() {
+		ticket, _, err := cl.loadTicket()
+		if err != nil {
+			return 0, err
+		}
+		return ticket.ReadyAt, nil
+	}
+	err = ErrNoTicket
+	for i := range cl.Servers {
+		if t, e := cl.forServer(i).PendingUnlock(); e == nil {
+			if t > readyAt {
+				readyAt = t
+			}
+			err = nil
+		}
+	}
+	return readyAt, err
+}
+
+// RequestUnlock requests the responses to a delayed lock from the server. It returns the time from
+// which the unlock can be completed with LoadLock. An unlock that is already pending is not
+// requested again. ErrNoDelay is returned if the lock could be unlocked right away.
+func (cl *Cypherlock) RequestUnlock(passphrase []byte, now uint64) (readyAt uint64, err error) {
+	_, err = cl.loadLockKey(passphrase, now)
+	if err == nil {
+		return 0, ErrNoDelay
+	}
+	if err != ErrUnlockPending {
+		return 0, err
+	}
+	return cl.PendingUnlock()
+}
+
+// CancelUnlocks cancels all pending unlocks of locks created with the public key of cancelKey that
+// were requested until now. It does not require the lock's passphrase. Threshold locks require the
+// cancellation to reach enough servers that the threshold cannot be reached anymore.
+func (cl *Cypherlock) CancelUnlocks(cancelKey *[ed25519.PrivateKeySize]byte, now uint64) error {
+	c := NewCancel(cancelKey, now).Bytes()
+	if !cl.isThreshold() {
+		return cl.ClientRPC.CancelUnlocks(cl.ServerURL, c)
+	}
+	var cancelled int
+	for _, s := range cl.Servers {
+		if err := cl.ClientRPC.CancelUnlocks(s.URL, c); err == nil {
+			cancelled++
+		}
+	}
+	if cancelled < len(cl.Servers)-cl.Threshold+1 {
+		return ErrThresholdNotReached
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestTicket(t *testing.T) {
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	var sigPublicKey [ed25519.PublicKeySize]byte
+	var sigPrivateKey [ed25519.PrivateKeySize]byte
+	copy(sigPublicKey[:], pubkey)
+	copy(sigPrivateKey[:], privkey)
+	ticket := &Ticket{ReadyAt: 1234}
+	copy(ticket.ID[:], []byte("ticket id"))
+	ticket.Sign(&sigPrivateKey, []byte("request"))
+	d := ticket.Bytes()
+	if !IsTicket(d) {
+		t.Fatal("IsTicket: false")
+	}
+	t2, err := new(Ticket).Parse(d)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if *t2 != *ticket {
+		t.Error("Ticket not reproduced")
+	}
+	if _, err := new(Ticket).Parse(d[:len(d)-1]); err == nil {
+		t.Error("Parse must fail on short ticket")
+	}
+	if !t2.Verify(&sigPublicKey, []byte("request")) {
+		t.Error("Verify: false")
+	}
+	if t2.Verify(&sigPublicKey, []byte("other request")) {
+		t.Error("Ticket must not verify for other request")
+	}
+	t2.ReadyAt--
+	if t2.Verify(&sigPublicKey, []byte("request")) {
+		t.Error("Ticket with modified ReadyAt must not verify")
+	}
+}
+
+func TestServerError(t *testing.T) {
+	for _, err := range []error{ErrUnlockPending, ErrTicketUnknown, ErrApprovalPending, ErrCancelInvalid} {
+		e := serverError(&types.RPCError{Code: ErrorCode(err), Message: err.Error()})
+		if (err == ErrCancelInvalid) == (e == err) {
+			t.Errorf("serverError of %v: %v", err, e)
+		}
+	}
+	if ErrorCode(nil) != types.RPCErrorNone {
+		t.Error("ErrorCode of nil must be RPCErrorNone")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	_, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	var cancelKey [ed25519.PrivateKeySize]byte
+	copy(cancelKey[:], privkey)
+	c, err := new(Cancel).Parse(NewCancel(&cancelKey, 1000).Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if err := c.Verify(1000); err != nil {
+		t.Errorf("Verify: %s", err)
+	}
+	if err := c.Verify(100000); err != ErrCancelInvalid {
+		t.Errorf("Verify outside clock skew: %v", err)
+	}
+	c.Time++
+	if err := c.Verify(1000); err != ErrCancelInvalid {
+		t.Errorf("Verify with modified time: %v", err)
+	}
+}
+
+func TestCypherlockDelay(t *testing.T) {
+	clock := timesource.Clock
+	defer func() { timesource.Clock = clock }()
+	nc := timesource.NewMockClock(time.Now())
+	timesource.Clock = nc
+
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	var cancelPublicKey [ed25519.PublicKeySize]byte
+	var cancelKey [ed25519.PrivateKeySize]byte
+	copy(cancelPublicKey[:], pubkey)
+	copy(cancelKey[:], privkey)
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Delay:        600,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+7200); err != ErrDelay {
+		t.Errorf("CreateLock without cancel key: %v", err)
+	}
+	cl.CancelKey = &cancelPublicKey
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+7200); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if _, err := cl.PendingUnlock(); err != ErrNoTicket {
+		t.Errorf("PendingUnlock before request: %v", err)
+	}
+	readyAt, err := cl.RequestUnlock(passphrase, now)
+	if err != nil {
+		t.Fatalf("RequestUnlock: %s", err)
+	}
+	if readyAt != now+600 {
+		t.Errorf("RequestUnlock ready at %d, expected %d", readyAt, now+600)
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != ErrUnlockPending {
+		t.Errorf("LoadLock before delay: %v", err)
+	}
+	if len(ts.pending) != 1 {
+		t.Errorf("Unlock requested again: %d pending", len(ts.pending))
+	}
+	nc.Advance(time.Second * 601)
+	now = testNow()
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock after delay: %v", err)
+	}
+	if _, err := cl.PendingUnlock(); err != ErrNoTicket {
+		t.Errorf("Ticket not removed: %v", err)
+	}
+
+	if _, err := cl.RequestUnlock(passphrase, now); err != nil {
+		t.Fatalf("RequestUnlock: %s", err)
+	}
+	if err := cl.CancelUnlocks(&cancelKey, now); err != nil {
+		t.Fatalf("CancelUnlocks: %s", err)
+	}
+	nc.Advance(time.Second * 601)
+	now = testNow()
+	if _, err := cl.LoadLock(passphrase, now); err != ErrTicketUnknown {
+		t.Errorf("LoadLock after cancel: %v", err)
+	}
+	if _, err := cl.PendingUnlock(); err != ErrNoTicket {
+		t.Errorf("Cancelled ticket not removed: %v", err)
+	}
+
+	storage2, cleanup2 := testStorage(t)
+	defer cleanup2()
+	cl.Storage, cl.Delay = storage2, 0
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+7200); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if _, err := cl.RequestUnlock(passphrase, now); err != ErrNoDelay {
+		t.Errorf("RequestUnlock without delay: %v", err)
+	}
+}
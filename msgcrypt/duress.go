@@ -0,0 +1,148 @@
+package msgcrypt
+
+import (
+	"errors"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+)
+
+var (
+	// ErrDuressPassphrase is returned if the duress passphrase equals the passphrase of the lock.
+	ErrDuressPassphrase = errors.New("msgcrypt: duress passphrase must differ from passphrase")
+	// ErrDuressClientKey is returned if a duress passphrase is set for a lock sealed to a client key.
+	ErrDuressClientKey = errors.New("msgcrypt: duress passphrase requires passphrase protection")
+	// ErrDuressBurn is returned if burning is requested for a lock without use limit.
+	ErrDuressBurn = errors.New("msgcrypt: duress burn requires a use limit")
+)
+
+// Duress files in the storage of a lock:
+//
+// duress:     Protector(duress passphrase, Flags (1 byte) | DuressPrivateKey)
+// duress.pub: SymEncrypt(deriveKey(secretKey), DuressPublicKey)
+// burn:       encodeSlice(KeyProtector(DuressPublicKey, burn records))...
+//
+// A burn record is encodeSlice(ServerURL) | encodeSlice(ServerMessage). Locks without duress
+// passphrase get the same files, sealed with a random passphrase.
+const (
+	duressFile    = "duress"
+	duressKeyFile = "duress.pub"
+	burnFile      = "burn"
+
+	duressFlagBurn = 0x01
+	duressSize     = 1 + 32
+)
+
+func (cl *Cypherlock) duressProtector(passphrase []byte) Protector {
+	return &PassphraseProtector{Passphrase: passphrase, Keyfile: cl.Keyfile, Params: cl.KDFParams}
+}
+
+// writeDuress writes the duress files of a new lock.
+func (cl *Cypherlock) writeDuress(passphrase []byte, secretKey *[32]byte) error {
+	duressPassphrase := cl.DuressPassphrase
+	if len(duressPassphrase) == 0 {
+		r, err := genRandom(cl.randomSource)
+		if err != nil {
+			return err
+		}
+		duressPassphrase = r[:]
+	} else if string(duressPassphrase) == string(passphrase) {
+		return ErrDuressPassphrase
+	}
+	if cl.DuressBurn && cl.MaxUses == 0 {
+		return ErrDuressBurn
+	}
+	pub, priv, err := GenKeyPair(cl.randomSource)
+	if err != nil {
+		return err
+	}
+	d := make([]byte, 1, duressSize)
+	if cl.DuressBurn && len(cl.DuressPassphrase) > 0 {
+		d[0] = duressFlagBurn
+	}
+	d = append(d, priv[:]...)
+	sealed, err := cl.duressProtector(duressPassphrase).Seal(d, cl.randomSource)
+	if err != nil {
+		return err
+	}
+	if err := cl.Storage.StoreData(duressFile, sealed); err != nil {
+		return err
+	}
+	encPub, err := SymEncrypt(deriveKey(secretKey, "cypherlock duress"), pub[:], cl.randomSource)
+	if err != nil {
+		return err
+	}
+	return cl.Storage.StoreData(duressKeyFile, encPub)
+}
+
+// duressPublicKey returns the duress public key of the lock, or nil if the lock has none.
+func (cl *Cypherlock) duressPublicKey(secretKey *[32]byte) *[32]byte {
+	d, err := cl.Storage.GetData(duressKeyFile)
+	if err != nil {
+		return nil
+	}
+	pubD, err := SymDecrypt(deriveKey(secretKey, "cypherlock duress"), d)
+	if err != nil || len(pubD) != 32 {
+		return nil
+	}
+	pub := new([32]byte)
+	copy(pub[:], pubD)
+	return pub
+}
+
+// appendBurnRecords seals the burn records of newly written oracle messages to the duress key.
+func (cl *Cypherlock) appendBurnRecords(duressKey *[32]byte, records []byte) error {
+	sealed, err := (&KeyProtector{PublicKey: duressKey}).Seal(records, cl.randomSource)
+	if err != nil {
+		return err
+	}
+	d, _ := cl.Storage.GetData(burnFile) // Missing file means no records yet.
+	return cl.Storage.StoreData(burnFile, append(d, encodeSlice(sealed)...))
+}
+
+// burn sends the oracle messages recorded in storage to their servers to be burned. Errors are ignored.
+func (cl *Cypherlock) burn(storage clientinterface.Storage, duressKey *[32]byte) {
+	d, err := storage.GetData(burnFile)
+	if err != nil {
+		return
+	}
+	sealed, err := splitSlices(d)
+	if err != nil {
+		return
+	}
+	for _, s := range sealed {
+		recordsD, err := (&KeyProtector{PrivateKey: duressKey}).Open(s)
+		if err != nil {
+			continue
+		}
+		records, err := splitSlices(recordsD)
+		if err != nil {
+			continue
+		}
+		for i := 0; i+1 < len(records); i += 2 {
+			cl.ClientRPC.Burn(string(records[i]), records[i+1])
+		}
+	}
+}
+
+// checkDuress destroys the lock if passphrase is its duress passphrase. It returns true if the
+// lock was destroyed.
+func (cl *Cypherlock) checkDuress(passphrase []byte) bool {
+	d, err := cl.Storage.GetData(duressFile)
+	if err != nil {
+		return false
+	}
+	p, err := cl.duressProtector(passphrase).Open(d)
+	if err != nil || len(p) != duressSize {
+		return false
+	}
+	if p[0]&duressFlagBurn != 0 {
+		duressKey := new([32]byte)
+		copy(duressKey[:], p[1:])
+		cl.burn(cl.Storage, duressKey)
+		for i := range cl.Servers {
+			cl.burn(cl.forServer(i).Storage, duressKey)
+		}
+	}
+	cl.Storage.Destroy()
+	return true
+}
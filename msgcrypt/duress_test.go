@@ -0,0 +1,125 @@
+package msgcrypt
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+)
+
+// serverMessages returns the server messages of all oracle files in storage.
+func serverMessages(t *testing.T, storage clientinterface.Storage, passphrase []byte) [][]byte {
+	dir := storage.(*clientinterface.DefaultStorage).Path
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	var ret [][]byte
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".oracle") {
+			continue
+		}
+		d, err := ioutil.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		om, err := new(OracleMessage).Open(&PassphraseProtector{Passphrase: passphrase}, d)
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		ret = append(ret, om.ServerMessage)
+	}
+	return ret
+}
+
+func TestCypherlockDuress(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+	}
+	passphrase, duress, secret := []byte("passphrase"), []byte("duress"), []byte("secret")
+	now := testNow()
+	cl.DuressPassphrase = passphrase
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != ErrDuressPassphrase {
+		t.Errorf("CreateLock with duress passphrase equal to passphrase: %v", err)
+	}
+	cl.DuressPassphrase, cl.DuressBurn = duress, true
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != ErrDuressBurn {
+		t.Errorf("CreateLock with burn and without use limit: %v", err)
+	}
+	cl.DuressBurn = false
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	_, errWrong := cl.LoadLock([]byte("wrong"), now)
+	if errWrong == nil {
+		t.Fatal("LoadLock must fail with wrong passphrase")
+	}
+	if _, err := cl.LoadLock(passphrase, now); err != nil {
+		t.Fatalf("LoadLock after wrong passphrase: %s", err)
+	}
+	_, errDuress := cl.LoadLock(duress, now)
+	if errDuress == nil || errDuress.Error() != errWrong.Error() {
+		t.Errorf("Duress passphrase must fail like a wrong passphrase: %v", errDuress)
+	}
+	if _, err := os.Stat(storage.(*clientinterface.DefaultStorage).Path); !os.IsNotExist(err) {
+		t.Error("Lock not destroyed")
+	}
+	if _, err := cl.LoadLock(passphrase, now); err == nil {
+		t.Error("LoadLock must fail after duress")
+	}
+}
+
+func TestCypherlockDuressBurn(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey:     &ts.sigPublicKey,
+		ServerURL:        "server",
+		Storage:          storage,
+		ClientRPC:        rpc,
+		MaxUses:          5,
+		DuressPassphrase: []byte("duress"),
+		DuressBurn:       true,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if _, _, err := cl.ExtendLock(passphrase, now, now, now+7200); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+	messages := serverMessages(t, storage, passphrase)
+	if len(messages) < 2 {
+		t.Fatalf("Too few oracle messages: %d", len(messages))
+	}
+	if _, err := cl.LoadLock([]byte("duress"), now); err == nil {
+		t.Error("LoadLock must fail with duress passphrase")
+	}
+	if len(ts.spent) != len(messages) {
+		t.Errorf("Burned %d of %d messages", len(ts.spent), len(messages))
+	}
+	for _, uses := range ts.spent {
+		if uses != math.MaxUint32 {
+			t.Error("Message not burned")
+		}
+	}
+	if _, err := ts.config.ProcessOracleMessage(messages[0]); err != ErrMessageSpent && err != ErrPolicyExpired {
+		t.Errorf("ProcessOracleMessage after burn: %v", err)
+	}
+}
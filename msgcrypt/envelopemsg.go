@@ -15,8 +15,11 @@ type EnvelopeMessage struct {
 	SymNonce          [24]byte
 	ValidFrom         uint64
 	ValidTo           uint64
+	Policy            []byte // Encoded Policy. Optional.
+	Bound             bool   // RatchetMessage is bound to ReceiverPublicKey, ValidFrom, ValidTo and Policy.
 	RatchetMessage    []byte // Must be encrypted already.
 	encPayload        []byte
+	version           byte
 }
 
 // NewEnvelopeMessage cretes a new EnvelopeMessage.
@@ -30,12 +33,45 @@ func NewEnvelopeMessage(receiverPublicKey *[32]byte, validFrom, validTo uint64,
 	return em
 }
 
+// Envelope cleartext:
+//
+// ValidFrom (uint64) | ValidTo (uint64) | [PolicyLength (uint16) | Policy] | RatchetMessage
+//
+// The policy is present if the highest bit of ValidFrom is set. The second highest bit is set
+// if the RatchetMessage is bound to the envelope, see AssociatedData. From version 2 the
+// cleartext is padded.
+
 const (
 	envelopeMessageBaseSize         = 32 + 32 + 32 + 24
 	envelopeMessageExtraPayloadSize = 8 + 8
 	envelopeMessageNoPayloadSize    = envelopeMessageExtraPayloadSize + envelopeMessageBaseSize + secretbox.Overhead
+
+	envelopePolicyFlag = 1 << 63
+	envelopeBoundFlag  = 1 << 62
+	envelopeFlags      = envelopePolicyFlag | envelopeBoundFlag
 )
 
+// EnvelopeAssociatedData returns the data that binds a RatchetMessage to an envelope.
+func EnvelopeAssociatedData(receiverPublicKey *[32]byte, validFrom, validTo uint64, policy []byte) []byte {
+	d := make([]byte, 0, 32+32+8+8+2+len(policy))
+	d = append(d, []byte("cypherlock envelope v1")...)
+	d = append(d, receiverPublicKey[:]...)
+	t := make([]byte, 8+8+2)
+	binary.BigEndian.PutUint64(t[0:8], validFrom)
+	binary.BigEndian.PutUint64(t[8:16], validTo)
+	binary.BigEndian.PutUint16(t[16:18], uint16(len(policy)))
+	d = append(d, t...)
+	return append(d, policy...)
+}
+
+// AssociatedData returns the data the RatchetMessage must be bound to, or nil if it is not bound.
+func (em *EnvelopeMessage) AssociatedData() []byte {
+	if !em.Bound {
+		return nil
+	}
+	return EnvelopeAssociatedData(&em.ReceiverPublicKey, em.ValidFrom, em.ValidTo, em.Policy)
+}
+
 func (em *EnvelopeMessage) templ() []byte {
 	capacity := envelopeMessageNoPayloadSize + len(em.RatchetMessage)
 	tmpl := make([]byte, 0, capacity)
@@ -47,15 +83,28 @@ func (em *EnvelopeMessage) templ() []byte {
 }
 
 func (em *EnvelopeMessage) genPayload() []byte {
-	pl := make([]byte, envelopeMessageExtraPayloadSize, envelopeMessageExtraPayloadSize+len(em.RatchetMessage))
+	pl := make([]byte, envelopeMessageExtraPayloadSize, envelopeMessageExtraPayloadSize+2+len(em.Policy)+len(em.RatchetMessage))
 	binary.BigEndian.PutUint64(pl[0:8], em.ValidFrom)
 	binary.BigEndian.PutUint64(pl[8:16], em.ValidTo)
+	if em.Bound {
+		pl[0] |= envelopeBoundFlag >> 56
+	}
+	if len(em.Policy) > 0 {
+		pl[0] |= envelopePolicyFlag >> 56
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(em.Policy)))
+		pl = append(pl, l...)
+		pl = append(pl, em.Policy...)
+	}
 	pl = append(pl, em.RatchetMessage...)
 	return pl
 }
 
 // Encrypt an EnvelopeMessage.
 func (em *EnvelopeMessage) Encrypt(rand io.Reader) ([]byte, error) {
+	if len(em.Policy) > maxPolicySize || em.ValidFrom&envelopeFlags != 0 {
+		return nil, ErrPolicyFormat
+	}
 	secret, sendKey, nonce, err := ToPublicKey(rand, &em.ReceiverPublicKey)
 	if err != nil {
 		return nil, err
@@ -67,15 +116,25 @@ func (em *EnvelopeMessage) Encrypt(rand io.Reader) ([]byte, error) {
 	em.SymNonce = *sn
 	em.DHNonce = *nonce
 	em.SenderPublicKey = *sendKey
-	return secretbox.Seal(em.templ(), em.genPayload(), &em.SymNonce, secret), nil
+	pl := em.genPayload()
+	out := newHeader(TypeEnvelope, envelopeMessageNoPayloadSize+padSize(len(pl), envelopePadSize))
+	if out[3] >= paddedVersion {
+		pl = pad(pl, envelopePadSize)
+	}
+	out = append(out, em.templ()...)
+	return secretbox.Seal(out, pl, &em.SymNonce, secret), nil
 }
 
 // Parse a binary EnvelopeMesssage.
 func (em *EnvelopeMessage) Parse(d []byte) (*EnvelopeMessage, error) {
+	version, d, err := splitHeader(d, TypeEnvelope)
+	if err != nil {
+		return nil, err
+	}
 	if len(d) < envelopeMessageNoPayloadSize {
 		return nil, ErrMessageIncomplete
 	}
-	nem := new(EnvelopeMessage)
+	nem := &EnvelopeMessage{version: version}
 	copy(nem.ReceiverPublicKey[:], d[0:32])
 	copy(nem.SenderPublicKey[:], d[32:64])
 	copy(nem.DHNonce[:], d[64:96])
@@ -91,8 +150,25 @@ func (em *EnvelopeMessage) parseCleartext(d []byte) error {
 	}
 	em.ValidFrom = binary.BigEndian.Uint64(d[0:8])
 	em.ValidTo = binary.BigEndian.Uint64(d[8:16])
-	em.RatchetMessage = make([]byte, 0, len(d)-envelopeMessageExtraPayloadSize)
-	em.RatchetMessage = append(em.RatchetMessage, d[16:]...)
+	d = d[envelopeMessageExtraPayloadSize:]
+	em.Policy = nil
+	em.Bound = em.ValidFrom&envelopeBoundFlag != 0
+	hasPolicy := em.ValidFrom&envelopePolicyFlag != 0
+	em.ValidFrom &^= envelopeFlags
+	if hasPolicy {
+		if len(d) < 2 {
+			return ErrMessageIncomplete
+		}
+		l := int(binary.BigEndian.Uint16(d[0:2]))
+		if l == 0 || len(d) <= 2+l {
+			return ErrMessageIncomplete
+		}
+		em.Policy = make([]byte, l)
+		copy(em.Policy, d[2:2+l])
+		d = d[2+l:]
+	}
+	em.RatchetMessage = make([]byte, 0, len(d))
+	em.RatchetMessage = append(em.RatchetMessage, d...)
 	return nil
 }
 
@@ -103,5 +179,11 @@ func (em *EnvelopeMessage) Decrypt(receiverPrivateKey *[32]byte) error {
 	if !ok {
 		return ErrCannotDecrypt
 	}
+	if em.version >= paddedVersion {
+		var err error
+		if pl, err = unpad(pl); err != nil {
+			return err
+		}
+	}
 	return em.parseCleartext(pl)
 }
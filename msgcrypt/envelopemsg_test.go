@@ -34,3 +34,31 @@ func TestEnvelopeMessage(t *testing.T) {
 	}
 
 }
+
+func TestEnvelopeMessagePolicy(t *testing.T) {
+	pubkey, privkey := genTestKeys()
+	input := []byte("Test message")
+	policy := (&Policy{MaxUses: 1}).Marshall()
+	msg := NewEnvelopeMessage(pubkey, 102398, 5987123, input)
+	msg.Policy = policy
+	enc, err := msg.Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	msg2, err := new(EnvelopeMessage).Parse(enc)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if err := msg2.Decrypt(privkey); err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if !bytes.Equal(policy, msg2.Policy) {
+		t.Error("Policy mismatch")
+	}
+	if !bytes.Equal(input, msg2.RatchetMessage) {
+		t.Error("Cleartext does not match")
+	}
+	if msg2.ValidFrom != 102398 {
+		t.Error("ValidFrom mismatch")
+	}
+}
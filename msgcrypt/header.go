@@ -0,0 +1,123 @@
+package msgcrypt
+
+import (
+	"errors"
+)
+
+// Common message header:
+//
+// "CL" | Type (1 byte) | Version (1 byte)
+//
+// Messages written before the header was introduced have none. They are read as version 0,
+// their type is known from context.
+
+var (
+	// ErrUnknownVersion is returned if a message has a version that is not supported.
+	ErrUnknownVersion = errors.New("msgcrypt: unsupported message version")
+	// ErrMessageType is returned if a message is not of the expected type.
+	ErrMessageType = errors.New("msgcrypt: unexpected message type")
+)
+
+// MessageType identifies a message in the common header.
+type MessageType byte
+
+// Message types.
+const (
+	TypeEnvelope  MessageType = 'E' // EnvelopeMessage.
+	TypeRatchet   MessageType = 'R' // RatchetMessage.
+	TypeResponse  MessageType = 'A' // ResponseMessage.
+	TypeOracle    MessageType = 'O' // Marshalled OracleMessage.
+	TypeSymmetric MessageType = 'Y' // SymEncrypt.
+	TypeSecret    MessageType = 'Z' // EncryptRealSecret.
+	TypePassword  MessageType = 'P' // PasswordEncrypt.
+	TypeKey       MessageType = 'K' // KeyProtector.
+	TypeStream    MessageType = 'S' // StreamWriter.
+	TypeRelease   MessageType = 'T' // ReleaseMessage.
+	TypeCheckin   MessageType = 'C' // Checkin.
+	TypeRecipient MessageType = 'L' // Recipient list.
+	TypeTicket    MessageType = 'D' // Ticket.
+	TypeCancel    MessageType = 'X' // Cancel.
+	TypeApproval  MessageType = 'V' // Approval.
+	TypePayload   MessageType = 'B' // Payload.
+)
+
+const (
+	headerMagic = "CL"
+	headerSize  = 4
+)
+
+// currentVersions contains the version written for each message type.
+var currentVersions = map[MessageType]byte{
+	TypeEnvelope:  2,
+	TypeRatchet:   1,
+	TypeResponse:  3,
+	TypeOracle:    3,
+	TypeSymmetric: 1,
+	TypeSecret:    1,
+	TypePassword:  1,
+	TypeKey:       1,
+	TypeStream:    1,
+	TypeRelease:   1,
+	TypeCheckin:   1,
+	TypeRecipient: 1,
+	TypeTicket:    1,
+	TypeCancel:    1,
+	TypeApproval:  1,
+	TypePayload:   1,
+}
+
+// CurrentVersion returns the version written for messages of type t.
+func CurrentVersion(t MessageType) byte {
+	return currentVersions[t]
+}
+
+// newHeader returns a slice containing the header for the current version of t, with
+// capacity for size more bytes.
+func newHeader(t MessageType, size int) []byte {
+	h := make([]byte, headerSize, headerSize+size)
+	copy(h[0:2], headerMagic)
+	h[2] = byte(t)
+	h[3] = currentVersions[t]
+	return h
+}
+
+// splitHeader returns the version and body of a message of type t. Messages without header
+// are returned unchanged as version 0.
+func splitHeader(d []byte, t MessageType) (version byte, body []byte, err error) {
+	if len(d) < headerSize || string(d[0:2]) != headerMagic || MessageType(d[2]) != t || d[3] == 0 {
+		return 0, d, nil
+	}
+	if d[3] > currentVersions[t] {
+		return 0, nil, ErrUnknownVersion
+	}
+	return d[3], d[headerSize:], nil
+}
+
+// Identify returns type and version of a message. Messages without header are version 0 of v0Type.
+func Identify(d []byte, v0Type MessageType) (t MessageType, version byte) {
+	if len(d) >= headerSize && string(d[0:2]) == headerMagic && d[3] != 0 {
+		if _, ok := currentVersions[MessageType(d[2])]; ok {
+			return MessageType(d[2]), d[3]
+		}
+	}
+	return v0Type, 0
+}
+
+// ParseMessage parses any supported version of an EnvelopeMessage, RatchetMessage, ResponseMessage
+// or marshalled OracleMessage. Messages without header are parsed as version 0 of v0Type.
+// The result is a *EnvelopeMessage, *RatchetMessage, *ResponseMessage or *OracleMessage.
+func ParseMessage(d []byte, v0Type MessageType) (interface{}, error) {
+	t, _ := Identify(d, v0Type)
+	switch t {
+	case TypeEnvelope:
+		return new(EnvelopeMessage).Parse(d)
+	case TypeRatchet:
+		return new(RatchetMessage).Parse(d)
+	case TypeResponse:
+		return new(ResponseMessage).Parse(d)
+	case TypeOracle:
+		return new(OracleMessage).Unmarshall(d)
+	default:
+		return nil, ErrMessageType
+	}
+}
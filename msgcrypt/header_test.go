@@ -0,0 +1,145 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// v0 returns the version 0 encoding of a message: Version 1 only added the header.
+func v0(t *testing.T, d []byte, msgType MessageType) []byte {
+	if mt, version := Identify(d, 0); mt != msgType || version != 1 {
+		t.Fatalf("Identify: %c %d", mt, version)
+	}
+	return d[headerSize:]
+}
+
+// writeVersion makes the writers of the message types use version until the returned function is called.
+func writeVersion(version byte, types ...MessageType) func() {
+	old := make(map[MessageType]byte)
+	for _, mt := range types {
+		old[mt] = currentVersions[mt]
+		currentVersions[mt] = version
+	}
+	return func() {
+		for mt, v := range old {
+			currentVersions[mt] = v
+		}
+	}
+}
+
+func TestHeaderVersion0(t *testing.T) {
+	// Version 1 of padded types is unpadded and only added the header.
+	defer writeVersion(1, TypeEnvelope, TypeResponse, TypeOracle)()
+	pubkey, privkey := genTestKeys()
+	input := []byte("Test message")
+
+	// EnvelopeMessage.
+	enc, err := NewEnvelopeMessage(pubkey, 1, 2, input).Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Envelope Encrypt: %s", err)
+	}
+	m, err := ParseMessage(v0(t, enc, TypeEnvelope), TypeEnvelope)
+	if err != nil {
+		t.Fatalf("Envelope ParseMessage: %s", err)
+	}
+	em := m.(*EnvelopeMessage)
+	if err := em.Decrypt(privkey); err != nil || !bytes.Equal(em.RatchetMessage, input) {
+		t.Errorf("Envelope v0: %v", err)
+	}
+
+	// RatchetMessage.
+	rm, _, err := NewRatchetMessage(pubkey, input, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewRatchetMessage: %s", err)
+	}
+	enc, err = rm.Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Ratchet Encrypt: %s", err)
+	}
+	m, err = ParseMessage(v0(t, enc, TypeRatchet), TypeRatchet)
+	if err != nil {
+		t.Fatalf("Ratchet ParseMessage: %s", err)
+	}
+	rm = m.(*RatchetMessage)
+	if err := rm.Decrypt(lookupF(pubkey, privkey)); err != nil || !bytes.Equal(rm.Payload, input) {
+		t.Errorf("Ratchet v0: %v", err)
+	}
+
+	// ResponseMessage.
+	pubkeyServ, privkeyServ := genTestKeys()
+	enc, err = NewResponseMessage(pubkeyServ, pubkey, input).Encrypt(privkeyServ, rand.Reader)
+	if err != nil {
+		t.Fatalf("Response Encrypt: %s", err)
+	}
+	m, err = ParseMessage(v0(t, enc, TypeResponse), TypeResponse)
+	if err != nil {
+		t.Fatalf("Response ParseMessage: %s", err)
+	}
+	rspm := m.(*ResponseMessage)
+	if err := rspm.Decrypt(privkey); err != nil || !bytes.Equal(rspm.Payload, input) {
+		t.Errorf("Response v0: %v", err)
+	}
+
+	// OracleMessage.
+	om := &OracleMessage{ValidFrom: 1, ValidTo: 2, EncryptedSecretKey: []byte("key"), ServerURL: "url", ServerMessage: input}
+	m, err = ParseMessage(v0(t, om.Marshall(), TypeOracle), TypeOracle)
+	if err != nil {
+		t.Fatalf("Oracle ParseMessage: %s", err)
+	}
+	if om2 := m.(*OracleMessage); om2.ServerURL != om.ServerURL || !bytes.Equal(om2.ServerMessage, input) {
+		t.Error("Oracle v0 mismatch")
+	}
+
+	// Symmetric.
+	key, _ := genRandom(rand.Reader)
+	enc, err = SymEncrypt(key, input, rand.Reader)
+	if err != nil {
+		t.Fatalf("SymEncrypt: %s", err)
+	}
+	if pt, err := SymDecrypt(key, v0(t, enc, TypeSymmetric)); err != nil || !bytes.Equal(pt, input) {
+		t.Errorf("Symmetric v0: %v", err)
+	}
+
+	// Real secret.
+	secretKey, enc, err := EncryptRealSecret(input, rand.Reader)
+	if err != nil {
+		t.Fatalf("EncryptRealSecret: %s", err)
+	}
+	if pt, err := DecryptRealSecret(secretKey, v0(t, enc, TypeSecret)); err != nil || !bytes.Equal(pt, input) {
+		t.Errorf("Secret v0: %v", err)
+	}
+}
+
+func TestHeaderVersion0LooksLikeHeader(t *testing.T) {
+	// A version 0 message whose random nonce starts like a header.
+	key, _ := genRandom(rand.Reader)
+	nonce := &[24]byte{'C', 'L', byte(TypeSymmetric), 1}
+	msg := secretbox.Seal(nonce[:], []byte("Test message"), nonce, key)
+	if pt, err := SymDecrypt(key, msg); err != nil || string(pt) != "Test message" {
+		t.Errorf("SymDecrypt: %v", err)
+	}
+}
+
+func TestHeaderErrors(t *testing.T) {
+	key, _ := genRandom(rand.Reader)
+	enc, err := SymEncrypt(key, []byte("Test message"), rand.Reader)
+	if err != nil {
+		t.Fatalf("SymEncrypt: %s", err)
+	}
+	enc[3] = CurrentVersion(TypeSymmetric) + 1
+	if _, err := SymDecrypt(key, enc); err != ErrUnknownVersion {
+		t.Errorf("Unknown version: %v", err)
+	}
+	if _, err := ParseMessage(enc, TypeEnvelope); err != ErrMessageType {
+		t.Errorf("ParseMessage of symmetric message: %v", err)
+	}
+	om := &OracleMessage{ServerURL: "url", EncryptedSecretKey: []byte("k"), ServerMessage: []byte("m")}
+	d := om.Marshall()
+	d[3] = 0xff
+	if _, err := new(OracleMessage).Unmarshall(d); err != ErrUnknownVersion {
+		t.Errorf("Oracle unknown version: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package msgcrypt
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	// ErrObliviousPolicy is returned if an oblivious lock is created with restrictions the server would have to enforce.
+	ErrObliviousPolicy = errors.New("msgcrypt: policy restrictions not supported by oblivious locks")
+	// ErrObliviousUnsupported is returned if a server does not support oblivious requests.
+	ErrObliviousUnsupported = errors.New("msgcrypt: oblivious requests not supported by server")
+	// ErrNotOblivious is returned if an OracleMessage that is not oblivious is unlocked obliviously.
+	ErrNotOblivious = errors.New("msgcrypt: oracle message is not oblivious")
+)
+
+// Oblivious decryption:
+//
+// The ServerMessage of an oblivious OracleMessage is the RatchetMessage itself. It is never sent
+// to the server. Instead the client sends SenderPublicKey multiplied with a random blinding
+// scalar b. The server multiplies the blinded key with each ratchet key k of its ring and returns
+// all results, the client multiplies them with u, the inverse of b modulo the group order, which
+// yields k * SenderPublicKey, the DH secret of DecryptRatchetKey, for each k. The client then
+// decrypts the RatchetMessage itself with whichever result fits.
+//
+// The server learns neither RatchetPublicKey nor SenderPublicKey, so it cannot enforce validity
+// periods or policies. Oblivious messages are only limited by the lifetime of the ratchet keys.
+//
+// curve25519.ScalarMult clamps scalars to 2^254 + 8*m with m < 2^251, so b is chosen such that
+// u can be represented in that form.
+
+var (
+	groupOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+	clampBase     = new(big.Int).Lsh(big.NewInt(1), 254)
+	clampLimit    = new(big.Int).Lsh(big.NewInt(1), 251)
+	eightInverse  = new(big.Int).ModInverse(big.NewInt(8), groupOrder)
+)
+
+// clampedScalar returns the scalar that curve25519.ScalarMult uses for d.
+func clampedScalar(d *[32]byte) *big.Int {
+	be := make([]byte, 32)
+	for i := range d {
+		be[31-i] = d[i]
+	}
+	be[31] &= 248
+	be[0] &= 127
+	be[0] |= 64
+	return new(big.Int).SetBytes(be)
+}
+
+// scalarBytes returns the little endian encoding of n.
+func scalarBytes(n *big.Int) *[32]byte {
+	be := n.Bytes()
+	d := new([32]byte)
+	for i := range be {
+		d[i] = be[len(be)-1-i]
+	}
+	return d
+}
+
+// blindingKeys returns a random blinding scalar and its inverse.
+func blindingKeys(rand io.Reader) (blindKey, unblindKey *[32]byte, err error) {
+	for {
+		blindKey, err = genRandom(rand)
+		if err != nil {
+			return nil, nil, err
+		}
+		inverse := new(big.Int).ModInverse(clampedScalar(blindKey), groupOrder)
+		if inverse == nil {
+			continue
+		}
+		// Find 2^254 + 8*m = inverse (mod l).
+		m := new(big.Int).Sub(inverse, clampBase)
+		m.Mul(m, eightInverse).Mod(m, groupOrder)
+		if m.Cmp(clampLimit) < 0 {
+			return blindKey, scalarBytes(m.Lsh(m, 3).Add(m, clampBase)), nil
+		}
+	}
+}
+
+// CreateOblivious creates an oblivious OracleMessage from an OracleMessageTemplate. The template
+// must not contain a Policy.
+func (omt OracleMessageTemplate) CreateOblivious(secretKey *[32]byte, rand io.Reader) (*OracleMessage, error) {
+	if !omt.Policy.IsEmpty() {
+		return nil, ErrObliviousPolicy
+	}
+	secretEncryptKey, err := genRandom(rand)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSecret, err := SymEncrypt(secretEncryptKey, secretKey[:], rand)
+	if err != nil {
+		return nil, err
+	}
+	ratchetMessage, _, err := NewRatchetMessage(&omt.RatchetPublicKey, secretEncryptKey[:], rand)
+	if err != nil {
+		return nil, err
+	}
+	ratchetMessageBytes, err := ratchetMessage.Encrypt(rand)
+	if err != nil {
+		return nil, err
+	}
+	ret := &OracleMessage{
+		ValidFrom:          omt.ValidFrom,
+		ValidTo:            omt.ValidTo,
+		EncryptedSecretKey: encryptedSecret,
+		ServerURL:          omt.ServerURL,
+		ServerMessage:      ratchetMessageBytes,
+		SignatureKey:       omt.SignatureKey,
+	}
+	return ret, nil
+}
+
+// Oblivious returns true if the OracleMessage must be unlocked obliviously.
+func (om *OracleMessage) Oblivious() bool {
+	t, _ := Identify(om.ServerMessage, TypeEnvelope)
+	return t == TypeRatchet
+}
+
+// Blind returns the blinded key to send to the server and the key to unblind the server's
+// secrets with.
+func (om *OracleMessage) Blind(rand io.Reader) (blindedKey, unblindKey *[32]byte, err error) {
+	if !om.Oblivious() {
+		return nil, nil, ErrNotOblivious
+	}
+	rm, err := new(RatchetMessage).Parse(om.ServerMessage)
+	if err != nil {
+		return nil, nil, err
+	}
+	blindKey, unblindKey, err := blindingKeys(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	blindedKey = new([32]byte)
+	curve25519.ScalarMult(blindedKey, blindKey, &rm.SenderPublicKey)
+	return blindedKey, unblindKey, nil
+}
+
+// ProcessObliviousResponse unblinds the secrets returned by the server and decrypts the secret.
+func (om *OracleMessage) ProcessObliviousResponse(unblindKey *[32]byte, secrets []*[32]byte) (secretKey *[32]byte, err error) {
+	if !om.Oblivious() {
+		return nil, ErrNotOblivious
+	}
+	rm, err := new(RatchetMessage).Parse(om.ServerMessage)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		unblinded := new([32]byte)
+		curve25519.ScalarMult(unblinded, unblindKey, secret)
+		presecret := sha256.Sum256(unblinded[:])
+		err = rm.Decrypt(func(expectedPubKey, peerPubKey *[32]byte) (*[32]byte, error) {
+			return &presecret, nil
+		})
+		if err == nil {
+			return om.openSecretKey(rm.Payload)
+		}
+	}
+	return nil, ErrCannotDecrypt
+}
+
+// ProcessObliviousRequest is the server-side processing of blinded keys. It returns the blinded
+// secrets of all current ratchet keys.
+func (sc ServerConfig) ProcessObliviousRequest(blindedKey *[32]byte) ([]*[32]byte, error) {
+	if sc.BlindSecretFunc == nil {
+		return nil, ErrObliviousUnsupported
+	}
+	return sc.BlindSecretFunc(blindedKey)
+}
@@ -0,0 +1,121 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestBlindingKeys(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, _ := genTestKeys()
+		blindKey, unblindKey, err := blindingKeys(rand.Reader)
+		if err != nil {
+			t.Fatalf("blindingKeys: %s", err)
+		}
+		blinded, unblinded := new([32]byte), new([32]byte)
+		curve25519.ScalarMult(blinded, blindKey, pub)
+		curve25519.ScalarMult(unblinded, unblindKey, blinded)
+		if *unblinded != *pub || *blinded == *pub {
+			t.Fatal("Blinding not reversed")
+		}
+	}
+}
+
+func TestOracleMessageOblivious(t *testing.T) {
+	secretKey, _ := genRandom(rand.Reader)
+	pubkeyRatchet, privkeyRatchet := genTestKeys()
+	_, privkeyOther := genTestKeys()
+	sc := &ServerConfig{
+		BlindSecretFunc: func(blindedPubKey *[32]byte) ([]*[32]byte, error) {
+			var secrets []*[32]byte
+			for _, k := range []*[32]byte{privkeyOther, privkeyRatchet} {
+				s := new([32]byte)
+				curve25519.ScalarMult(s, k, blindedPubKey)
+				secrets = append(secrets, s)
+			}
+			return secrets, nil
+		},
+	}
+	omt := &OracleMessageTemplate{
+		ValidFrom:        1,
+		ValidTo:          2,
+		ServerURL:        "https://test.com",
+		RatchetPublicKey: *pubkeyRatchet,
+	}
+	om, err := omt.CreateOblivious(secretKey, rand.Reader)
+	if err != nil {
+		t.Fatalf("CreateOblivious: %s", err)
+	}
+	om, err = new(OracleMessage).Unmarshall(om.Marshall())
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	if !om.Oblivious() {
+		t.Fatal("Oblivious: false")
+	}
+	blindedKey, unblindKey, err := om.Blind(rand.Reader)
+	if err != nil {
+		t.Fatalf("Blind: %s", err)
+	}
+	if bytes.Contains(om.ServerMessage, blindedKey[:]) {
+		t.Error("Blinded key reveals sender key")
+	}
+	secrets, err := sc.ProcessObliviousRequest(blindedKey)
+	if err != nil {
+		t.Fatalf("ProcessObliviousRequest: %s", err)
+	}
+	decSecret, err := om.ProcessObliviousResponse(unblindKey, secrets)
+	if err != nil {
+		t.Fatalf("ProcessObliviousResponse: %s", err)
+	}
+	if *secretKey != *decSecret {
+		t.Error("Secrets don't match")
+	}
+	if _, err := om.ProcessObliviousResponse(unblindKey, secrets[:1]); err != ErrCannotDecrypt {
+		t.Errorf("ProcessObliviousResponse without ratchet key: %v", err)
+	}
+	if _, err := (ServerConfig{}).ProcessObliviousRequest(blindedKey); err != ErrObliviousUnsupported {
+		t.Errorf("ProcessObliviousRequest without BlindSecretFunc: %v", err)
+	}
+	omt.Policy = &Policy{MaxUses: 1}
+	if _, err := omt.CreateOblivious(secretKey, rand.Reader); err != ErrObliviousPolicy {
+		t.Errorf("CreateOblivious with policy: %v", err)
+	}
+}
+
+func TestCypherlockOblivious(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Oblivious:    true,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	if secrets, errs := cl.LoadLocks(passphrase, now, []clientinterface.Storage{storage}); errs[0] != nil || !bytes.Equal(secret, secrets[0]) {
+		t.Errorf("LoadLocks: %v", errs[0])
+	}
+	if rpc.decrypts != 0 {
+		t.Errorf("Oracle messages sent to server: %d", rpc.decrypts)
+	}
+	cl.MaxUses = 1
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != ErrObliviousPolicy {
+		t.Errorf("CreateLock with MaxUses: %v", err)
+	}
+}
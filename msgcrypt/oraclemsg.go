@@ -8,21 +8,27 @@ import (
 
 	"github.com/JonathanLogan/cypherlock/ratchet"
 	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
 	// ErrPolicyExpired is returned when the policy of a message has expired.
 	ErrPolicyExpired = errors.New("msgcrypt: policy expired")
+	// ErrPolicyMismatch is returned if a RatchetMessage was not created for the envelope it was received in.
+	ErrPolicyMismatch = errors.New("msgcrypt: envelope policy does not match ratchet message")
+	// ErrPolicyUnbound is returned if the server requires bound messages and receives an unbound one.
+	ErrPolicyUnbound = errors.New("msgcrypt: ratchet message not bound to envelope policy")
 )
 
 // OracleMessage contains an oracle message for the sender, and the secret access.
 type OracleMessage struct {
-	ValidFrom          uint64   // From when is the message valid.
-	ValidTo            uint64   // Until when is the message valid.
-	ResponsePrivateKey [32]byte // The private key to decrypt the server response.
-	EncryptedSecretKey []byte   // The encrypted key to decrypt the secret.
-	ServerURL          string   // The URL to send the message to.
-	ServerMessage      []byte   // The message to send to the server. about 352 bytes.
+	ValidFrom          uint64                      // From when is the message valid.
+	ValidTo            uint64                      // Until when is the message valid.
+	ResponsePrivateKey [32]byte                    // The private key to decrypt the server response.
+	EncryptedSecretKey []byte                      // The encrypted key to decrypt the secret.
+	ServerURL          string                      // The URL to send the message to.
+	ServerMessage      []byte                      // The message to send to the server. Padded, about 652 bytes. The RatchetMessage for oblivious messages.
+	SignatureKey       [ed25519.PublicKeySize]byte // Pinned key of the server that signs responses. Zero if unknown.
 }
 
 func encodeSlice(d []byte) []byte {
@@ -31,6 +37,23 @@ func encodeSlice(d []byte) []byte {
 	return append(l, d...)
 }
 
+// splitSlices splits a sequence of encodeSlice results.
+func splitSlices(d []byte) ([][]byte, error) {
+	var ret [][]byte
+	for len(d) > 0 {
+		if len(d) < 8 {
+			return nil, ErrMessageIncomplete
+		}
+		l := binary.BigEndian.Uint64(d[0:8])
+		if uint64(len(d)-8) < l {
+			return nil, ErrMessageIncomplete
+		}
+		ret = append(ret, d[8:8+l])
+		d = d[8+l:]
+	}
+	return ret, nil
+}
+
 // Valid returns true if the message is currently valid.
 func (om *OracleMessage) Valid() bool {
 	now := uint64(timesource.Clock.Now().Unix())
@@ -40,8 +63,12 @@ func (om *OracleMessage) Valid() bool {
 	return true
 }
 
-// ProcessResponseMessage decrypts the responseMessage and secret.
+// ProcessResponseMessage decrypts the responseMessage and secret. The response must answer
+// ServerMessage and be signed by SignatureKey.
 func (om *OracleMessage) ProcessResponseMessage(d []byte) (secretKey *[32]byte, err error) {
+	if om.SignatureKey == ([ed25519.PublicKeySize]byte{}) {
+		return nil, ErrNoSignatureKey
+	}
 	// decrypt ReponseMessage
 	rm, err := new(ResponseMessage).Parse(d)
 	if err != nil {
@@ -51,9 +78,16 @@ func (om *OracleMessage) ProcessResponseMessage(d []byte) (secretKey *[32]byte,
 	if err != nil {
 		return nil, err
 	}
-	// Decrypt response content
+	if !rm.Verify(&om.SignatureKey, om.ServerMessage) {
+		return nil, ErrResponseUntrusted
+	}
+	return om.openSecretKey(rm.Payload)
+}
+
+// openSecretKey decrypts the secret with the payload of the RatchetMessage.
+func (om *OracleMessage) openSecretKey(payload []byte) (secretKey *[32]byte, err error) {
 	key := new([32]byte)
-	copy(key[:], rm.Payload)
+	copy(key[:], payload)
 	secretT, err := SymDecrypt(key, om.EncryptedSecretKey)
 	if err != nil {
 		return nil, err
@@ -63,21 +97,44 @@ func (om *OracleMessage) ProcessResponseMessage(d []byte) (secretKey *[32]byte,
 	return secretKey, nil
 }
 
+// Marshalled OracleMessage format:
+//
+// Header | ValidFrom (uint64) | ValidTo (uint64) | ResponsePrivateKey | encodeSlice(EncryptedSecretKey) |
+// encodeSlice(ServerURL) | encodeSlice(ServerMessage) | [SignatureKey]
+//
+// From version 2 the body is padded. From version 3 it contains SignatureKey.
+
 // Marshall an OracleMessage.
 func (om OracleMessage) Marshall() []byte {
-	cap := 8 + 8 + 32 + 8 + len(om.EncryptedSecretKey) + 8 + len(om.ServerURL) + 8 + len(om.ServerMessage)
-	ret := make([]byte, 48, cap)
-	binary.BigEndian.PutUint64(ret[0:8], om.ValidFrom)
-	binary.BigEndian.PutUint64(ret[8:16], om.ValidTo)
-	copy(ret[16:48], om.ResponsePrivateKey[:])
-	ret = append(ret, encodeSlice(om.EncryptedSecretKey)...)
-	ret = append(ret, encodeSlice([]byte(om.ServerURL))...)
-	ret = append(ret, encodeSlice(om.ServerMessage)...)
-	return ret
+	size := 8 + 8 + 32 + 8 + len(om.EncryptedSecretKey) + 8 + len(om.ServerURL) + 8 + len(om.ServerMessage) + ed25519.PublicKeySize
+	body := make([]byte, 48, size)
+	binary.BigEndian.PutUint64(body[0:8], om.ValidFrom)
+	binary.BigEndian.PutUint64(body[8:16], om.ValidTo)
+	copy(body[16:48], om.ResponsePrivateKey[:])
+	body = append(body, encodeSlice(om.EncryptedSecretKey)...)
+	body = append(body, encodeSlice([]byte(om.ServerURL))...)
+	body = append(body, encodeSlice(om.ServerMessage)...)
+	ret := newHeader(TypeOracle, padSize(size, oraclePadSize))
+	if ret[3] >= signedResponseVersion {
+		body = append(body, om.SignatureKey[:]...)
+	}
+	if ret[3] >= paddedVersion {
+		body = pad(body, oraclePadSize)
+	}
+	return append(ret, body...)
 }
 
 // Unmarshall an OracleMessage.
 func (om *OracleMessage) Unmarshall(d []byte) (*OracleMessage, error) {
+	version, d, err := splitHeader(d, TypeOracle)
+	if err != nil {
+		return nil, err
+	}
+	if version >= paddedVersion {
+		if d, err = unpad(d); err != nil {
+			return nil, err
+		}
+	}
 	if len(d) < 8+8+32+8+1+8+1+8+1 {
 		return nil, ErrMessageIncomplete
 	}
@@ -112,13 +169,31 @@ func (om *OracleMessage) Unmarshall(d []byte) (*OracleMessage, error) {
 	c = make([]byte, l2)
 	copy(c, d[l+8:l+8+l2])
 	ret.ServerMessage = c
+	// SignatureKey
+	if version >= signedResponseVersion {
+		l = l + 8 + l2
+		if len(d) < l+ed25519.PublicKeySize {
+			return nil, ErrMessageIncomplete
+		}
+		copy(ret.SignatureKey[:], d[l:l+ed25519.PublicKeySize])
+	}
 	return ret, nil
 }
 
 // Encrypt the OracleMessage
 func (om OracleMessage) Encrypt(passphrase []byte, rand io.Reader) (encrypted []byte, filename string, err error) {
+	return om.EncryptParams(passphrase, nil, rand)
+}
+
+// EncryptParams encrypts the OracleMessage using the given KDF parameters. If params is nil, DefaultKDFParams are used.
+func (om OracleMessage) EncryptParams(passphrase []byte, params *KDFParams, rand io.Reader) (encrypted []byte, filename string, err error) {
+	return om.Seal(&PassphraseProtector{Passphrase: passphrase, Params: params}, rand)
+}
+
+// Seal encrypts the OracleMessage with the Protector.
+func (om OracleMessage) Seal(p Protector, rand io.Reader) (encrypted []byte, filename string, err error) {
 	fn := strconv.FormatUint(om.ValidFrom, 10) + "-" + strconv.FormatUint(om.ValidTo, 10) + ".oracle"
-	enc, err := PasswordEncrypt(passphrase, om.Marshall(), rand)
+	enc, err := p.Seal(om.Marshall(), rand)
 	if err != nil {
 		return nil, "", err
 	}
@@ -127,7 +202,12 @@ func (om OracleMessage) Encrypt(passphrase []byte, rand io.Reader) (encrypted []
 
 // Decrypt the OracleMessage.
 func (om OracleMessage) Decrypt(passphrase, message []byte) (*OracleMessage, error) {
-	ct, err := PasswordDecrypt(passphrase, message)
+	return om.Open(&PassphraseProtector{Passphrase: passphrase}, message)
+}
+
+// Open decrypts the OracleMessage with the Protector.
+func (om OracleMessage) Open(p Protector, message []byte) (*OracleMessage, error) {
+	ct, err := p.Open(message)
 	if err != nil {
 		return nil, err
 	}
@@ -136,11 +216,13 @@ func (om OracleMessage) Decrypt(passphrase, message []byte) (*OracleMessage, err
 
 // OracleMessageTemplate is the template from which to create an OracleMessage.
 type OracleMessageTemplate struct {
-	ValidFrom        uint64   // From when is the message valid.
-	ValidTo          uint64   // Until when is the message valid.
-	ServerURL        string   // The URL to send the message to.
-	ServerPublicKey  [32]byte // The server's public key.
-	RatchetPublicKey [32]byte // The public key for the ratchet.
+	ValidFrom        uint64                      // From when is the message valid.
+	ValidTo          uint64                      // Until when is the message valid.
+	ServerURL        string                      // The URL to send the message to.
+	ServerPublicKey  [32]byte                    // The server's public key.
+	RatchetPublicKey [32]byte                    // The public key for the ratchet.
+	Policy           *Policy                     // Restrictions enforced by the server. Optional.
+	SignatureKey     [ed25519.PublicKeySize]byte // The server's signature key, pinned to verify responses.
 }
 
 // CreateEncrypted creates an encrypted Oracle message from template.
@@ -164,16 +246,20 @@ func (omt OracleMessageTemplate) Create(secretKey *[32]byte, rand io.Reader) (*O
 		return nil, err
 	}
 	// Create the RatchetMessage
+	policy := omt.Policy.Marshall()
 	ratchetMessage, receivePrivKey, err := NewRatchetMessage(&omt.RatchetPublicKey, secretEncryptKey[:], rand)
 	if err != nil {
 		return nil, err
 	}
+	ratchetMessage.AssociatedData = EnvelopeAssociatedData(&omt.ServerPublicKey, omt.ValidFrom, omt.ValidTo, policy)
 	ratchetMessageBytes, err := ratchetMessage.Encrypt(rand)
 	if err != nil {
 		return nil, err
 	}
 	// Create the EnvelopeMessage
 	envMsg := NewEnvelopeMessage(&omt.ServerPublicKey, omt.ValidFrom, omt.ValidTo, ratchetMessageBytes)
+	envMsg.Policy = policy
+	envMsg.Bound = true
 	envMsgB, err := envMsg.Encrypt(rand)
 	if err != nil {
 		return nil, err
@@ -185,47 +271,127 @@ func (omt OracleMessageTemplate) Create(secretKey *[32]byte, rand io.Reader) (*O
 		ServerURL:          omt.ServerURL,
 		ResponsePrivateKey: *receivePrivKey,
 		ServerMessage:      envMsgB,
+		SignatureKey:       omt.SignatureKey,
 	}
 	return ret, nil
 }
 
+// SpendFunc records one use of the message identified by nullifier. It must return ErrMessageSpent
+// if the message has been used maxUses times already. The record can be forgotten after expire.
+type SpendFunc func(nullifier *[32]byte, maxUses uint32, expire uint64) error
+
+// BurnFunc is called to use up all remaining uses of the message identified by nullifier.
+type BurnFunc func(nullifier *[32]byte, expire uint64) error
+
 // ServerConfig contains the static configuration for OracleMessage processing.
 type ServerConfig struct {
-	PublicKey, PrivateKey [32]byte           // Server's long term curve25519 keypari
-	GetSecretFunc         ratchet.SecretFunc // Lookup function of fountain.
-	RandomSource          io.Reader          // Random source for key generation.
+	PublicKey, PrivateKey [32]byte                      // Server's long term curve25519 keypari
+	GetSecretFunc         ratchet.SecretFunc            // Lookup function of fountain.
+	BlindSecretFunc       ratchet.BlindSecretFunc       // Blinded lookup function of fountain. If nil, oblivious requests are rejected.
+	SpendFunc             SpendFunc                     // Records uses of use-limited messages. If nil, such messages are rejected.
+	BurnFunc              BurnFunc                      // Burns use-limited messages. If nil, burning is not supported.
+	CheckinFunc           CheckinFunc                   // Returns the last check-in of an owner. If nil, messages requiring check-ins are rejected.
+	DelayFunc             DelayFunc                     // Holds back responses to delayed messages. If nil, delayed messages are rejected.
+	ApprovalFunc          ApprovalFunc                  // Checks the approvals of requests. If nil, messages requiring approvals are rejected.
+	SignatureKey          *[ed25519.PrivateKeySize]byte // Server's signature key to sign responses with.
+	RequireBinding        bool                          // Reject messages that are not bound to their envelope policy.
+	RandomSource          io.Reader                     // Random source for key generation.
 }
 
-// ProcessOracleMessage is the server-side processing of OracleMessages.
-func (sc ServerConfig) ProcessOracleMessage(d []byte) ([]byte, error) {
+// openEnvelope decrypts and validates the envelope of a message and parses its policy and
+// RatchetMessage. Messages that are not valid yet are accepted if future is true.
+func (sc ServerConfig) openEnvelope(d []byte, future bool) (*EnvelopeMessage, *Policy, *RatchetMessage, error) {
 	// Decrypt envelope.s
 	em, err := new(EnvelopeMessage).Parse(d)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	err = em.Decrypt(&sc.PrivateKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	// Validate:  ValidFrom  ValidTo
 	now := uint64(timesource.Clock.Now().Unix())
-	if em.ValidFrom > now || em.ValidTo < now {
-		return nil, ErrPolicyExpired
+	if (em.ValidFrom > now && !future) || em.ValidTo < now {
+		return nil, nil, nil, ErrPolicyExpired
+	}
+	if sc.RequireBinding && !em.Bound {
+		return nil, nil, nil, ErrPolicyUnbound
+	}
+	policy, err := new(Policy).Unmarshall(em.Policy)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if (policy.MaxUses > 0 && sc.SpendFunc == nil) || (policy.CheckinInterval > 0 && sc.CheckinFunc == nil) ||
+		(policy.Delay > 0 && sc.DelayFunc == nil) || (policy.Approvals > 0 && sc.ApprovalFunc == nil) {
+		return nil, nil, nil, ErrPolicyUnsupported
 	}
 	// RatchetMessage.
 	rm, err := new(RatchetMessage).Parse(em.RatchetMessage)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rm.AssociatedData = em.AssociatedData()
+	return em, policy, rm, nil
+}
+
+// BurnOracleMessage uses up all remaining uses of a use-limited message, so that it cannot be
+// decrypted anymore. Messages that are not valid yet can be burned, messages without use limit cannot.
+func (sc ServerConfig) BurnOracleMessage(d []byte) error {
+	em, policy, rm, err := sc.openEnvelope(d, true)
+	if err != nil {
+		return err
+	}
+	if policy.MaxUses == 0 || sc.BurnFunc == nil {
+		return ErrPolicyUnsupported
+	}
+	return sc.BurnFunc(rm.Nullifier(), em.ValidTo)
+}
+
+// ProcessOracleMessage is the server-side processing of OracleMessages. For delayed messages a
+// signed Ticket is returned instead of the ResponseMessage.
+func (sc ServerConfig) ProcessOracleMessage(d []byte) ([]byte, error) {
+	if sc.SignatureKey == nil {
+		return nil, ErrNoSignatureKey
+	}
+	em, policy, rm, err := sc.openEnvelope(d, false)
 	if err != nil {
 		return nil, err
 	}
 	err = rm.Decrypt(sc.GetSecretFunc)
+	if err == ErrCannotDecrypt && em.Bound {
+		return nil, ErrPolicyMismatch
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := sc.checkCheckin(policy); err != nil {
+		return nil, err
+	}
+	if policy.Approvals > 0 {
+		if err := sc.ApprovalFunc(RequestID(d), policy.Approvers, policy.Approvals); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MaxUses > 0 {
+		if err := sc.SpendFunc(rm.Nullifier(), policy.MaxUses, em.ValidTo); err != nil {
+			return nil, err
+		}
+	}
 	// ResponseMessage
 	rspm := NewResponseMessage(&sc.PublicKey, &rm.ReceiverPublicKey, rm.Payload)
+	rspm.Sign(sc.SignatureKey, d)
 	rspmB, err := rspm.Encrypt(&sc.PrivateKey, sc.RandomSource)
 	if err != nil {
 		return nil, err
 	}
+	if policy.Delay > 0 {
+		ticket, err := sc.DelayFunc(rspmB, &policy.CancelKey, policy.Delay)
+		if err != nil {
+			return nil, err
+		}
+		ticket.Sign(sc.SignatureKey, d)
+		return ticket.Bytes(), nil
+	}
 	return rspmB, nil
 }
@@ -6,8 +6,21 @@ import (
 	"testing"
 
 	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
 )
 
+func genTestSigKeys() (*[ed25519.PublicKeySize]byte, *[ed25519.PrivateKeySize]byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("genTestSigKeys")
+	}
+	pubkey, privkey := new([ed25519.PublicKeySize]byte), new([ed25519.PrivateKeySize]byte)
+	copy(pubkey[:], pub)
+	copy(privkey[:], priv)
+	return pubkey, privkey
+}
+
 func TestOracleMessageMarshall(t *testing.T) {
 	td := &OracleMessage{
 		ValidFrom:          298,
@@ -16,6 +29,7 @@ func TestOracleMessageMarshall(t *testing.T) {
 		EncryptedSecretKey: []byte("EncryptedSecretKey"),
 		ServerURL:          "ServerURL",
 		ServerMessage:      []byte("ServerMessage"),
+		SignatureKey:       [32]byte{0x09, 0x0a},
 	}
 	m := td.Marshall()
 	td2, err := new(OracleMessage).Unmarshall(m)
@@ -40,6 +54,9 @@ func TestOracleMessageMarshall(t *testing.T) {
 	if !bytes.Equal(td.ServerMessage, td2.ServerMessage) {
 		t.Error("ServerMessage")
 	}
+	if td.SignatureKey != td2.SignatureKey {
+		t.Error("SignatureKey")
+	}
 }
 
 func TestOracleMessageCrypt(t *testing.T) {
@@ -85,11 +102,13 @@ func TestOracleMessageCreate(t *testing.T) {
 	secretKey, _ := genRandom(rand.Reader)
 	pubkeyServer, privkeyServer := genTestKeys()
 	pubkeyRatchet, privkeyRatchet := genTestKeys()
+	sigPubkey, sigPrivkey := genTestSigKeys()
 
 	sc := &ServerConfig{
 		PublicKey:     *pubkeyServer,
 		PrivateKey:    *privkeyServer,
 		GetSecretFunc: lookupF(pubkeyRatchet, privkeyRatchet),
+		SignatureKey:  sigPrivkey,
 		RandomSource:  rand.Reader,
 	}
 
@@ -100,6 +119,7 @@ func TestOracleMessageCreate(t *testing.T) {
 		ServerURL:        "https://test.com",
 		ServerPublicKey:  *pubkeyServer,
 		RatchetPublicKey: *pubkeyRatchet,
+		SignatureKey:     *sigPubkey,
 	}
 	enc, fn, err := omt.CreateEncrypted(passphrase, secretKey, rand.Reader)
 	if err != nil {
@@ -124,4 +144,99 @@ func TestOracleMessageCreate(t *testing.T) {
 	if *secretKey != *decSecret {
 		t.Error("Secrets don't match")
 	}
+	// Response signed by another key.
+	_, otherSigPrivkey := genTestSigKeys()
+	scOther := *sc
+	scOther.SignatureKey = otherSigPrivkey
+	if resp, err = scOther.ProcessOracleMessage(om.ServerMessage); err != nil {
+		t.Fatalf("ProcessOracleMessage: %s", err)
+	}
+	if _, err := om.ProcessResponseMessage(resp); err != ErrResponseUntrusted {
+		t.Errorf("Response with wrong signature: %v", err)
+	}
+	// Correctly signed response to another request.
+	receiverPublicKey := new([32]byte)
+	curve25519.ScalarBaseMult(receiverPublicKey, &om.ResponsePrivateKey)
+	rspm := NewResponseMessage(pubkeyServer, receiverPublicKey, make([]byte, 32))
+	rspm.Sign(sigPrivkey, []byte("other request"))
+	if resp, err = rspm.Encrypt(privkeyServer, rand.Reader); err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	if _, err := om.ProcessResponseMessage(resp); err != ErrResponseUntrusted {
+		t.Errorf("Response to other request: %v", err)
+	}
+	// Unsigned response.
+	restore := writeVersion(2, TypeResponse)
+	resp, err = sc.ProcessOracleMessage(om.ServerMessage)
+	restore()
+	if err != nil {
+		t.Fatalf("ProcessOracleMessage: %s", err)
+	}
+	if _, err := om.ProcessResponseMessage(resp); err != ErrResponseUntrusted {
+		t.Errorf("Unsigned response: %v", err)
+	}
+	om.SignatureKey = [32]byte{}
+	if _, err := om.ProcessResponseMessage(resp); err != ErrNoSignatureKey {
+		t.Errorf("Response without signature key: %v", err)
+	}
+}
+
+func TestOracleMessageBinding(t *testing.T) {
+	secretKey, _ := genRandom(rand.Reader)
+	pubkeyServer, privkeyServer := genTestKeys()
+	pubkeyRatchet, privkeyRatchet := genTestKeys()
+	_, sigPrivkey := genTestSigKeys()
+	sc := &ServerConfig{
+		PublicKey:      *pubkeyServer,
+		PrivateKey:     *privkeyServer,
+		GetSecretFunc:  lookupF(pubkeyRatchet, privkeyRatchet),
+		SpendFunc:      func(*[32]byte, uint32, uint64) error { return nil },
+		SignatureKey:   sigPrivkey,
+		RandomSource:   rand.Reader,
+		RequireBinding: true,
+	}
+	now := uint64(timesource.Clock.Now().Unix())
+	omt := &OracleMessageTemplate{
+		ValidFrom:        now,
+		ValidTo:          now + 3600,
+		ServerURL:        "https://test.com",
+		ServerPublicKey:  *pubkeyServer,
+		RatchetPublicKey: *pubkeyRatchet,
+	}
+	om, err := omt.Create(secretKey, rand.Reader)
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if _, err := sc.ProcessOracleMessage(om.ServerMessage); err != nil {
+		t.Fatalf("ProcessOracleMessage: %s", err)
+	}
+	// Re-wrap the ratchet message with a different window, as the holder of the envelope key could.
+	rewrap := func(modify func(em *EnvelopeMessage)) []byte {
+		em, err := new(EnvelopeMessage).Parse(om.ServerMessage)
+		if err != nil {
+			t.Fatalf("Parse: %s", err)
+		}
+		if err := em.Decrypt(privkeyServer); err != nil {
+			t.Fatalf("Decrypt: %s", err)
+		}
+		modify(em)
+		d, err := em.Encrypt(rand.Reader)
+		if err != nil {
+			t.Fatalf("Encrypt: %s", err)
+		}
+		return d
+	}
+	if _, err := sc.ProcessOracleMessage(rewrap(func(em *EnvelopeMessage) { em.ValidTo += 3600 })); err != ErrPolicyMismatch {
+		t.Errorf("Changed window: %v", err)
+	}
+	if _, err := sc.ProcessOracleMessage(rewrap(func(em *EnvelopeMessage) { em.Policy = (&Policy{MaxUses: 1}).Marshall() })); err != ErrPolicyMismatch {
+		t.Errorf("Changed policy: %v", err)
+	}
+	if _, err := sc.ProcessOracleMessage(rewrap(func(em *EnvelopeMessage) { em.Bound = false })); err != ErrPolicyUnbound {
+		t.Errorf("Unbound message: %v", err)
+	}
+	sc.RequireBinding = false
+	if _, err := sc.ProcessOracleMessage(rewrap(func(em *EnvelopeMessage) { em.Bound = false })); err != ErrCannotDecrypt {
+		t.Errorf("Stripped binding: %v", err)
+	}
 }
@@ -0,0 +1,57 @@
+package msgcrypt
+
+import (
+	"errors"
+)
+
+// ErrPadding is returned if the padding of a message is invalid.
+var ErrPadding = errors.New("msgcrypt: invalid padding")
+
+// Padding:
+//
+// Message | 0x80 | 0x00...
+//
+// EnvelopeMessages, ResponseMessages and marshalled OracleMessages of version 2 and later are
+// padded to a bucket size, so that their lengths do not reveal ServerURL, policy or payload
+// sizes. The smallest bucket depends on the message type, larger buckets double in size.
+// EnvelopeMessages and ResponseMessages are padded inside the encryption. Padding does not
+// hide the validity window of an OracleMessage, the client storage names lock files after it.
+// That leak is out of scope.
+
+const (
+	paddedVersion = 2 // First version of padded message types.
+
+	envelopePadSize = 512  // Envelope cleartext.
+	responsePadSize = 256  // Response cleartext.
+	oraclePadSize   = 1024 // Marshalled OracleMessage body.
+)
+
+// padSize returns the bucket size for n bytes of message.
+func padSize(n, min int) int {
+	size := min
+	for size < n+1 {
+		size *= 2
+	}
+	return size
+}
+
+// pad returns d padded to its bucket.
+func pad(d []byte, min int) []byte {
+	size := padSize(len(d), min)
+	p := make([]byte, len(d), size)
+	copy(p, d)
+	p = append(p, 0x80)
+	return append(p, make([]byte, size-len(p))...)
+}
+
+// unpad removes the padding from d.
+func unpad(d []byte) ([]byte, error) {
+	i := len(d) - 1
+	for i >= 0 && d[i] == 0x00 {
+		i--
+	}
+	if i < 0 || d[i] != 0x80 {
+		return nil, ErrPadding
+	}
+	return d[:i], nil
+}
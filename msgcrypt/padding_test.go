@@ -0,0 +1,105 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPadding(t *testing.T) {
+	for _, n := range []int{0, 1, 62, 63, 64, 65, 200} {
+		d := bytes.Repeat([]byte{0x80}, n)
+		p := pad(d, 64)
+		if len(p) != padSize(n, 64) || len(p)%64 != 0 || len(p) <= n {
+			t.Errorf("pad %d: length %d", n, len(p))
+		}
+		if d2, err := unpad(p); err != nil || !bytes.Equal(d, d2) {
+			t.Errorf("unpad %d: %v", n, err)
+		}
+	}
+	if padSize(63, 64) != 64 || padSize(64, 64) != 128 {
+		t.Error("padSize")
+	}
+	for _, p := range [][]byte{nil, {0x00, 0x00}, {0x80, 0x01}} {
+		if _, err := unpad(p); err != ErrPadding {
+			t.Errorf("unpad %x: %v", p, err)
+		}
+	}
+}
+
+func TestPaddingSizes(t *testing.T) {
+	pubkey, privkey := genTestKeys()
+	em1 := NewEnvelopeMessage(pubkey, 1, 2, []byte("short"))
+	em2 := NewEnvelopeMessage(pubkey, 1, 2, bytes.Repeat([]byte("long"), 50))
+	em2.Policy = (&Policy{MaxUses: 3}).Marshall()
+	enc1, err := em1.Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Envelope Encrypt: %s", err)
+	}
+	enc2, err := em2.Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Envelope Encrypt: %s", err)
+	}
+	if len(enc1) != len(enc2) {
+		t.Errorf("Envelope lengths differ: %d %d", len(enc1), len(enc2))
+	}
+	em3, err := new(EnvelopeMessage).Parse(enc2)
+	if err != nil {
+		t.Fatalf("Envelope Parse: %s", err)
+	}
+	if err := em3.Decrypt(privkey); err != nil || !bytes.Equal(em3.RatchetMessage, em2.RatchetMessage) || !bytes.Equal(em3.Policy, em2.Policy) {
+		t.Errorf("Envelope Decrypt: %v", err)
+	}
+
+	pubkeyServ, privkeyServ := genTestKeys()
+	rsp1, err := NewResponseMessage(pubkeyServ, pubkey, []byte("x")).Encrypt(privkeyServ, rand.Reader)
+	if err != nil {
+		t.Fatalf("Response Encrypt: %s", err)
+	}
+	rsp2, err := NewResponseMessage(pubkeyServ, pubkey, make([]byte, 32)).Encrypt(privkeyServ, rand.Reader)
+	if err != nil {
+		t.Fatalf("Response Encrypt: %s", err)
+	}
+	if len(rsp1) != len(rsp2) {
+		t.Errorf("Response lengths differ: %d %d", len(rsp1), len(rsp2))
+	}
+	rspm, err := new(ResponseMessage).Parse(rsp2)
+	if err != nil {
+		t.Fatalf("Response Parse: %s", err)
+	}
+	if err := rspm.Decrypt(privkey); err != nil || !bytes.Equal(rspm.Payload, make([]byte, 32)) {
+		t.Errorf("Response Decrypt: %v", err)
+	}
+
+	om1 := &OracleMessage{EncryptedSecretKey: []byte("key"), ServerURL: "a", ServerMessage: enc1}
+	om2 := &OracleMessage{EncryptedSecretKey: []byte("key"), ServerURL: "cypherlock.example.com:11139", ServerMessage: enc2}
+	if len(om1.Marshall()) != len(om2.Marshall()) {
+		t.Errorf("Oracle lengths differ: %d %d", len(om1.Marshall()), len(om2.Marshall()))
+	}
+	om3, err := new(OracleMessage).Unmarshall(om2.Marshall())
+	if err != nil || om3.ServerURL != om2.ServerURL || !bytes.Equal(om3.ServerMessage, enc2) {
+		t.Errorf("Oracle Unmarshall: %v", err)
+	}
+}
+
+func TestPaddingVersion1(t *testing.T) {
+	restore := writeVersion(1, TypeEnvelope, TypeOracle)
+	pubkey, privkey := genTestKeys()
+	enc, err := NewEnvelopeMessage(pubkey, 1, 2, []byte("ratchet")).Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Envelope Encrypt: %s", err)
+	}
+	omD := (&OracleMessage{EncryptedSecretKey: []byte("key"), ServerURL: "url", ServerMessage: enc}).Marshall()
+	restore()
+	om, err := new(OracleMessage).Unmarshall(omD)
+	if err != nil {
+		t.Fatalf("Oracle v1 Unmarshall: %s", err)
+	}
+	em, err := new(EnvelopeMessage).Parse(om.ServerMessage)
+	if err != nil {
+		t.Fatalf("Envelope v1 Parse: %s", err)
+	}
+	if err := em.Decrypt(privkey); err != nil || string(em.RatchetMessage) != "ratchet" {
+		t.Errorf("Envelope v1 Decrypt: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package msgcrypt
+
+import (
+	"errors"
+)
+
+// ErrNoPassphrase is returned when changing the passphrase of a lock sealed to a client key.
+var ErrNoPassphrase = errors.New("msgcrypt: lock is not protected by a passphrase")
+
+// ChangePassphrase re-encrypts all files of the lock that are protected by passphrase to
+// newPassphrase, keeping their KDF parameters unless KDFParams is set. It does not contact the
+// server. All files are replaced atomically, files already encrypted to newPassphrase are left
+// unchanged. For multi-recipient locks only the passphrase of cl.Recipient is changed.
+func (cl *Cypherlock) ChangePassphrase(passphrase, newPassphrase []byte) error {
+	cl.init()
+	if cl.Recipient == "" && (cl.ClientPublicKey != nil || cl.ClientPrivateKey != nil) {
+		return ErrNoPassphrase
+	}
+	if d, err := cl.Storage.GetData(duressFile); err == nil {
+		if _, err := cl.duressProtector(newPassphrase).Open(d); err == nil {
+			return ErrDuressPassphrase
+		}
+	}
+	var err error
+	if cl.Recipient != "" {
+		err = cl.changeRecipientPassphrase(passphrase, newPassphrase)
+	} else {
+		err = cl.changeLockPassphrase(passphrase, newPassphrase)
+	}
+	if err != nil && passphrase != nil {
+		cl.checkDuress(passphrase)
+	}
+	return err
+}
+
+// changeLockPassphrase re-encrypts the oracle messages of all servers and the check-in key.
+// Nothing is written unless all files could be re-encrypted.
+func (cl *Cypherlock) changeLockPassphrase(passphrase, newPassphrase []byte) error {
+	files, locks, err := cl.lockFiles()
+	if err != nil {
+		return err
+	}
+	if locks == 0 {
+		return ErrNoLocksFound
+	}
+	for name, d := range files {
+		resealed, err := cl.reseal(passphrase, newPassphrase, d)
+		if err != nil {
+			return err
+		}
+		if resealed == nil {
+			delete(files, name)
+		} else {
+			files[name] = resealed
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return cl.Storage.Replace(files)
+}
+
+// reseal re-encrypts a passphrase encrypted message to newPassphrase. It returns nil if the
+// message is already encrypted to newPassphrase.
+func (cl *Cypherlock) reseal(passphrase, newPassphrase, d []byte) ([]byte, error) {
+	params, _, _, _, err := parsePasswordMessage(d)
+	if err != nil {
+		return nil, err
+	}
+	if cl.KDFParams != nil {
+		params = cl.KDFParams
+	}
+	p, err := PasswordDecryptKeyfile(passphrase, cl.Keyfile, d)
+	if err != nil {
+		if _, errNew := PasswordDecryptKeyfile(newPassphrase, cl.Keyfile, d); errNew == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return PasswordEncryptKeyfile(newPassphrase, cl.Keyfile, p, params, cl.randomSource)
+}
@@ -0,0 +1,126 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCypherlockChangePassphrase(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey:     &ts.sigPublicKey,
+		ServerURL:        "server",
+		Storage:          storage,
+		ClientRPC:        rpc,
+		CheckinInterval:  600,
+		DuressPassphrase: []byte("duress"),
+	}
+	passphrase, newPassphrase, secret := []byte("passphrase"), []byte("new passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if _, _, err := cl.ExtendLock(passphrase, now, now+1800, now+3600); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+	if err := cl.ChangePassphrase([]byte("wrong"), newPassphrase); err == nil {
+		t.Error("ChangePassphrase must fail with wrong passphrase")
+	}
+	if err := cl.ChangePassphrase(passphrase, []byte("duress")); err != ErrDuressPassphrase {
+		t.Errorf("ChangePassphrase to duress passphrase: %v", err)
+	}
+	if err := cl.ChangePassphrase(passphrase, newPassphrase); err != nil {
+		t.Fatalf("ChangePassphrase: %s", err)
+	}
+	if _, err := cl.LoadLock(passphrase, now); err == nil {
+		t.Error("LoadLock must fail with old passphrase")
+	}
+	if secret2, err := cl.LoadLock(newPassphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock with new passphrase: %v", err)
+	}
+	serverMessages(t, storage, newPassphrase) // Fails unless all oracle files are re-encrypted.
+	if err := cl.Checkin(newPassphrase); err != nil {
+		t.Errorf("Checkin with new passphrase: %s", err)
+	}
+	// Repeating the change leaves the files unchanged.
+	if err := cl.ChangePassphrase(passphrase, newPassphrase); err != nil {
+		t.Errorf("Repeated ChangePassphrase: %s", err)
+	}
+}
+
+func TestCypherlockChangePassphraseThreshold(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase, newPassphrase, secret := []byte("passphrase"), []byte("new passphrase"), []byte("threshold secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if err := cl.ChangePassphrase(passphrase, newPassphrase); err != nil {
+		t.Fatalf("ChangePassphrase: %s", err)
+	}
+	rpc.down["a"] = true
+	if secret2, err := cl.LoadLock(newPassphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock with new passphrase: %v", err)
+	}
+}
+
+func TestCypherlockChangePassphraseRecipient(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Recipient:    "alice",
+	}
+	alice, newAlice, bob, secret := []byte("alice"), []byte("new alice"), []byte("bob"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(alice, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if err := cl.AddRecipient(alice, now, "bob", bob, nil); err != nil {
+		t.Fatalf("AddRecipient: %s", err)
+	}
+	if err := cl.ChangePassphrase(alice, newAlice); err != nil {
+		t.Fatalf("ChangePassphrase: %s", err)
+	}
+	if secret2, err := cl.LoadLock(newAlice, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock with new passphrase: %v", err)
+	}
+	cl.Recipient = "bob"
+	if secret2, err := cl.LoadLock(bob, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock of other recipient: %v", err)
+	}
+}
+
+func TestCypherlockChangePassphraseClientKey(t *testing.T) {
+	_, priv, err := GenKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenKeyPair: %s", err)
+	}
+	cl := &Cypherlock{ClientPrivateKey: priv}
+	if err := cl.ChangePassphrase(nil, []byte("passphrase")); err != ErrNoPassphrase {
+		t.Errorf("ChangePassphrase with client key: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrPayloadFormat is returned if a secret is not a payload.
+	ErrPayloadFormat = errors.New("msgcrypt: secret is not a payload")
+	// ErrEntryName is returned if an entry name or content type is empty or too long.
+	ErrEntryName = errors.New("msgcrypt: invalid entry name")
+	// ErrEntryNotFound is returned if a payload has no entry of the requested name.
+	ErrEntryNotFound = errors.New("msgcrypt: entry not found")
+)
+
+// Payload format:
+//
+// Header | Count (uint16) | Count * Entry
+//
+// Entry:
+//
+// NameLength (1 byte) | Name | ContentTypeLength (1 byte) | ContentType | ValueLength (uint16) | Value
+//
+// The payload is stored as the real secret of a lock, so it must fit into MaxSecretSize.
+
+// Entry is a named value in a Payload.
+type Entry struct {
+	Name        string // Name of the entry, unique within the payload.
+	ContentType string // Type of the value, for example "text/plain". Optional.
+	Value       []byte // Value of the entry.
+}
+
+// Payload is a set of named entries stored as the secret of a lock.
+type Payload struct {
+	Entries []Entry
+}
+
+// Get returns the entry of name.
+func (p *Payload) Get(name string) (*Entry, error) {
+	for i := range p.Entries {
+		if p.Entries[i].Name == name {
+			return &p.Entries[i], nil
+		}
+	}
+	return nil, ErrEntryNotFound
+}
+
+// Set adds e to the payload, replacing any entry of the same name.
+func (p *Payload) Set(e Entry) error {
+	if e.Name == "" || len(e.Name) > 0xff || len(e.ContentType) > 0xff {
+		return ErrEntryName
+	}
+	if len(e.Value) > MaxSecretSize {
+		return ErrSecretToLong
+	}
+	if old, err := p.Get(e.Name); err == nil {
+		*old = e
+		return nil
+	}
+	p.Entries = append(p.Entries, e)
+	return nil
+}
+
+// Remove removes the entry of name.
+func (p *Payload) Remove(name string) error {
+	for i := range p.Entries {
+		if p.Entries[i].Name == name {
+			p.Entries = append(p.Entries[:i], p.Entries[i+1:]...)
+			return nil
+		}
+	}
+	return ErrEntryNotFound
+}
+
+// Bytes returns the payload in binary format.
+func (p *Payload) Bytes() []byte {
+	size := 2
+	for _, e := range p.Entries {
+		size += 4 + len(e.Name) + len(e.ContentType) + len(e.Value)
+	}
+	d := newHeader(TypePayload, size)
+	d = append(d, byte(len(p.Entries)>>8), byte(len(p.Entries)))
+	for _, e := range p.Entries {
+		d = append(d, byte(len(e.Name)))
+		d = append(d, e.Name...)
+		d = append(d, byte(len(e.ContentType)))
+		d = append(d, e.ContentType...)
+		d = append(d, byte(len(e.Value)>>8), byte(len(e.Value)))
+		d = append(d, e.Value...)
+	}
+	return d
+}
+
+// Parse a payload from binary format. An empty secret is an empty payload.
+func (p *Payload) Parse(d []byte) (*Payload, error) {
+	if len(d) == 0 {
+		return new(Payload), nil
+	}
+	version, body, err := splitHeader(d, TypePayload)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) < 2 {
+		return nil, ErrPayloadFormat
+	}
+	count := int(binary.BigEndian.Uint16(body[0:2]))
+	body = body[2:]
+	np := &Payload{Entries: make([]Entry, 0, count)}
+	field := func(lenSize int) ([]byte, bool) {
+		if len(body) < lenSize {
+			return nil, false
+		}
+		l := int(body[0])
+		if lenSize == 2 {
+			l = int(binary.BigEndian.Uint16(body[0:2]))
+		}
+		if len(body) < lenSize+l {
+			return nil, false
+		}
+		f := body[lenSize : lenSize+l]
+		body = body[lenSize+l:]
+		return f, true
+	}
+	for i := 0; i < count; i++ {
+		name, ok1 := field(1)
+		contentType, ok2 := field(1)
+		value, ok3 := field(2)
+		if !ok1 || !ok2 || !ok3 || len(name) == 0 {
+			return nil, ErrPayloadFormat
+		}
+		np.Entries = append(np.Entries, Entry{Name: string(name), ContentType: string(contentType), Value: value})
+	}
+	if len(body) != 0 {
+		return nil, ErrPayloadFormat
+	}
+	return np, nil
+}
+
+// LoadPayload unlocks the lock and returns its secret as a payload. Locks created with an empty
+// secret hold an empty payload.
+func (cl *Cypherlock) LoadPayload(passphrase []byte, now uint64) (*Payload, error) {
+	realSecret, err := cl.LoadLock(passphrase, now)
+	if err != nil {
+		return nil, err
+	}
+	return new(Payload).Parse(realSecret)
+}
+
+// UpdatePayload unlocks the lock, calls update with its payload and replaces the secret of the
+// lock with the updated payload. The secret key, and with it the oracle messages and subkeys of
+// the lock, remain unchanged. Nothing is written if update returns an error.
+func (cl *Cypherlock) UpdatePayload(passphrase []byte, now uint64, update func(*Payload) error) error {
+	cl.init()
+	secretKey, err := cl.loadLockKey(passphrase, now)
+	if err != nil {
+		return err
+	}
+	encryptedSecret, err := cl.Storage.GetSecret()
+	if err != nil {
+		return err
+	}
+	realSecret, err := DecryptRealSecret(secretKey, encryptedSecret)
+	if err != nil {
+		return err
+	}
+	payload, err := new(Payload).Parse(realSecret)
+	if err != nil {
+		return err
+	}
+	if err := update(payload); err != nil {
+		return err
+	}
+	encryptedSecret, err = encryptRealSecret(secretKey, payload.Bytes(), cl.randomSource)
+	if err != nil {
+		return err
+	}
+	return cl.Storage.StoreSecret(encryptedSecret)
+}
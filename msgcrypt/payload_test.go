@@ -0,0 +1,105 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPayload(t *testing.T) {
+	p := new(Payload)
+	if err := p.Set(Entry{Name: "db", ContentType: "text/plain", Value: []byte("password")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if err := p.Set(Entry{Name: "api", Value: []byte{0x00, 0xff}}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if err := p.Set(Entry{Name: "db", ContentType: "text/plain", Value: []byte("new password")}); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if err := p.Set(Entry{Value: []byte("value")}); err != ErrEntryName {
+		t.Errorf("Set without name: %v", err)
+	}
+	p2, err := new(Payload).Parse(p.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Errorf("Payload not reproduced: %v", p2)
+	}
+	if e, err := p2.Get("db"); err != nil || string(e.Value) != "new password" {
+		t.Errorf("Get: %v", err)
+	}
+	if err := p2.Remove("db"); err != nil {
+		t.Errorf("Remove: %s", err)
+	}
+	if _, err := p2.Get("db"); err != ErrEntryNotFound {
+		t.Errorf("Get removed entry: %v", err)
+	}
+	if err := p2.Remove("db"); err != ErrEntryNotFound {
+		t.Errorf("Remove removed entry: %v", err)
+	}
+	if _, err := new(Payload).Parse([]byte("secret")); err != ErrPayloadFormat {
+		t.Errorf("Parse plain secret: %v", err)
+	}
+	d := p.Bytes()
+	if _, err := new(Payload).Parse(d[:len(d)-1]); err != ErrPayloadFormat {
+		t.Errorf("Parse truncated payload: %v", err)
+	}
+	if p3, err := new(Payload).Parse(nil); err != nil || len(p3.Entries) != 0 {
+		t.Errorf("Parse empty secret: %v", err)
+	}
+}
+
+func TestCypherlockPayload(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+	}
+	passphrase := []byte("passphrase")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, nil, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	subkey, err := cl.LoadLockSubkey(passphrase, now, "disk")
+	if err != nil {
+		t.Fatalf("LoadLockSubkey: %s", err)
+	}
+	err = cl.UpdatePayload(passphrase, now, func(p *Payload) error {
+		return p.Set(Entry{Name: "db", ContentType: "text/plain", Value: []byte("password")})
+	})
+	if err != nil {
+		t.Fatalf("UpdatePayload: %s", err)
+	}
+	errUpdate := errors.New("update failed")
+	if err := cl.UpdatePayload(passphrase, now, func(p *Payload) error { p.Entries = nil; return errUpdate }); err != errUpdate {
+		t.Errorf("UpdatePayload: %v", err)
+	}
+	p, err := cl.LoadPayload(passphrase, now)
+	if err != nil {
+		t.Fatalf("LoadPayload: %s", err)
+	}
+	if e, err := p.Get("db"); err != nil || !bytes.Equal(e.Value, []byte("password")) || e.ContentType != "text/plain" {
+		t.Errorf("Entry not stored: %v", err)
+	}
+	if subkey2, err := cl.LoadLockSubkey(passphrase, now, "disk"); err != nil || *subkey2 != *subkey {
+		t.Errorf("Subkey changed by UpdatePayload: %v", err)
+	}
+	err = cl.UpdatePayload(passphrase, now, func(p *Payload) error {
+		return p.Set(Entry{Name: "big", Value: make([]byte, MaxSecretSize)})
+	})
+	if err != ErrSecretToLong {
+		t.Errorf("UpdatePayload over MaxSecretSize: %v", err)
+	}
+	if _, err := cl.LoadPayload([]byte("wrong"), now); err == nil {
+		t.Error("LoadPayload must fail with wrong passphrase")
+	}
+}
@@ -0,0 +1,147 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrPolicyFormat is returned if an encoded policy cannot be parsed.
+	ErrPolicyFormat = errors.New("msgcrypt: invalid policy encoding")
+	// ErrPolicyUnknown is returned if a policy contains a restriction the server does not know.
+	ErrPolicyUnknown = errors.New("msgcrypt: unknown policy restriction")
+	// ErrPolicyUnsupported is returned if the server cannot enforce a policy restriction.
+	ErrPolicyUnsupported = errors.New("msgcrypt: policy restriction not supported by server")
+	// ErrMessageSpent is returned if a message has been used up.
+	ErrMessageSpent = errors.New("msgcrypt: message use limit reached")
+)
+
+// Policy contains optional restrictions that the server enforces on an EnvelopeMessage.
+// Servers reject messages with restrictions they do not know.
+type Policy struct {
+	MaxUses         uint32     // Number of times the message may be processed. 0 for unlimited.
+	CheckinKey      [32]byte   // Ed25519 public key of the owner, who must check in regularly.
+	CheckinInterval uint32     // Maximum number of seconds since the last check-in. 0 for no check-in.
+	CancelKey       [32]byte   // Ed25519 public key of the owner, who can cancel delayed responses.
+	Delay           uint32     // Number of seconds the server holds back the response. 0 for no delay.
+	Approvers       [][32]byte // Ed25519 public keys of the approvers of requests.
+	Approvals       uint8      // Number of Approvers that must approve a request. 0 for no approval.
+}
+
+// Policy encoding is a sequence of restrictions:
+//
+// Type (1 byte) | Length (uint16) | Value
+
+const (
+	policyTypeMaxUses  = 0x01
+	policyTypeCheckin  = 0x02 // CheckinKey | CheckinInterval (uint32)
+	policyTypeDelay    = 0x03 // CancelKey | Delay (uint32)
+	policyTypeApproval = 0x04 // Approvals (1 byte) | Approvers
+
+	policyFieldHeaderSize = 1 + 2
+	maxPolicySize         = 0xffff
+)
+
+func appendPolicyField(d []byte, fieldType byte, value []byte) []byte {
+	h := make([]byte, policyFieldHeaderSize)
+	h[0] = fieldType
+	binary.BigEndian.PutUint16(h[1:3], uint16(len(value)))
+	d = append(d, h...)
+	return append(d, value...)
+}
+
+// IsEmpty returns true if the policy contains no restrictions.
+func (p *Policy) IsEmpty() bool {
+	return p == nil || (p.MaxUses == 0 && p.CheckinInterval == 0 && p.Delay == 0 && p.Approvals == 0)
+}
+
+// Marshall the policy. Returns nil for an empty policy.
+func (p *Policy) Marshall() []byte {
+	if p.IsEmpty() {
+		return nil
+	}
+	var d []byte
+	if p.MaxUses > 0 {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, p.MaxUses)
+		d = appendPolicyField(d, policyTypeMaxUses, v)
+	}
+	if p.CheckinInterval > 0 {
+		v := make([]byte, 32+4)
+		copy(v[0:32], p.CheckinKey[:])
+		binary.BigEndian.PutUint32(v[32:36], p.CheckinInterval)
+		d = appendPolicyField(d, policyTypeCheckin, v)
+	}
+	if p.Delay > 0 {
+		v := make([]byte, 32+4)
+		copy(v[0:32], p.CancelKey[:])
+		binary.BigEndian.PutUint32(v[32:36], p.Delay)
+		d = appendPolicyField(d, policyTypeDelay, v)
+	}
+	if p.Approvals > 0 {
+		v := make([]byte, 1, 1+32*len(p.Approvers))
+		v[0] = p.Approvals
+		for _, approver := range p.Approvers {
+			v = append(v, approver[:]...)
+		}
+		d = appendPolicyField(d, policyTypeApproval, v)
+	}
+	return d
+}
+
+// Unmarshall an encoded policy.
+func (p *Policy) Unmarshall(d []byte) (*Policy, error) {
+	np := new(Policy)
+	for len(d) > 0 {
+		if len(d) < policyFieldHeaderSize {
+			return nil, ErrPolicyFormat
+		}
+		fieldType, l := d[0], int(binary.BigEndian.Uint16(d[1:3]))
+		if len(d) < policyFieldHeaderSize+l {
+			return nil, ErrPolicyFormat
+		}
+		value := d[policyFieldHeaderSize : policyFieldHeaderSize+l]
+		d = d[policyFieldHeaderSize+l:]
+		switch fieldType {
+		case policyTypeMaxUses:
+			if l != 4 || np.MaxUses != 0 {
+				return nil, ErrPolicyFormat
+			}
+			np.MaxUses = binary.BigEndian.Uint32(value)
+		case policyTypeCheckin:
+			if l != 32+4 || np.CheckinInterval != 0 {
+				return nil, ErrPolicyFormat
+			}
+			copy(np.CheckinKey[:], value[0:32])
+			np.CheckinInterval = binary.BigEndian.Uint32(value[32:36])
+			if np.CheckinInterval == 0 {
+				return nil, ErrPolicyFormat
+			}
+		case policyTypeDelay:
+			if l != 32+4 || np.Delay != 0 {
+				return nil, ErrPolicyFormat
+			}
+			copy(np.CancelKey[:], value[0:32])
+			np.Delay = binary.BigEndian.Uint32(value[32:36])
+			if np.Delay == 0 {
+				return nil, ErrPolicyFormat
+			}
+		case policyTypeApproval:
+			if l < 1 || (l-1)%32 != 0 || (l-1)/32 > MaxApprovers || np.Approvals != 0 {
+				return nil, ErrPolicyFormat
+			}
+			np.Approvals = value[0]
+			for i := 1; i < l; i += 32 {
+				var approver [32]byte
+				copy(approver[:], value[i:i+32])
+				np.Approvers = append(np.Approvers, approver)
+			}
+			if np.Approvals == 0 || int(np.Approvals) > len(np.Approvers) {
+				return nil, ErrPolicyFormat
+			}
+		default:
+			return nil, ErrPolicyUnknown
+		}
+	}
+	return np, nil
+}
@@ -0,0 +1,57 @@
+package msgcrypt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	if d := new(Policy).Marshall(); d != nil {
+		t.Error("Empty policy must encode to nil")
+	}
+	p := &Policy{MaxUses: 3}
+	p2, err := new(Policy).Unmarshall(p.Marshall())
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	if !reflect.DeepEqual(p2, p) {
+		t.Errorf("Policy mismatch: %v != %v", p2, p)
+	}
+	pc := &Policy{MaxUses: 1, CheckinKey: [32]byte{0x01, 0x02}, CheckinInterval: 86400}
+	pc2, err := new(Policy).Unmarshall(pc.Marshall())
+	if err != nil {
+		t.Fatalf("Unmarshall check-in: %s", err)
+	}
+	if !reflect.DeepEqual(pc2, pc) {
+		t.Errorf("Policy mismatch: %v != %v", pc2, pc)
+	}
+	pd := &Policy{CancelKey: [32]byte{0x03, 0x04}, Delay: 3600}
+	pd2, err := new(Policy).Unmarshall(pd.Marshall())
+	if err != nil {
+		t.Fatalf("Unmarshall delay: %s", err)
+	}
+	if !reflect.DeepEqual(pd2, pd) || pd.IsEmpty() {
+		t.Errorf("Policy mismatch: %v != %v", pd2, pd)
+	}
+	pa := &Policy{Approvers: [][32]byte{{0x05}, {0x06}, {0x07}}, Approvals: 2}
+	pa2, err := new(Policy).Unmarshall(pa.Marshall())
+	if err != nil {
+		t.Fatalf("Unmarshall approval: %s", err)
+	}
+	if !reflect.DeepEqual(pa2, pa) {
+		t.Errorf("Policy mismatch: %v != %v", pa2, pa)
+	}
+	pa.Approvals = 4
+	if _, err := new(Policy).Unmarshall(pa.Marshall()); err != ErrPolicyFormat {
+		t.Errorf("Approvals above approvers: %v", err)
+	}
+	if _, err := new(Policy).Unmarshall([]byte{0xee, 0x00, 0x00}); err != ErrPolicyUnknown {
+		t.Errorf("Unknown restriction: %v", err)
+	}
+	if _, err := new(Policy).Unmarshall(p.Marshall()[:5]); err != ErrPolicyFormat {
+		t.Errorf("Truncated policy: %v", err)
+	}
+	if _, err := new(Policy).Unmarshall(append(p.Marshall(), p.Marshall()...)); err != ErrPolicyFormat {
+		t.Errorf("Duplicate restriction: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package msgcrypt
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	// ErrNoClientKey is returned if a KeyProtector lacks the key required for the operation.
+	ErrNoClientKey = errors.New("msgcrypt: client key missing")
+	// ErrKeyHeader is returned if a message is not sealed to a client key.
+	ErrKeyHeader = errors.New("msgcrypt: message not sealed to client key")
+)
+
+// Protector protects OracleMessages at rest.
+type Protector interface {
+	Seal(message []byte, rand io.Reader) ([]byte, error) // Seal encrypts message.
+	Open(message []byte) ([]byte, error)                 // Open decrypts message.
+}
+
+// PassphraseProtector protects messages with a passphrase and an optional keyfile.
+type PassphraseProtector struct {
+	Passphrase []byte     // The passphrase.
+	Keyfile    []byte     // Content of the keyfile. Optional.
+	Params     *KDFParams // Key derivation parameters for Seal. Defaults to DefaultKDFParams.
+}
+
+// Seal encrypts message with the passphrase and keyfile.
+func (pp *PassphraseProtector) Seal(message []byte, rand io.Reader) ([]byte, error) {
+	return PasswordEncryptKeyfile(pp.Passphrase, pp.Keyfile, message, pp.Params, rand)
+}
+
+// Open decrypts message with the passphrase and keyfile.
+func (pp *PassphraseProtector) Open(message []byte) ([]byte, error) {
+	return PasswordDecryptKeyfile(pp.Passphrase, pp.Keyfile, message)
+}
+
+// Key sealed message format:
+//
+// Header (TypeKey) | SendKey (32 byte) | Nonce (32 byte) | SymEncrypt(message)
+
+const keyParamsSize = 32 + 32
+
+// KeyProtector protects messages with a client X25519 key pair. Sealing only requires the PublicKey,
+// opening requires the PrivateKey.
+type KeyProtector struct {
+	PublicKey  *[32]byte // The client's public key. Derived from PrivateKey if nil.
+	PrivateKey *[32]byte // The client's private key.
+}
+
+func (kp *KeyProtector) publicKey() *[32]byte {
+	if kp.PublicKey != nil {
+		return kp.PublicKey
+	}
+	if kp.PrivateKey == nil {
+		return nil
+	}
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, kp.PrivateKey)
+	return pub
+}
+
+// Seal encrypts message to the public key.
+func (kp *KeyProtector) Seal(message []byte, rand io.Reader) ([]byte, error) {
+	pub := kp.publicKey()
+	if pub == nil {
+		return nil, ErrNoClientKey
+	}
+	secret, sendKey, nonce, err := ToPublicKey(rand, pub)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := SymEncrypt(secret, message, rand)
+	if err != nil {
+		return nil, err
+	}
+	out := newHeader(TypeKey, keyParamsSize+len(ct))
+	out = append(out, sendKey[:]...)
+	out = append(out, nonce[:]...)
+	return append(out, ct...), nil
+}
+
+// Open decrypts message with the private key.
+func (kp *KeyProtector) Open(message []byte) ([]byte, error) {
+	if kp.PrivateKey == nil {
+		return nil, ErrNoClientKey
+	}
+	version, body, err := splitHeader(message, TypeKey)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) < keyParamsSize {
+		return nil, ErrKeyHeader
+	}
+	sendKey, nonce := new([32]byte), new([32]byte)
+	copy(sendKey[:], body[0:32])
+	copy(nonce[:], body[32:64])
+	secret := DecryptKey(sendKey, nonce, kp.PrivateKey)
+	return SymDecrypt(secret, body[keyParamsSize:])
+}
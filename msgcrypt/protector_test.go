@@ -0,0 +1,66 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPassphraseProtector(t *testing.T) {
+	message := []byte("Test message")
+	params := &KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+	p := &PassphraseProtector{Passphrase: []byte("passphrase"), Keyfile: []byte("keyfile"), Params: params}
+	sealed, err := p.Seal(message, rand.Reader)
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	opened, err := p.Open(sealed)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if !bytes.Equal(opened, message) {
+		t.Error("Cleartext no match")
+	}
+	if _, err := PasswordDecrypt(p.Passphrase, sealed); err != ErrKeyfileRequired {
+		t.Errorf("Open without keyfile: %v", err)
+	}
+	if _, err := (&PassphraseProtector{Passphrase: p.Passphrase, Keyfile: []byte("wrong")}).Open(sealed); err == nil {
+		t.Error("Open with wrong keyfile must fail")
+	}
+	plain, err := PasswordEncryptParams(p.Passphrase, message, params, rand.Reader)
+	if err != nil {
+		t.Fatalf("PasswordEncryptParams: %s", err)
+	}
+	if _, err := p.Open(plain); err != ErrKeyfileUnexpected {
+		t.Errorf("Open with unexpected keyfile: %v", err)
+	}
+}
+
+func TestKeyProtector(t *testing.T) {
+	message := []byte("Test message")
+	pub, priv, err := GenKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenKeyPair: %s", err)
+	}
+	sealed, err := (&KeyProtector{PublicKey: pub}).Seal(message, rand.Reader)
+	if err != nil {
+		t.Fatalf("Seal: %s", err)
+	}
+	if _, err := (&KeyProtector{PublicKey: pub}).Open(sealed); err != ErrNoClientKey {
+		t.Errorf("Open without private key: %v", err)
+	}
+	opened, err := (&KeyProtector{PrivateKey: priv}).Open(sealed)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if !bytes.Equal(opened, message) {
+		t.Error("Cleartext no match")
+	}
+	_, otherPriv, _ := GenKeyPair(rand.Reader)
+	if _, err := (&KeyProtector{PrivateKey: otherPriv}).Open(sealed); err == nil {
+		t.Error("Open with wrong key must fail")
+	}
+	if _, err := (&KeyProtector{PrivateKey: priv}).Open(sealed[1:]); err != ErrKeyHeader {
+		t.Errorf("Open without header: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package msgcrypt
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"io"
 
 	"github.com/JonathanLogan/cypherlock/ratchet"
@@ -15,6 +17,7 @@ type RatchetMessage struct {
 	DHNonce           [32]byte
 	SymNonce          [24]byte
 	Payload           []byte
+	AssociatedData    []byte // Authenticated but not transmitted. Optional.
 	encPayload        []byte
 }
 
@@ -54,6 +57,21 @@ func (rm *RatchetMessage) template() []byte {
 	return tmpl
 }
 
+// bind derives the key for the payload. If AssociatedData is set, the key is bound to it and to
+// the message header.
+func (rm *RatchetMessage) bind(secret *[32]byte) *[32]byte {
+	if len(rm.AssociatedData) == 0 {
+		return secret
+	}
+	h := hmac.New(sha256.New, secret[:])
+	h.Write([]byte("cypherlock ratchet binding"))
+	h.Write(rm.template())
+	h.Write(rm.AssociatedData)
+	r := new([32]byte)
+	copy(r[:], h.Sum(nil))
+	return r
+}
+
 // Encrypt the RatchetMessage.
 func (rm *RatchetMessage) Encrypt(rand io.Reader) ([]byte, error) {
 	secret, sendKey, nonce, err := ToRatchetKey(rand, &rm.RatchetPublicKey)
@@ -62,11 +80,16 @@ func (rm *RatchetMessage) Encrypt(rand io.Reader) ([]byte, error) {
 	}
 	rm.DHNonce = *nonce
 	rm.SenderPublicKey = *sendKey
-	return secretbox.Seal(rm.template(), rm.Payload, &rm.SymNonce, secret), nil
+	out := append(newHeader(TypeRatchet, ratchetMessageNoPayloadSize+len(rm.Payload)), rm.template()...)
+	return secretbox.Seal(out, rm.Payload, &rm.SymNonce, rm.bind(secret)), nil
 }
 
 // Parse a binary encrypted RatchetMessage into the struct.
 func (rm *RatchetMessage) Parse(d []byte) (*RatchetMessage, error) {
+	_, d, err := splitHeader(d, TypeRatchet)
+	if err != nil {
+		return nil, err
+	}
 	if len(d) < ratchetMessageNoPayloadSize+1 {
 		return nil, ErrMessageIncomplete
 	}
@@ -81,6 +104,18 @@ func (rm *RatchetMessage) Parse(d []byte) (*RatchetMessage, error) {
 	return orm, nil
 }
 
+// Nullifier returns a value that identifies the RatchetMessage independent of its envelope.
+func (rm *RatchetMessage) Nullifier() *[32]byte {
+	h := sha256.New()
+	h.Write([]byte("cypherlock nullifier"))
+	h.Write(rm.RatchetPublicKey[:])
+	h.Write(rm.SenderPublicKey[:])
+	h.Write(rm.DHNonce[:])
+	r := new([32]byte)
+	copy(r[:], h.Sum(nil))
+	return r
+}
+
 // Decrypt ratchet message.
 func (rm *RatchetMessage) Decrypt(getSecret ratchet.SecretFunc) error {
 	var ok bool
@@ -88,7 +123,7 @@ func (rm *RatchetMessage) Decrypt(getSecret ratchet.SecretFunc) error {
 	if err != nil {
 		return err
 	}
-	rm.Payload, ok = secretbox.Open(nil, rm.encPayload, &rm.SymNonce, secret)
+	rm.Payload, ok = secretbox.Open(nil, rm.encPayload, &rm.SymNonce, rm.bind(secret))
 	if !ok {
 		return ErrCannotDecrypt
 	}
@@ -36,3 +36,35 @@ func TestRatchetMessage(t *testing.T) {
 		t.Fatal("PubKey no match")
 	}
 }
+
+func TestRatchetMessageAssociatedData(t *testing.T) {
+	pubkey, privkey := genTestKeys()
+	msg, _, err := NewRatchetMessage(pubkey, []byte("testmessage"), rand.Reader)
+	if err != nil {
+		t.Fatalf("NewRatchetMessage: %s", err)
+	}
+	msg.AssociatedData = []byte("associated data")
+	encMsg, err := msg.Encrypt(rand.Reader)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	for _, ad := range [][]byte{nil, []byte("other data")} {
+		msg2, _ := new(RatchetMessage).Parse(encMsg)
+		msg2.AssociatedData = ad
+		if err := msg2.Decrypt(lookupF(pubkey, privkey)); err != ErrCannotDecrypt {
+			t.Errorf("Decrypt with associated data %q: %v", ad, err)
+		}
+	}
+	msg2, _ := new(RatchetMessage).Parse(encMsg)
+	msg2.AssociatedData = msg.AssociatedData
+	if err := msg2.Decrypt(lookupF(pubkey, privkey)); err != nil {
+		t.Errorf("Decrypt: %s", err)
+	}
+	// The header is bound as well.
+	encMsg[64] ^= 0x01
+	msg3, _ := new(RatchetMessage).Parse(encMsg)
+	msg3.AssociatedData = msg.AssociatedData
+	if err := msg3.Decrypt(lookupF(pubkey, privkey)); err != ErrCannotDecrypt {
+		t.Errorf("Decrypt with modified ReceiverPublicKey: %v", err)
+	}
+}
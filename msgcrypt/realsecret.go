@@ -25,23 +25,49 @@ func EncryptRealSecret(realSecret []byte, rand io.Reader) (secretKey *[32]byte,
 	if len(realSecret) > MaxSecretSize {
 		return nil, nil, ErrSecretToLong
 	}
-	msg := make([]byte, MaxSecretSize+8)
-	binary.BigEndian.PutUint64(msg[0:8], uint64(len(realSecret)))
-	copy(msg[8:], realSecret)
 	secretKey, err = genRandom(rand)
 	if err != nil {
 		return nil, nil, err
 	}
-	nonce, err := genSymNonce(rand)
+	encrypted, err = encryptRealSecret(secretKey, realSecret, rand)
 	if err != nil {
 		return nil, nil, err
 	}
-	out := secretbox.Seal(nil, msg, nonce, secretKey)
-	return secretKey, append(nonce[:], out...), nil
+	return secretKey, encrypted, nil
+}
+
+// encryptRealSecret encrypts a real secret to secretKey.
+func encryptRealSecret(secretKey *[32]byte, realSecret []byte, rand io.Reader) ([]byte, error) {
+	if len(realSecret) > MaxSecretSize {
+		return nil, ErrSecretToLong
+	}
+	msg := make([]byte, MaxSecretSize+8)
+	binary.BigEndian.PutUint64(msg[0:8], uint64(len(realSecret)))
+	copy(msg[8:], realSecret)
+	nonce, err := genSymNonce(rand)
+	if err != nil {
+		return nil, err
+	}
+	out := append(newHeader(TypeSecret, 24+len(msg)+secretbox.Overhead), nonce[:]...)
+	return secretbox.Seal(out, msg, nonce, secretKey), nil
 }
 
 // DecryptRealSecret decrypts a real secret.
 func DecryptRealSecret(secretKey *[32]byte, encrypted []byte) (realSecret []byte, err error) {
+	version, body, err := splitHeader(encrypted, TypeSecret)
+	if err == nil {
+		if realSecret, err = decryptRealSecret(secretKey, body); err == nil || version == 0 {
+			return realSecret, err
+		}
+	}
+	// A version 0 message might start with bytes that look like a header.
+	if realSecret, err0 := decryptRealSecret(secretKey, encrypted); err0 == nil {
+		return realSecret, nil
+	}
+	return nil, err
+}
+
+func decryptRealSecret(secretKey *[32]byte, encrypted []byte) (realSecret []byte, err error) {
 	if len(encrypted) < MaxSecretSize+8+24+secretbox.Overhead {
 		return nil, ErrEncryptedTooShort
 	}
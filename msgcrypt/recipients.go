@@ -0,0 +1,358 @@
+package msgcrypt
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrRecipientUnknown is returned if the recipient is not in the recipient list of the lock.
+	ErrRecipientUnknown = errors.New("msgcrypt: unknown recipient")
+	// ErrRecipientExists is returned when adding a recipient whose label is already used.
+	ErrRecipientExists = errors.New("msgcrypt: recipient exists")
+	// ErrRecipientLabel is returned if a recipient label is empty or too long.
+	ErrRecipientLabel = errors.New("msgcrypt: invalid recipient label")
+	// ErrLastRecipient is returned when removing the only recipient of a lock.
+	ErrLastRecipient = errors.New("msgcrypt: cannot remove last recipient")
+	// ErrNoRecipients is returned if a lock has no recipient list.
+	ErrNoRecipients = errors.New("msgcrypt: lock has no recipients")
+)
+
+// MaxRecipientLabel is the maximum length of a recipient label.
+const MaxRecipientLabel = 255
+
+// Multi-recipient locks seal their oracle messages to a lock key pair instead of a passphrase.
+// Each recipient holds an X25519 key pair whose private key is sealed with their own passphrase
+// and keyfile, and the lock private key is sealed to the recipient's public key. This allows to
+// rotate the lock key without knowing the passphrases of the recipients.
+//
+// Recipient list format:
+//
+// Header | LockPublicKey (32 byte) | Recipient...
+//
+// Recipient:
+//
+// encodeSlice(Label) | encodeSlice(RecipientPublicKey) | encodeSlice(PassphraseProtector(RecipientPrivateKey)) | encodeSlice(LockKey)
+//
+// LockKey is KeyProtector(RecipientPublicKey)(LockPrivateKey).
+
+const recipientsFile = "recipients"
+
+// recipient is an entry of the recipient list.
+type recipient struct {
+	label      string
+	publicKey  []byte // Public key of the recipient.
+	privateKey []byte // Private key of the recipient sealed with their passphrase.
+	lockKey    []byte // Lock private key sealed to the recipient.
+}
+
+// recipientList is the recipient list of a lock.
+type recipientList struct {
+	lockPublicKey [32]byte
+	recipients    []recipient
+}
+
+func (rl *recipientList) bytes() []byte {
+	d := newHeader(TypeRecipient, 32)
+	d = append(d, rl.lockPublicKey[:]...)
+	for _, r := range rl.recipients {
+		d = append(d, encodeSlice([]byte(r.label))...)
+		d = append(d, encodeSlice(r.publicKey)...)
+		d = append(d, encodeSlice(r.privateKey)...)
+		d = append(d, encodeSlice(r.lockKey)...)
+	}
+	return d
+}
+
+func (rl *recipientList) parse(d []byte) (*recipientList, error) {
+	version, body, err := splitHeader(d, TypeRecipient)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) < 32 {
+		return nil, ErrMessageIncomplete
+	}
+	fields, err := splitSlices(body[32:])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields)%4 != 0 {
+		return nil, ErrMessageIncomplete
+	}
+	nrl := new(recipientList)
+	copy(nrl.lockPublicKey[:], body[0:32])
+	for i := 0; i < len(fields); i += 4 {
+		if len(fields[i+1]) != 32 {
+			return nil, ErrMessageIncomplete
+		}
+		nrl.recipients = append(nrl.recipients, recipient{label: string(fields[i]), publicKey: fields[i+1], privateKey: fields[i+2], lockKey: fields[i+3]})
+	}
+	return nrl, nil
+}
+
+// find returns the position of the recipient with label, or -1.
+func (rl *recipientList) find(label string) int {
+	for i, r := range rl.recipients {
+		if r.label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cl *Cypherlock) loadRecipients() (*recipientList, error) {
+	d, err := cl.Storage.GetData(recipientsFile)
+	if err != nil {
+		return nil, ErrNoRecipients
+	}
+	return new(recipientList).parse(d)
+}
+
+// sealLockKey creates a recipient key pair sealed with passphrase and keyfile, and seals the lock
+// private key to it.
+func (cl *Cypherlock) sealLockKey(label string, passphrase, keyfile []byte) (*recipient, error) {
+	if len(label) == 0 || len(label) > MaxRecipientLabel {
+		return nil, ErrRecipientLabel
+	}
+	pub, priv, err := GenKeyPair(cl.randomSource)
+	if err != nil {
+		return nil, err
+	}
+	p := &PassphraseProtector{Passphrase: passphrase, Keyfile: keyfile, Params: cl.KDFParams}
+	sealedPriv, err := p.Seal(priv[:], cl.randomSource)
+	if err != nil {
+		return nil, err
+	}
+	r := &recipient{label: label, publicKey: pub[:], privateKey: sealedPriv}
+	if err := r.sealLockKey(cl.lockPrivateKey, cl.randomSource); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sealLockKey seals lockPrivateKey to the public key of the recipient.
+func (r *recipient) sealLockKey(lockPrivateKey *[32]byte, rand io.Reader) error {
+	pub := new([32]byte)
+	copy(pub[:], r.publicKey)
+	sealed, err := (&KeyProtector{PublicKey: pub}).Seal(lockPrivateKey[:], rand)
+	if err != nil {
+		return err
+	}
+	r.lockKey = sealed
+	return nil
+}
+
+// createRecipients creates the lock key pair of a new lock and its recipient list with
+// cl.Recipient as only recipient.
+func (cl *Cypherlock) createRecipients(passphrase []byte) error {
+	pub, priv, err := GenKeyPair(cl.randomSource)
+	if err != nil {
+		return err
+	}
+	cl.lockPublicKey, cl.lockPrivateKey = pub, priv
+	r, err := cl.sealLockKey(cl.Recipient, passphrase, cl.Keyfile)
+	if err != nil {
+		return err
+	}
+	rl := &recipientList{lockPublicKey: *pub, recipients: []recipient{*r}}
+	return cl.Storage.StoreData(recipientsFile, rl.bytes())
+}
+
+// loadLockPublicKey loads the lock public key for sealing new oracle messages.
+func (cl *Cypherlock) loadLockPublicKey() error {
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return err
+	}
+	cl.lockPublicKey = &rl.lockPublicKey
+	return nil
+}
+
+// openKey returns the 32 byte key sealed in d.
+func openKey(p Protector, d []byte) (*[32]byte, error) {
+	keyD, err := p.Open(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyD) != 32 {
+		return nil, ErrMessageIncomplete
+	}
+	key := new([32]byte)
+	copy(key[:], keyD)
+	return key, nil
+}
+
+// openRecipient opens the lock private key with the passphrase of cl.Recipient. The key is
+// cleared if that fails.
+func (cl *Cypherlock) openRecipient(passphrase []byte) error {
+	cl.lockPrivateKey = nil
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return err
+	}
+	i := rl.find(cl.Recipient)
+	if i < 0 {
+		return ErrRecipientUnknown
+	}
+	recipientKey, err := openKey(&PassphraseProtector{Passphrase: passphrase, Keyfile: cl.Keyfile}, rl.recipients[i].privateKey)
+	if err != nil {
+		return err
+	}
+	lockPrivateKey, err := openKey(&KeyProtector{PrivateKey: recipientKey}, rl.recipients[i].lockKey)
+	if err != nil {
+		return err
+	}
+	cl.lockPrivateKey = lockPrivateKey
+	cl.lockPublicKey = &rl.lockPublicKey
+	return nil
+}
+
+// lockFiles returns the oracle messages of all servers and the check-in key of the lock by their
+// names relative to cl.Storage, and the number of oracle messages.
+func (cl *Cypherlock) lockFiles() (files map[string][]byte, locks int, err error) {
+	subs := []string{""}
+	for _, s := range cl.Servers {
+		subs = append(subs, serverStorage(s.URL)+"/")
+	}
+	files = make(map[string][]byte)
+	for _, sub := range subs {
+		storage := cl.Storage
+		if sub != "" {
+			storage = storage.Sub(sub[:len(sub)-1])
+		}
+		// Servers of threshold locks that failed when the lock was written have no storage.
+		names, err := storage.ListLocks()
+		if err != nil && !cl.isThreshold() {
+			return nil, 0, err
+		}
+		locks += len(names)
+		if sub == "" {
+			names = append(names, checkinFile)
+		}
+		for _, name := range names {
+			d, err := storage.GetData(name)
+			if err != nil {
+				if name == checkinFile {
+					continue // Lock without check-ins.
+				}
+				return nil, 0, err
+			}
+			files[sub+name] = d
+		}
+	}
+	return files, locks, nil
+}
+
+// rotateLockKey replaces the lock key pair, reseals the lock private key to the recipients of rl
+// and reseals the oracle messages of all servers and the check-in key to the new lock key. The
+// recipient list and all resealed files are replaced atomically.
+func (cl *Cypherlock) rotateLockKey(rl *recipientList) error {
+	pub, priv, err := GenKeyPair(cl.randomSource)
+	if err != nil {
+		return err
+	}
+	rl.lockPublicKey = *pub
+	for i := range rl.recipients {
+		if err := rl.recipients[i].sealLockKey(priv, cl.randomSource); err != nil {
+			return err
+		}
+	}
+	from := &KeyProtector{PublicKey: cl.lockPublicKey, PrivateKey: cl.lockPrivateKey}
+	to := &KeyProtector{PublicKey: pub, PrivateKey: priv}
+	files, _, err := cl.lockFiles()
+	if err != nil {
+		return err
+	}
+	for name, d := range files {
+		p, err := from.Open(d)
+		if err != nil {
+			return err
+		}
+		if files[name], err = to.Seal(p, cl.randomSource); err != nil {
+			return err
+		}
+	}
+	files[recipientsFile] = rl.bytes()
+	if err := cl.Storage.Replace(files); err != nil {
+		return err
+	}
+	cl.lockPublicKey, cl.lockPrivateKey = pub, priv
+	return nil
+}
+
+// changeRecipientPassphrase re-seals the recipient key of cl.Recipient to newPassphrase.
+func (cl *Cypherlock) changeRecipientPassphrase(passphrase, newPassphrase []byte) error {
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return err
+	}
+	i := rl.find(cl.Recipient)
+	if i < 0 {
+		return ErrRecipientUnknown
+	}
+	resealed, err := cl.reseal(passphrase, newPassphrase, rl.recipients[i].privateKey)
+	if err != nil || resealed == nil {
+		return err
+	}
+	rl.recipients[i].privateKey = resealed
+	return cl.Storage.Replace(map[string][]byte{recipientsFile: rl.bytes()})
+}
+
+// Recipients returns the labels of the recipients of the lock.
+func (cl *Cypherlock) Recipients() ([]string, error) {
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]string, len(rl.recipients))
+	for i, r := range rl.recipients {
+		labels[i] = r.label
+	}
+	return labels, nil
+}
+
+// AddRecipient adds a recipient that unlocks the lock with newPassphrase and newKeyfile. The lock
+// must be unlockable with passphrase of cl.Recipient.
+func (cl *Cypherlock) AddRecipient(passphrase []byte, now uint64, label string, newPassphrase, newKeyfile []byte) error {
+	cl.init()
+	if _, err := cl.loadLockKey(passphrase, now); err != nil {
+		return err
+	}
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return err
+	}
+	if rl.find(label) >= 0 {
+		return ErrRecipientExists
+	}
+	r, err := cl.sealLockKey(label, newPassphrase, newKeyfile)
+	if err != nil {
+		return err
+	}
+	rl.recipients = append(rl.recipients, *r)
+	return cl.Storage.Replace(map[string][]byte{recipientsFile: rl.bytes()})
+}
+
+// RemoveRecipient removes a recipient from the lock and rotates the lock key, so that the removed
+// recipient cannot open the current lock files or those written later. The lock must be
+// unlockable with passphrase of cl.Recipient. Access is not revoked for copies of the lock files
+// the removed recipient kept, nor for the secret they already unlocked.
+func (cl *Cypherlock) RemoveRecipient(passphrase []byte, now uint64, label string) error {
+	cl.init()
+	if _, err := cl.loadLockKey(passphrase, now); err != nil {
+		return err
+	}
+	rl, err := cl.loadRecipients()
+	if err != nil {
+		return err
+	}
+	i := rl.find(label)
+	if i < 0 {
+		return ErrRecipientUnknown
+	}
+	if len(rl.recipients) == 1 {
+		return ErrLastRecipient
+	}
+	rl.recipients = append(rl.recipients[:i], rl.recipients[i+1:]...)
+	return cl.rotateLockKey(rl)
+}
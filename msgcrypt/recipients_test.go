@@ -0,0 +1,158 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecipientList(t *testing.T) {
+	rl := &recipientList{
+		lockPublicKey: [32]byte{0x01, 0x02},
+		recipients: []recipient{
+			{label: "alice", publicKey: make([]byte, 32), privateKey: []byte("alice private"), lockKey: []byte("alice key")},
+			{label: "bob", publicKey: make([]byte, 32), privateKey: []byte("bob private"), lockKey: []byte("bob key")},
+		},
+	}
+	d := rl.bytes()
+	rl2, err := new(recipientList).parse(d)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if rl2.lockPublicKey != rl.lockPublicKey || len(rl2.recipients) != 2 {
+		t.Fatal("Recipient list not restored")
+	}
+	for i, r := range rl.recipients {
+		r2 := rl2.recipients[i]
+		if r2.label != r.label || !bytes.Equal(r2.publicKey, r.publicKey) || !bytes.Equal(r2.privateKey, r.privateKey) || !bytes.Equal(r2.lockKey, r.lockKey) {
+			t.Errorf("Recipient %d not restored", i)
+		}
+	}
+	if rl2.find("bob") != 1 || rl2.find("carol") != -1 {
+		t.Error("find")
+	}
+	if _, err := new(recipientList).parse(d[:len(d)-1]); err == nil {
+		t.Error("parse must fail on truncated list")
+	}
+}
+
+func TestCypherlockRecipients(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Recipient:    "alice",
+	}
+	alice, bob, secret := []byte("alice passphrase"), []byte("bob passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(alice, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if err := cl.AddRecipient(bob, now, "bob", bob, nil); err == nil {
+		t.Error("AddRecipient must fail with wrong passphrase")
+	}
+	if err := cl.AddRecipient(alice, now, "alice", bob, nil); err != ErrRecipientExists {
+		t.Errorf("AddRecipient with existing label: %v", err)
+	}
+	if err := cl.AddRecipient(alice, now, "bob", bob, nil); err != nil {
+		t.Fatalf("AddRecipient: %s", err)
+	}
+	if labels, err := cl.Recipients(); err != nil || len(labels) != 2 || labels[0] != "alice" || labels[1] != "bob" {
+		t.Errorf("Recipients: %v %v", labels, err)
+	}
+	clBob := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Recipient:    "bob",
+	}
+	if secret2, err := clBob.LoadLock(bob, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock by added recipient: %v", err)
+	}
+	if _, _, err := clBob.ExtendLock(bob, now, now+1800, now+3600); err != nil {
+		t.Fatalf("ExtendLock by added recipient: %s", err)
+	}
+	if err := clBob.RemoveRecipient(bob, now, "carol"); err != ErrRecipientUnknown {
+		t.Errorf("RemoveRecipient of unknown recipient: %v", err)
+	}
+	aliceKey := cl.lockPrivateKey
+	names, err := storage.ListLocks()
+	if err != nil || len(names) == 0 {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if err := clBob.RemoveRecipient(bob, now, "alice"); err != nil {
+		t.Fatalf("RemoveRecipient: %s", err)
+	}
+	for _, name := range names {
+		d, _ := storage.GetData(name)
+		if _, err := (&KeyProtector{PrivateKey: aliceKey}).Open(d); err == nil {
+			t.Errorf("Lock file %s not resealed", name)
+		}
+	}
+	if _, err := cl.LoadLock(alice, now); err != ErrRecipientUnknown {
+		t.Errorf("LoadLock by removed recipient: %v", err)
+	}
+	if err := clBob.RemoveRecipient(bob, now, "bob"); err != ErrLastRecipient {
+		t.Errorf("RemoveRecipient of last recipient: %v", err)
+	}
+	if secret2, err := clBob.LoadLock(bob, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock after removal: %v", err)
+	}
+	if _, _, err := clBob.ExtendLock(bob, now, now+3600, now+5400); err != nil {
+		t.Fatalf("ExtendLock after removal: %s", err)
+	}
+	if d, err := storage.GetLock(now + 3700); err != nil {
+		t.Errorf("GetLock: %s", err)
+	} else if _, err := (&KeyProtector{PrivateKey: aliceKey}).Open(d); err == nil {
+		t.Error("Extended lock sealed to removed lock key")
+	}
+}
+
+func TestCypherlockRecipientsThreshold(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+		Recipient: "alice",
+	}
+	for _, url := range []string{"a", "b"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	alice, bob, secret := []byte("alice passphrase"), []byte("bob passphrase"), []byte("secret")
+	now := testNow()
+	if _, _, err := cl.CreateLock(alice, secret, now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if err := cl.AddRecipient(alice, now, "bob", bob, nil); err != nil {
+		t.Fatalf("AddRecipient: %s", err)
+	}
+	aliceKey := cl.lockPrivateKey
+	clBob := *cl
+	clBob.Recipient = "bob"
+	if err := clBob.RemoveRecipient(bob, now, "alice"); err != nil {
+		t.Fatalf("RemoveRecipient: %s", err)
+	}
+	for i := range cl.Servers {
+		d, err := cl.forServer(i).Storage.GetLock(now)
+		if err != nil {
+			t.Fatalf("GetLock: %s", err)
+		}
+		if _, err := (&KeyProtector{PrivateKey: aliceKey}).Open(d); err == nil {
+			t.Errorf("Lock file of server %d not resealed", i)
+		}
+	}
+	if secret2, err := clBob.LoadLock(bob, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock after removal: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
+)
+
+var (
+	// ErrReleaseFormat is returned if a ReleaseMessage cannot be parsed.
+	ErrReleaseFormat = errors.New("msgcrypt: invalid release message")
+	// ErrReleasedKeyMismatch is returned if a released key does not belong to the release message.
+	ErrReleasedKeyMismatch = errors.New("msgcrypt: released key does not match release message")
+	// ErrReleasedKeyUntrusted is returned if the signature of a released key could not be verified.
+	ErrReleasedKeyUntrusted = errors.New("msgcrypt: released key is untrusted")
+	// ErrKeylistType is returned if a keylist of the wrong type was received.
+	ErrKeylistType = errors.New("msgcrypt: wrong keylist type")
+	// ErrReleaseTime is returned if no release key exists for the requested release time.
+	ErrReleaseTime = errors.New("msgcrypt: no release key for release time")
+	// ErrNoSignatureKey is returned if no signature key is available to sign or verify a server message.
+	ErrNoSignatureKey = errors.New("msgcrypt: signature key missing")
+)
+
+// ReleaseMessage contains a secret that can only be decrypted with the private key of a
+// timed-release period. The server releases that key once the period has started.
+type ReleaseMessage struct {
+	Counter          uint64   // Period of the release key.
+	ValidFrom        uint64   // Start of the period, the time at which the message can be decrypted.
+	ReleasePublicKey [32]byte // Public key of the period.
+	SendKey          [32]byte // Ephemeral public key of the sender.
+	DHNonce          [32]byte // Nonce for the key derivation.
+	Payload          []byte   // Encrypted payload.
+}
+
+// Release message format:
+//
+// Header | Counter (uint64) | ValidFrom (uint64) | ReleasePublicKey | SendKey | DHNonce | SymEncrypt(payload)
+
+const releaseMessageParamsSize = 8 + 8 + 32 + 32 + 32
+
+// NewReleaseMessage encrypts payload to the release key of a period.
+func NewReleaseMessage(releaseKey *types.PregenerateEntry, payload []byte, rand io.Reader) (*ReleaseMessage, error) {
+	secret, sendKey, nonce, err := ToPublicKey(rand, &releaseKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := SymEncrypt(secret, payload, rand)
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseMessage{
+		Counter:          releaseKey.Counter,
+		ValidFrom:        releaseKey.ValidFrom,
+		ReleasePublicKey: releaseKey.PublicKey,
+		SendKey:          *sendKey,
+		DHNonce:          *nonce,
+		Payload:          ct,
+	}, nil
+}
+
+// Bytes returns the marshalled ReleaseMessage.
+func (rm *ReleaseMessage) Bytes() []byte {
+	out := newHeader(TypeRelease, releaseMessageParamsSize+len(rm.Payload))
+	n := make([]byte, 16)
+	binary.BigEndian.PutUint64(n[0:8], rm.Counter)
+	binary.BigEndian.PutUint64(n[8:16], rm.ValidFrom)
+	out = append(out, n...)
+	out = append(out, rm.ReleasePublicKey[:]...)
+	out = append(out, rm.SendKey[:]...)
+	out = append(out, rm.DHNonce[:]...)
+	return append(out, rm.Payload...)
+}
+
+// Parse a marshalled ReleaseMessage.
+func (rm *ReleaseMessage) Parse(d []byte) (*ReleaseMessage, error) {
+	version, body, err := splitHeader(d, TypeRelease)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || len(body) < releaseMessageParamsSize {
+		return nil, ErrReleaseFormat
+	}
+	nrm := &ReleaseMessage{
+		Counter:   binary.BigEndian.Uint64(body[0:8]),
+		ValidFrom: binary.BigEndian.Uint64(body[8:16]),
+		Payload:   make([]byte, len(body)-releaseMessageParamsSize),
+	}
+	copy(nrm.ReleasePublicKey[:], body[16:48])
+	copy(nrm.SendKey[:], body[48:80])
+	copy(nrm.DHNonce[:], body[80:112])
+	copy(nrm.Payload, body[releaseMessageParamsSize:])
+	return nrm, nil
+}
+
+// Decrypt the payload with a released key. The signature of the key must have been verified.
+func (rm *ReleaseMessage) Decrypt(rk *types.ReleasedKey) ([]byte, error) {
+	if rk.Counter != rm.Counter || *rk.PublicKey() != rm.ReleasePublicKey {
+		return nil, ErrReleasedKeyMismatch
+	}
+	secret := DecryptKey(&rm.SendKey, &rm.DHNonce, &rk.PrivateKey)
+	return SymDecrypt(secret, rm.Payload)
+}
+
+// Files of a release lock in the release storage.
+const releaseLockName = "release"
+
+func (cl *Cypherlock) releaseStorage() clientinterface.Storage {
+	return cl.Storage.Sub(releaseLockName)
+}
+
+// checkReleaseKeylist verifies the signature, structure and freshness of a release keylist.
+func (cl *Cypherlock) checkReleaseKeylist(keys *types.RatchetList) error {
+	if !keys.IsReleaseList() {
+		return ErrKeylistType
+	}
+	if !keys.Verify(cl.SignatureKey) {
+		return ErrKeylistUntrusted
+	}
+	if err := keys.Validate(); err != nil {
+		return err
+	}
+	now := uint64(timesource.Clock.Now().Unix())
+	return keys.CheckFreshness(now, cl.MaxKeylistAge)
+}
+
+// CreateReleaseLock creates a lock that can only be opened after releaseAt. The secret is
+// encrypted to the first release key whose period starts at or after releaseAt, which is returned.
+func (cl *Cypherlock) CreateReleaseLock(secret []byte, releaseAt uint64) (finalReleaseAt uint64, err error) {
+	cl.init()
+	if cl.isThreshold() {
+		return 0, ErrThresholdInvalid
+	}
+	keys, err := cl.ClientRPC.GetReleaseKeys(cl.ServerURL)
+	if err != nil {
+		return 0, err
+	}
+	if err := cl.checkReleaseKeylist(keys); err != nil {
+		return 0, err
+	}
+	var releaseKey *types.PregenerateEntry
+	for i := range keys.PublicKeys {
+		if keys.PublicKeys[i].ValidFrom >= releaseAt {
+			releaseKey = &keys.PublicKeys[i]
+			break
+		}
+	}
+	if releaseKey == nil {
+		return 0, ErrReleaseTime
+	}
+	secretKey, encrypted, err := EncryptRealSecret(secret, cl.randomSource)
+	if err != nil {
+		return 0, err
+	}
+	rm, err := NewReleaseMessage(releaseKey, secretKey[:], cl.randomSource)
+	if err != nil {
+		return 0, err
+	}
+	storage := cl.releaseStorage()
+	if err := storage.StoreSecret(encrypted); err != nil {
+		return 0, err
+	}
+	if err := storage.StoreData(releaseLockName, rm.Bytes()); err != nil {
+		return 0, err
+	}
+	return releaseKey.ValidFrom, nil
+}
+
+func (cl *Cypherlock) loadReleaseMessage() (*ReleaseMessage, error) {
+	d, err := cl.releaseStorage().GetData(releaseLockName)
+	if err != nil {
+		return nil, err
+	}
+	return new(ReleaseMessage).Parse(d)
+}
+
+// ReleaseTime returns the time after which the release lock can be opened.
+func (cl *Cypherlock) ReleaseTime() (uint64, error) {
+	rm, err := cl.loadReleaseMessage()
+	if err != nil {
+		return 0, err
+	}
+	return rm.ValidFrom, nil
+}
+
+// FetchReleasedKey requests the released key of the release lock from the server. The key can be
+// stored to open the lock offline with OpenReleaseLockWithKey.
+func (cl *Cypherlock) FetchReleasedKey() (*types.ReleasedKey, error) {
+	if cl.SignatureKey == nil {
+		return nil, ErrNoSignatureKey
+	}
+	rm, err := cl.loadReleaseMessage()
+	if err != nil {
+		return nil, err
+	}
+	rk, err := cl.ClientRPC.GetReleasedKey(cl.ServerURL, rm.Counter)
+	if err != nil {
+		return nil, err
+	}
+	if !rk.Verify(cl.SignatureKey) {
+		return nil, ErrReleasedKeyUntrusted
+	}
+	if rk.Counter != rm.Counter || *rk.PublicKey() != rm.ReleasePublicKey {
+		return nil, ErrReleasedKeyMismatch
+	}
+	return rk, nil
+}
+
+// OpenReleaseLock returns the secret of the release lock, fetching the released key from the server.
+func (cl *Cypherlock) OpenReleaseLock() (realSecret []byte, err error) {
+	rk, err := cl.FetchReleasedKey()
+	if err != nil {
+		return nil, err
+	}
+	return cl.OpenReleaseLockWithKey(rk)
+}
+
+// OpenReleaseLockWithKey returns the secret of the release lock. It does not contact the server.
+func (cl *Cypherlock) OpenReleaseLockWithKey(rk *types.ReleasedKey) (realSecret []byte, err error) {
+	if cl.SignatureKey == nil {
+		return nil, ErrNoSignatureKey
+	}
+	if !rk.Verify(cl.SignatureKey) {
+		return nil, ErrReleasedKeyUntrusted
+	}
+	rm, err := cl.loadReleaseMessage()
+	if err != nil {
+		return nil, err
+	}
+	secretKeyD, err := rm.Decrypt(rk)
+	if err != nil {
+		return nil, err
+	}
+	if len(secretKeyD) != 32 {
+		return nil, ErrReleaseFormat
+	}
+	secretKey := new([32]byte)
+	copy(secretKey[:], secretKeyD)
+	encrypted, err := cl.releaseStorage().GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	return DecryptRealSecret(secretKey, encrypted)
+}
@@ -0,0 +1,141 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/cypherlock/ratchet"
+	"github.com/JonathanLogan/cypherlock/types"
+	"github.com/JonathanLogan/timesource"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestReleaseMessage(t *testing.T) {
+	pub, priv := genTestKeys()
+	entry := types.NewPregenerateEntry(nil, 3, 7200, 10800, *pub)
+	payload := []byte("payload")
+	rm, err := NewReleaseMessage(entry, payload, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewReleaseMessage: %s", err)
+	}
+	rm2, err := new(ReleaseMessage).Parse(rm.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if rm2.Counter != 3 || rm2.ValidFrom != 7200 {
+		t.Error("Parse: wrong period")
+	}
+	rk := &types.ReleasedKey{Counter: 3, ValidFrom: 7200, PrivateKey: *priv}
+	dec, err := rm2.Decrypt(rk)
+	if err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if !bytes.Equal(dec, payload) {
+		t.Error("Payload does not match")
+	}
+	rk.Counter = 4
+	if _, err := rm2.Decrypt(rk); err != ErrReleasedKeyMismatch {
+		t.Errorf("Decrypt with wrong counter: %v", err)
+	}
+	if _, err := new(ReleaseMessage).Parse(rm.Bytes()[:50]); err != ErrReleaseFormat {
+		t.Errorf("Parse short message: %v", err)
+	}
+}
+
+// newReleaseTestServer returns a testServer that only serves timed-release keys.
+func newReleaseTestServer(t *testing.T) *testServer {
+	ts := new(testServer)
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	copy(ts.sigPublicKey[:], pubkey)
+	copy(ts.sigPrivateKey[:], privkey)
+	ts.release, err = ratchet.NewReleaseFountain(3600, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewReleaseFountain: %s", err)
+	}
+	list := ts.release.Generate(24 * 3600)
+	list.EnvelopeKey = types.ReleaseEnvelopeKey
+	list.SignatureKey = ts.sigPublicKey
+	list.Sign(&ts.sigPrivateKey)
+	ts.releaseList = list.Bytes()
+	return ts
+}
+
+func TestCypherlockRelease(t *testing.T) {
+	clock := timesource.Clock
+	defer func() { timesource.Clock = clock }()
+	nc := timesource.NewMockClock(time.Now())
+	timesource.Clock = nc
+
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newReleaseTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+	}
+	secret := []byte("secret")
+	now := testNow()
+	releaseAt, err := cl.CreateReleaseLock(secret, now+1800)
+	if err != nil {
+		t.Fatalf("CreateReleaseLock: %s", err)
+	}
+	if releaseAt < now+1800 {
+		t.Error("Release time before requested time")
+	}
+	if rt, err := cl.ReleaseTime(); err != nil || rt != releaseAt {
+		t.Errorf("ReleaseTime: %d %v", rt, err)
+	}
+	if _, err := cl.OpenReleaseLock(); err != ratchet.ErrNotReleased {
+		t.Errorf("OpenReleaseLock before release: %v", err)
+	}
+	if _, err := cl.CreateReleaseLock(secret, now+48*3600); err != ErrReleaseTime {
+		t.Errorf("CreateReleaseLock beyond horizon: %v", err)
+	}
+	nc.Advance(time.Second * time.Duration(releaseAt-now))
+	rk, err := cl.FetchReleasedKey()
+	if err != nil {
+		t.Fatalf("FetchReleasedKey: %s", err)
+	}
+	rk, err = new(types.ReleasedKey).Parse(rk.Bytes())
+	if err != nil {
+		t.Fatalf("Parse released key: %s", err)
+	}
+	rpc.down["server"] = true
+	secret2, err := cl.OpenReleaseLockWithKey(rk)
+	if err != nil {
+		t.Fatalf("OpenReleaseLockWithKey: %s", err)
+	}
+	if !bytes.Equal(secret, secret2) {
+		t.Error("Secrets don't match")
+	}
+	noKey := *cl
+	noKey.SignatureKey = nil
+	if _, err := noKey.OpenReleaseLockWithKey(rk); err != ErrNoSignatureKey {
+		t.Errorf("OpenReleaseLockWithKey without signature key: %v", err)
+	}
+	rpc.down["server"] = false
+	if _, err := noKey.FetchReleasedKey(); err != ErrNoSignatureKey {
+		t.Errorf("FetchReleasedKey without signature key: %v", err)
+	}
+	forged := *rk
+	curve25519.ScalarBaseMult(&forged.PrivateKey, &forged.PrivateKey)
+	if _, err := cl.OpenReleaseLockWithKey(&forged); err != ErrReleasedKeyUntrusted {
+		t.Errorf("OpenReleaseLockWithKey forged key: %v", err)
+	}
+	// Release lists must not be used for normal locks.
+	rpc.down["server"] = false
+	ts.keylist = ts.releaseList
+	if _, _, err := cl.CreateLock([]byte("passphrase"), secret, now, now+1800); err != ErrKeylistType {
+		t.Errorf("CreateLock with release list: %v", err)
+	}
+}
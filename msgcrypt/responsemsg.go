@@ -1,11 +1,20 @@
 package msgcrypt
 
 import (
+	"crypto/sha256"
+	"errors"
 	"io"
 
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+var (
+	// ErrResponseUntrusted is returned if a response is unsigned, not signed by the pinned signature key of
+	// the server, or does not answer the request.
+	ErrResponseUntrusted = errors.New("msgcrypt: response is untrusted")
+)
+
 // ResponseMessage is a message containing a decrypted payload.
 type ResponseMessage struct {
 	ReceiverPublicKey  [32]byte // RatchetMessage.ReceiverPublicKey
@@ -14,7 +23,10 @@ type ResponseMessage struct {
 	DHNonce            [32]byte
 	SymNonce           [24]byte
 	Payload            []byte
+	RequestHash        [32]byte                    // SHA-256 of the request answered by the response.
+	Signature          [ed25519.SignatureSize]byte // Signature by the server's signature key, see Sign.
 	encPayload         []byte
+	version            byte
 }
 
 // NewResponseMessage creates a new NewResponseMessage.
@@ -26,7 +38,18 @@ func NewResponseMessage(senderPubKey, receiverPubKey *[32]byte, payload []byte)
 	}
 }
 
+// Response message format:
+//
+// Header | ReceiverPublicKey | EphemeralPublicKey | SenderPublicKey | DHNonce | SymNonce | secretbox(Cleartext)
+//
+// Cleartext: [RequestHash | Signature] | Payload
+//
+// From version 2 the cleartext is padded. From version 3 it contains RequestHash and Signature.
+
 const (
+	signedResponseVersion = 3
+	responseSignedSize    = 32 + ed25519.SignatureSize
+
 	responseMessageBaseSize      = 32 + 32 + 32 + 32 + 24
 	responseMessageNoPayloadSize = responseMessageBaseSize + secretbox.Overhead
 )
@@ -56,15 +79,31 @@ func (rmsg *ResponseMessage) Encrypt(serverPrivateKey *[32]byte, rand io.Reader)
 	}
 	rmsg.EphemeralPublicKey = *ephemeralKey
 	rmsg.DHNonce = *nonce
-	return secretbox.Seal(rmsg.template(), rmsg.Payload, &rmsg.SymNonce, secret), nil
+	out := newHeader(TypeResponse, responseMessageNoPayloadSize+padSize(responseSignedSize+len(rmsg.Payload), responsePadSize))
+	pl := rmsg.Payload
+	if out[3] >= signedResponseVersion {
+		pl = make([]byte, 0, responseSignedSize+len(rmsg.Payload))
+		pl = append(pl, rmsg.RequestHash[:]...)
+		pl = append(pl, rmsg.Signature[:]...)
+		pl = append(pl, rmsg.Payload...)
+	}
+	if out[3] >= paddedVersion {
+		pl = pad(pl, responsePadSize)
+	}
+	out = append(out, rmsg.template()...)
+	return secretbox.Seal(out, pl, &rmsg.SymNonce, secret), nil
 }
 
 // Parse a binary ResponseMessage.
 func (rmsg *ResponseMessage) Parse(d []byte) (*ResponseMessage, error) {
+	version, d, err := splitHeader(d, TypeResponse)
+	if err != nil {
+		return nil, err
+	}
 	if len(d) < responseMessageNoPayloadSize+1 {
 		return nil, ErrMessageIncomplete
 	}
-	nrmsg := new(ResponseMessage)
+	nrmsg := &ResponseMessage{version: version}
 	copy(nrmsg.ReceiverPublicKey[:], d[0:32])
 	copy(nrmsg.EphemeralPublicKey[:], d[32:64])
 	copy(nrmsg.SenderPublicKey[:], d[64:96])
@@ -83,6 +122,49 @@ func (rmsg *ResponseMessage) Decrypt(receiverPrivateKey *[32]byte) error {
 	if !ok {
 		return ErrCannotDecrypt
 	}
+	if rmsg.version >= paddedVersion {
+		var err error
+		if rmsg.Payload, err = unpad(rmsg.Payload); err != nil {
+			return err
+		}
+	}
+	if rmsg.version >= signedResponseVersion {
+		if len(rmsg.Payload) < responseSignedSize {
+			return ErrMessageIncomplete
+		}
+		copy(rmsg.RequestHash[:], rmsg.Payload[0:32])
+		copy(rmsg.Signature[:], rmsg.Payload[32:responseSignedSize])
+		rmsg.Payload = rmsg.Payload[responseSignedSize:]
+	}
 	rmsg.encPayload = nil
 	return nil
 }
+
+var responseContext = []byte("cypherlock response")
+
+func (rmsg *ResponseMessage) signedData() []byte {
+	d := make([]byte, 0, len(responseContext)+32+32+32+len(rmsg.Payload))
+	d = append(d, responseContext...)
+	d = append(d, rmsg.RequestHash[:]...)
+	d = append(d, rmsg.ReceiverPublicKey[:]...)
+	d = append(d, rmsg.SenderPublicKey[:]...)
+	return append(d, rmsg.Payload...)
+}
+
+// Sign binds the ResponseMessage to request and signs it with the server's signature key.
+func (rmsg *ResponseMessage) Sign(signatureKey *[ed25519.PrivateKeySize]byte, request []byte) {
+	rmsg.RequestHash = sha256.Sum256(request)
+	copy(rmsg.Signature[:], ed25519.Sign(signatureKey[:], rmsg.signedData()))
+}
+
+// Verify returns true if the decrypted ResponseMessage answers request and was signed by signatureKey.
+// Responses before version 3 are unsigned.
+func (rmsg *ResponseMessage) Verify(signatureKey *[ed25519.PublicKeySize]byte, request []byte) bool {
+	if rmsg.version < signedResponseVersion {
+		return false
+	}
+	if rmsg.RequestHash != sha256.Sum256(request) {
+		return false
+	}
+	return ed25519.Verify(signatureKey[:], rmsg.signedData(), rmsg.Signature[:])
+}
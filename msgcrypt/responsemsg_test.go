@@ -27,3 +27,33 @@ func TestResponseMsg(t *testing.T) {
 		t.Error("Cleartext does not match.")
 	}
 }
+
+func TestResponseMsgSignature(t *testing.T) {
+	pubkey, privkey := genTestKeys()
+	pubkeyServ, privkeyServ := genTestKeys()
+	sigPubkey, sigPrivkey := genTestSigKeys()
+	request := []byte("request")
+	msg := NewResponseMessage(pubkeyServ, pubkey, []byte("test payload"))
+	msg.Sign(sigPrivkey, request)
+	encrypted, err := msg.Encrypt(privkeyServ, rand.Reader)
+	if err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	msg2, err := new(ResponseMessage).Parse(encrypted)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if err := msg2.Decrypt(privkey); err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if !msg2.Verify(sigPubkey, request) {
+		t.Error("Verify failed")
+	}
+	if msg2.Verify(sigPubkey, []byte("other request")) {
+		t.Error("Verify must fail for other request")
+	}
+	msg2.Payload[0] ^= 0x01
+	if msg2.Verify(sigPubkey, request) {
+		t.Error("Verify must fail for modified payload")
+	}
+}
@@ -0,0 +1,322 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrScheduleFormat is returned if a schedule cannot be parsed.
+	ErrScheduleFormat = errors.New("msgcrypt: invalid schedule")
+	// ErrScheduleEmpty is returned if a schedule has no occurrence within the requested time range.
+	ErrScheduleEmpty = errors.New("msgcrypt: no scheduled occurrence in time range")
+	// ErrNoSchedule is returned if a lock was not created with a schedule.
+	ErrNoSchedule = errors.New("msgcrypt: lock has no schedule")
+)
+
+// Schedule is a set of recurring daily time windows in a time zone. New locks written with a
+// Schedule can only be unlocked within the windows.
+type Schedule struct {
+	Location *time.Location // Time zone of the windows.
+	Rules    []ScheduleRule // Windows of the schedule.
+}
+
+// ScheduleRule is a daily time window on some weekdays.
+type ScheduleRule struct {
+	Weekdays uint8  // Bit (1 << time.Weekday) set for each weekday on which the window starts.
+	Start    uint32 // Start of the window in seconds after midnight.
+	End      uint32 // End of the window in seconds after midnight. If not after Start, the window ends on the next day.
+}
+
+// Window is one occurrence of a Schedule.
+type Window struct {
+	ValidFrom, ValidTo uint64
+}
+
+// Schedule text format:
+//
+// Zone Rule [; Rule ...]
+//
+// Zone is an IANA time zone name like "Europe/Berlin" or "UTC". A Rule is Days HH:MM-HH:MM,
+// where Days is "*" or a comma separated list of weekdays (Mon, Tue, ...) and weekday ranges
+// (Mon-Fri). Example: "Europe/Berlin Mon-Fri 09:00-17:00; Sat 10:00-12:00".
+
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+const allWeekdays = 0x7f
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for i, name := range weekdayNames {
+		if strings.EqualFold(s, name) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, ErrScheduleFormat
+}
+
+func parseWeekdays(s string) (uint8, error) {
+	if s == "*" {
+		return allWeekdays, nil
+	}
+	var weekdays uint8
+	for _, e := range strings.Split(s, ",") {
+		days := strings.SplitN(e, "-", 2)
+		first, err := parseWeekday(days[0])
+		if err != nil {
+			return 0, err
+		}
+		last := first
+		if len(days) == 2 {
+			if last, err = parseWeekday(days[1]); err != nil {
+				return 0, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			weekdays |= 1 << uint(d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return weekdays, nil
+}
+
+func parseTimeOfDay(s string) (uint32, error) {
+	f := strings.SplitN(s, ":", 2)
+	if len(f) != 2 {
+		return 0, ErrScheduleFormat
+	}
+	h, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil || h > 24 {
+		return 0, ErrScheduleFormat
+	}
+	m, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil || m > 59 || (h == 24 && m > 0) {
+		return 0, ErrScheduleFormat
+	}
+	return uint32(h*3600 + m*60), nil
+}
+
+// ParseSchedule parses a schedule in text format.
+func ParseSchedule(s string) (*Schedule, error) {
+	f := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(f) != 2 {
+		return nil, ErrScheduleFormat
+	}
+	location, err := time.LoadLocation(f[0])
+	if err != nil {
+		return nil, ErrScheduleFormat
+	}
+	schedule := &Schedule{Location: location}
+	for _, r := range strings.Split(f[1], ";") {
+		fields := strings.Fields(r)
+		if len(fields) != 2 {
+			return nil, ErrScheduleFormat
+		}
+		weekdays, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		times := strings.SplitN(fields[1], "-", 2)
+		if len(times) != 2 {
+			return nil, ErrScheduleFormat
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		schedule.Rules = append(schedule.Rules, ScheduleRule{Weekdays: weekdays, Start: start, End: end})
+	}
+	return schedule, nil
+}
+
+// String returns the schedule in text format.
+func (s *Schedule) String() string {
+	rules := make([]string, len(s.Rules))
+	for i, r := range s.Rules {
+		var days []string
+		for d, name := range weekdayNames {
+			if r.Weekdays&(1<<uint(d)) != 0 {
+				days = append(days, name)
+			}
+		}
+		if r.Weekdays&allWeekdays == allWeekdays {
+			days = []string{"*"}
+		}
+		rules[i] = fmt.Sprintf("%s %02d:%02d-%02d:%02d", strings.Join(days, ","), r.Start/3600, r.Start%3600/60, r.End/3600, r.End%3600/60)
+	}
+	return s.Location.String() + " " + strings.Join(rules, "; ")
+}
+
+// atTime returns the time seconds after midnight on the day of t.
+func atTime(t time.Time, seconds uint32) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), int(seconds/3600), int(seconds%3600/60), int(seconds%60), 0, t.Location())
+}
+
+// Windows returns the occurrences of the schedule between validFrom and validTo, cut to that range.
+// Overlapping occurrences are merged.
+func (s *Schedule) Windows(validFrom, validTo uint64) []Window {
+	var windows []Window
+	first := time.Unix(int64(validFrom), 0).In(s.Location).AddDate(0, 0, -1)
+	last := time.Unix(int64(validTo), 0).In(s.Location)
+	for day := atTime(first, 0); !day.After(last); day = day.AddDate(0, 0, 1) {
+		for _, r := range s.Rules {
+			if r.Weekdays&(1<<uint(day.Weekday())) == 0 {
+				continue
+			}
+			end := atTime(day, r.End)
+			if r.End <= r.Start {
+				end = atTime(day.AddDate(0, 0, 1), r.End)
+			}
+			w := Window{ValidFrom: uint64(atTime(day, r.Start).Unix()), ValidTo: uint64(end.Unix())}
+			if w.ValidTo <= validFrom || w.ValidFrom >= validTo {
+				continue
+			}
+			if w.ValidFrom < validFrom {
+				w.ValidFrom = validFrom
+			}
+			if w.ValidTo > validTo {
+				w.ValidTo = validTo
+			}
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].ValidFrom < windows[j].ValidFrom })
+	var merged []Window
+	for _, w := range windows {
+		if n := len(merged); n > 0 && w.ValidFrom <= merged[n-1].ValidTo {
+			if w.ValidTo > merged[n-1].ValidTo {
+				merged[n-1].ValidTo = w.ValidTo
+			}
+			continue
+		}
+		merged = append(merged, w)
+	}
+	return merged
+}
+
+// Schedule file in the storage of a lock:
+//
+// ScheduledTo (uint64) | Schedule in text format
+
+const scheduleFile = "schedule"
+
+// storeSchedule records the schedule of the lock and the end of its last written occurrence.
+func (cl *Cypherlock) storeSchedule(scheduledTo uint64) error {
+	if _, prev, err := cl.loadSchedule(); err == nil && prev > scheduledTo {
+		scheduledTo = prev
+	}
+	d := make([]byte, 8)
+	binary.BigEndian.PutUint64(d, scheduledTo)
+	return cl.Storage.StoreData(scheduleFile, append(d, []byte(cl.Schedule.String())...))
+}
+
+// loadSchedule returns the schedule of the lock and the end of its last written occurrence.
+func (cl *Cypherlock) loadSchedule() (*Schedule, uint64, error) {
+	d, err := cl.Storage.GetData(scheduleFile)
+	if err != nil {
+		return nil, 0, ErrNoSchedule
+	}
+	if len(d) < 8 {
+		return nil, 0, ErrScheduleFormat
+	}
+	schedule, err := ParseSchedule(string(d[8:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	return schedule, binary.BigEndian.Uint64(d[0:8]), nil
+}
+
+// writeScheduleLock writes oracle messages for each occurrence of the schedule between validFrom
+// and validTo. Writing stops at the first occurrence that cannot be written, usually because it
+// lies beyond the keylists of the servers. It returns the time range of the written occurrences.
+func (cl *Cypherlock) writeScheduleLock(passphrase []byte, secretKey *[32]byte, policy *Policy, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
+	windows := cl.Schedule.Windows(validFrom, validTo)
+	if len(windows) == 0 {
+		return 0, 0, ErrScheduleEmpty
+	}
+	if !cl.isThreshold() {
+		return cl.writeOccurrences(passphrase, secretKey, policy, windows)
+	}
+	// The occurrences of threshold locks are written together with the schedule.
+	n := *cl
+	staged := newStagedStorage(cl.Storage)
+	n.Storage = staged
+	if finalValidFrom, finalValidTo, err = n.writeOccurrences(passphrase, secretKey, policy, windows); err != nil {
+		return 0, 0, err
+	}
+	return finalValidFrom, finalValidTo, staged.commit()
+}
+
+// writeOccurrences writes oracle messages for windows, as writeScheduleLock.
+func (cl *Cypherlock) writeOccurrences(passphrase []byte, secretKey *[32]byte, policy *Policy, windows []Window) (finalValidFrom, finalValidTo uint64, err error) {
+	duressKey := cl.duressPublicKey(secretKey)
+	for i, w := range windows {
+		from, to, err := cl.writeLock(passphrase, secretKey, duressKey, policy, w.ValidFrom, w.ValidTo)
+		if err != nil {
+			if i == 0 {
+				return 0, 0, err
+			}
+			break
+		}
+		if i == 0 {
+			finalValidFrom = from
+		}
+		finalValidTo = to
+		if to < w.ValidTo {
+			break // Keylist ends within the occurrence.
+		}
+	}
+	return finalValidFrom, finalValidTo, cl.storeSchedule(finalValidTo)
+}
+
+// ScheduledUntil returns the end of the last occurrence written for a schedule lock.
+func (cl *Cypherlock) ScheduledUntil() (uint64, error) {
+	_, scheduledTo, err := cl.loadSchedule()
+	return scheduledTo, err
+}
+
+// ExtendSchedule writes the occurrences of the lock's schedule from the last written occurrence up
+// to horizon seconds after now, as far as the keylists of the servers reach. Like ExtendLock it
+// must unlock the lock, so it only succeeds during an occurrence. Agents can call it at every
+// occurrence to keep the lock topped up as new keylists appear. It returns the end of the last
+// written occurrence.
+func (cl *Cypherlock) ExtendSchedule(passphrase []byte, now, horizon uint64) (scheduledTo uint64, err error) {
+	schedule, scheduledTo, err := cl.loadSchedule()
+	if err != nil {
+		return 0, err
+	}
+	secretKey, err := cl.loadLockKey(passphrase, now)
+	if err != nil {
+		return 0, err
+	}
+	from := now
+	if scheduledTo > from {
+		from = scheduledTo
+	}
+	if from >= now+horizon {
+		return scheduledTo, nil
+	}
+	cl.Schedule = schedule
+	if cl.isThreshold() {
+		for i := range cl.Servers {
+			// Fetch new keylists, the stored ones end before the new occurrences. Errors show in WriteLock.
+			cl.forServer(i).getRatchetPublicKeysFromCypherlockd()
+		}
+	} else {
+		cl.getRatchetPublicKeysFromCypherlockd()
+	}
+	if _, _, err := cl.WriteLock(passphrase, secretKey, from, now+horizon); err != nil {
+		return scheduledTo, err
+	}
+	return cl.ScheduledUntil()
+}
@@ -0,0 +1,181 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/timesource"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("UTC Mon-Wed,Fri 09:00-17:30; * 22:00-02:00")
+	if err != nil {
+		t.Fatalf("ParseSchedule: %s", err)
+	}
+	if s.Rules[0].Weekdays != 1<<1|1<<2|1<<3|1<<5 || s.Rules[0].Start != 9*3600 || s.Rules[0].End != 17*3600+1800 {
+		t.Errorf("Rule not parsed: %v", s.Rules[0])
+	}
+	if str := s.String(); str != "UTC Mon,Tue,Wed,Fri 09:00-17:30; * 22:00-02:00" {
+		t.Errorf("String: %s", str)
+	}
+	if s2, err := ParseSchedule(s.String()); err != nil || s2.String() != s.String() {
+		t.Errorf("Schedule not reproduced: %v", err)
+	}
+	if s, err := ParseSchedule("UTC Fri-Mon 10:00-11:00"); err != nil || s.Rules[0].Weekdays != 1<<5|1<<6|1<<0|1<<1 {
+		t.Errorf("Wrapping weekday range: %v", err)
+	}
+	for _, invalid := range []string{"UTC", "Nowhere/Nothing * 09:00-10:00", "UTC Xyz 09:00-10:00", "UTC * 25:00-26:00", "UTC * 09:00", "UTC * 09:00-10:00;"} {
+		if _, err := ParseSchedule(invalid); err != ErrScheduleFormat {
+			t.Errorf("ParseSchedule(%q): %v", invalid, err)
+		}
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	s, err := ParseSchedule("UTC Mon-Fri 09:00-17:00; Sat 22:00-02:00")
+	if err != nil {
+		t.Fatalf("ParseSchedule: %s", err)
+	}
+	monday := uint64(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	windows := s.Windows(monday, monday+7*24*3600)
+	if len(windows) != 6 {
+		t.Fatalf("Windows: %d", len(windows))
+	}
+	for i, w := range windows[:5] {
+		if w.ValidFrom != monday+uint64(i)*24*3600+9*3600 || w.ValidTo-w.ValidFrom != 8*3600 {
+			t.Errorf("Window %d: %v", i, w)
+		}
+	}
+	if w := windows[5]; w.ValidFrom != monday+5*24*3600+22*3600 || w.ValidTo != monday+6*24*3600+2*3600 {
+		t.Errorf("Overnight window: %v", w)
+	}
+	if windows := s.Windows(monday+12*3600, monday+13*3600); len(windows) != 1 || windows[0].ValidFrom != monday+12*3600 || windows[0].ValidTo != monday+13*3600 {
+		t.Errorf("Windows must be cut to time range: %v", windows)
+	}
+	if windows := s.Windows(monday+6*24*3600+3*3600, monday+7*24*3600); len(windows) != 0 {
+		t.Errorf("Windows on Sunday: %v", windows)
+	}
+	if berlin, err := time.LoadLocation("Europe/Berlin"); err == nil {
+		// Daylight saving time starts on 2024-03-31 at 02:00.
+		s := &Schedule{Location: berlin, Rules: []ScheduleRule{{Weekdays: 1 << 0, Start: 1 * 3600, End: 4 * 3600}}}
+		from := uint64(time.Date(2024, 3, 31, 0, 0, 0, 0, berlin).Unix())
+		if windows := s.Windows(from, from+24*3600); len(windows) != 1 || windows[0].ValidTo-windows[0].ValidFrom != 2*3600 {
+			t.Errorf("Window across daylight saving time: %v", windows)
+		}
+	}
+}
+
+func TestCypherlockSchedule(t *testing.T) {
+	clock := timesource.Clock
+	defer func() { timesource.Clock = clock }()
+	nc := timesource.NewMockClock(time.Now())
+	timesource.Clock = nc
+
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	now := testNow()
+	// Two daily windows of ten minutes, the first one open now.
+	start := now - now%60
+	s, err := ParseSchedule(fmt.Sprintf("UTC * %s-%s; * %s-%s",
+		time.Unix(int64(start), 0).UTC().Format("15:04"), time.Unix(int64(start+600), 0).UTC().Format("15:04"),
+		time.Unix(int64(start+7200), 0).UTC().Format("15:04"), time.Unix(int64(start+7800), 0).UTC().Format("15:04")))
+	if err != nil {
+		t.Fatalf("ParseSchedule: %s", err)
+	}
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+		Schedule:     s,
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	validFrom, validTo, err := cl.CreateLock(passphrase, secret, now, now+3*3600)
+	if err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if validFrom != now || validTo != start+7800 {
+		t.Errorf("CreateLock time range: %d-%d, expected %d-%d", validFrom, validTo, now, start+7800)
+	}
+	if until, err := cl.ScheduledUntil(); err != nil || until != start+7800 {
+		t.Errorf("ScheduledUntil: %d %v", until, err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	if _, err := cl.LoadLock(passphrase, start+3600); err == nil {
+		t.Error("LoadLock outside schedule must fail")
+	}
+	if _, err := cl.ExtendSchedule(passphrase, start+3600, 48*3600); err == nil {
+		t.Error("ExtendSchedule outside schedule must fail")
+	}
+	nc.Advance(time.Duration(start+7260-now) * time.Second)
+	now = testNow()
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock in second window: %v", err)
+	}
+	// The keylist of the test server covers about 24 hours, so it ends before the second window of
+	// the next day.
+	until, err := cl.ExtendSchedule(passphrase, now, 48*3600)
+	if err != nil {
+		t.Fatalf("ExtendSchedule: %s", err)
+	}
+	if until < start+22*3600 || until >= start+24*3600+7200 {
+		t.Errorf("ExtendSchedule until %d, expected end of keylist", until)
+	}
+	if _, err := storage.GetLock(start + 24*3600 + 60); err != nil && until > start+24*3600+60 {
+		t.Errorf("Occurrence of next day not written: %s", err)
+	}
+	if _, err := storage.GetLock(start + 24*3600 + 3600); err == nil {
+		t.Error("Lock written outside schedule")
+	}
+}
+
+func TestCypherlockScheduleThreshold(t *testing.T) {
+	clock := timesource.Clock
+	defer func() { timesource.Clock = clock }()
+	nc := timesource.NewMockClock(time.Now())
+	timesource.Clock = nc
+
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	now := testNow()
+	start := now - now%60
+	s, err := ParseSchedule(fmt.Sprintf("UTC * %s-%s; * %s-%s",
+		time.Unix(int64(start), 0).UTC().Format("15:04"), time.Unix(int64(start+600), 0).UTC().Format("15:04"),
+		time.Unix(int64(start+7200), 0).UTC().Format("15:04"), time.Unix(int64(start+7800), 0).UTC().Format("15:04")))
+	if err != nil {
+		t.Fatalf("ParseSchedule: %s", err)
+	}
+	cl := &Cypherlock{
+		Storage:   storage,
+		ClientRPC: rpc,
+		Threshold: 2,
+		Schedule:  s,
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		ts := newTestServer(t)
+		rpc.servers[url] = ts
+		cl.Servers = append(cl.Servers, Server{URL: url, SignatureKey: &ts.sigPublicKey})
+	}
+	passphrase, secret := []byte("passphrase"), []byte("secret")
+	if _, _, err := cl.CreateLock(passphrase, secret, now, now+3*3600); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	if until, err := cl.ScheduledUntil(); err != nil || until != start+7800 {
+		t.Errorf("ScheduledUntil: %d %v", until, err)
+	}
+	if secret2, err := cl.LoadLock(passphrase, now); err != nil || !bytes.Equal(secret, secret2) {
+		t.Fatalf("LoadLock: %v", err)
+	}
+	nc.Advance(time.Duration(start+7260-now) * time.Second)
+	if secret2, err := cl.LoadLock(passphrase, testNow()); err != nil || !bytes.Equal(secret, secret2) {
+		t.Errorf("LoadLock in second window: %v", err)
+	}
+}
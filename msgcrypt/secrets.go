@@ -4,6 +4,7 @@ package msgcrypt
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"io"
 
@@ -138,3 +139,45 @@ func FromEphemeralKey(nonce *[32]byte, ephemeralKey *[32]byte, serverPublicKey *
 	k2 := twoPartySecret(receiverPrivateKey, ephemeralKey, nonce, true)
 	return keyHMAC(k1, k2)
 }
+
+// deriveKey derives a 32 byte key for a purpose given by label.
+func deriveKey(key *[32]byte, label string) *[32]byte {
+	r := new([32]byte)
+	newKeyStream(key, label).Read(r[:])
+	return r
+}
+
+// keyStream is a deterministic stream of bytes derived from a key and a label.
+type keyStream struct {
+	key     []byte
+	label   []byte
+	counter uint64
+	buf     []byte
+}
+
+// newKeyStream returns a reader that produces HMAC-SHA256(key, label | counter) blocks.
+func newKeyStream(key *[32]byte, label string) io.Reader {
+	return &keyStream{
+		key:   key[:],
+		label: []byte(label),
+	}
+}
+
+func (ks *keyStream) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(ks.buf) == 0 {
+			c := make([]byte, 8)
+			binary.BigEndian.PutUint64(c, ks.counter)
+			ks.counter++
+			h := hmac.New(sha256.New, ks.key)
+			h.Write(ks.label)
+			h.Write(c)
+			ks.buf = h.Sum(nil)
+		}
+		m := copy(p[n:], ks.buf)
+		ks.buf = ks.buf[m:]
+		n += m
+	}
+	return n, nil
+}
@@ -0,0 +1,208 @@
+package msgcrypt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Stream format:
+//
+// Header: Header (TypeStream) | NoncePrefix (16 byte)
+// Chunk:  Flags (1 byte) | Length (uint32) | secretbox(Data, NoncePrefix | Counter)
+//
+// Counter is the 64 bit big endian chunk counter starting at 0, its highest bit is set on
+// the final chunk. Binding counter and final flag into the nonce detects reordering and truncation.
+
+var (
+	// ErrStreamHeader is returned if a stream does not start with a valid header.
+	ErrStreamHeader = errors.New("msgcrypt: invalid stream header")
+	// ErrStreamTruncated is returned if a stream ends before its final chunk.
+	ErrStreamTruncated = errors.New("msgcrypt: stream truncated")
+	// ErrStreamTrailing is returned if data follows the final chunk of a stream.
+	ErrStreamTrailing = errors.New("msgcrypt: data after end of stream")
+	// ErrStreamClosed is returned when writing to a closed stream.
+	ErrStreamClosed = errors.New("msgcrypt: stream closed")
+)
+
+const (
+	// StreamChunkSize is the maximum size of cleartext per chunk.
+	StreamChunkSize = 64 * 1024
+
+	streamHeaderSize = headerSize + 16
+	streamFinalFlag  = 0x01
+	streamFinalBit   = 1 << 63
+)
+
+func streamNonce(prefix *[16]byte, counter uint64, final bool) *[24]byte {
+	nonce := new([24]byte)
+	copy(nonce[:16], prefix[:])
+	if final {
+		counter |= streamFinalBit
+	}
+	binary.BigEndian.PutUint64(nonce[16:], counter)
+	return nonce
+}
+
+// StreamWriter encrypts a stream of data in authenticated chunks. Close MUST be called to
+// write the final chunk.
+type StreamWriter struct {
+	w       io.Writer
+	key     *[32]byte
+	prefix  [16]byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// NewStreamWriter returns a StreamWriter that writes the encrypted stream to w.
+func NewStreamWriter(w io.Writer, key *[32]byte, rand io.Reader) (*StreamWriter, error) {
+	sw := &StreamWriter{
+		w:   w,
+		key: key,
+		buf: make([]byte, 0, StreamChunkSize),
+	}
+	if _, err := io.ReadFull(rand, sw.prefix[:]); err != nil {
+		return nil, err
+	}
+	header := append(newHeader(TypeStream, 16), sw.prefix[:]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *StreamWriter) writeChunk(final bool) error {
+	var flags byte
+	if final {
+		flags = streamFinalFlag
+	}
+	out := make([]byte, 5, 5+len(sw.buf)+secretbox.Overhead)
+	out[0] = flags
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(sw.buf)+secretbox.Overhead))
+	out = secretbox.Seal(out, sw.buf, streamNonce(&sw.prefix, sw.counter, final), sw.key)
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	_, err := sw.w.Write(out)
+	return err
+}
+
+// Write encrypts p. Full chunks are only written once more data follows, so that the final
+// chunk is never empty unless the stream is.
+func (sw *StreamWriter) Write(p []byte) (n int, err error) {
+	if sw.closed {
+		return 0, ErrStreamClosed
+	}
+	for len(p) > 0 {
+		if len(sw.buf) == StreamChunkSize {
+			if err := sw.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		m := StreamChunkSize - len(sw.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		sw.buf = append(sw.buf, p[:m]...)
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (sw *StreamWriter) Close() error {
+	if sw.closed {
+		return ErrStreamClosed
+	}
+	sw.closed = true
+	return sw.writeChunk(true)
+}
+
+// StreamReader decrypts a stream written by StreamWriter.
+type StreamReader struct {
+	r       io.Reader
+	key     *[32]byte
+	prefix  [16]byte
+	counter uint64
+	buf     []byte
+	final   bool
+}
+
+// NewStreamReader reads the stream header from r and returns a StreamReader.
+func NewStreamReader(r io.Reader, key *[32]byte) (*StreamReader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrStreamHeader
+	}
+	version, prefix, err := splitHeader(header, TypeStream)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, ErrStreamHeader
+	}
+	sr := &StreamReader{
+		r:   r,
+		key: key,
+	}
+	copy(sr.prefix[:], prefix)
+	return sr, nil
+}
+
+func (sr *StreamReader) readChunk() error {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(sr.r, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+	l := binary.BigEndian.Uint32(head[1:5])
+	if l < secretbox.Overhead || l > StreamChunkSize+secretbox.Overhead {
+		return ErrCannotDecrypt
+	}
+	final := head[0] == streamFinalFlag
+	ct := make([]byte, l)
+	if _, err := io.ReadFull(sr.r, ct); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+	pt, ok := secretbox.Open(sr.buf[:0], ct, streamNonce(&sr.prefix, sr.counter, final), sr.key)
+	if !ok {
+		return ErrCannotDecrypt
+	}
+	sr.counter++
+	sr.buf = pt
+	sr.final = final
+	if final {
+		if n, _ := io.ReadFull(sr.r, head[:1]); n > 0 {
+			return ErrStreamTrailing
+		}
+	}
+	return nil
+}
+
+// Read decrypted data. Returns io.EOF only after the final chunk has been verified.
+func (sr *StreamReader) Read(p []byte) (n int, err error) {
+	for len(sr.buf) == 0 {
+		if sr.final {
+			return 0, io.EOF
+		}
+		if err := sr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// StreamKey returns the key for streaming encryption derived from the secret key of a lock.
+func StreamKey(secretKey *[32]byte) *[32]byte {
+	return deriveKey(secretKey, "cypherlock stream")
+}
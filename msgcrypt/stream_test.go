@@ -0,0 +1,91 @@
+package msgcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func streamEncrypt(t *testing.T, key *[32]byte, data []byte) []byte {
+	out := new(bytes.Buffer)
+	sw, err := NewStreamWriter(out, key, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewStreamWriter: %s", err)
+	}
+	// Write in odd sizes to cross chunk boundaries.
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := sw.Write(data[:n]); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		data = data[n:]
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	return out.Bytes()
+}
+
+func streamDecrypt(key *[32]byte, data []byte) ([]byte, error) {
+	sr, err := NewStreamReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(sr)
+}
+
+func TestStream(t *testing.T) {
+	key, _ := genRandom(rand.Reader)
+	for _, size := range []int{0, 1, StreamChunkSize, 3*StreamChunkSize + 17} {
+		data := make([]byte, size)
+		io.ReadFull(rand.Reader, data)
+		enc := streamEncrypt(t, key, data)
+		dec, err := streamDecrypt(key, enc)
+		if err != nil {
+			t.Fatalf("Decrypt %d: %s", size, err)
+		}
+		if !bytes.Equal(data, dec) {
+			t.Errorf("Cleartext mismatch %d", size)
+		}
+	}
+}
+
+func TestStreamTamper(t *testing.T) {
+	key, _ := genRandom(rand.Reader)
+	data := make([]byte, 2*StreamChunkSize+100)
+	enc := streamEncrypt(t, key, data)
+	chunk := 5 + StreamChunkSize + 16
+	first := enc[streamHeaderSize : streamHeaderSize+chunk]
+	second := enc[streamHeaderSize+chunk : streamHeaderSize+2*chunk]
+	// Truncate after full chunks.
+	if _, err := streamDecrypt(key, enc[:streamHeaderSize+2*chunk]); err != ErrStreamTruncated {
+		t.Errorf("Truncation: %v", err)
+	}
+	// Reorder chunks.
+	reordered := append([]byte{}, enc[:streamHeaderSize]...)
+	reordered = append(reordered, second...)
+	reordered = append(reordered, first...)
+	reordered = append(reordered, enc[streamHeaderSize+2*chunk:]...)
+	if _, err := streamDecrypt(key, reordered); err != ErrCannotDecrypt {
+		t.Errorf("Reorder: %v", err)
+	}
+	// Mark a chunk as final.
+	final := append([]byte{}, enc[:streamHeaderSize+chunk]...)
+	final[streamHeaderSize] = streamFinalFlag
+	if _, err := streamDecrypt(key, final); err != ErrCannotDecrypt {
+		t.Errorf("Final flag: %v", err)
+	}
+	// Append data.
+	if _, err := streamDecrypt(key, append(append([]byte{}, enc...), 0x00)); err != ErrStreamTrailing {
+		t.Errorf("Trailing: %v", err)
+	}
+	wrongKey, _ := genRandom(rand.Reader)
+	if _, err := streamDecrypt(wrongKey, enc); err != ErrCannotDecrypt {
+		t.Errorf("Wrong key: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package msgcrypt
+
+import (
+	"errors"
+)
+
+// ErrSubkeyName is returned if a subkey is requested without a name.
+var ErrSubkeyName = errors.New("msgcrypt: subkey name missing")
+
+// Subkey returns the key named name derived from the secret key of a lock. Subkeys of different
+// names are independent, and independent of the lock's secret and stream key.
+func Subkey(secretKey *[32]byte, name string) *[32]byte {
+	return deriveKey(secretKey, "cypherlock subkey "+name)
+}
+
+// LoadLockSubkeys unlocks the lock once and returns the subkeys of names. The subkeys expire with
+// the lock, but remain the same when it is extended or its passphrase is changed.
+func (cl *Cypherlock) LoadLockSubkeys(passphrase []byte, now uint64, names []string) ([]*[32]byte, error) {
+	for _, name := range names {
+		if name == "" {
+			return nil, ErrSubkeyName
+		}
+	}
+	secretKey, err := cl.loadLockKey(passphrase, now)
+	if err != nil {
+		return nil, err
+	}
+	subkeys := make([]*[32]byte, len(names))
+	for i, name := range names {
+		subkeys[i] = Subkey(secretKey, name)
+	}
+	return subkeys, nil
+}
+
+// LoadLockSubkey unlocks the lock and returns the subkey of name.
+func (cl *Cypherlock) LoadLockSubkey(passphrase []byte, now uint64, name string) (*[32]byte, error) {
+	subkeys, err := cl.LoadLockSubkeys(passphrase, now, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	return subkeys[0], nil
+}
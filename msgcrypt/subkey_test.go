@@ -0,0 +1,58 @@
+package msgcrypt
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestSubkey(t *testing.T) {
+	secretKey, _ := genRandom(rand.Reader)
+	disk, db := Subkey(secretKey, "disk"), Subkey(secretKey, "db")
+	if *disk == *db || *disk == *secretKey || *disk == *StreamKey(secretKey) {
+		t.Error("Subkeys not independent")
+	}
+	if *Subkey(secretKey, "disk") != *disk {
+		t.Error("Subkey not deterministic")
+	}
+}
+
+func TestCypherlockSubkeys(t *testing.T) {
+	storage, cleanup := testStorage(t)
+	defer cleanup()
+	rpc := newTestRPC()
+	ts := newTestServer(t)
+	rpc.servers["server"] = ts
+	cl := &Cypherlock{
+		SignatureKey: &ts.sigPublicKey,
+		ServerURL:    "server",
+		Storage:      storage,
+		ClientRPC:    rpc,
+	}
+	passphrase := []byte("passphrase")
+	now := testNow()
+	if _, _, err := cl.CreateLock(passphrase, []byte("secret"), now, now+1800); err != nil {
+		t.Fatalf("CreateLock: %s", err)
+	}
+	subkeys, err := cl.LoadLockSubkeys(passphrase, now, []string{"disk", "db", "api"})
+	if err != nil {
+		t.Fatalf("LoadLockSubkeys: %s", err)
+	}
+	if rpc.decrypts != 1 {
+		t.Errorf("LoadLockSubkeys made %d requests", rpc.decrypts)
+	}
+	if *subkeys[0] == *subkeys[1] || *subkeys[1] == *subkeys[2] {
+		t.Error("Subkeys not independent")
+	}
+	if _, _, err := cl.ExtendLock(passphrase, now, now, now+3600); err != nil {
+		t.Fatalf("ExtendLock: %s", err)
+	}
+	if db, err := cl.LoadLockSubkey(passphrase, now, "db"); err != nil || *db != *subkeys[1] {
+		t.Errorf("Subkey changed by ExtendLock: %v", err)
+	}
+	if _, err := cl.LoadLockSubkeys(passphrase, now, []string{"disk", ""}); err != ErrSubkeyName {
+		t.Errorf("LoadLockSubkeys without name: %v", err)
+	}
+	if _, err := cl.LoadLockSubkey([]byte("wrong"), now, "disk"); err == nil {
+		t.Error("LoadLockSubkey must fail with wrong passphrase")
+	}
+}
@@ -1,23 +1,59 @@
 package msgcrypt
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"io"
+	"time"
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+var (
+	// ErrKDFParams is returned if a password encrypted message has unknown or excessive KDF parameters.
+	ErrKDFParams = errors.New("msgcrypt: unsupported key derivation parameters")
+	// ErrKeyfileRequired is returned if a message requires a keyfile but none was given.
+	ErrKeyfileRequired = errors.New("msgcrypt: keyfile required")
+	// ErrKeyfileUnexpected is returned if a keyfile was given for a message that is not protected by one.
+	ErrKeyfileUnexpected = errors.New("msgcrypt: message is not protected by keyfile")
+)
+
+// Symmetric message format:
+//
+// Header (TypeSymmetric) | Nonce (24 byte) | secretbox(message)
+//
+// Version 0 has no header.
+
 // SymEncrypt encrypts message with a key.
 func SymEncrypt(key *[32]byte, message []byte, rand io.Reader) ([]byte, error) {
 	nonce, err := genSymNonce(rand)
 	if err != nil {
 		return nil, err
 	}
-	return secretbox.Seal(nonce[:], message, nonce, key), nil
+	out := append(newHeader(TypeSymmetric, 24+len(message)+secretbox.Overhead), nonce[:]...)
+	return secretbox.Seal(out, message, nonce, key), nil
 }
 
 // SymDecrypt decrypts a message with a key.
 func SymDecrypt(key *[32]byte, message []byte) ([]byte, error) {
+	version, body, err := splitHeader(message, TypeSymmetric)
+	if err == nil {
+		var ct []byte
+		if ct, err = symDecrypt(key, body); err == nil || version == 0 {
+			return ct, err
+		}
+	}
+	// A version 0 message might start with bytes that look like a header.
+	if ct, err0 := symDecrypt(key, message); err0 == nil {
+		return ct, nil
+	}
+	return nil, err
+}
+
+func symDecrypt(key *[32]byte, message []byte) ([]byte, error) {
 	if len(message) < 24+secretbox.Overhead+1 {
 		return nil, ErrMessageIncomplete
 	}
@@ -30,34 +66,200 @@ func SymDecrypt(key *[32]byte, message []byte) ([]byte, error) {
 	return ct, nil
 }
 
+// KDFParams are the Argon2id parameters used to derive a key from a password.
+type KDFParams struct {
+	Time    uint32 // Number of passes over the memory.
+	Memory  uint32 // Memory in KiB.
+	Threads uint8  // Degree of parallelism.
+}
+
+// DefaultKDFParams are used when no parameters are given, and for messages without header.
+var DefaultKDFParams = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+const (
+	// MaxKDFMemory is the maximum memory in KiB accepted when decrypting.
+	MaxKDFMemory = 4 * 1024 * 1024
+	// MaxKDFTime is the maximum number of passes accepted when decrypting.
+	MaxKDFTime = 1024
+	// MinKDFMemory is the minimum memory in KiB used by CalibrateKDF.
+	MinKDFMemory = 8 * 1024
+)
+
+// valid returns true if the parameters are within bounds.
+func (p *KDFParams) valid() bool {
+	return p.Time >= 1 && p.Time <= MaxKDFTime && p.Memory >= 8*uint32(p.Threads) && p.Memory <= MaxKDFMemory && p.Threads >= 1
+}
+
+// CalibrateKDF returns parameters that take about target time on this machine, using at most
+// maxMemory KiB. Memory is reduced if a single pass takes longer than target.
+func CalibrateKDF(target time.Duration, maxMemory uint32) *KDFParams {
+	p := &KDFParams{Time: 1, Memory: maxMemory, Threads: DefaultKDFParams.Threads}
+	if p.Memory > MaxKDFMemory {
+		p.Memory = MaxKDFMemory
+	}
+	if p.Memory < MinKDFMemory {
+		p.Memory = MinKDFMemory
+	}
+	salt := make([]byte, 32)
+	for {
+		start := time.Now()
+		argon2.IDKey([]byte("calibrate"), salt, 1, p.Memory, p.Threads, 32)
+		pass := time.Since(start)
+		if pass > target && p.Memory/2 >= MinKDFMemory {
+			p.Memory /= 2
+			continue
+		}
+		if pass > 0 && target/pass > 1 {
+			p.Time = uint32(target / pass)
+		}
+		if p.Time > MaxKDFTime {
+			p.Time = MaxKDFTime
+		}
+		return p
+	}
+}
+
 // generate a 32 byte key from password.
-func keyFromPassword32(password, salt []byte) *[32]byte {
-	key := argon2.IDKey(password, salt, 1, 64*1024, 4, 32)
+func keyFromPassword32(password, salt []byte, params *KDFParams) *[32]byte {
+	key := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, 32)
 	r := new([32]byte)
 	copy(r[:], key[:])
 	return r
 }
 
-// PasswordEncrypt encrypts a message with a password.
+// Password encrypted message format:
+//
+// Header (TypePassword) | Algorithm (0x01 Argon2id) | Flags | Time (uint32) |
+// Memory (uint32) | Threads (uint8) | Salt (32 byte) | SymEncrypt(message)
+//
+// Flags: 0x01 the key is mixed with a keyfile.
+//
+// Version 0 has no header: Salt (32 byte) | SymEncrypt(message), using DefaultKDFParams.
+
+const (
+	passwordAlgArgon2id   = 0x01
+	passwordParamsSize    = 1 + 1 + 4 + 4 + 1 + 32
+	passwordLegacySaltLen = 32
+
+	passwordFlagKeyfile = 0x01
+)
+
+// mixKeyfile combines the key derived from the password with the keyfile.
+func mixKeyfile(key *[32]byte, keyfile []byte) *[32]byte {
+	kh := sha256.Sum256(keyfile)
+	m := hmac.New(sha256.New, kh[:])
+	m.Write([]byte("cypherlock keyfile"))
+	m.Write(key[:])
+	r := new([32]byte)
+	copy(r[:], m.Sum(nil))
+	return r
+}
+
+// PasswordEncrypt encrypts a message with a password, using DefaultKDFParams.
 func PasswordEncrypt(password, message []byte, rand io.Reader) ([]byte, error) {
+	return PasswordEncryptParams(password, message, nil, rand)
+}
+
+// PasswordEncryptParams encrypts a message with a password. The KDF parameters are written
+// to the header of the message. If params is nil, DefaultKDFParams are used.
+func PasswordEncryptParams(password, message []byte, params *KDFParams, rand io.Reader) ([]byte, error) {
+	return PasswordEncryptKeyfile(password, nil, message, params, rand)
+}
+
+// PasswordEncryptKeyfile encrypts a message with a password and a keyfile. Both are required for decryption.
+// If keyfile is nil, only the password is used.
+func PasswordEncryptKeyfile(password, keyfile, message []byte, params *KDFParams, rand io.Reader) ([]byte, error) {
+	if params == nil {
+		params = &DefaultKDFParams
+	}
+	if !params.valid() {
+		return nil, ErrKDFParams
+	}
 	salt, err := genRandom(rand)
 	if err != nil {
 		return nil, err
 	}
-	key := keyFromPassword32(password, salt[:])
+	var flags byte
+	key := keyFromPassword32(password, salt[:], params)
+	if keyfile != nil {
+		key = mixKeyfile(key, keyfile)
+		flags |= passwordFlagKeyfile
+	}
 	ct, err := SymEncrypt(key, message, rand)
 	if err != nil {
 		return nil, err
 	}
-	return append(salt[:], ct...), nil
+	p := make([]byte, passwordParamsSize)
+	p[0] = passwordAlgArgon2id
+	p[1] = flags
+	binary.BigEndian.PutUint32(p[2:6], params.Time)
+	binary.BigEndian.PutUint32(p[6:10], params.Memory)
+	p[10] = params.Threads
+	copy(p[11:43], salt[:])
+	out := append(newHeader(TypePassword, passwordParamsSize+len(ct)), p...)
+	return append(out, ct...), nil
 }
 
-// PasswordDecrypt decrypts a message with a password.
+// PasswordDecrypt decrypts a message with a password, using the KDF parameters from the header.
 func PasswordDecrypt(password, message []byte) ([]byte, error) {
-	key := keyFromPassword32(password, message[0:32])
-	ct, err := SymDecrypt(key, message[32:])
+	return PasswordDecryptKeyfile(password, nil, message)
+}
+
+// PasswordDecryptKeyfile decrypts a message with a password and, if the message requires it, a keyfile.
+func PasswordDecryptKeyfile(password, keyfile, message []byte) ([]byte, error) {
+	params, flags, salt, ct, err := parsePasswordMessage(message)
 	if err != nil {
 		return nil, err
 	}
-	return ct, nil
+	hasKeyfile := flags&passwordFlagKeyfile != 0
+	if hasKeyfile && keyfile == nil {
+		return nil, ErrKeyfileRequired
+	}
+	if !hasKeyfile && keyfile != nil {
+		return nil, ErrKeyfileUnexpected
+	}
+	key := keyFromPassword32(password, salt, params)
+	if hasKeyfile {
+		key = mixKeyfile(key, keyfile)
+	}
+	pt, err := SymDecrypt(key, ct)
+	if err != nil {
+		return nil, err
+	}
+	return pt, nil
+}
+
+// parsePasswordMessage splits a password encrypted message into KDF parameters, flags, salt and ciphertext.
+func parsePasswordMessage(message []byte) (params *KDFParams, flags byte, salt, ct []byte, err error) {
+	version, body, err := splitHeader(message, TypePassword)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+	if version == 0 {
+		if len(body) < passwordLegacySaltLen {
+			return nil, 0, nil, nil, ErrMessageIncomplete
+		}
+		return &DefaultKDFParams, 0, body[:passwordLegacySaltLen], body[passwordLegacySaltLen:], nil
+	}
+	if len(body) < passwordParamsSize {
+		return nil, 0, nil, nil, ErrMessageIncomplete
+	}
+	if body[0] != passwordAlgArgon2id || body[1]&^passwordFlagKeyfile != 0 {
+		return nil, 0, nil, nil, ErrKDFParams
+	}
+	params = &KDFParams{
+		Time:    binary.BigEndian.Uint32(body[2:6]),
+		Memory:  binary.BigEndian.Uint32(body[6:10]),
+		Threads: body[10],
+	}
+	if !params.valid() {
+		return nil, 0, nil, nil, ErrKDFParams
+	}
+	return params, body[1], body[11:43], body[passwordParamsSize:], nil
+}
+
+// PasswordParams returns the KDF parameters of a password encrypted message.
+func PasswordParams(message []byte) (*KDFParams, error) {
+	params, _, _, _, err := parsePasswordMessage(message)
+	return params, err
 }
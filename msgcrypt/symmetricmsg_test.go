@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"testing"
+	"time"
 )
 
 func TestSymmetric(t *testing.T) {
@@ -41,3 +42,73 @@ func TestPassword(t *testing.T) {
 		t.Error("Cleartext no match")
 	}
 }
+
+func TestPasswordParams(t *testing.T) {
+	passphrase := []byte("Secret passphrase")
+	message := []byte("Test message")
+	params := &KDFParams{Time: 2, Memory: 8 * 1024, Threads: 2}
+
+	msg, err := PasswordEncryptParams(passphrase, message, params, rand.Reader)
+	if err != nil {
+		t.Fatalf("PasswordEncryptParams: %s", err)
+	}
+	parsed, err := PasswordParams(msg)
+	if err != nil {
+		t.Fatalf("PasswordParams: %s", err)
+	}
+	if *parsed != *params {
+		t.Errorf("KDF parameters not preserved: %v != %v", parsed, params)
+	}
+	ct, err := PasswordDecrypt(passphrase, msg)
+	if err != nil {
+		t.Fatalf("PasswordDecrypt: %s", err)
+	}
+	if !bytes.Equal(ct, message) {
+		t.Error("Cleartext no match")
+	}
+	if _, err := PasswordDecrypt([]byte("wrong"), msg); err == nil {
+		t.Error("Wrong passphrase must fail")
+	}
+
+	excessive := make([]byte, len(msg))
+	copy(excessive, msg)
+	excessive[10] = 0xff // Memory > MaxKDFMemory.
+	if _, err := PasswordDecrypt(passphrase, excessive); err != ErrKDFParams {
+		t.Errorf("Excessive memory must be rejected: %v", err)
+	}
+	if _, err := PasswordEncryptParams(passphrase, message, &KDFParams{}, rand.Reader); err != ErrKDFParams {
+		t.Errorf("Invalid parameters must be rejected: %v", err)
+	}
+}
+
+func TestPasswordLegacy(t *testing.T) {
+	passphrase := []byte("Secret passphrase")
+	message := []byte("Test message")
+
+	salt, err := genRandom(rand.Reader)
+	if err != nil {
+		t.Fatalf("genRandom: %s", err)
+	}
+	ct, err := SymEncrypt(keyFromPassword32(passphrase, salt[:], &DefaultKDFParams), message, rand.Reader)
+	if err != nil {
+		t.Fatalf("SymEncrypt: %s", err)
+	}
+	msg := append(salt[:], ct...)
+	pt, err := PasswordDecrypt(passphrase, msg)
+	if err != nil {
+		t.Fatalf("PasswordDecrypt: %s", err)
+	}
+	if !bytes.Equal(pt, message) {
+		t.Error("Cleartext no match")
+	}
+}
+
+func TestCalibrateKDF(t *testing.T) {
+	params := CalibrateKDF(10*time.Millisecond, MinKDFMemory)
+	if !params.valid() {
+		t.Fatalf("Invalid parameters: %v", params)
+	}
+	if params.Memory != MinKDFMemory {
+		t.Errorf("Memory exceeds maximum: %d", params.Memory)
+	}
+}
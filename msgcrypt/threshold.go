@@ -0,0 +1,346 @@
+package msgcrypt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/JonathanLogan/cypherlock/clientinterface"
+	"github.com/JonathanLogan/cypherlock/shamir"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrThresholdInvalid is returned if the threshold is not between 1 and the number of servers,
+	// or differs from the threshold the lock was created with.
+	ErrThresholdInvalid = errors.New("msgcrypt: invalid threshold")
+	// ErrThresholdNotReached is returned if fewer servers than the threshold could be used.
+	ErrThresholdNotReached = errors.New("msgcrypt: threshold of servers not reached")
+	// ErrServersFailed is returned if a threshold lock could not be written for all servers.
+	ErrServersFailed = errors.New("msgcrypt: lock not written for all servers")
+	// ErrServerUnknown is returned when extending a threshold lock with a server it was not created with.
+	ErrServerUnknown = errors.New("msgcrypt: server is not part of the threshold lock")
+)
+
+// ServerWriteError is returned when a threshold lock could not be written for some servers. Err is
+// ErrServersFailed, or ErrThresholdNotReached if fewer than Threshold servers succeeded.
+type ServerWriteError struct {
+	Err     error
+	Servers []string // URLs of the servers that failed.
+	Errs    []error  // Error of each failed server.
+}
+
+func (se *ServerWriteError) Error() string {
+	failed := make([]string, len(se.Servers))
+	for i, url := range se.Servers {
+		failed[i] = fmt.Sprintf("%s (%s)", url, se.Errs[i])
+	}
+	return fmt.Sprintf("%s: %s", se.Err, strings.Join(failed, ", "))
+}
+
+// Server is a Cypherlock server of a threshold lock.
+type Server struct {
+	URL          string                       // Address of the server.
+	SignatureKey *[ed25519.PublicKeySize]byte // Pinned signature key of the server.
+}
+
+// isThreshold returns true if the Cypherlock uses multiple servers.
+func (cl *Cypherlock) isThreshold() bool {
+	return len(cl.Servers) > 0
+}
+
+// serverStorage returns the name of the sub storage that holds the lock data of the server at url.
+func serverStorage(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return "server-" + hex.EncodeToString(h[:8])
+}
+
+// forServer returns a single server Cypherlock for the server at position i. The lock
+// data of each server is kept in its own sub storage.
+func (cl *Cypherlock) forServer(i int) *Cypherlock {
+	n := *cl
+	n.Servers = nil
+	n.Threshold = 0
+	n.ServerURL = cl.Servers[i].URL
+	n.SignatureKey = cl.Servers[i].SignatureKey
+	n.Storage = cl.Storage.Sub(serverStorage(n.ServerURL))
+	n.ratchetPublicKeys = nil
+	return &n
+}
+
+// Shares file in the storage of a threshold lock:
+//
+// Threshold (1 byte) | (encodeSlice(URL) | encodeSlice(SymEncrypt(deriveKey(SecretKey), Share)))...
+//
+// The X coordinate of a share is its position in the file, starting at 1. The shares are encrypted
+// to the secret key of the lock, so that extending the lock writes the same shares again.
+
+const sharesFile = "shares"
+
+// shareList is the list of the servers of a threshold lock and their shares.
+type shareList struct {
+	threshold int
+	urls      []string
+	shares    [][]byte // Encrypted shares.
+}
+
+func (sl *shareList) bytes() []byte {
+	d := []byte{byte(sl.threshold)}
+	for i, url := range sl.urls {
+		d = append(d, encodeSlice([]byte(url))...)
+		d = append(d, encodeSlice(sl.shares[i])...)
+	}
+	return d
+}
+
+func (sl *shareList) parse(d []byte) (*shareList, error) {
+	if len(d) < 1 {
+		return nil, ErrMessageIncomplete
+	}
+	fields, err := splitSlices(d[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, ErrMessageIncomplete
+	}
+	nsl := &shareList{threshold: int(d[0])}
+	for i := 0; i < len(fields); i += 2 {
+		nsl.urls = append(nsl.urls, string(fields[i]))
+		nsl.shares = append(nsl.shares, fields[i+1])
+	}
+	return nsl, nil
+}
+
+// x returns the X coordinate of the share of the server at url, or 0 if there is none.
+func (sl *shareList) x(url string) byte {
+	for i, u := range sl.urls {
+		if u == url {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+// loadShares loads the share list of the lock.
+func (cl *Cypherlock) loadShares() (*shareList, error) {
+	d, err := cl.Storage.GetData(sharesFile)
+	if err != nil {
+		return nil, err
+	}
+	return new(shareList).parse(d)
+}
+
+// splitKey returns one share of secretKey per server, and the share list to store with the lock.
+// The shares of an existing lock are reused, otherwise secretKey is split with random coefficients
+// and the returned share list is not nil.
+func (cl *Cypherlock) splitKey(secretKey *[32]byte) ([]*[32]byte, *shareList, error) {
+	if cl.Threshold < 1 || cl.Threshold > len(cl.Servers) || len(cl.Servers) > 255 {
+		return nil, nil, ErrThresholdInvalid
+	}
+	shareKey := deriveKey(secretKey, "cypherlock threshold shares")
+	if sl, err := cl.loadShares(); err == nil {
+		if ret, err := sl.open(shareKey, cl.Servers, cl.Threshold); err != ErrCannotDecrypt {
+			return ret, nil, err
+		}
+		// Shares of a previous lock in the same storage are replaced.
+	}
+	shares, err := shamir.Split(secretKey[:], len(cl.Servers), cl.Threshold, cl.randomSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	sl := &shareList{threshold: cl.Threshold}
+	ret := make([]*[32]byte, len(shares))
+	for i, share := range shares {
+		ret[i] = new([32]byte)
+		copy(ret[i][:], share.Value)
+		encrypted, err := SymEncrypt(shareKey, share.Value, cl.randomSource)
+		if err != nil {
+			return nil, nil, err
+		}
+		sl.urls = append(sl.urls, cl.Servers[i].URL)
+		sl.shares = append(sl.shares, encrypted)
+	}
+	return ret, sl, nil
+}
+
+// open decrypts the shares of servers with shareKey. It returns ErrCannotDecrypt if the shares
+// belong to a different secret key.
+func (sl *shareList) open(shareKey *[32]byte, servers []Server, threshold int) ([]*[32]byte, error) {
+	if _, err := SymDecrypt(shareKey, sl.shares[0]); err != nil {
+		return nil, ErrCannotDecrypt
+	}
+	if sl.threshold != threshold {
+		return nil, ErrThresholdInvalid
+	}
+	ret := make([]*[32]byte, len(servers))
+	for i, s := range servers {
+		x := sl.x(s.URL)
+		if x == 0 {
+			return nil, ErrServerUnknown
+		}
+		share, err := SymDecrypt(shareKey, sl.shares[x-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(share) != 32 {
+			return nil, ErrMessageIncomplete
+		}
+		ret[i] = new([32]byte)
+		copy(ret[i][:], share)
+	}
+	return ret, nil
+}
+
+// stagedStorage collects the data written to a storage instead of writing it, including the files
+// passed to Replace. All data is written together by commit.
+type stagedStorage struct {
+	clientinterface.Storage
+	files map[string][]byte
+}
+
+func newStagedStorage(storage clientinterface.Storage) *stagedStorage {
+	return &stagedStorage{Storage: storage, files: make(map[string][]byte)}
+}
+
+func (ss *stagedStorage) StoreLock(filename string, data []byte) error {
+	ss.files[filename] = data
+	return nil
+}
+
+func (ss *stagedStorage) StoreSecret(data []byte) error {
+	ss.files[clientinterface.SecretFile] = data
+	return nil
+}
+
+func (ss *stagedStorage) StoreData(name string, data []byte) error {
+	ss.files[name] = data
+	return nil
+}
+
+func (ss *stagedStorage) GetData(name string) ([]byte, error) {
+	if d, ok := ss.files[name]; ok {
+		return d, nil
+	}
+	return ss.Storage.GetData(name)
+}
+
+func (ss *stagedStorage) Replace(files map[string][]byte) error {
+	for name, d := range files {
+		ss.files[name] = d
+	}
+	return nil
+}
+
+// commit replaces the files of the underlying storage with the staged data.
+func (ss *stagedStorage) commit() error {
+	return ss.Storage.Replace(ss.files)
+}
+
+// writeThresholdLock writes one lock per server, each protecting a share of secretKey. The locks
+// of all servers are written together once all servers succeeded, or at least Threshold servers
+// with PartialWrite. Otherwise nothing is written and a *ServerWriteError is returned. The returned
+// time range is covered by all servers that succeeded.
+func (cl *Cypherlock) writeThresholdLock(passphrase []byte, secretKey, duressKey *[32]byte, policy *Policy, validFrom, validTo uint64) (finalValidFrom, finalValidTo uint64, err error) {
+	shares, sl, err := cl.splitKey(secretKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	files := make(map[string][]byte)
+	if sl != nil {
+		files[sharesFile] = sl.bytes()
+	}
+	writeErr := &ServerWriteError{Err: ErrServersFailed}
+	written := 0
+	for i, share := range shares {
+		server := cl.forServer(i)
+		staged := newStagedStorage(server.Storage)
+		server.Storage = staged
+		from, to, err := server.writeLock(passphrase, share, duressKey, policy, validFrom, validTo)
+		if err != nil {
+			writeErr.Servers = append(writeErr.Servers, server.ServerURL)
+			writeErr.Errs = append(writeErr.Errs, err)
+			continue
+		}
+		for name, d := range staged.files {
+			files[serverStorage(server.ServerURL)+"/"+name] = d
+		}
+		if written == 0 || from > finalValidFrom {
+			finalValidFrom = from
+		}
+		if written == 0 || to < finalValidTo {
+			finalValidTo = to
+		}
+		written++
+	}
+	if written < len(shares) && !(cl.PartialWrite && written >= cl.Threshold) {
+		if written < cl.Threshold {
+			writeErr.Err = ErrThresholdNotReached
+		}
+		return 0, 0, writeErr
+	}
+	if err := cl.Storage.Replace(files); err != nil {
+		return 0, 0, err
+	}
+	return finalValidFrom, finalValidTo, nil
+}
+
+// loadThresholdLockKey collects shares from the servers until the threshold is reached. It returns
+// ErrUnlockPending if the threshold could be reached once pending unlocks are ready, and
+// ErrApprovalPending if it could be reached once pending requests are approved.
+func (cl *Cypherlock) loadThresholdLockKey(passphrase []byte, now uint64) (secretKey *[32]byte, err error) {
+	if cl.Threshold < 1 || cl.Threshold > len(cl.Servers) {
+		return nil, ErrThresholdInvalid
+	}
+	sl, err := cl.loadShares()
+	if err != nil {
+		return nil, err
+	}
+	if sl.threshold != cl.Threshold {
+		return nil, ErrThresholdInvalid
+	}
+	shares := make([]shamir.Share, 0, cl.Threshold)
+	var pending, approvals int
+	for i, s := range cl.Servers {
+		x := sl.x(s.URL)
+		if x == 0 {
+			continue
+		}
+		share, err := cl.forServer(i).openLockKey(passphrase, now)
+		if err == ErrUnlockPending {
+			pending++
+		} else if err == ErrApprovalPending {
+			approvals++
+		}
+		if err != nil {
+			continue
+		}
+		shares = append(shares, shamir.Share{X: x, Value: share[:]})
+		if len(shares) == cl.Threshold {
+			break
+		}
+	}
+	if len(shares) < cl.Threshold && len(shares)+pending >= cl.Threshold {
+		return nil, ErrUnlockPending
+	}
+	if len(shares) < cl.Threshold && len(shares)+pending+approvals >= cl.Threshold {
+		return nil, ErrApprovalPending
+	}
+	return cl.combineShares(shares)
+}
+
+// combineShares returns the secret key of a threshold lock from its shares.
+func (cl *Cypherlock) combineShares(shares []shamir.Share) (*[32]byte, error) {
+	if len(shares) < cl.Threshold {
+		return nil, ErrThresholdNotReached
+	}
+	key, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	secretKey := new([32]byte)
+	copy(secretKey[:], key)
+	return secretKey, nil
+}
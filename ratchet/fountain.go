@@ -12,6 +12,10 @@ import (
 // SecretFunc is a function that returns a secret for a ratchet key.
 type SecretFunc func(expectedPubKey, peerPubKey *[32]byte) (*[32]byte, error)
 
+// BlindSecretFunc is a function that returns the blinded secrets of all current ratchet keys for a
+// blinded peer key, without learning which ratchet key the peer expects.
+type BlindSecretFunc func(blindedPubKey *[32]byte) ([]*[32]byte, error)
+
 // Overwriteable for testing.
 var unixNow = func() int64 {
 	return timesource.Clock.Now().Unix()
@@ -52,6 +56,12 @@ type getSecret struct {
 	c      chan *[32]byte // channel on which to return the secret.
 }
 
+// getBlindSecrets message type, return blinded secrets of all ratchets in the ring.
+type getBlindSecrets struct {
+	in *[32]byte        // Blinded pubkey of peer.
+	c  chan []*[32]byte // channel on which to return the secrets.
+}
+
 // stopService message type, return ratchetstate.
 type stopService struct {
 	c    chan *State
@@ -89,6 +99,11 @@ func (f *Fountain) StartService() {
 	go f.service()
 }
 
+// Duration returns the number of seconds between ratchet steps.
+func (f *Fountain) Duration() int64 {
+	return f.duration
+}
+
 // Calculate the counter that should be current NOW.
 func (f *Fountain) getCurrentStep() uint64 {
 	return uint64(((unixNow() - f.startdate) / f.duration) + 1)
@@ -135,6 +150,12 @@ MessageLoop:
 					d := r.SharedSecret(n.in)
 					n.c <- d
 				}
+			case getBlindSecrets:
+				var d []*[32]byte
+				for _, r := range ring.States() {
+					d = append(d, r.BlindSecret(n.in))
+				}
+				n.c <- d
 			case stopService:
 				d := ring.Current()
 				n.c <- d
@@ -215,6 +236,24 @@ func (f *Fountain) GetSecret(expectedPubKey, peerPubKey *[32]byte) (*[32]byte, e
 	return r, nil
 }
 
+// GetBlindSecrets returns the blinded secrets of the past, current and future ratchet keys of the
+// fountain for blindedPubKey.
+func (f *Fountain) GetBlindSecrets(blindedPubKey *[32]byte) ([]*[32]byte, error) {
+	inT := new([32]byte)
+	copy(inT[:], blindedPubKey[:]) // Prevent programming errors.
+	m := getBlindSecrets{
+		in: inT,
+		c:  make(chan []*[32]byte, 1),
+	}
+	err := f.sendToService(m)
+	if err != nil {
+		return nil, err
+	}
+	r := <-m.c
+	close(m.c)
+	return r, nil
+}
+
 // Marshall a fountain into a byte slice. It does NOT stop the service.
 func (f *Fountain) Marshall() []byte {
 	o := make([]byte, 16, 136+16)
@@ -2,7 +2,10 @@ package ratchet
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"testing"
+
+	"golang.org/x/crypto/curve25519"
 )
 
 func TestFountainMarshal(t *testing.T) {
@@ -34,3 +37,35 @@ func TestFountainMarshal(t *testing.T) {
 		t.Error("Ratchet/PublicKey")
 	}
 }
+
+func TestFountainBlindSecrets(t *testing.T) {
+	nf, err := NewFountain(3600, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewFountain: %s", err)
+	}
+	nf.StartService()
+	defer nf.Stop()
+	peerPriv, peerPub := new([32]byte), new([32]byte)
+	if _, err := rand.Read(peerPriv[:]); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	curve25519.ScalarBaseMult(peerPub, peerPriv)
+	secrets, err := nf.GetBlindSecrets(peerPub)
+	if err != nil {
+		t.Fatalf("GetBlindSecrets: %s", err)
+	}
+	r := nf.getRatchet()
+	secret, err := nf.GetSecret(&r.PublicKey, peerPub)
+	if err != nil {
+		t.Fatalf("GetSecret: %s", err)
+	}
+	found := false
+	for _, s := range secrets {
+		if sha256.Sum256(s[:]) == *secret {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Blind secrets do not contain secret of current ratchet")
+	}
+}
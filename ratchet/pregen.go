@@ -29,6 +29,11 @@ func NewPregeneratorFromFountain(f *Fountain, pregenInterval int64) *PreGenerato
 	return pg
 }
 
+// Interval returns for how many seconds keys are generated in advance.
+func (pg *PreGenerator) Interval() int64 {
+	return pg.pregenInterval
+}
+
 // Marshall the PreGenerator.
 func (pg *PreGenerator) Marshall() []byte {
 	o := make([]byte, 64)
@@ -69,7 +74,7 @@ func (pg *PreGenerator) Generate() *types.RatchetList {
 	// we have never done the initial pregeneration.
 	currentStep := uint64(((unixNow() - pg.startdate) / pg.duration) + 1)
 	if currentStep > pg.ratchet.Counter() {
-		for i := pg.ratchet.Counter(); i <= currentStep; i++ {
+		for i := pg.ratchet.Counter(); i < currentStep; i++ {
 			pg.ratchet.Step()
 		}
 	}
@@ -84,6 +89,9 @@ func (pg *PreGenerator) Generate() *types.RatchetList {
 	}
 
 	list := types.NewRatchetList(pg.lastLineHash, int(stepsPeriod))
+	list.IssuedAt = uint64(unixNow())
+	list.StartDate = uint64(pg.startdate)
+	list.Duration = uint64(pg.duration)
 	previousHash := &pg.lastLineHash
 	if pg.lastLineHash == [32]byte{} {
 		previousHash = nil
@@ -94,9 +102,12 @@ func (pg *PreGenerator) Generate() *types.RatchetList {
 
 		e := types.NewPregenerateEntry(previousHash, workRatchet.Counter(), from, to, workRatchet.PublicKey)
 		list.Append(*e)
+		list.ValidUntil = to
+		previousHash = &e.LineHash
 		workRatchet.Step()
 	}
 	pg.ratchet = workRatchet
 	pg.lastCounter = workRatchet.Counter()
+	pg.lastLineHash = *previousHash
 	return list
 }
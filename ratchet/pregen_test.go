@@ -80,3 +80,32 @@ func TestPregeneratorMarshal(t *testing.T) {
 	}
 
 }
+
+func TestPregeneratorList(t *testing.T) {
+	nf, err := NewFountain(3600, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewFountain: %s", err)
+	}
+	pg := NewPregeneratorFromFountain(nf, 3*3600)
+	r := pg.Generate()
+	if r == nil {
+		t.Fatal("No list generated")
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate first list: %s", err)
+	}
+	nc.Advance(time.Second * time.Duration(3600*4))
+	r2 := pg.Generate()
+	if r2 == nil {
+		t.Fatal("No second list generated")
+	}
+	if err := r2.Validate(); err != nil {
+		t.Fatalf("Validate second list: %s", err)
+	}
+	if r2.PreviousLineHash != r.PublicKeys[len(r.PublicKeys)-1].LineHash {
+		t.Error("Lists not chained")
+	}
+	if r2.PublicKeys[0].Counter != r.PublicKeys[len(r.PublicKeys)-1].Counter+1 {
+		t.Error("Counters not continued")
+	}
+}
@@ -113,3 +113,12 @@ func (s *State) SharedSecret(peerPubKey *[32]byte) *[32]byte {
 	copy(out[:], ss)
 	return out
 }
+
+// BlindSecret multiplies RatchetKey with a blinded curve25519 public key. Unlike SharedSecret
+// the result is not hashed, so that the peer can remove its blinding factor and then hash the result
+// to arrive at the SharedSecret of the unblinded public key.
+func (s *State) BlindSecret(blindedPubKey *[32]byte) *[32]byte {
+	out := new([32]byte)
+	curve25519.ScalarMult(out, &s.privateKey, blindedPubKey)
+	return out
+}
@@ -85,3 +85,14 @@ func (rr *Ring) Find(expect *[32]byte) *State {
 	}
 	return nil
 }
+
+// States returns copies of all ratchet states of the ring, past first.
+func (rr *Ring) States() []*State {
+	states := make([]*State, 0, 3)
+	for _, r := range []*State{rr.past, rr.current, rr.future} {
+		if r != nil {
+			states = append(states, r.Copy())
+		}
+	}
+	return states
+}
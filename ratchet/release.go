@@ -0,0 +1,134 @@
+package ratchet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/JonathanLogan/cypherlock/types"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	// ErrNotReleased is returned when requesting the private key of a period that has not started yet.
+	ErrNotReleased = errors.New("ratchet: key not released yet")
+)
+
+// ReleaseFountain generates key pairs for consecutive periods. Public keys are published in
+// advance, private keys are released once their period has started. Contrary to the ratchet,
+// every private key is derived from the seed independently, so releasing one reveals no other.
+type ReleaseFountain struct {
+	startdate int64    // Unix time of the start date.
+	duration  int64    // Number of seconds per period.
+	seed      [32]byte // Secret from which all keys are derived.
+}
+
+const releaseFountainSize = 8 + 8 + 32
+
+// NewReleaseFountain returns a new ReleaseFountain with periods of duration seconds, starting now.
+func NewReleaseFountain(duration int64, rand io.Reader) (*ReleaseFountain, error) {
+	if duration < 1 {
+		return nil, ErrInvalidDuration
+	}
+	rf := &ReleaseFountain{
+		startdate: unixNow(),
+		duration:  duration,
+	}
+	if _, err := io.ReadFull(rand, rf.seed[:]); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Duration returns the number of seconds per period.
+func (rf *ReleaseFountain) Duration() int64 {
+	return rf.duration
+}
+
+// CurrentPeriod returns the counter of the period containing now. Counters start at 1.
+func (rf *ReleaseFountain) CurrentPeriod() uint64 {
+	return uint64(((unixNow() - rf.startdate) / rf.duration) + 1)
+}
+
+// periodStart returns the unix time at which the period starts.
+func (rf *ReleaseFountain) periodStart(counter uint64) uint64 {
+	return uint64(rf.startdate + (int64(counter)-1)*rf.duration)
+}
+
+// privateKey returns the private key of a period.
+func (rf *ReleaseFountain) privateKey(counter uint64) *[32]byte {
+	d := make([]byte, 8)
+	binary.BigEndian.PutUint64(d, counter)
+	h := hmac.New(sha256.New, rf.seed[:])
+	h.Write([]byte("cypherlock release"))
+	h.Write(d)
+	priv := new([32]byte)
+	copy(priv[:], h.Sum(nil))
+	return priv
+}
+
+// PublicKey returns the public key of a period.
+func (rf *ReleaseFountain) PublicKey(counter uint64) *[32]byte {
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, rf.privateKey(counter))
+	return pub
+}
+
+// Release returns the private key of a period, unless the period has not started yet.
+func (rf *ReleaseFountain) Release(counter uint64) (privateKey *[32]byte, validFrom uint64, err error) {
+	if counter < 1 || counter > rf.CurrentPeriod() {
+		return nil, 0, ErrNotReleased
+	}
+	return rf.privateKey(counter), rf.periodStart(counter), nil
+}
+
+// Generate returns a list of the public keys of all periods that start after now and before
+// now+horizon. The list must be signed.
+func (rf *ReleaseFountain) Generate(horizon int64) *types.RatchetList {
+	first := rf.CurrentPeriod() + 1
+	count := uint64(horizon / rf.duration)
+	if count < 1 {
+		count = 1
+	}
+	list := types.NewRatchetList([32]byte{}, int(count))
+	list.IssuedAt = uint64(unixNow())
+	list.StartDate = uint64(rf.startdate)
+	list.Duration = uint64(rf.duration)
+	var previousHash *[32]byte
+	for counter := first; counter < first+count; counter++ {
+		from := rf.periodStart(counter)
+		to := from + uint64(rf.duration)
+		e := types.NewPregenerateEntry(previousHash, counter, from, to, *rf.PublicKey(counter))
+		list.Append(*e)
+		list.ValidUntil = to
+		previousHash = &e.LineHash
+	}
+	return list
+}
+
+// Marshall a ReleaseFountain into a byte slice.
+func (rf *ReleaseFountain) Marshall() []byte {
+	o := make([]byte, releaseFountainSize)
+	binary.BigEndian.PutUint64(o[0:8], uint64(rf.startdate))
+	binary.BigEndian.PutUint64(o[8:16], uint64(rf.duration))
+	copy(o[16:48], rf.seed[:])
+	return o
+}
+
+// Unmarshall a ReleaseFountain. Returns nil on error.
+func (rf *ReleaseFountain) Unmarshall(d []byte) *ReleaseFountain {
+	if len(d) != releaseFountainSize {
+		return nil
+	}
+	nrf := &ReleaseFountain{
+		startdate: int64(binary.BigEndian.Uint64(d[0:8])),
+		duration:  int64(binary.BigEndian.Uint64(d[8:16])),
+	}
+	if nrf.duration < 1 {
+		return nil
+	}
+	copy(nrf.seed[:], d[16:48])
+	return nrf
+}
@@ -0,0 +1,53 @@
+package ratchet
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestReleaseFountain(t *testing.T) {
+	rf, err := NewReleaseFountain(3600, rand.Reader)
+	if err != nil {
+		t.Fatalf("NewReleaseFountain: %s", err)
+	}
+	list := rf.Generate(24 * 3600)
+	if len(list.PublicKeys) != 24 {
+		t.Fatalf("Wrong number of keys: %d", len(list.PublicKeys))
+	}
+	if err := list.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	first := list.PublicKeys[0]
+	if first.ValidFrom <= uint64(unixNow()) {
+		t.Error("List contains a released period")
+	}
+	if _, _, err := rf.Release(first.Counter); err != ErrNotReleased {
+		t.Errorf("Release before period: %v", err)
+	}
+	nc.Advance(time.Second * time.Duration(int64(first.ValidFrom)-unixNow()))
+	priv, validFrom, err := rf.Release(first.Counter)
+	if err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	if validFrom != first.ValidFrom {
+		t.Error("Wrong period start")
+	}
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	if *pub != first.PublicKey {
+		t.Error("Released key does not match public key")
+	}
+	if _, _, err := rf.Release(first.Counter + 1); err != ErrNotReleased {
+		t.Errorf("Release of next period: %v", err)
+	}
+	rf2 := new(ReleaseFountain).Unmarshall(rf.Marshall())
+	if rf2 == nil {
+		t.Fatal("Unmarshall failed")
+	}
+	if *rf2.PublicKey(first.Counter + 1) != list.PublicKeys[1].PublicKey {
+		t.Error("Unmarshalled fountain generates different keys")
+	}
+}
@@ -0,0 +1,256 @@
+package ratchetserver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+	"github.com/JonathanLogan/cypherlock/types"
+)
+
+// approvalRequest is a request waiting for approvals.
+type approvalRequest struct {
+	created   uint64
+	approvals uint8
+	approvers [][32]byte
+	approved  []bool
+}
+
+// count returns the number of approvers that approved the request.
+func (ar *approvalRequest) count() int {
+	var n int
+	for _, approved := range ar.approved {
+		if approved {
+			n++
+		}
+	}
+	return n
+}
+
+// approvalSet records the approvals of pending requests by request ID. Each change is appended to
+// persistent storage before it takes effect, the periodic persistence of the server replaces the
+// log with the pruned set.
+type approvalSet struct {
+	mutex   sync.Mutex
+	entries map[[32]byte]*approvalRequest
+	counts  map[[32]byte]int // Number of entries per approver set.
+}
+
+// Approval set and log format:
+//
+// (Request | Delete)...
+//
+// Request: 'R' | ID | Created (uint64) | Approvals (1 byte) | Count (1 byte) | Count * (Approver | Approved (1 byte))
+// Delete:  'D' | ID
+//
+// A Request record replaces earlier records of the same ID. The set contains only Request records.
+
+const (
+	approvalRequestRecord = 'R'
+	approvalDeleteRecord  = 'D'
+
+	approvalRequestHeaderSize = 1 + 32 + 8 + 1 + 1
+	approvalDeleteSize        = 1 + 32
+)
+
+// ErrApprovalLimit is returned if an approver set has too many pending requests.
+var ErrApprovalLimit = errors.New("ratchetserver: too many pending approval requests")
+
+// MaxPendingApprovals is the maximum number of pending requests per approver set.
+const MaxPendingApprovals = 16
+
+func newApprovalSet() *approvalSet {
+	return &approvalSet{
+		entries: make(map[[32]byte]*approvalRequest),
+		counts:  make(map[[32]byte]int),
+	}
+}
+
+// approverSet returns the key under which requests of approvers are counted.
+func approverSet(approvers [][32]byte) [32]byte {
+	h := sha256.New()
+	for _, approver := range approvers {
+		h.Write(approver[:])
+	}
+	var k [32]byte
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// insert records ar under id, replacing an earlier request. Must be called with mutex held.
+func (as *approvalSet) insert(id *[32]byte, ar *approvalRequest) {
+	if old, ok := as.entries[*id]; ok {
+		as.remove(id, old)
+	}
+	as.entries[*id] = ar
+	as.counts[approverSet(ar.approvers)]++
+}
+
+// remove deletes the request ar under id. Must be called with mutex held.
+func (as *approvalSet) remove(id *[32]byte, ar *approvalRequest) {
+	delete(as.entries, *id)
+	k := approverSet(ar.approvers)
+	if as.counts[k]--; as.counts[k] <= 0 {
+		delete(as.counts, k)
+	}
+}
+
+// request returns nil and removes the request id if it has enough approvals. Otherwise the request
+// is recorded and msgcrypt.ErrApprovalPending is returned. Changes are passed to persist first and
+// not made if it fails. At most MaxPendingApprovals requests are recorded per approver set.
+func (as *approvalSet) request(id *[32]byte, approvers [][32]byte, approvals uint8, now uint64, persist func([]byte) error) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	as.prune(now)
+	ar, ok := as.entries[*id]
+	if ok && ar.count() >= int(ar.approvals) {
+		if err := persist(approvalDelete(id)); err != nil {
+			return err
+		}
+		as.remove(id, ar)
+		return nil
+	}
+	if ok {
+		return msgcrypt.ErrApprovalPending
+	}
+	if as.counts[approverSet(approvers)] >= MaxPendingApprovals {
+		return ErrApprovalLimit
+	}
+	ar = &approvalRequest{
+		created:   now,
+		approvals: approvals,
+		approvers: approvers,
+		approved:  make([]bool, len(approvers)),
+	}
+	if err := persist(approvalEntry(id, ar)); err != nil {
+		return err
+	}
+	as.insert(id, ar)
+	return msgcrypt.ErrApprovalPending
+}
+
+// approve records a verified approval and calls persist with the updated request. Approvals must be
+// for a pending request, by one of its approvers and not older than the request.
+func (as *approvalSet) approve(a *msgcrypt.Approval, now uint64, persist func([]byte) error) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	as.prune(now)
+	ar, ok := as.entries[a.Request]
+	if !ok {
+		return msgcrypt.ErrApprovalUnknown
+	}
+	if a.Time+types.MaxClockSkew < ar.created {
+		return msgcrypt.ErrApprovalInvalid
+	}
+	for i, approver := range ar.approvers {
+		if approver != a.PublicKey {
+			continue
+		}
+		if ar.approved[i] {
+			return nil
+		}
+		ar.approved[i] = true
+		if err := persist(approvalEntry(&a.Request, ar)); err != nil {
+			ar.approved[i] = false
+			return err
+		}
+		return nil
+	}
+	return msgcrypt.ErrApprovalInvalid
+}
+
+// prune removes requests older than msgcrypt.ApprovalRetention. Must be called with mutex held.
+func (as *approvalSet) prune(now uint64) {
+	for id, ar := range as.entries {
+		if ar.created+msgcrypt.ApprovalRetention < now {
+			as.remove(&id, ar)
+		}
+	}
+}
+
+// store prunes the approval set and calls persist with its encoding.
+func (as *approvalSet) store(now uint64, persist func([]byte) error) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	as.prune(now)
+	return persist(as.marshall())
+}
+
+func approvalEntry(id *[32]byte, ar *approvalRequest) []byte {
+	d := make([]byte, approvalRequestHeaderSize, approvalRequestHeaderSize+33*len(ar.approvers))
+	d[0] = approvalRequestRecord
+	copy(d[1:33], id[:])
+	binary.BigEndian.PutUint64(d[33:41], ar.created)
+	d[41] = ar.approvals
+	d[42] = byte(len(ar.approvers))
+	for i, approver := range ar.approvers {
+		d = append(d, approver[:]...)
+		if ar.approved[i] {
+			d = append(d, 0x01)
+		} else {
+			d = append(d, 0x00)
+		}
+	}
+	return d
+}
+
+func approvalDelete(id *[32]byte) []byte {
+	d := make([]byte, approvalDeleteSize)
+	d[0] = approvalDeleteRecord
+	copy(d[1:33], id[:])
+	return d
+}
+
+func (as *approvalSet) marshall() []byte {
+	var o []byte
+	for id, ar := range as.entries {
+		o = append(o, approvalEntry(&id, ar)...)
+	}
+	return o
+}
+
+// Unmarshall an approval set or log. An incomplete last record, left by an interrupted append, is ignored.
+func (as *approvalSet) Unmarshall(d []byte) (*approvalSet, error) {
+	nas := newApprovalSet()
+	for len(d) > 0 {
+		var id [32]byte
+		switch d[0] {
+		case approvalRequestRecord:
+			if len(d) < approvalRequestHeaderSize {
+				return nas, nil
+			}
+			count := int(d[42])
+			if len(d) < approvalRequestHeaderSize+33*count {
+				return nas, nil
+			}
+			copy(id[:], d[1:33])
+			ar := &approvalRequest{
+				created:   binary.BigEndian.Uint64(d[33:41]),
+				approvals: d[41],
+				approvers: make([][32]byte, count),
+				approved:  make([]bool, count),
+			}
+			for i := 0; i < count; i++ {
+				e := d[approvalRequestHeaderSize+33*i:]
+				copy(ar.approvers[i][:], e[0:32])
+				ar.approved[i] = e[32] == 0x01
+			}
+			nas.insert(&id, ar)
+			d = d[approvalRequestHeaderSize+33*count:]
+		case approvalDeleteRecord:
+			if len(d) < approvalDeleteSize {
+				return nas, nil
+			}
+			copy(id[:], d[1:33])
+			if ar, ok := nas.entries[id]; ok {
+				nas.remove(&id, ar)
+			}
+			d = d[approvalDeleteSize:]
+		default:
+			return nil, errors.New("ratchetserver: unmarshall error")
+		}
+	}
+	return nas, nil
+}
@@ -0,0 +1,109 @@
+package ratchetserver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+func TestApprovalSet(t *testing.T) {
+	var stored []byte
+	persist := func(d []byte) error {
+		stored = append(stored, d...)
+		return nil
+	}
+	as := newApprovalSet()
+	id := &[32]byte{0x01}
+	approvers := [][32]byte{{0x0a}, {0x0b}, {0x0c}}
+	approval := func(approver [32]byte, time uint64) *msgcrypt.Approval {
+		return &msgcrypt.Approval{PublicKey: approver, Request: *id, Time: time}
+	}
+	if err := as.approve(approval(approvers[0], 10000), 10000, persist); err != msgcrypt.ErrApprovalUnknown {
+		t.Errorf("approve before request: %v", err)
+	}
+	if err := as.request(id, approvers, 2, 10000, persist); err != msgcrypt.ErrApprovalPending {
+		t.Fatalf("request: %v", err)
+	}
+	if err := as.approve(approval([32]byte{0x0d}, 10000), 10000, persist); err != msgcrypt.ErrApprovalInvalid {
+		t.Errorf("approve by other key: %v", err)
+	}
+	if err := as.approve(approval(approvers[0], 1), 10000, persist); err != msgcrypt.ErrApprovalInvalid {
+		t.Errorf("approve before request time: %v", err)
+	}
+	if err := as.approve(approval(approvers[0], 10000), 10000, persist); err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if err := as.approve(approval(approvers[0], 10001), 10001, persist); err != nil {
+		t.Fatalf("approve again: %s", err)
+	}
+	if err := as.request(id, approvers, 2, 10001, persist); err != msgcrypt.ErrApprovalPending {
+		t.Errorf("request with one approval: %v", err)
+	}
+	as2, err := new(approvalSet).Unmarshall(append(stored, approvalRequestRecord))
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	failing := func([]byte) error { return errors.New("disk full") }
+	if err := as2.approve(approval(approvers[2], 10002), 10002, failing); err == nil {
+		t.Error("approve must fail if not persisted")
+	}
+	if err := as2.request(id, approvers, 2, 10002, persist); err != msgcrypt.ErrApprovalPending {
+		t.Errorf("Failed approve must be reverted: %v", err)
+	}
+	if err := as2.approve(approval(approvers[2], 10002), 10002, persist); err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if err := as2.request(id, approvers, 2, 10003, persist); err != nil {
+		t.Errorf("request with approvals: %v", err)
+	}
+	if err := as2.request(id, approvers, 2, 10004, persist); err != msgcrypt.ErrApprovalPending {
+		t.Errorf("Approvals must be used up: %v", err)
+	}
+	as3, err := new(approvalSet).Unmarshall(stored)
+	if err != nil {
+		t.Fatalf("Unmarshall log: %s", err)
+	}
+	if ar := as3.entries[*id]; ar == nil || ar.count() != 0 || ar.created != 10004 {
+		t.Error("Approval log not replayed")
+	}
+	replace := func(d []byte) error {
+		stored = d
+		return nil
+	}
+	if err := as2.store(10004+msgcrypt.ApprovalRetention+1, replace); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if len(stored) != 0 {
+		t.Error("Old requests must be pruned")
+	}
+	if _, err := new(approvalSet).Unmarshall([]byte("unknown record")); err == nil {
+		t.Error("Unmarshall must fail on unknown records")
+	}
+}
+
+func TestApprovalLimit(t *testing.T) {
+	persist := func([]byte) error { return nil }
+	as := newApprovalSet()
+	approvers := [][32]byte{{0x0a}, {0x0b}}
+	for i := 0; i < MaxPendingApprovals; i++ {
+		if err := as.request(&[32]byte{byte(i)}, approvers, 1, 10000, persist); err != msgcrypt.ErrApprovalPending {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := as.request(&[32]byte{0xff}, approvers, 1, 10000, persist); err != ErrApprovalLimit {
+		t.Errorf("request over limit: %v", err)
+	}
+	if err := as.request(&[32]byte{0xff}, approvers[:1], 1, 10000, persist); err != msgcrypt.ErrApprovalPending {
+		t.Errorf("Limit must apply per approver set: %v", err)
+	}
+	if err := as.approve(&msgcrypt.Approval{PublicKey: approvers[0], Request: [32]byte{0x00}, Time: 10000}, 10000, persist); err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if err := as.request(&[32]byte{0x00}, approvers, 1, 10000, persist); err != nil {
+		t.Fatalf("request with approval: %v", err)
+	}
+	if err := as.request(&[32]byte{0xfe}, approvers, 1, 10000, persist); err != msgcrypt.ErrApprovalPending {
+		t.Errorf("request after approved request: %v", err)
+	}
+}
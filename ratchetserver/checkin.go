@@ -0,0 +1,120 @@
+package ratchetserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+// ErrCheckinRate is returned if too many new lock owners checked in within the last minute.
+var ErrCheckinRate = errors.New("ratchetserver: too many new check-ins")
+
+// MaxNewCheckins is the maximum number of new lock owners recorded per minute. Check-ins of
+// known owners are not limited. The set holds at most MaxNewCheckins owners per minute of
+// msgcrypt.MaxCheckinInterval.
+const MaxNewCheckins = 20
+
+// checkinSet records the last check-in of each lock owner. Each check-in is appended to
+// persistent storage before it is acknowledged, the periodic persistence of the server
+// replaces the log with the pruned set.
+type checkinSet struct {
+	mutex     sync.Mutex
+	entries   map[[32]byte]uint64
+	minute    uint64 // Minute in which newOwners were recorded.
+	newOwners int    // Number of new owners recorded in minute.
+}
+
+// Check-in set and log format:
+//
+// (OwnerKey | Time (uint64))...
+//
+// A later entry of the same owner replaces earlier ones.
+
+const checkinEntrySize = 32 + 8
+
+func newCheckinSet() *checkinSet {
+	return &checkinSet{entries: make(map[[32]byte]uint64)}
+}
+
+// checkin records a check-in of ownerKey at time and calls persist with its entry. The check-in
+// is not recorded if persist fails. At most MaxNewCheckins new owners are recorded per minute.
+func (cs *checkinSet) checkin(ownerKey *[32]byte, time, now uint64, persist func([]byte) error) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	last, ok := cs.entries[*ownerKey]
+	if ok && last >= time {
+		return msgcrypt.ErrCheckinReplay
+	}
+	if !ok {
+		if minute := now / 60; minute != cs.minute {
+			cs.minute = minute
+			cs.newOwners = 0
+		}
+		if cs.newOwners >= MaxNewCheckins {
+			return ErrCheckinRate
+		}
+	}
+	if err := persist(checkinEntry(ownerKey, time)); err != nil {
+		return err
+	}
+	if !ok {
+		cs.newOwners++
+	}
+	cs.entries[*ownerKey] = time
+	return nil
+}
+
+func checkinEntry(ownerKey *[32]byte, time uint64) []byte {
+	d := make([]byte, checkinEntrySize)
+	copy(d[0:32], ownerKey[:])
+	binary.BigEndian.PutUint64(d[32:40], time)
+	return d
+}
+
+// last returns the time of the last check-in of ownerKey, or 0 if there is none.
+func (cs *checkinSet) last(ownerKey *[32]byte) uint64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.entries[*ownerKey]
+}
+
+// prune removes check-ins older than msgcrypt.MaxCheckinInterval. Must be called with mutex held.
+func (cs *checkinSet) prune(now uint64) {
+	for k, t := range cs.entries {
+		if t+msgcrypt.MaxCheckinInterval < now {
+			delete(cs.entries, k)
+		}
+	}
+}
+
+// store prunes the check-in set and calls persist with its encoding.
+func (cs *checkinSet) store(now uint64, persist func([]byte) error) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.prune(now)
+	return persist(cs.marshall())
+}
+
+func (cs *checkinSet) marshall() []byte {
+	o := make([]byte, 0, len(cs.entries)*checkinEntrySize)
+	for k, t := range cs.entries {
+		o = append(o, checkinEntry(&k, t)...)
+	}
+	return o
+}
+
+// Unmarshall a check-in set or log. An incomplete last entry, left by an interrupted append, is ignored.
+func (cs *checkinSet) Unmarshall(d []byte) (*checkinSet, error) {
+	d = d[:len(d)-len(d)%checkinEntrySize]
+	ncs := newCheckinSet()
+	for ; len(d) > 0; d = d[checkinEntrySize:] {
+		var k [32]byte
+		copy(k[:], d[0:32])
+		if t := binary.BigEndian.Uint64(d[32:40]); t > ncs.entries[k] {
+			ncs.entries[k] = t
+		}
+	}
+	return ncs, nil
+}
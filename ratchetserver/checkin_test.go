@@ -0,0 +1,121 @@
+package ratchetserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestCheckinSet(t *testing.T) {
+	var stored, log []byte
+	persist := func(d []byte) error {
+		stored = d
+		log = nil
+		return nil
+	}
+	appendLog := func(d []byte) error {
+		log = append(log, d...)
+		return nil
+	}
+	cs := newCheckinSet()
+	k1, k2 := &[32]byte{0x01}, &[32]byte{0x02}
+	if err := cs.checkin(k1, 90, 100, appendLog); err != nil {
+		t.Fatalf("checkin: %s", err)
+	}
+	if err := cs.store(100, persist); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if err := cs.checkin(k1, 100, 100, appendLog); err != nil {
+		t.Fatalf("checkin: %s", err)
+	}
+	if err := cs.checkin(k1, 100, 100, appendLog); err != msgcrypt.ErrCheckinReplay {
+		t.Errorf("checkin replay: %v", err)
+	}
+	if err := cs.checkin(k2, 50, 100, appendLog); err != nil {
+		t.Fatalf("checkin: %s", err)
+	}
+	if len(log) != 2*checkinEntrySize {
+		t.Fatalf("Check-ins not appended: %d bytes", len(log))
+	}
+	// Snapshot followed by the log, with a torn last entry.
+	cs2, err := new(checkinSet).Unmarshall(append(append(stored, log...), 0x01, 0x02))
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	if cs2.last(k1) != 100 || cs2.last(k2) != 50 {
+		t.Error("Check-ins not restored")
+	}
+	if err := cs.checkin(k2, 60, 100, func([]byte) error { return errors.New("fail") }); err == nil {
+		t.Error("checkin must fail if not persisted")
+	}
+	if cs.last(k2) != 50 {
+		t.Error("Check-in recorded without persisting")
+	}
+	if err := cs2.store(50+msgcrypt.MaxCheckinInterval+1, persist); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if cs2.last(k2) != 0 || cs2.last(k1) != 100 {
+		t.Error("Old check-ins must be pruned")
+	}
+}
+
+func TestCheckinRate(t *testing.T) {
+	appendLog := func([]byte) error { return nil }
+	cs := newCheckinSet()
+	var k [32]byte
+	for i := 0; i < MaxNewCheckins; i++ {
+		binary.BigEndian.PutUint64(k[:], uint64(i))
+		if err := cs.checkin(&k, 100, 100, appendLog); err != nil {
+			t.Fatalf("checkin %d: %s", i, err)
+		}
+	}
+	binary.BigEndian.PutUint64(k[:], MaxNewCheckins)
+	if err := cs.checkin(&k, 100, 100, appendLog); err != ErrCheckinRate {
+		t.Errorf("checkin above rate: %v", err)
+	}
+	binary.BigEndian.PutUint64(k[:], 0)
+	if err := cs.checkin(&k, 110, 110, appendLog); err != nil {
+		t.Errorf("checkin of known owner above rate: %s", err)
+	}
+	binary.BigEndian.PutUint64(k[:], MaxNewCheckins)
+	if err := cs.checkin(&k, 180, 180, appendLog); err != nil {
+		t.Errorf("checkin in next minute: %s", err)
+	}
+}
+
+func TestCheckinPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	persistence := &DummyFileStore{Path: dir}
+	rs, err := NewRatchetServer(persistence, rand.Reader, 3600, 24*3600)
+	if err != nil {
+		t.Fatalf("NewRatchetServer: %s", err)
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	priv := new([ed25519.PrivateKeySize]byte)
+	copy(priv[:], privateKey)
+	c := msgcrypt.NewCheckin(priv, unixNow())
+	if err := rs.Checkin(c.Bytes()); err != nil {
+		t.Fatalf("Checkin: %s", err)
+	}
+	// Acknowledged check-ins survive a restart without periodic persistence.
+	rs2, err := LoadRatchetServer(persistence, rand.Reader)
+	if err != nil {
+		t.Fatalf("LoadRatchetServer: %s", err)
+	}
+	if last, _ := rs2.lastCheckin(&c.PublicKey); last != c.Time {
+		t.Error("Check-in not persisted")
+	}
+}
@@ -0,0 +1,216 @@
+package ratchetserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+// ErrPendingLimit is returned if a cancel key has too many pending requests.
+var ErrPendingLimit = errors.New("ratchetserver: too many pending unlocks")
+
+// MaxPendingUnlocks is the maximum number of pending requests per cancel key.
+const MaxPendingUnlocks = 16
+
+// pendingRequest is a response held back for a delayed message.
+type pendingRequest struct {
+	cancelKey [32]byte
+	created   uint64
+	readyAt   uint64
+	response  []byte
+}
+
+// pendingSet records the responses to delayed messages by ticket ID. Each added request and each
+// cancellation is appended to persistent storage before it takes effect, the periodic persistence
+// of the server replaces the log with the pruned set.
+type pendingSet struct {
+	mutex   sync.Mutex
+	entries map[[32]byte]*pendingRequest
+	counts  map[[32]byte]int // Number of entries per cancel key.
+}
+
+// Pending set and log format:
+//
+// (Add | Cancel)...
+//
+// Add:    'A' | ID | CancelKey | Created (uint64) | ReadyAt (uint64) | Length (uint32) | Response
+// Cancel: 'C' | CancelKey | Time (uint64)
+//
+// The set contains only Add records. A Cancel record removes the requests of CancelKey added
+// before it that were created until Time.
+
+const (
+	pendingAdd    = 'A'
+	pendingCancel = 'C'
+
+	pendingAddHeaderSize = 1 + 32 + 32 + 8 + 8 + 4
+	pendingCancelSize    = 1 + 32 + 8
+)
+
+func newPendingSet() *pendingSet {
+	return &pendingSet{
+		entries: make(map[[32]byte]*pendingRequest),
+		counts:  make(map[[32]byte]int),
+	}
+}
+
+// add records a pending request under id and calls persist with its record. The request is not
+// recorded if persist fails. At most MaxPendingUnlocks requests are recorded per cancel key.
+func (ps *pendingSet) add(id *[32]byte, pr *pendingRequest, persist func([]byte) error) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.prune(pr.created)
+	if _, ok := ps.entries[*id]; ok {
+		return errors.New("ratchetserver: duplicate ticket")
+	}
+	if ps.counts[pr.cancelKey] >= MaxPendingUnlocks {
+		return ErrPendingLimit
+	}
+	if err := persist(pendingAddRecord(id, pr)); err != nil {
+		return err
+	}
+	ps.insert(id, pr)
+	return nil
+}
+
+// insert records pr under id. Must be called with mutex held.
+func (ps *pendingSet) insert(id *[32]byte, pr *pendingRequest) {
+	if old, ok := ps.entries[*id]; ok {
+		ps.remove(id, old)
+	}
+	ps.entries[*id] = pr
+	ps.counts[pr.cancelKey]++
+}
+
+// remove deletes the request pr under id. Must be called with mutex held.
+func (ps *pendingSet) remove(id *[32]byte, pr *pendingRequest) {
+	delete(ps.entries, *id)
+	if ps.counts[pr.cancelKey]--; ps.counts[pr.cancelKey] <= 0 {
+		delete(ps.counts, pr.cancelKey)
+	}
+}
+
+// poll returns the response of the request id if it is ready at now.
+func (ps *pendingSet) poll(id *[32]byte, now uint64) ([]byte, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	pr, ok := ps.entries[*id]
+	if !ok || pr.readyAt+msgcrypt.TicketRetention < now {
+		return nil, msgcrypt.ErrTicketUnknown
+	}
+	if pr.readyAt > now {
+		return nil, msgcrypt.ErrUnlockPending
+	}
+	return pr.response, nil
+}
+
+// cancel removes all requests of cancelKey created until time and calls persist with the
+// cancellation record. No request is removed if persist fails.
+func (ps *pendingSet) cancel(cancelKey *[32]byte, time, now uint64, persist func([]byte) error) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.prune(now)
+	if ps.counts[*cancelKey] == 0 {
+		return nil
+	}
+	if err := persist(pendingCancelRecord(cancelKey, time)); err != nil {
+		return err
+	}
+	ps.cancelEntries(cancelKey, time)
+	return nil
+}
+
+// cancelEntries removes all requests of cancelKey created until time. Must be called with mutex held.
+func (ps *pendingSet) cancelEntries(cancelKey *[32]byte, time uint64) {
+	for id, pr := range ps.entries {
+		if pr.cancelKey == *cancelKey && pr.created <= time {
+			ps.remove(&id, pr)
+		}
+	}
+}
+
+// prune removes requests whose response was ready for longer than msgcrypt.TicketRetention.
+// Must be called with mutex held.
+func (ps *pendingSet) prune(now uint64) {
+	for id, pr := range ps.entries {
+		if pr.readyAt+msgcrypt.TicketRetention < now {
+			ps.remove(&id, pr)
+		}
+	}
+}
+
+// store prunes the pending set and calls persist with its encoding.
+func (ps *pendingSet) store(now uint64, persist func([]byte) error) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.prune(now)
+	return persist(ps.marshall())
+}
+
+func pendingAddRecord(id *[32]byte, pr *pendingRequest) []byte {
+	d := make([]byte, pendingAddHeaderSize, pendingAddHeaderSize+len(pr.response))
+	d[0] = pendingAdd
+	copy(d[1:33], id[:])
+	copy(d[33:65], pr.cancelKey[:])
+	binary.BigEndian.PutUint64(d[65:73], pr.created)
+	binary.BigEndian.PutUint64(d[73:81], pr.readyAt)
+	binary.BigEndian.PutUint32(d[81:85], uint32(len(pr.response)))
+	return append(d, pr.response...)
+}
+
+func pendingCancelRecord(cancelKey *[32]byte, time uint64) []byte {
+	d := make([]byte, pendingCancelSize)
+	d[0] = pendingCancel
+	copy(d[1:33], cancelKey[:])
+	binary.BigEndian.PutUint64(d[33:41], time)
+	return d
+}
+
+func (ps *pendingSet) marshall() []byte {
+	var o []byte
+	for id, pr := range ps.entries {
+		o = append(o, pendingAddRecord(&id, pr)...)
+	}
+	return o
+}
+
+// Unmarshall a pending set or log. An incomplete last record, left by an interrupted append, is ignored.
+func (ps *pendingSet) Unmarshall(d []byte) (*pendingSet, error) {
+	nps := newPendingSet()
+	for len(d) > 0 {
+		switch d[0] {
+		case pendingAdd:
+			if len(d) < pendingAddHeaderSize {
+				return nps, nil
+			}
+			l := int(binary.BigEndian.Uint32(d[81:85]))
+			if len(d) < pendingAddHeaderSize+l {
+				return nps, nil
+			}
+			var id [32]byte
+			copy(id[:], d[1:33])
+			pr := &pendingRequest{
+				created:  binary.BigEndian.Uint64(d[65:73]),
+				readyAt:  binary.BigEndian.Uint64(d[73:81]),
+				response: make([]byte, l),
+			}
+			copy(pr.cancelKey[:], d[33:65])
+			copy(pr.response, d[pendingAddHeaderSize:pendingAddHeaderSize+l])
+			nps.insert(&id, pr)
+			d = d[pendingAddHeaderSize+l:]
+		case pendingCancel:
+			if len(d) < pendingCancelSize {
+				return nps, nil
+			}
+			var cancelKey [32]byte
+			copy(cancelKey[:], d[1:33])
+			nps.cancelEntries(&cancelKey, binary.BigEndian.Uint64(d[33:41]))
+			d = d[pendingCancelSize:]
+		default:
+			return nil, errors.New("ratchetserver: unmarshall error")
+		}
+	}
+	return nps, nil
+}
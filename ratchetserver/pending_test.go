@@ -0,0 +1,113 @@
+package ratchetserver
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+func TestPendingSet(t *testing.T) {
+	var stored []byte
+	persist := func(d []byte) error {
+		stored = append(stored, d...)
+		return nil
+	}
+	ps := newPendingSet()
+	id1, id2, id3 := &[32]byte{0x01}, &[32]byte{0x02}, &[32]byte{0x03}
+	k1, k2 := [32]byte{0x01}, [32]byte{0x02}
+	if err := ps.add(id1, &pendingRequest{cancelKey: k1, created: 100, readyAt: 200, response: []byte("response 1")}, persist); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if err := ps.add(id1, &pendingRequest{cancelKey: k1, created: 100, readyAt: 200}, persist); err == nil {
+		t.Error("add must fail on duplicate ticket")
+	}
+	if err := ps.add(id2, &pendingRequest{cancelKey: k2, created: 100, readyAt: 300, response: []byte("response 2")}, persist); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if _, err := ps.poll(id1, 150); err != msgcrypt.ErrUnlockPending {
+		t.Errorf("poll before ready: %v", err)
+	}
+	if _, err := ps.poll(id3, 150); err != msgcrypt.ErrTicketUnknown {
+		t.Errorf("poll unknown ticket: %v", err)
+	}
+	ps2, err := new(pendingSet).Unmarshall(append(stored, pendingCancel))
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	if response, err := ps2.poll(id1, 200); err != nil || !bytes.Equal(response, []byte("response 1")) {
+		t.Errorf("Pending request not restored: %v", err)
+	}
+	failing := func([]byte) error { return errors.New("disk full") }
+	if err := ps2.cancel(&k1, 150, 150, failing); err == nil {
+		t.Error("cancel must fail if not persisted")
+	}
+	if _, err := ps2.poll(id1, 200); err != nil {
+		t.Error("Failed cancel must be reverted")
+	}
+	if err := ps2.cancel(&k1, 50, 150, persist); err != nil {
+		t.Fatalf("cancel: %s", err)
+	}
+	if _, err := ps2.poll(id1, 200); err != nil {
+		t.Error("Requests after cancel time must not be cancelled")
+	}
+	if err := ps2.cancel(&k1, 150, 150, persist); err != nil {
+		t.Fatalf("cancel: %s", err)
+	}
+	if _, err := ps2.poll(id1, 200); err != msgcrypt.ErrTicketUnknown {
+		t.Errorf("poll cancelled ticket: %v", err)
+	}
+	ps3, err := new(pendingSet).Unmarshall(stored)
+	if err != nil {
+		t.Fatalf("Unmarshall log: %s", err)
+	}
+	if _, err := ps3.poll(id1, 200); err != msgcrypt.ErrTicketUnknown {
+		t.Errorf("Cancellation not restored from log: %v", err)
+	}
+	if _, err := ps3.poll(id2, 300); err != nil {
+		t.Errorf("Pending request not restored from log: %v", err)
+	}
+	if _, err := ps2.poll(id2, 300); err != nil {
+		t.Errorf("Other cancel key affected: %v", err)
+	}
+	if _, err := ps2.poll(id2, 300+msgcrypt.TicketRetention+1); err != msgcrypt.ErrTicketUnknown {
+		t.Errorf("poll expired ticket: %v", err)
+	}
+	replace := func(d []byte) error {
+		stored = d
+		return nil
+	}
+	if err := ps2.store(300+msgcrypt.TicketRetention+1, replace); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if len(stored) != 0 {
+		t.Error("Expired requests must be pruned")
+	}
+	if _, err := new(pendingSet).Unmarshall([]byte("unknown record")); err == nil {
+		t.Error("Unmarshall must fail on unknown records")
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+	persist := func([]byte) error { return nil }
+	ps := newPendingSet()
+	k1, k2 := [32]byte{0x01}, [32]byte{0x02}
+	for i := 0; i < MaxPendingUnlocks; i++ {
+		if err := ps.add(&[32]byte{byte(i)}, &pendingRequest{cancelKey: k1, created: 100, readyAt: 200}, persist); err != nil {
+			t.Fatalf("add %d: %s", i, err)
+		}
+	}
+	if err := ps.add(&[32]byte{0xff}, &pendingRequest{cancelKey: k1, created: 100, readyAt: 200}, persist); err != ErrPendingLimit {
+		t.Errorf("add over limit: %v", err)
+	}
+	if err := ps.add(&[32]byte{0xff}, &pendingRequest{cancelKey: k2, created: 100, readyAt: 200}, persist); err != nil {
+		t.Errorf("Limit must apply per cancel key: %v", err)
+	}
+	if err := ps.cancel(&k1, 100, 100, persist); err != nil {
+		t.Fatalf("cancel: %s", err)
+	}
+	if err := ps.add(&[32]byte{0xfe}, &pendingRequest{cancelKey: k1, created: 100, readyAt: 200}, persist); err != nil {
+		t.Errorf("add after cancel: %v", err)
+	}
+}
@@ -20,12 +20,25 @@ const (
 	StoreTypePregen
 	// StoreTypeKeyList for the pregenerated key list.
 	StoreTypeKeyList
+	// StoreTypeSpent for the nullifiers of use-limited messages.
+	StoreTypeSpent
+	// StoreTypeRelease for the timed-release fountain.
+	StoreTypeRelease
+	// StoreTypeReleaseList for the published timed-release key list.
+	StoreTypeReleaseList
+	// StoreTypeCheckin for the last check-ins of lock owners.
+	StoreTypeCheckin
+	// StoreTypePending for the held back responses to delayed messages.
+	StoreTypePending
+	// StoreTypeApproval for the approvals of pending requests.
+	StoreTypeApproval
 )
 
 // Persistence defines the persistency interface of a ratchet server.
 type Persistence interface {
-	Store(storeType StoreType, data []byte) error // Write data of type StoreType to persistent storage.
-	Load(storeType StoreType) ([]byte, error)     // Load data of type StoreType from persistent storage.
+	Store(storeType StoreType, data []byte) error  // Write data of type StoreType to persistent storage.
+	Load(storeType StoreType) ([]byte, error)      // Load data of type StoreType from persistent storage.
+	Append(storeType StoreType, data []byte) error // Append data to the data of type StoreType, durably.
 }
 
 // DummyFileStore is trivial storage to files.
@@ -47,6 +60,18 @@ func (dfs *DummyFileStore) getFileName(storeType StoreType) string {
 		fn = "pregenerator.state"
 	case StoreTypeKeyList:
 		fn = "keys.list"
+	case StoreTypeSpent:
+		fn = "spent.set"
+	case StoreTypeRelease:
+		fn = "release.state"
+	case StoreTypeReleaseList:
+		fn = "release.list"
+	case StoreTypeCheckin:
+		fn = "checkin.set"
+	case StoreTypePending:
+		fn = "pending.set"
+	case StoreTypeApproval:
+		fn = "approval.set"
 	default:
 		panic("Unknown storage type.")
 	}
@@ -58,11 +83,43 @@ func (dfs *DummyFileStore) mkDir() error {
 	return os.MkdirAll(dfs.Path, 0700)
 }
 
-// Store data.
+// Store data. The file is replaced atomically.
 func (dfs *DummyFileStore) Store(storeType StoreType, data []byte) error {
 	dfs.mkDir() // Ignore errors.
 	fn := dfs.getFileName(storeType)
-	return ioutil.WriteFile(fn, data, 0600)
+	f, err := ioutil.TempFile(dfs.Path, path.Base(fn)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Append data and sync it to disk.
+func (dfs *DummyFileStore) Append(storeType StoreType, data []byte) error {
+	dfs.mkDir() // Ignore errors.
+	fn := dfs.getFileName(storeType)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
 // Load data.
@@ -5,10 +5,12 @@ package ratchetserver
 import (
 	"errors"
 	"io"
+	"os"
 	"time"
 
 	"github.com/JonathanLogan/cypherlock/msgcrypt"
 	"github.com/JonathanLogan/cypherlock/ratchet"
+	"github.com/JonathanLogan/cypherlock/types"
 	"github.com/JonathanLogan/timesource"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
@@ -62,6 +64,16 @@ func (sk *ServerKeys) Unmarshall(d []byte) (*ServerKeys, error) {
 	return skn, nil
 }
 
+// ErrBatchSize is returned if a batch contains more than types.MaxDecryptBatch messages.
+var ErrBatchSize = errors.New("ratchetserver: batch too large")
+
+var (
+	// ReleaseDuration is the length of a timed-release period in seconds.
+	ReleaseDuration int64 = 24 * 3600
+	// ReleaseHorizon is for how many seconds into the future timed-release keys are published.
+	ReleaseHorizon int64 = 2 * 365 * 24 * 3600
+)
+
 // RatchetServer implements a ratchet server.
 type RatchetServer struct {
 	keys         *ServerKeys
@@ -69,7 +81,15 @@ type RatchetServer struct {
 	pregenerator *ratchet.PreGenerator
 	persistence  Persistence
 	keylist      []byte // current signed keylist pregeneration.
+	compactList  []byte // compact encoding of keylist.
 	serverConfig *msgcrypt.ServerConfig
+	spent        *spentSet // uses of use-limited messages.
+	checkins     *checkinSet
+	pending      *pendingSet  // held back responses to delayed messages.
+	approvals    *approvalSet // approvals of pending requests.
+	release      *ratchet.ReleaseFountain
+	releaseList  []byte // current signed timed-release keylist.
+	releaseFirst uint64 // first period in releaseList.
 	ticker       timesource.Ticker
 	isStarted    bool
 }
@@ -90,15 +110,30 @@ func NewRatchetServer(persistence Persistence, rand io.Reader, interKeyDuration,
 		return nil, err
 	}
 	rs.pregenerator = ratchet.NewPregeneratorFromFountain(rs.fountain, pregenInterval)
+	rs.spent = newSpentSet()
+	rs.checkins = newCheckinSet()
+	rs.pending = newPendingSet()
+	rs.approvals = newApprovalSet()
+	rs.release, err = ratchet.NewReleaseFountain(ReleaseDuration, rand)
+	if err != nil {
+		return nil, err
+	}
 	err = rs.persist()
 	if err != nil {
 		return nil, err
 	}
 	rs.serverConfig = &msgcrypt.ServerConfig{
-		PublicKey:     rs.keys.EncPublicKey,
-		PrivateKey:    rs.keys.EncPrivateKey,
-		GetSecretFunc: rs.fountain.GetSecret,
-		RandomSource:  rand,
+		PublicKey:       rs.keys.EncPublicKey,
+		PrivateKey:      rs.keys.EncPrivateKey,
+		GetSecretFunc:   rs.fountain.GetSecret,
+		BlindSecretFunc: rs.fountain.GetBlindSecrets,
+		SpendFunc:       rs.spend,
+		BurnFunc:        rs.burn,
+		CheckinFunc:     rs.lastCheckin,
+		DelayFunc:       rs.delay,
+		ApprovalFunc:    rs.approval,
+		SignatureKey:    &rs.keys.SigPrivateKey,
+		RandomSource:    rand,
 	}
 	return rs, nil
 }
@@ -133,7 +168,114 @@ func (rs *RatchetServer) persist() error {
 			return err
 		}
 	}
-	return nil
+	// StoreTypeRelease
+	if err := rs.persistence.Store(StoreTypeRelease, rs.release.Marshall()); err != nil {
+		return err
+	}
+	// StoreTypeReleaseList
+	if rs.releaseList != nil {
+		if err := rs.persistence.Store(StoreTypeReleaseList, rs.releaseList); err != nil {
+			return err
+		}
+	}
+	// StoreTypeCheckin
+	if err := rs.checkins.store(unixNow(), rs.storeCheckins); err != nil {
+		return err
+	}
+	// StoreTypePending
+	if err := rs.pending.store(unixNow(), rs.storePending); err != nil {
+		return err
+	}
+	// StoreTypeApproval
+	if err := rs.approvals.store(unixNow(), rs.storeApprovals); err != nil {
+		return err
+	}
+	// StoreTypeSpent
+	return rs.spent.store(unixNow(), rs.storeSpent)
+}
+
+func (rs *RatchetServer) storeCheckins(d []byte) error {
+	return rs.persistence.Store(StoreTypeCheckin, d)
+}
+
+func (rs *RatchetServer) appendCheckin(d []byte) error {
+	return rs.persistence.Append(StoreTypeCheckin, d)
+}
+
+// lastCheckin implements msgcrypt.CheckinFunc.
+func (rs *RatchetServer) lastCheckin(ownerKey *[32]byte) (uint64, error) {
+	return rs.checkins.last(ownerKey), nil
+}
+
+func (rs *RatchetServer) storePending(d []byte) error {
+	return rs.persistence.Store(StoreTypePending, d)
+}
+
+func (rs *RatchetServer) appendPending(d []byte) error {
+	return rs.persistence.Append(StoreTypePending, d)
+}
+
+// delay implements msgcrypt.DelayFunc.
+func (rs *RatchetServer) delay(response []byte, cancelKey *[32]byte, delay uint32) (*msgcrypt.Ticket, error) {
+	if delay > msgcrypt.MaxDelay {
+		return nil, msgcrypt.ErrDelay
+	}
+	ticket := new(msgcrypt.Ticket)
+	if _, err := io.ReadFull(rs.serverConfig.RandomSource, ticket.ID[:]); err != nil {
+		return nil, err
+	}
+	now := unixNow()
+	ticket.ReadyAt = now + uint64(delay)
+	pr := &pendingRequest{
+		cancelKey: *cancelKey,
+		created:   now,
+		readyAt:   ticket.ReadyAt,
+		response:  response,
+	}
+	if err := rs.pending.add(&ticket.ID, pr, rs.appendPending); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+func (rs *RatchetServer) storeApprovals(d []byte) error {
+	return rs.persistence.Store(StoreTypeApproval, d)
+}
+
+func (rs *RatchetServer) appendApproval(d []byte) error {
+	return rs.persistence.Append(StoreTypeApproval, d)
+}
+
+// approval implements msgcrypt.ApprovalFunc.
+func (rs *RatchetServer) approval(request *[32]byte, approvers [][32]byte, approvals uint8) error {
+	return rs.approvals.request(request, approvers, approvals, unixNow(), rs.appendApproval)
+}
+
+func (rs *RatchetServer) storeSpent(d []byte) error {
+	return rs.persistence.Store(StoreTypeSpent, d)
+}
+
+// spend records a use of a use-limited message. The record is kept as long as the ratchet key
+// of the message can be in the ring, at most until the message expires.
+func (rs *RatchetServer) spend(nullifier *[32]byte, maxUses uint32, expire uint64) error {
+	now := unixNow()
+	if keyExpire := now + 3*uint64(rs.fountain.Duration()); keyExpire < expire {
+		expire = keyExpire
+	}
+	return rs.spent.spend(nullifier, maxUses, expire, now, rs.storeSpent)
+}
+
+// burn implements msgcrypt.BurnFunc. Burned messages may be valid only in the future.
+func (rs *RatchetServer) burn(nullifier *[32]byte, expire uint64) error {
+	now := unixNow()
+	if keyExpire := now + uint64(rs.pregenerator.Interval()+3*rs.fountain.Duration()); keyExpire < expire {
+		expire = keyExpire
+	}
+	return rs.spent.burn(nullifier, expire, now, rs.storeSpent)
+}
+
+func unixNow() uint64 {
+	return uint64(timesource.Clock.Now().Unix())
 }
 
 // LoadRatchetServer from persistence layer.
@@ -171,29 +313,129 @@ func LoadRatchetServer(persistence Persistence, rand io.Reader) (*RatchetServer,
 		return nil, err
 	}
 	rs.serverConfig = &msgcrypt.ServerConfig{
-		PublicKey:     rs.keys.EncPublicKey,
-		PrivateKey:    rs.keys.EncPrivateKey,
-		GetSecretFunc: rs.fountain.GetSecret,
-		RandomSource:  rand,
+		PublicKey:       rs.keys.EncPublicKey,
+		PrivateKey:      rs.keys.EncPrivateKey,
+		GetSecretFunc:   rs.fountain.GetSecret,
+		BlindSecretFunc: rs.fountain.GetBlindSecrets,
+		SpendFunc:       rs.spend,
+		BurnFunc:        rs.burn,
+		CheckinFunc:     rs.lastCheckin,
+		DelayFunc:       rs.delay,
+		ApprovalFunc:    rs.approval,
+		SignatureKey:    &rs.keys.SigPrivateKey,
+		RandomSource:    rand,
+	}
+	// StoreTypeSpent
+	if d, err := rs.persistence.Load(StoreTypeSpent); err == nil {
+		if rs.spent, err = new(spentSet).Unmarshall(d); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		rs.spent = newSpentSet()
+	} else {
+		return nil, err
+	}
+	// StoreTypeCheckin
+	if d, err := rs.persistence.Load(StoreTypeCheckin); err == nil {
+		if rs.checkins, err = new(checkinSet).Unmarshall(d); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		rs.checkins = newCheckinSet()
+	} else {
+		return nil, err
+	}
+	// StoreTypePending
+	if d, err := rs.persistence.Load(StoreTypePending); err == nil {
+		if rs.pending, err = new(pendingSet).Unmarshall(d); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		rs.pending = newPendingSet()
+	} else {
+		return nil, err
+	}
+	// StoreTypeApproval
+	if d, err := rs.persistence.Load(StoreTypeApproval); err == nil {
+		if rs.approvals, err = new(approvalSet).Unmarshall(d); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		rs.approvals = newApprovalSet()
+	} else {
+		return nil, err
+	}
+	// StoreTypeRelease. Servers created before timed-release get a new release fountain.
+	if d, err := rs.persistence.Load(StoreTypeRelease); err == nil {
+		if rs.release = new(ratchet.ReleaseFountain).Unmarshall(d); rs.release == nil {
+			return nil, errors.New("ratchetserver: release state cannot be loaded")
+		}
+	} else if os.IsNotExist(err) {
+		if rs.release, err = ratchet.NewReleaseFountain(ReleaseDuration, rand); err != nil {
+			return nil, err
+		}
+		if err := rs.persistence.Store(StoreTypeRelease, rs.release.Marshall()); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+	// StoreTypeReleaseList
+	if d, err := rs.persistence.Load(StoreTypeReleaseList); err == nil {
+		if keylist, err := new(types.RatchetList).Parse(d); err == nil && len(keylist.PublicKeys) > 0 {
+			rs.releaseList = d
+			rs.releaseFirst = keylist.PublicKeys[0].Counter
+		}
 	}
 	// StoreTypeKeyList
 	if d, err := rs.persistence.Load(StoreTypeKeyList); err == nil {
 		rs.keylist = d
+		if keylist, err := new(types.RatchetList).Parse(d); err == nil {
+			rs.compactList, _ = keylist.Compact() // Ignore error, only serve full list.
+		}
 	}
 	return rs, nil
 }
 
-// GenerateKeys generates the ratchet server keys.
+// GenerateKeys generates the ratchet server keys. If no keys are due, the current keylist is
+// reissued, so that clients always receive a keylist issued within the last pregeneration tick.
 func (rs *RatchetServer) GenerateKeys() {
-	if keylist := rs.pregenerator.Generate(); keylist != nil {
+	keylist := rs.pregenerator.Generate()
+	if keylist == nil && rs.keylist != nil {
+		current, err := new(types.RatchetList).Parse(rs.keylist)
+		if err != nil {
+			panic(err)
+		}
+		keylist = current.Reissue(uint64(timesource.Clock.Now().Unix()))
+	}
+	if keylist != nil {
 		keylist.EnvelopeKey = rs.keys.EncPublicKey
 		keylist.SignatureKey = rs.keys.SigPublicKey
 		keylist.Sign(&rs.keys.SigPrivateKey)
 		rs.keylist = keylist.Bytes()
+		rs.compactList, _ = keylist.Compact() // Ignore error, only serve full list.
 		if err := rs.persistence.Store(StoreTypeKeyList, keylist.Bytes()); err != nil {
 			panic(err)
 		}
 	}
+	rs.generateReleaseKeys()
+}
+
+// generateReleaseKeys publishes a new timed-release keylist when the first period of the
+// current one has started.
+func (rs *RatchetServer) generateReleaseKeys() {
+	if rs.releaseList != nil && rs.releaseFirst > rs.release.CurrentPeriod() {
+		return
+	}
+	keylist := rs.release.Generate(ReleaseHorizon)
+	keylist.EnvelopeKey = types.ReleaseEnvelopeKey
+	keylist.SignatureKey = rs.keys.SigPublicKey
+	keylist.Sign(&rs.keys.SigPrivateKey)
+	rs.releaseList = keylist.Bytes()
+	rs.releaseFirst = keylist.PublicKeys[0].Counter
+	if err := rs.persistence.Store(StoreTypeReleaseList, rs.releaseList); err != nil {
+		panic(err)
+	}
 }
 
 // StartService starts the ratchet server goroutine.
@@ -230,7 +472,102 @@ func (rs *RatchetServer) GetKeys() []byte {
 	return kl
 }
 
+// GetCompactKeys returns the current pregenerated keys in compact encoding, or nil if not available. EXPOSED.
+func (rs *RatchetServer) GetCompactKeys() []byte {
+	kl := make([]byte, len(rs.compactList))
+	copy(kl, rs.compactList)
+	return kl
+}
+
+// GetReleaseKeys returns the current timed-release keylist. EXPOSED.
+func (rs *RatchetServer) GetReleaseKeys() []byte {
+	kl := make([]byte, len(rs.releaseList))
+	copy(kl, rs.releaseList)
+	return kl
+}
+
+// GetReleasedKey returns the signed private key of a timed-release period that has started. EXPOSED.
+func (rs *RatchetServer) GetReleasedKey(counter uint64) ([]byte, error) {
+	privateKey, validFrom, err := rs.release.Release(counter)
+	if err != nil {
+		return nil, err
+	}
+	rk := &types.ReleasedKey{
+		Counter:    counter,
+		ValidFrom:  validFrom,
+		PrivateKey: *privateKey,
+	}
+	rk.Sign(&rs.keys.SigPrivateKey)
+	return rk.Bytes(), nil
+}
+
 // Decrypt the message and return it's payload. Only use over TLS. EXPOSED.
 func (rs *RatchetServer) Decrypt(msg []byte) ([]byte, error) {
 	return rs.serverConfig.ProcessOracleMessage(msg)
 }
+
+// DecryptBatch decrypts the messages and returns a payload or an error for each. Only use over TLS. EXPOSED.
+func (rs *RatchetServer) DecryptBatch(msgs [][]byte) ([][]byte, []error, error) {
+	if len(msgs) > types.MaxDecryptBatch {
+		return nil, nil, ErrBatchSize
+	}
+	responses, errs := make([][]byte, len(msgs)), make([]error, len(msgs))
+	for i, msg := range msgs {
+		responses[i], errs[i] = rs.serverConfig.ProcessOracleMessage(msg)
+	}
+	return responses, errs, nil
+}
+
+// DecryptOblivious returns the blinded secrets of all current ratchet keys for blindedKey. EXPOSED.
+func (rs *RatchetServer) DecryptOblivious(blindedKey *[32]byte) ([]*[32]byte, error) {
+	return rs.serverConfig.ProcessObliviousRequest(blindedKey)
+}
+
+// Checkin records a signed check-in of a lock owner. EXPOSED.
+func (rs *RatchetServer) Checkin(d []byte) error {
+	c, err := new(msgcrypt.Checkin).Parse(d)
+	if err != nil {
+		return err
+	}
+	now := unixNow()
+	if err := c.Verify(now); err != nil {
+		return err
+	}
+	return rs.checkins.checkin(&c.PublicKey, c.Time, now, rs.appendCheckin)
+}
+
+// PollUnlock returns the response to a delayed message once its ticket is ready. EXPOSED.
+func (rs *RatchetServer) PollUnlock(ticket *[32]byte) ([]byte, error) {
+	return rs.pending.poll(ticket, unixNow())
+}
+
+// CancelUnlocks cancels the delayed messages of the owner of a signed Cancel. EXPOSED.
+func (rs *RatchetServer) CancelUnlocks(d []byte) error {
+	c, err := new(msgcrypt.Cancel).Parse(d)
+	if err != nil {
+		return err
+	}
+	now := unixNow()
+	if err := c.Verify(now); err != nil {
+		return err
+	}
+	return rs.pending.cancel(&c.PublicKey, c.Time, now, rs.appendPending)
+}
+
+// Approve records a signed approval of a pending request. EXPOSED.
+func (rs *RatchetServer) Approve(d []byte) error {
+	a, err := new(msgcrypt.Approval).Parse(d)
+	if err != nil {
+		return err
+	}
+	now := unixNow()
+	if err := a.Verify(now); err != nil {
+		return err
+	}
+	return rs.approvals.approve(a, now, rs.appendApproval)
+}
+
+// Burn a use-limited message so that it cannot be decrypted anymore. EXPOSED.
+func (rs *RatchetServer) Burn(msg []byte) error {
+	return rs.serverConfig.BurnOracleMessage(msg)
+}
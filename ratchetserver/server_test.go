@@ -1,8 +1,14 @@
 package ratchetserver
 
 import (
+	"bytes"
 	"crypto/rand"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/JonathanLogan/cypherlock/ratchet"
+	"github.com/JonathanLogan/cypherlock/types"
 )
 
 func TestMarshall(t *testing.T) {
@@ -28,3 +34,74 @@ func TestMarshall(t *testing.T) {
 		t.Error("SigPrivateKey")
 	}
 }
+
+func TestReleaseKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	persistence := &DummyFileStore{Path: dir}
+	rs, err := NewRatchetServer(persistence, rand.Reader, 3600, 24*3600)
+	if err != nil {
+		t.Fatalf("NewRatchetServer: %s", err)
+	}
+	rs.GenerateKeys()
+	list, err := new(types.RatchetList).Parse(rs.GetReleaseKeys())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	sigKey := rs.SignatureKey()
+	if !list.IsReleaseList() || !list.Verify(&sigKey) {
+		t.Error("Release list not signed")
+	}
+	if err := list.Validate(); err != nil {
+		t.Errorf("Validate: %s", err)
+	}
+	if _, err := rs.GetReleasedKey(list.PublicKeys[0].Counter); err != ratchet.ErrNotReleased {
+		t.Errorf("GetReleasedKey of future period: %v", err)
+	}
+	rkD, err := rs.GetReleasedKey(list.PublicKeys[0].Counter - 1)
+	if err != nil {
+		t.Fatalf("GetReleasedKey: %s", err)
+	}
+	rk, err := new(types.ReleasedKey).Parse(rkD)
+	if err != nil {
+		t.Fatalf("Parse released key: %s", err)
+	}
+	if !rk.Verify(&sigKey) {
+		t.Error("Released key not signed")
+	}
+	rs2, err := LoadRatchetServer(persistence, rand.Reader)
+	if err != nil {
+		t.Fatalf("LoadRatchetServer: %s", err)
+	}
+	if !bytes.Equal(rs2.GetReleaseKeys(), rs.GetReleaseKeys()) {
+		t.Error("Release list not persisted")
+	}
+	if rkD2, err := rs2.GetReleasedKey(rk.Counter); err != nil || !bytes.Equal(rkD2, rkD) {
+		t.Errorf("Release fountain not persisted: %v", err)
+	}
+}
+
+func TestDecryptBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cypherlock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	rs, err := NewRatchetServer(&DummyFileStore{Path: dir}, rand.Reader, 3600, 24*3600)
+	if err != nil {
+		t.Fatalf("NewRatchetServer: %s", err)
+	}
+	responses, errs, err := rs.DecryptBatch([][]byte{[]byte("nothing"), []byte("else")})
+	if err != nil {
+		t.Fatalf("DecryptBatch: %s", err)
+	}
+	if len(responses) != 2 || len(errs) != 2 || errs[0] == nil || errs[1] == nil {
+		t.Error("DecryptBatch must return an error per invalid message")
+	}
+	if _, _, err := rs.DecryptBatch(make([][]byte, types.MaxDecryptBatch+1)); err != ErrBatchSize {
+		t.Errorf("DecryptBatch of too many messages: %v", err)
+	}
+}
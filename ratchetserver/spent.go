@@ -0,0 +1,122 @@
+package ratchetserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+// spentEntry records the uses of a message.
+type spentEntry struct {
+	uses   uint32 // Number of times the message has been used.
+	expire uint64 // Unix time after which the entry can be pruned.
+}
+
+// spentSet records the uses of use-limited messages.
+type spentSet struct {
+	mutex   sync.Mutex
+	entries map[[32]byte]*spentEntry
+}
+
+const spentEntrySize = 32 + 4 + 8
+
+func newSpentSet() *spentSet {
+	return &spentSet{entries: make(map[[32]byte]*spentEntry)}
+}
+
+// spend records one use of nullifier and calls persist with the new encoding. The use is reverted if persist fails.
+func (ss *spentSet) spend(nullifier *[32]byte, maxUses uint32, expire, now uint64, persist func([]byte) error) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.prune(now)
+	e, ok := ss.entries[*nullifier]
+	if !ok {
+		e = &spentEntry{expire: expire}
+		ss.entries[*nullifier] = e
+	}
+	if e.uses >= maxUses {
+		return msgcrypt.ErrMessageSpent
+	}
+	e.uses++
+	if err := persist(ss.marshall()); err != nil {
+		e.uses--
+		if e.uses == 0 {
+			delete(ss.entries, *nullifier)
+		}
+		return err
+	}
+	return nil
+}
+
+// burn uses up all uses of nullifier and calls persist with the new encoding. The entry is
+// restored if persist fails.
+func (ss *spentSet) burn(nullifier *[32]byte, expire, now uint64, persist func([]byte) error) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.prune(now)
+	e, ok := ss.entries[*nullifier]
+	if !ok {
+		e = &spentEntry{expire: expire}
+		ss.entries[*nullifier] = e
+	}
+	uses := e.uses
+	e.uses = math.MaxUint32
+	if err := persist(ss.marshall()); err != nil {
+		e.uses = uses
+		if e.uses == 0 {
+			delete(ss.entries, *nullifier)
+		}
+		return err
+	}
+	return nil
+}
+
+// prune removes expired entries. Must be called with mutex held.
+func (ss *spentSet) prune(now uint64) {
+	for k, e := range ss.entries {
+		if e.expire < now {
+			delete(ss.entries, k)
+		}
+	}
+}
+
+// store prunes the spent set and calls persist with its encoding. Holding the mutex while
+// persisting prevents an older encoding from overwriting a newer one.
+func (ss *spentSet) store(now uint64, persist func([]byte) error) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.prune(now)
+	return persist(ss.marshall())
+}
+
+func (ss *spentSet) marshall() []byte {
+	o := make([]byte, 0, len(ss.entries)*spentEntrySize)
+	for k, e := range ss.entries {
+		d := make([]byte, spentEntrySize)
+		copy(d[0:32], k[:])
+		binary.BigEndian.PutUint32(d[32:36], e.uses)
+		binary.BigEndian.PutUint64(d[36:44], e.expire)
+		o = append(o, d...)
+	}
+	return o
+}
+
+// Unmarshall a spent set.
+func (ss *spentSet) Unmarshall(d []byte) (*spentSet, error) {
+	if len(d)%spentEntrySize != 0 {
+		return nil, errors.New("ratchetserver: unmarshall error")
+	}
+	nss := newSpentSet()
+	for ; len(d) > 0; d = d[spentEntrySize:] {
+		var k [32]byte
+		copy(k[:], d[0:32])
+		nss.entries[k] = &spentEntry{
+			uses:   binary.BigEndian.Uint32(d[32:36]),
+			expire: binary.BigEndian.Uint64(d[36:44]),
+		}
+	}
+	return nss, nil
+}
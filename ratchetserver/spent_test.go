@@ -0,0 +1,67 @@
+package ratchetserver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JonathanLogan/cypherlock/msgcrypt"
+)
+
+func TestSpentSet(t *testing.T) {
+	var stored []byte
+	persist := func(d []byte) error {
+		stored = d
+		return nil
+	}
+	ss := newSpentSet()
+	n1, n2 := &[32]byte{0x01}, &[32]byte{0x02}
+	if err := ss.spend(n1, 2, 100, 10, persist); err != nil {
+		t.Fatalf("spend: %s", err)
+	}
+	if err := ss.spend(n1, 2, 100, 10, persist); err != nil {
+		t.Fatalf("spend: %s", err)
+	}
+	if err := ss.spend(n1, 2, 100, 10, persist); err != msgcrypt.ErrMessageSpent {
+		t.Errorf("spend beyond limit: %v", err)
+	}
+	if err := ss.spend(n2, 1, 50, 10, persist); err != nil {
+		t.Fatalf("spend: %s", err)
+	}
+	ss2, err := new(spentSet).Unmarshall(stored)
+	if err != nil {
+		t.Fatalf("Unmarshall: %s", err)
+	}
+	if err := ss2.spend(n1, 2, 100, 10, persist); err != msgcrypt.ErrMessageSpent {
+		t.Errorf("spend after reload: %v", err)
+	}
+	if err := ss2.spend(n2, 1, 50, 60, persist); err != nil {
+		t.Errorf("spend after expiry: %v", err)
+	}
+	failing := func([]byte) error { return errors.New("disk full") }
+	n3 := &[32]byte{0x03}
+	if err := ss2.spend(n3, 1, 100, 10, failing); err == nil {
+		t.Error("spend must fail if not persisted")
+	}
+	if err := ss2.spend(n3, 1, 100, 10, persist); err != nil {
+		t.Errorf("Failed spend must be reverted: %v", err)
+	}
+	n4 := &[32]byte{0x04}
+	if err := ss2.spend(n4, 3, 100, 10, persist); err != nil {
+		t.Fatalf("spend: %s", err)
+	}
+	if err := ss2.burn(n4, 100, 10, failing); err == nil {
+		t.Error("burn must fail if not persisted")
+	}
+	if err := ss2.spend(n4, 3, 100, 10, persist); err != nil {
+		t.Errorf("Failed burn must be reverted: %v", err)
+	}
+	if err := ss2.burn(n4, 100, 10, persist); err != nil {
+		t.Fatalf("burn: %s", err)
+	}
+	if err := ss2.spend(n4, 3, 100, 10, persist); err != msgcrypt.ErrMessageSpent {
+		t.Errorf("spend after burn: %v", err)
+	}
+	if _, err := new(spentSet).Unmarshall(stored[1:]); err == nil {
+		t.Error("Unmarshall must fail on truncated data")
+	}
+}
@@ -0,0 +1,118 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+package shamir
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrInvalidParameters is returned if the threshold or number of shares is out of range.
+	ErrInvalidParameters = errors.New("shamir: invalid parameters")
+	// ErrInvalidShares is returned if shares are empty, of different length or contain duplicates.
+	ErrInvalidShares = errors.New("shamir: invalid shares")
+)
+
+// MaxShares is the maximum number of shares.
+const MaxShares = 255
+
+// Share is one share of a secret. X is the evaluation point of the polynomials, never 0.
+type Share struct {
+	X     byte
+	Value []byte
+}
+
+// exp and log tables for GF(2^8) with polynomial x^8+x^4+x^3+x+1 and generator 3.
+var expTable, logTable [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		x = mul3(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+// mul3 multiplies by the generator without tables.
+func mul3(a byte) byte {
+	b := a << 1
+	if a&0x80 != 0 {
+		b ^= 0x1b
+	}
+	return b ^ a
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+255-int(logTable[b]))%255]
+}
+
+// Split secret into n shares of which k are required to recover it. Coefficients are read from rand.
+func Split(secret []byte, n, k int, rand io.Reader) ([]Share, error) {
+	if k < 1 || n < k || n > MaxShares || len(secret) == 0 {
+		return nil, ErrInvalidParameters
+	}
+	coefficients := make([]byte, len(secret)*(k-1))
+	if _, err := io.ReadFull(rand, coefficients); err != nil {
+		return nil, err
+	}
+	shares := make([]Share, n)
+	for i := range shares {
+		x := byte(i + 1)
+		shares[i].X = x
+		shares[i].Value = make([]byte, len(secret))
+		for j, s := range secret {
+			// Horner's method, highest coefficient first.
+			var y byte
+			for c := k - 2; c >= 0; c-- {
+				y = mul(y, x) ^ coefficients[j*(k-1)+c]
+			}
+			shares[i].Value[j] = mul(y, x) ^ s
+		}
+	}
+	return shares, nil
+}
+
+// Combine shares into the secret. At least the threshold number of shares must be given,
+// otherwise the result is garbage.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, ErrInvalidShares
+	}
+	l := len(shares[0].Value)
+	for i, s := range shares {
+		if s.X == 0 || len(s.Value) != l || l == 0 {
+			return nil, ErrInvalidShares
+		}
+		for _, o := range shares[:i] {
+			if o.X == s.X {
+				return nil, ErrInvalidShares
+			}
+		}
+	}
+	secret := make([]byte, l)
+	for i, s := range shares {
+		// Lagrange basis polynomial for s, evaluated at 0.
+		basis := byte(1)
+		for j, o := range shares {
+			if i != j {
+				basis = mul(basis, div(o.X, o.X^s.X))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(basis, s.Value[b])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,52 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if div(mul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatalf("mul/div: %d %d", a, b)
+			}
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("a secret of thirty-two bytes....")
+	shares, err := Split(secret, 5, 3, rand.Reader)
+	if err != nil {
+		t.Fatalf("Split: %s", err)
+	}
+	subsets := [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}}
+	for _, subset := range subsets {
+		var s []Share
+		for _, i := range subset {
+			s = append(s, shares[i])
+		}
+		r, err := Combine(s)
+		if err != nil {
+			t.Fatalf("Combine: %s", err)
+		}
+		if !bytes.Equal(r, secret) {
+			t.Errorf("Secret not recovered from %v", subset)
+		}
+	}
+	r, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("Combine: %s", err)
+	}
+	if bytes.Equal(r, secret) {
+		t.Error("Secret recovered below threshold")
+	}
+	if _, err := Combine([]Share{shares[0], shares[0]}); err != ErrInvalidShares {
+		t.Error("Duplicate shares must fail")
+	}
+	if _, err := Split(secret, 2, 3, rand.Reader); err != ErrInvalidParameters {
+		t.Error("Threshold above shares must fail")
+	}
+}
@@ -0,0 +1,90 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Compact keylist encoding. Counter, ValidFrom, ValidTo and LineHash of all entries are
+// derived from the fountain parameters, the first counter and PreviousLineHash, only the
+// public keys are stored:
+//
+// 0x11 | PreviousLineHash | IssuedAt | StartDate | Duration | FirstCounter | Count |
+// PublicKey * Count | EnvelopeKey | SignatureKey | Signature
+
+// ErrNotCompactable is returned if a list cannot be represented in compact encoding.
+var ErrNotCompactable = errors.New("types: keylist cannot be compacted")
+
+const (
+	compactHeaderSize  = 1 + 32 + 8 + 8 + 8 + 8 + 4
+	compactTrailerSize = 32 + ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+// IsCompact returns true if d is a compact encoded keylist.
+func IsCompact(d []byte) bool {
+	return len(d) > 0 && d[0] == 0x11
+}
+
+// Compact returns the compact encoding of a signed RatchetList. The list must be valid.
+func (rl *RatchetList) Compact() ([]byte, error) {
+	if err := rl.Validate(); err != nil {
+		return nil, ErrNotCompactable
+	}
+	ret := make([]byte, compactHeaderSize, compactHeaderSize+len(rl.PublicKeys)*32+compactTrailerSize)
+	ret[0] = 0x11
+	copy(ret[1:33], rl.PreviousLineHash[:])
+	binary.BigEndian.PutUint64(ret[33:41], rl.IssuedAt)
+	binary.BigEndian.PutUint64(ret[41:49], rl.StartDate)
+	binary.BigEndian.PutUint64(ret[49:57], rl.Duration)
+	binary.BigEndian.PutUint64(ret[57:65], rl.PublicKeys[0].Counter)
+	binary.BigEndian.PutUint32(ret[65:69], uint32(len(rl.PublicKeys)))
+	for _, e := range rl.PublicKeys {
+		ret = append(ret, e.PublicKey[:]...)
+	}
+	ret = append(ret, rl.EnvelopeKey[:]...)
+	ret = append(ret, rl.SignatureKey[:]...)
+	ret = append(ret, rl.Signature[:]...)
+	return ret, nil
+}
+
+// ParseCompact parses a compact encoded RatchetList into struct. The result is identical
+// to parsing the full encoding, including Bytes().
+func (rl *RatchetList) ParseCompact(d []byte) (*RatchetList, error) {
+	if len(d) < compactHeaderSize+compactTrailerSize || !IsCompact(d) {
+		return nil, ErrParse
+	}
+	previousLineHash := new([32]byte)
+	copy(previousLineHash[:], d[1:33])
+	issuedAt := binary.BigEndian.Uint64(d[33:41])
+	startDate := binary.BigEndian.Uint64(d[41:49])
+	duration := binary.BigEndian.Uint64(d[49:57])
+	counter := binary.BigEndian.Uint64(d[57:65])
+	count := int(binary.BigEndian.Uint32(d[65:69]))
+	if count < 1 || counter < 1 || duration < 1 || len(d) != compactHeaderSize+count*32+compactTrailerSize {
+		return nil, ErrParse
+	}
+	ret := NewRatchetList(*previousLineHash, count)
+	ret.IssuedAt, ret.StartDate, ret.Duration = issuedAt, startDate, duration
+	previousHash := previousLineHash
+	pos := compactHeaderSize
+	for i := 0; i < count; i++ {
+		var publicKey [32]byte
+		copy(publicKey[:], d[pos:pos+32])
+		validFrom := startDate + (counter-1)*duration
+		e := NewPregenerateEntry(previousHash, counter, validFrom, validFrom+duration, publicKey)
+		ret.Append(*e)
+		ret.ValidUntil = e.ValidTo
+		previousHash = &e.LineHash
+		counter++
+		pos += 32
+	}
+	copy(ret.EnvelopeKey[:], d[pos:pos+32])
+	copy(ret.SignatureKey[:], d[pos+32:pos+32+ed25519.PublicKeySize])
+	copy(ret.Signature[:], d[pos+32+ed25519.PublicKeySize:])
+	ret.addMetadataField()
+	ret.addKeyField()
+	ret.marshalled = append(ret.marshalled, ret.Signature[:]...)
+	return ret, nil
+}
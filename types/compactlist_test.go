@@ -0,0 +1,92 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testSignedList(n int) *RatchetList {
+	sigPrivkey, sigPubkey := genED25519KeyPair()
+	_, pubkey := genCurve25519KeyPair()
+	rl := testValidList(n)
+	rl.IssuedAt = 900
+	rl.EnvelopeKey = *pubkey
+	rl.SignatureKey = *sigPubkey
+	rl.Sign(sigPrivkey)
+	return rl
+}
+
+func TestCompact(t *testing.T) {
+	rl := testSignedList(24)
+	c, err := rl.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+	if !IsCompact(c) || IsCompact(rl.Bytes()) {
+		t.Error("IsCompact")
+	}
+	if len(c) >= len(rl.Bytes()) {
+		t.Errorf("Compact encoding not smaller: %d >= %d", len(c), len(rl.Bytes()))
+	}
+	rl2, err := new(RatchetList).ParseCompact(c)
+	if err != nil {
+		t.Fatalf("ParseCompact: %s", err)
+	}
+	if !bytes.Equal(rl.Bytes(), rl2.Bytes()) {
+		t.Error("Conversion not lossless")
+	}
+	if rl.ListHash != rl2.ListHash {
+		t.Error("ListHash")
+	}
+	if !rl2.Verify(&rl.SignatureKey) {
+		t.Error("Does not verify after ParseCompact")
+	}
+	if err := rl2.Validate(); err != nil {
+		t.Errorf("Validate: %s", err)
+	}
+	c[compactHeaderSize+5] ^= 0x01
+	rl3, err := new(RatchetList).ParseCompact(c)
+	if err != nil {
+		t.Fatalf("ParseCompact modified: %s", err)
+	}
+	if rl3.Verify(&rl.SignatureKey) {
+		t.Error("Modified list must not verify")
+	}
+	if _, err := new(RatchetList).ParseCompact(c[:len(c)-1]); err == nil {
+		t.Error("Truncated list must not parse")
+	}
+	rl.PublicKeys[3].Counter = 9
+	if _, err := rl.Compact(); err != ErrNotCompactable {
+		t.Error("Invalid list must not compact")
+	}
+}
+
+// One year of hourly keys.
+const benchmarkListLength = 365 * 24
+
+func BenchmarkParseFull(b *testing.B) {
+	d := testSignedList(benchmarkListLength).Bytes()
+	b.SetBytes(int64(len(d)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := new(RatchetList).Parse(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(d)), "size-bytes")
+}
+
+func BenchmarkParseCompact(b *testing.B) {
+	d, err := testSignedList(benchmarkListLength).Compact()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(d)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := new(RatchetList).ParseCompact(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(d)), "size-bytes")
+}
@@ -2,7 +2,9 @@ package types
 
 import (
 	"crypto"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash"
 
 	"golang.org/x/crypto/ed25519"
@@ -12,6 +14,10 @@ import (
 type RatchetList struct {
 	PreviousLineHash [32]byte                    // Last LineHash of previous list. Ignored for now.
 	PublicKeys       []PregenerateEntry          // Pregenerated items.
+	IssuedAt         uint64                      // Time the list was issued.
+	StartDate        uint64                      // Start date of the fountain.
+	Duration         uint64                      // Number of seconds between ratchet steps of the fountain.
+	ValidUntil       uint64                      // Time after which the list must not be used anymore.
 	ListHash         [32]byte                    // Hash of list.
 	EnvelopeKey      [32]byte                    // Curve25519 envelope key, long term.
 	SignatureKey     [ed25519.PublicKeySize]byte // Long term signature key of server.
@@ -20,12 +26,14 @@ type RatchetList struct {
 	marshalled       []byte                      // Marshalled version.
 }
 
-// NewRatchetList returns a new ratchet list. New, Append, set SignatureKey and EnvelopeKey, Sign.
+const metadataFieldSize = 1 + 8 + 8 + 8 + 8
+
+// NewRatchetList returns a new ratchet list. New, Append, set metadata, SignatureKey and EnvelopeKey, Sign.
 func NewRatchetList(previousLineHash [32]byte, expectedLength int) *RatchetList {
 	rl := &RatchetList{
 		PreviousLineHash: previousLineHash,
 		PublicKeys:       make([]PregenerateEntry, 0, expectedLength),
-		marshalled:       make([]byte, 0, expectedLength*89+33+ed25519.PublicKeySize+ed25519.SignatureSize+2),
+		marshalled:       make([]byte, 0, expectedLength*pageEntryMarshallSize+33+metadataFieldSize+33+ed25519.PublicKeySize+ed25519.SignatureSize),
 		h:                crypto.SHA256.New(),
 	}
 	first := [33]byte{0x01} // LastListHash
@@ -38,10 +46,36 @@ func NewRatchetList(previousLineHash [32]byte, expectedLength int) *RatchetList
 // Append an entry to the list.
 func (rl *RatchetList) Append(e PregenerateEntry) {
 	m := e.Marshall()
+	rl.h.Write(m[:])
 	rl.marshalled = append(rl.marshalled, m[:]...)
 	rl.PublicKeys = append(rl.PublicKeys, e)
 }
 
+// Reissue returns a copy of the list with the same entries and validity, issued at issuedAt. Set
+// SignatureKey and EnvelopeKey, Sign.
+func (rl *RatchetList) Reissue(issuedAt uint64) *RatchetList {
+	nrl := NewRatchetList(rl.PreviousLineHash, len(rl.PublicKeys))
+	for _, e := range rl.PublicKeys {
+		nrl.Append(e)
+	}
+	nrl.IssuedAt = issuedAt
+	nrl.StartDate = rl.StartDate
+	nrl.Duration = rl.Duration
+	nrl.ValidUntil = rl.ValidUntil
+	return nrl
+}
+
+// addMetadataField adds the metadata field. 0x04 | IssuedAt | StartDate | Duration | ValidUntil
+func (rl *RatchetList) addMetadataField() {
+	field := [metadataFieldSize]byte{0x04}
+	binary.BigEndian.PutUint64(field[1:9], rl.IssuedAt)
+	binary.BigEndian.PutUint64(field[9:17], rl.StartDate)
+	binary.BigEndian.PutUint64(field[17:25], rl.Duration)
+	binary.BigEndian.PutUint64(field[25:33], rl.ValidUntil)
+	rl.h.Write(field[:])
+	rl.marshalled = append(rl.marshalled, field[:]...)
+}
+
 // addKeyField adds the key field to the end. 0x03 | EnvelopeKey | SignatureKey
 func (rl *RatchetList) addKeyField() {
 	lastField := [1 + 32 + ed25519.PublicKeySize]byte{0x03} // Type, LtPK,SigPK
@@ -53,8 +87,9 @@ func (rl *RatchetList) addKeyField() {
 	copy(rl.ListHash[:], h)
 }
 
-// Sign RatchetList. Make sure EnvelopeKey and SignatureKey are set.
+// Sign RatchetList. Make sure metadata, EnvelopeKey and SignatureKey are set.
 func (rl *RatchetList) Sign(privateKey *[ed25519.PrivateKeySize]byte) {
+	rl.addMetadataField()
 	rl.addKeyField()
 	signature := ed25519.Sign(privateKey[:], rl.ListHash[:])
 	copy(rl.Signature[:], signature)
@@ -81,7 +116,7 @@ func findLastListHash(d []byte) *[32]byte {
 func (rl *RatchetList) findPubKeys(d []byte) int {
 	var i int
 	for i = 33; i < len(d); i = i + pageEntryMarshallSize {
-		if d[i] != 0x02 {
+		if d[i] != 0x02 || len(d) < i+pageEntryMarshallSize {
 			return i
 		}
 		em := new([pageEntryMarshallSize]byte)
@@ -94,8 +129,21 @@ func (rl *RatchetList) findPubKeys(d []byte) int {
 	return i
 }
 
+// setMetadata parses the optional metadata field and returns the position after it.
+func (rl *RatchetList) setMetadata(d []byte, pos int) int {
+	if len(d) < pos+metadataFieldSize || d[pos] != 0x04 {
+		return pos
+	}
+	rl.IssuedAt = binary.BigEndian.Uint64(d[pos+1 : pos+9])
+	rl.StartDate = binary.BigEndian.Uint64(d[pos+9 : pos+17])
+	rl.Duration = binary.BigEndian.Uint64(d[pos+17 : pos+25])
+	rl.ValidUntil = binary.BigEndian.Uint64(d[pos+25 : pos+33])
+	rl.addMetadataField()
+	return pos + metadataFieldSize
+}
+
 func (rl *RatchetList) setBody(d []byte, pos int) error {
-	if d[pos] != 0x03 {
+	if len(d) <= pos || d[pos] != 0x03 {
 		return ErrParse
 	}
 	minLen := 32 + ed25519.PublicKeySize + ed25519.SignatureSize + 1
@@ -119,12 +167,13 @@ func (rl *RatchetList) Parse(d []byte) (*RatchetList, error) {
 	}
 	ret := NewRatchetList(*listHash, 2)
 	pos := ret.findPubKeys(d)
+	pos = ret.setMetadata(d, pos)
 	err := ret.setBody(d, pos)
 	if err != nil {
 		return nil, err
 	}
 	ret.addKeyField()
-	ret.marshalled = nil
+	ret.marshalled = append(ret.marshalled, ret.Signature[:]...)
 	return ret, nil
 }
 
@@ -139,6 +188,92 @@ func (rl *RatchetList) Verify(expectPubkey *[ed25519.PublicKeySize]byte) bool {
 	return ed25519.Verify(rl.SignatureKey[:], rl.ListHash[:], rl.Signature[:])
 }
 
+var (
+	// ErrListStale is returned if a list was issued too long ago, or in the future.
+	ErrListStale = errors.New("types: keylist is stale")
+	// ErrListExpired is returned if a list is used after its ValidUntil time.
+	ErrListExpired = errors.New("types: keylist has expired")
+)
+
+// MaxClockSkew is the number of seconds an issuance time may lie in the future.
+const MaxClockSkew = 300
+
+// CheckFreshness verifies that the list was issued at most maxAge seconds before now, and that
+// now has not passed ValidUntil. Only meaningful after Verify.
+func (rl *RatchetList) CheckFreshness(now, maxAge uint64) error {
+	if rl.IssuedAt > now+MaxClockSkew || rl.IssuedAt+maxAge < now {
+		return ErrListStale
+	}
+	if rl.ValidUntil < now {
+		return ErrListExpired
+	}
+	return nil
+}
+
+var (
+	// ErrListEmpty is returned if a list contains no entries.
+	ErrListEmpty = errors.New("types: keylist is empty")
+	// ErrListMetadata is returned if the fountain parameters or ValidUntil of a list are missing or inconsistent.
+	ErrListMetadata = errors.New("types: keylist metadata invalid")
+	// ErrLineHash is returned if an entry's LineHash does not chain to the previous entry.
+	ErrLineHash = errors.New("types: keylist line hash mismatch")
+	// ErrCounterSequence is returned if entry counters are not consecutive.
+	ErrCounterSequence = errors.New("types: keylist counters not consecutive")
+	// ErrWindowSequence is returned if entry windows are not contiguous or overlap.
+	ErrWindowSequence = errors.New("types: keylist windows not contiguous")
+	// ErrWindowDuration is returned if an entry window does not match the fountain duration.
+	ErrWindowDuration = errors.New("types: keylist window does not match duration")
+	// ErrWindowStart is returned if an entry window does not match the fountain start date and counter.
+	ErrWindowStart = errors.New("types: keylist window does not match start date")
+)
+
+// EntryError is returned by Validate for an invalid entry. Err is one of the keylist errors above.
+type EntryError struct {
+	Index int   // Position of the entry in PublicKeys.
+	Err   error // What is wrong with the entry.
+}
+
+func (ee *EntryError) Error() string {
+	return fmt.Sprintf("%s (entry %d)", ee.Err, ee.Index)
+}
+
+// Validate the structure of a RatchetList: The LineHash chain starting at PreviousLineHash,
+// consecutive counters, contiguous non-overlapping windows of the fountain duration that are
+// aligned to the fountain start date, and ValidUntil matching the last entry.
+// Errors for entries are of type *EntryError. Validate does not verify the signature.
+func (rl *RatchetList) Validate() error {
+	if len(rl.PublicKeys) == 0 {
+		return ErrListEmpty
+	}
+	if rl.Duration == 0 {
+		return ErrListMetadata
+	}
+	previousHash := &rl.PreviousLineHash
+	for i := range rl.PublicKeys {
+		e := &rl.PublicKeys[i]
+		if !e.Validate(previousHash) {
+			return &EntryError{Index: i, Err: ErrLineHash}
+		}
+		if e.Counter < 1 || (i > 0 && e.Counter != rl.PublicKeys[i-1].Counter+1) {
+			return &EntryError{Index: i, Err: ErrCounterSequence}
+		}
+		if i > 0 && e.ValidFrom != rl.PublicKeys[i-1].ValidTo {
+			return &EntryError{Index: i, Err: ErrWindowSequence}
+		}
+		if e.ValidTo < e.ValidFrom || e.ValidTo-e.ValidFrom != rl.Duration {
+			return &EntryError{Index: i, Err: ErrWindowDuration}
+		}
+		if e.ValidFrom != rl.StartDate+(e.Counter-1)*rl.Duration {
+			return &EntryError{Index: i, Err: ErrWindowStart}
+		}
+		previousHash = &e.LineHash
+	}
+	if rl.ValidUntil != rl.PublicKeys[len(rl.PublicKeys)-1].ValidTo {
+		return ErrListMetadata
+	}
+	return nil
+}
+
 // MatchKey represents one matching key.
 type MatchKey struct {
 	ValidFrom   uint64
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
 	"testing"
@@ -60,6 +61,10 @@ func TestRatchetList(t *testing.T) {
 		ValidTo:   300,
 		PublicKey: [32]byte{0x03, 0x02},
 	})
+	rl.IssuedAt = 50
+	rl.StartDate = 1
+	rl.Duration = 100
+	rl.ValidUntil = 300
 	rl.Sign(sigPrivkey)
 	rl2, err := new(RatchetList).Parse(rl.Bytes())
 	if err != nil {
@@ -89,6 +94,21 @@ func TestRatchetList(t *testing.T) {
 	} else {
 		t.Error("Public Keys missed")
 	}
+	if rl.IssuedAt != rl2.IssuedAt {
+		t.Error("IssuedAt")
+	}
+	if rl.StartDate != rl2.StartDate {
+		t.Error("StartDate")
+	}
+	if rl.Duration != rl2.Duration {
+		t.Error("Duration")
+	}
+	if rl.ValidUntil != rl2.ValidUntil {
+		t.Error("ValidUntil")
+	}
+	if !bytes.Equal(rl.Bytes(), rl2.Bytes()) {
+		t.Error("Bytes")
+	}
 	if rl.EnvelopeKey != rl2.EnvelopeKey {
 		t.Error("EnvelopeKey")
 	}
@@ -143,3 +163,146 @@ func TestRatchetList(t *testing.T) {
 		t.Error("FindRatchetKeys 6")
 	}
 }
+
+func TestRatchetListSigned(t *testing.T) {
+	sigPrivkey, sigPubkey := genED25519KeyPair()
+	rl := NewRatchetList([32]byte{}, 1)
+	rl.SignatureKey = *sigPubkey
+	rl.Append(*NewPregenerateEntry(nil, 1, 1, 100, [32]byte{0x01}))
+	rl.IssuedAt = 50
+	rl.ValidUntil = 100
+	rl.Sign(sigPrivkey)
+	d := rl.Bytes()
+	// Modify public key of entry.
+	d1 := make([]byte, len(d))
+	copy(d1, d)
+	d1[33+60] ^= 0x01
+	if rl2, err := new(RatchetList).Parse(d1); err != nil || rl2.Verify(sigPubkey) {
+		t.Error("Modified entry must not verify")
+	}
+	// Modify IssuedAt.
+	d2 := make([]byte, len(d))
+	copy(d2, d)
+	d2[33+pageEntryMarshallSize+8] ^= 0x01
+	if rl2, err := new(RatchetList).Parse(d2); err != nil || rl2.Verify(sigPubkey) {
+		t.Error("Modified metadata must not verify")
+	}
+}
+
+func TestRatchetListReissue(t *testing.T) {
+	sigPrivkey, sigPubkey := genED25519KeyPair()
+	rl := NewRatchetList([32]byte{0x01}, 1)
+	rl.SignatureKey = *sigPubkey
+	rl.Append(*NewPregenerateEntry(nil, 1, 1, 100, [32]byte{0x01}))
+	rl.IssuedAt = 50
+	rl.StartDate = 1
+	rl.Duration = 100
+	rl.ValidUntil = 100
+	rl.Sign(sigPrivkey)
+	rl2 := rl.Reissue(80)
+	rl2.SignatureKey = *sigPubkey
+	rl2.Sign(sigPrivkey)
+	rl3, err := new(RatchetList).Parse(rl2.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if !rl3.Verify(sigPubkey) {
+		t.Error("Reissued list does not verify")
+	}
+	if rl3.IssuedAt != 80 || rl3.ValidUntil != rl.ValidUntil || rl3.Duration != rl.Duration || rl3.PreviousLineHash != rl.PreviousLineHash {
+		t.Error("Metadata not reissued")
+	}
+	if len(rl3.PublicKeys) != 1 || rl3.PublicKeys[0] != rl.PublicKeys[0] {
+		t.Error("Entries not reissued")
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	rl := &RatchetList{
+		IssuedAt:   1000,
+		ValidUntil: 5000,
+	}
+	if err := rl.CheckFreshness(1500, 1000); err != nil {
+		t.Errorf("Fresh list: %s", err)
+	}
+	if err := rl.CheckFreshness(2001, 1000); err != ErrListStale {
+		t.Error("Old list must be stale")
+	}
+	if err := rl.CheckFreshness(1000-MaxClockSkew-1, 1000); err != ErrListStale {
+		t.Error("List from the future must be stale")
+	}
+	if err := rl.CheckFreshness(5001, 10000); err != ErrListExpired {
+		t.Error("List must be expired")
+	}
+}
+
+func testValidList(n int) *RatchetList {
+	rl := NewRatchetList([32]byte{0x07}, n)
+	rl.StartDate = 1000
+	rl.Duration = 100
+	previousHash := &rl.PreviousLineHash
+	for i := uint64(1); i <= uint64(n); i++ {
+		from := rl.StartDate + (i-1)*rl.Duration
+		e := NewPregenerateEntry(previousHash, i, from, from+rl.Duration, [32]byte{byte(i)})
+		rl.Append(*e)
+		previousHash = &e.LineHash
+		rl.ValidUntil = e.ValidTo
+	}
+	return rl
+}
+
+func TestValidate(t *testing.T) {
+	if err := testValidList(5).Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	if err := new(RatchetList).Validate(); err != ErrListEmpty {
+		t.Error("Empty list must fail")
+	}
+	checkEntryError := func(name string, rl *RatchetList, index int, expect error) {
+		err := rl.Validate()
+		ee, ok := err.(*EntryError)
+		if !ok {
+			t.Errorf("%s: unexpected error %v", name, err)
+			return
+		}
+		if ee.Index != index || ee.Err != expect {
+			t.Errorf("%s: %s", name, ee)
+		}
+	}
+	rl := testValidList(5)
+	rl.PublicKeys[2].PublicKey[0] = 0xff
+	checkEntryError("PublicKey", rl, 2, ErrLineHash)
+
+	rl = testValidList(5)
+	rl.PreviousLineHash[0] = 0x00
+	checkEntryError("PreviousLineHash", rl, 0, ErrLineHash)
+
+	rl = testValidList(5)
+	rl.PublicKeys[3].Counter = 5
+	rl.PublicKeys[3].Hash(&rl.PublicKeys[2].LineHash)
+	checkEntryError("Counter", rl, 3, ErrCounterSequence)
+
+	rl = testValidList(5)
+	rl.PublicKeys[2].ValidFrom -= 10
+	rl.PublicKeys[2].Hash(&rl.PublicKeys[1].LineHash)
+	checkEntryError("Overlap", rl, 2, ErrWindowSequence)
+
+	rl = testValidList(5)
+	rl.PublicKeys[4].ValidTo += 10
+	rl.PublicKeys[4].Hash(&rl.PublicKeys[3].LineHash)
+	checkEntryError("Duration", rl, 4, ErrWindowDuration)
+
+	rl = testValidList(5)
+	rl.Duration = 50
+	checkEntryError("Metadata duration", rl, 0, ErrWindowDuration)
+
+	rl = testValidList(5)
+	rl.StartDate = 900
+	checkEntryError("StartDate", rl, 0, ErrWindowStart)
+
+	rl = testValidList(5)
+	rl.ValidUntil++
+	if err := rl.Validate(); err != ErrListMetadata {
+		t.Errorf("ValidUntil: %v", err)
+	}
+}
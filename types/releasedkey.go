@@ -0,0 +1,93 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ReleaseEnvelopeKey is the EnvelopeKey of release lists. It distinguishes release lists from
+// ratchet lists signed by the same server, no envelope can be encrypted to it.
+var ReleaseEnvelopeKey = [32]byte{}
+
+// IsReleaseList returns true if the list contains timed-release keys instead of ratchet keys.
+func (rl *RatchetList) IsReleaseList() bool {
+	return rl.EnvelopeKey == ReleaseEnvelopeKey
+}
+
+var (
+	// ErrReleasedKeyFormat is returned if a released key cannot be parsed.
+	ErrReleasedKeyFormat = errors.New("types: invalid released key")
+)
+
+// ReleasedKey is the private key of a timed-release period, published by the server once the
+// period has started.
+type ReleasedKey struct {
+	Counter    uint64                      // Period of the key.
+	ValidFrom  uint64                      // Start of the period.
+	PrivateKey [32]byte                    // Curve25519 private key of the period.
+	Signature  [ed25519.SignatureSize]byte // Server signature over the above.
+}
+
+// Released key format:
+//
+// 0x21 | Counter (uint64) | ValidFrom (uint64) | PrivateKey (32 byte) | Signature
+
+const (
+	releasedKeyType     = 0x21
+	releasedKeyBodySize = 1 + 8 + 8 + 32
+	releasedKeySize     = releasedKeyBodySize + ed25519.SignatureSize
+)
+
+var releasedKeyContext = []byte("cypherlock released key")
+
+func (rk *ReleasedKey) body() []byte {
+	d := make([]byte, releasedKeyBodySize)
+	d[0] = releasedKeyType
+	binary.BigEndian.PutUint64(d[1:9], rk.Counter)
+	binary.BigEndian.PutUint64(d[9:17], rk.ValidFrom)
+	copy(d[17:49], rk.PrivateKey[:])
+	return d
+}
+
+// Sign the ReleasedKey.
+func (rk *ReleasedKey) Sign(privateKey *[ed25519.PrivateKeySize]byte) {
+	signature := ed25519.Sign(privateKey[:], append(releasedKeyContext, rk.body()...))
+	copy(rk.Signature[:], signature)
+}
+
+// Verify the signature of the ReleasedKey. It fails if expectPubkey is nil.
+func (rk *ReleasedKey) Verify(expectPubkey *[ed25519.PublicKeySize]byte) bool {
+	if expectPubkey == nil {
+		return false
+	}
+	return ed25519.Verify(expectPubkey[:], append(releasedKeyContext, rk.body()...), rk.Signature[:])
+}
+
+// PublicKey returns the public key belonging to PrivateKey.
+func (rk *ReleasedKey) PublicKey() *[32]byte {
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, &rk.PrivateKey)
+	return pub
+}
+
+// Bytes returns the marshalled ReleasedKey.
+func (rk *ReleasedKey) Bytes() []byte {
+	return append(rk.body(), rk.Signature[:]...)
+}
+
+// Parse a marshalled ReleasedKey.
+func (rk *ReleasedKey) Parse(d []byte) (*ReleasedKey, error) {
+	if len(d) != releasedKeySize || d[0] != releasedKeyType {
+		return nil, ErrReleasedKeyFormat
+	}
+	nrk := &ReleasedKey{
+		Counter:   binary.BigEndian.Uint64(d[1:9]),
+		ValidFrom: binary.BigEndian.Uint64(d[9:17]),
+	}
+	copy(nrk.PrivateKey[:], d[17:49])
+	copy(nrk.Signature[:], d[49:])
+	return nrk, nil
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestReleasedKey(t *testing.T) {
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	sigPub, sigPriv := new([ed25519.PublicKeySize]byte), new([ed25519.PrivateKeySize]byte)
+	copy(sigPub[:], pubkey)
+	copy(sigPriv[:], privkey)
+	rk := &ReleasedKey{Counter: 17, ValidFrom: 1000, PrivateKey: [32]byte{0x01, 0x02}}
+	rk.Sign(sigPriv)
+	rk2, err := new(ReleasedKey).Parse(rk.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if *rk2 != *rk {
+		t.Error("Parsed key does not match")
+	}
+	if !rk2.Verify(sigPub) {
+		t.Error("Verify failed")
+	}
+	if rk2.Verify(nil) {
+		t.Error("Verify must fail without key")
+	}
+	rk2.Counter++
+	if rk2.Verify(sigPub) {
+		t.Error("Verify must fail for modified key")
+	}
+	if _, err := new(ReleasedKey).Parse(rk.Bytes()[1:]); err != ErrReleasedKeyFormat {
+		t.Errorf("Parse truncated: %v", err)
+	}
+}
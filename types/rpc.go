@@ -13,7 +13,95 @@ type RPCTypeDecrypt struct {
 	OracleMessage []byte
 }
 
-// RPCTypeDecryptResponse is the response from a Cypherlock server that contains the binary ResponseMessage.
+// RPCErrorCode identifies the errors of a Cypherlock server that clients act upon.
+type RPCErrorCode uint8
+
+const (
+	// RPCErrorNone is the code of a successful call.
+	RPCErrorNone RPCErrorCode = iota
+	// RPCErrorOther is the code of all errors without their own code.
+	RPCErrorOther
+	// RPCErrorUnlockPending is the code of a response to a delayed message that is not ready yet.
+	RPCErrorUnlockPending
+	// RPCErrorTicketUnknown is the code of a ticket that is unknown, cancelled or expired.
+	RPCErrorTicketUnknown
+	// RPCErrorApprovalPending is the code of a request that has not been approved by enough approvers yet.
+	RPCErrorApprovalPending
+)
+
+// RPCError is an error returned by a Cypherlock server with its code.
+type RPCError struct {
+	Code    RPCErrorCode
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCTypeDecryptResponse is the response from a Cypherlock server that contains the binary ResponseMessage,
+// or the code and message of an error.
 type RPCTypeDecryptResponse struct {
 	ResponseMessage []byte
+	Code            RPCErrorCode
+	Error           string
+}
+
+// MaxDecryptBatch is the maximum number of OracleMessages in a RPCTypeDecryptBatch.
+const MaxDecryptBatch = 256
+
+// RPCTypeDecryptBatch is the request for a Cypherlock server to decrypt the contained binary OracleMessages.
+type RPCTypeDecryptBatch struct {
+	OracleMessages [][]byte
+}
+
+// RPCTypeDecryptBatchResponse is the response from a Cypherlock server that contains a binary ResponseMessage
+// or an error for each OracleMessage of a RPCTypeDecryptBatch. Codes are RPCErrorNone and Errors are empty for
+// successfully decrypted messages.
+type RPCTypeDecryptBatchResponse struct {
+	ResponseMessages [][]byte
+	Codes            []RPCErrorCode
+	Errors           []string
+}
+
+// RPCTypeDecryptOblivious is the request for a Cypherlock server to multiply the contained blinded key
+// with all of its current ratchet keys.
+type RPCTypeDecryptOblivious struct {
+	BlindedKey [32]byte
+}
+
+// RPCTypeDecryptObliviousResponse is the response from a Cypherlock server that contains the blinded
+// secrets of all of its current ratchet keys.
+type RPCTypeDecryptObliviousResponse struct {
+	Secrets [][32]byte
+}
+
+// RPCTypePollUnlock is the request for a Cypherlock server to return the ResponseMessage of a delayed OracleMessage.
+type RPCTypePollUnlock struct {
+	Ticket [32]byte
+}
+
+// RPCTypeCancelUnlocks is the request for a Cypherlock server to cancel delayed OracleMessages with the contained binary Cancel.
+type RPCTypeCancelUnlocks struct {
+	Cancel []byte
+}
+
+// RPCTypeApprove is the request for a Cypherlock server to record the contained binary Approval.
+type RPCTypeApprove struct {
+	Approval []byte
+}
+
+// RPCTypeGetReleasedKey is the request for a Cypherlock server to return the private key of a timed-release period.
+type RPCTypeGetReleasedKey struct {
+	Counter uint64
+}
+
+// RPCTypeGetReleasedKeyResponse is the response from a Cypherlock server that contains the binary ReleasedKey.
+type RPCTypeGetReleasedKeyResponse struct {
+	Key []byte
+}
+
+// RPCTypeCheckin is the request for a Cypherlock server to record the contained binary Checkin.
+type RPCTypeCheckin struct {
+	Checkin []byte
 }